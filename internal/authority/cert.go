@@ -1,19 +1,23 @@
 package authority
 
 import (
+	"context"
 	"crypto/ed25519"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
 	"fmt"
-	"net/http"
+	"strings"
 
+	"github.com/Cealgull/Middleware/internal/config"
 	"github.com/Cealgull/Middleware/internal/proto"
+	"github.com/Cealgull/Middleware/internal/rest"
 	"github.com/go-resty/resty/v2"
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
+	"gorm.io/gorm"
 )
 
 type CACert struct {
@@ -21,63 +25,223 @@ type CACert struct {
 }
 
 type CertAuthority struct {
-	client   *resty.Client
-	logger   *zap.Logger
-	endpoint string
+	client      *resty.Client
+	logger      *zap.Logger
+	endpoint    string
+	crlEndpoint string
+
+	nonces      *nonceStore
+	verified    *certCache
+	roots       *x509.CertPool
+	revocations *revocations
+	db          *gorm.DB
+	admins      map[string]bool
+	session     *config.SessionConfig
+	store       sessions.Store
+	sessions    *DBStore
+	options     *sessions.Options
+}
+
+type CertAuthorityOption func(ca *CertAuthority) error
+
+// WithSessionConfig signs and encrypts session cookies with the configured
+// keys, applies the configured cookie attributes and selects where session
+// values are kept.
+func WithSessionConfig(cfg *config.SessionConfig) CertAuthorityOption {
+	return func(ca *CertAuthority) error {
+		ca.session = cfg
+		return nil
+	}
+}
+
+// WithOffchainStore keeps sessions in db unless the cookie store is
+// configured.
+func WithOffchainStore(db *gorm.DB) CertAuthorityOption {
+	return func(ca *CertAuthority) error {
+		ca.db = db
+		return nil
+	}
+}
+
+// WithAdmins grants the wallets administrative rights over other users.
+func WithAdmins(wallets []string) CertAuthorityOption {
+	return func(ca *CertAuthority) error {
+		for _, wallet := range wallets {
+			ca.admins[wallet] = true
+		}
+		return nil
+	}
+}
+
+func (ca *CertAuthority) IsAdmin(wallet string) bool {
+	return ca.admins[wallet]
+}
+
+func (ca *CertAuthority) initSessionStore(cfg *config.SessionConfig) error {
+
+	keys, err := LoadSessionKeys(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	options, err := sessionOptions(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		ca.logger.Warn("No session keys configured, sessions will not survive a restart")
+	}
+
+	pairs, err := sessionKeyPairs(keys)
+
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(cfg.Store) {
+	case "":
+		if ca.db == nil {
+			ca.store = newCookieStore(pairs, options)
+			break
+		}
+		fallthrough
+	case "database":
+		if ca.db == nil {
+			return errSessionStoreNoDB
+		}
+		ca.sessions = NewDBStore(ca.db, options, pairs...)
+		ca.store = ca.sessions
+	case "cookie":
+		ca.store = newCookieStore(pairs, options)
+	default:
+		return errSessionStoreKind
+	}
+
+	ca.options = options
+	return nil
 }
 
 const (
 	CERT = "CERTIFICATE"
 )
 
-func NewCertAuthority(logger *zap.Logger, host string, port int) *CertAuthority {
+func NewCertAuthority(logger *zap.Logger, host string, port int, options ...CertAuthorityOption) (*CertAuthority, error) {
 
-  endpoint := fmt.Sprintf("http://%s:%d/cert/verify", host, port)
+	endpoint := fmt.Sprintf("http://%s:%d/cert/verify", host, port)
 
 	ca := &CertAuthority{
-		client:   resty.New(),
-		logger:   logger,
-		endpoint: endpoint,
+		client:      resty.New(),
+		logger:      logger,
+		endpoint:    endpoint,
+		crlEndpoint: fmt.Sprintf("http://%s:%d/cert/crl", host, port),
+		nonces:      newNonceStore(defaultChallengeTTL),
+		admins:      map[string]bool{},
+		session:     &config.SessionConfig{},
+	}
+
+	for _, option := range options {
+		if err := option(ca); err != nil {
+			return nil, err
+		}
+	}
+
+	if ca.verified == nil {
+		if err := WithVerifyConfig(&config.VerifyConfig{})(ca); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ca.initSessionStore(ca.session); err != nil {
+		return nil, err
+	}
+
+	if ca.session.MaxChallenges > 0 {
+		ca.nonces.max = ca.session.MaxChallenges
 	}
-	return ca
+
+	return ca, nil
 }
 
-func (ca *CertAuthority) validateCert(sigb64 string, reqcert CACert) (*x509.Certificate, proto.MiddlewareError) {
+// validateCert checks that sigb64 is a signature over message by the ed25519
+// key of reqcert and that Verify issued reqcert.
+func (ca *CertAuthority) validateCert(sigb64 string, reqcert CACert, message []byte) (*x509.Certificate, proto.MiddlewareError) {
+
+	b, _ := pem.Decode([]byte(reqcert.Cert))
+
+	if b == nil || b.Type != CERT {
+		return nil, certDecodeError
+	}
 
-	resp, err := ca.client.R().SetBody(reqcert).Post(ca.endpoint)
+	x509cert, err := x509.ParseCertificate(b.Bytes)
 
 	if err != nil {
-		return nil, &CertInternalError{}
+		return nil, certDecodeError
 	}
 
-	if resp.StatusCode() != http.StatusOK {
-		return nil, &CertUnauthorizedError{}
+	// use ed25519 as the crypto algorithm
+	pubKey, ok := x509cert.PublicKey.(ed25519.PublicKey)
+
+	if !ok {
+		return nil, certFormatError
 	}
 
 	sig, err := base64.StdEncoding.DecodeString(sigb64)
 
 	if err != nil {
-		return nil, &SignatureDecodeError{}
+		return nil, signatureDecodeError
 	}
 
-	b, _ := pem.Decode([]byte(reqcert.Cert))
+	if !ed25519.Verify(pubKey, message, sig) {
+		return nil, signatureVerificationError
+	}
 
-	x509cert, _ := x509.ParseCertificate(b.Bytes)
+	if ca.isRevoked(x509cert) {
+		return nil, certRevokedError
+	}
 
-	ca.logger.Info("Requesting identity", zap.String("Common Name", x509cert.Subject.CommonName))
+	if err := ca.trustCert(x509cert, reqcert); err != nil {
+		return nil, err
+	}
 
-	// use ed25519 as the crypto algorithm
-	pubKey := x509cert.PublicKey.(ed25519.PublicKey)
+	ca.logger.Info("Requesting identity", zap.String("Common Name", x509cert.Subject.CommonName))
 
-	if ed25519.Verify(pubKey, []byte(reqcert.Cert), sig) {
-		return x509cert, nil
-	} else {
-		return nil, &SignatureVerificationError{}
-	}
+	return x509cert, nil
 }
 
 func (ca *CertAuthority) Register(e *echo.Echo) error {
-	e.Use(session.Middleware(sessions.NewCookieStore([]byte("secret"))))
+	e.Use(session.Middleware(ca.store))
 	e.Use(ca.ValidateSession)
+
+	rest.Declare(e, rest.AuthPublic, e.POST("/auth/challenge", ca.issueChallenge))
+	go ca.nonces.run(context.Background(), nonceSweepInterval)
+
+	if ca.sessions != nil {
+		// sessions record the client IP as the rest of the server tells it
+		if e.IPExtractor != nil {
+			ca.sessions.ip = e.IPExtractor
+		}
+		rest.Declare(e, rest.AuthRequired,
+			e.GET("/auth/sessions", ca.listSessions),
+			e.POST("/auth/sessions/revoke", ca.revokeSessions),
+		)
+		rest.Declare(e, rest.AuthAdmin, e.POST("/auth/sessions/revoke/wallet", ca.revokeWalletSessions))
+		go ca.sessions.Cleanup(context.Background(), sessionCleanupInterval)
+	}
+
+	if ca.db != nil {
+		rest.Declare(e, rest.AuthRequired,
+			e.GET("/auth/tokens", ca.listTokens),
+			e.POST("/auth/tokens", ca.mintToken),
+			e.POST("/auth/tokens/revoke", ca.revokeToken),
+		)
+	}
+
+	if ca.revocations != nil {
+		go ca.watchRevocations(context.Background())
+	}
+
 	return nil
 }
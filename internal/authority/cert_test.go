@@ -1,13 +1,16 @@
 package authority
 
 import (
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/pem"
 	"math/big"
+	"strings"
 	"testing"
 
 	"github.com/jarcoal/httpmock"
@@ -22,7 +25,7 @@ var server *echo.Echo
 const HOST = "api.cealgull.verify"
 const PORT = 80
 
-func generateCert(t *testing.T) (string, string) {
+func generateCert(t *testing.T) (ed25519.PrivateKey, string) {
 	pub, priv, _ := ed25519.GenerateKey(nil)
 
 	template := &x509.Certificate{
@@ -43,19 +46,23 @@ func generateCert(t *testing.T) (string, string) {
 		Bytes: cert,
 	})
 
-	sig := ed25519.Sign(priv, pemcert)
-
-	sigb64 := base64.StdEncoding.EncodeToString(sig)
+	return priv, string(pemcert)
+}
 
-	return sigb64, string(pemcert)
+func sign(priv ed25519.PrivateKey, message []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(priv, message))
 }
 
 
 func TestValidateCertInternalError(t *testing.T) {
-	cert, err := ca.validateCert("test", CACert{Cert: "test"})
 
-  var _ = err.Message()
-  var _ = err.Status()
+	message := []byte("message")
+	priv, pemcert := generateCert(t)
+
+	cert, err := ca.validateCert(sign(priv, message), CACert{Cert: pemcert}, message)
+
+	var _ = err.Message()
+	var _ = err.Status()
 
 	assert.IsType(t, &CertInternalError{}, err)
 	assert.Nil(t, cert)
@@ -68,14 +75,52 @@ func TestValidateCertUnauthorized(t *testing.T) {
 
 	defer httpmock.Reset()
 
-	cert, err := ca.validateCert("test", CACert{Cert: "test"})
+	message := []byte("message")
+	priv, pemcert := generateCert(t)
 
-  var _ = err.Message()
-  var _ = err.Status()
+	cert, err := ca.validateCert(sign(priv, message), CACert{Cert: pemcert}, message)
+
+	var _ = err.Message()
+	var _ = err.Status()
 
 	assert.IsType(t, &CertUnauthorizedError{}, err)
 	assert.Nil(t, cert)
 
+	// server errors are retried
+	assert.Equal(t, 1+defaultVerifyRetries, httpmock.GetCallCountInfo()["POST "+ca.endpoint])
+}
+
+func TestValidateCertMalformed(t *testing.T) {
+
+	cert, err := ca.validateCert("test", CACert{Cert: "test"}, nil)
+
+	var _ = err.Message()
+	var _ = err.Status()
+
+	assert.IsType(t, &CertDecodeError{}, err)
+	assert.Nil(t, cert)
+
+	garbage := pem.EncodeToMemory(&pem.Block{Type: CERT, Bytes: []byte("not a certificate")})
+	_, err = ca.validateCert("test", CACert{Cert: string(garbage)}, nil)
+	assert.IsType(t, &CertDecodeError{}, err)
+
+	_, pemcert := generateCert(t)
+	key := strings.Replace(pemcert, CERT, "PUBLIC KEY", -1)
+	_, err = ca.validateCert("test", CACert{Cert: key}, nil)
+	assert.IsType(t, &CertDecodeError{}, err)
+
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "Cealgull"}}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	ecdsacert := pem.EncodeToMemory(&pem.Block{Type: CERT, Bytes: der})
+
+	cert, err = ca.validateCert("test", CACert{Cert: string(ecdsacert)}, nil)
+
+	var _ = err.Message()
+	var _ = err.Status()
+
+	assert.IsType(t, &CertFormatError{}, err)
+	assert.Nil(t, cert)
 }
 
 func TestValidateCertNoExternal(t *testing.T) {
@@ -85,35 +130,53 @@ func TestValidateCertNoExternal(t *testing.T) {
 
 	defer httpmock.Reset()
 
-	cert, err := ca.validateCert("[]ssqs", CACert{Cert: "abcd"})
+	message := ChallengeMessage("nonce", "1700000000", "https://cealgull.org")
 
-  var _ = err.Message()
-  var _ = err.Status()
+	priv1, _ := generateCert(t)
+	priv2, cert2 := generateCert(t)
+
+	cert, err := ca.validateCert("[]ssqs", CACert{Cert: cert2}, message)
+
+	var _ = err.Message()
+	var _ = err.Status()
 
 	assert.IsType(t, &SignatureDecodeError{}, err)
 	assert.Nil(t, cert)
 
-	sig1, _ := generateCert(t)
-	sig2, cert2 := generateCert(t)
+	cert, err = ca.validateCert(sign(priv1, message), CACert{Cert: cert2}, message)
+
+	var _ = err.Message()
+	var _ = err.Status()
 
-	cert, err = ca.validateCert(sig1, CACert{Cert: cert2})
+	assert.IsType(t, &SignatureVerificationError{}, err)
+	assert.Nil(t, cert)
 
-  var _ = err.Message()
-  var _ = err.Status()
+	// a signature over the certificate alone no longer logs in
+	cert, err = ca.validateCert(sign(priv2, []byte(cert2)), CACert{Cert: cert2}, message)
 
 	assert.IsType(t, &SignatureVerificationError{}, err)
 	assert.Nil(t, cert)
 
-	cert, err = ca.validateCert(sig2, CACert{Cert: cert2})
+	// forged signatures never reach the Verify service
+	assert.Equal(t, 0, httpmock.GetTotalCallCount())
+
+	cert, err = ca.validateCert(sign(priv2, message), CACert{Cert: cert2}, message)
+
+	assert.NoError(t, err)
+	assert.NotNil(t, cert)
+
+	// verified certificates are cached
+	cert, err = ca.validateCert(sign(priv2, message), CACert{Cert: cert2}, message)
 
 	assert.NoError(t, err)
 	assert.NotNil(t, cert)
+	assert.Equal(t, 1, httpmock.GetTotalCallCount())
 }
 
 func TestMain(m *testing.M) {
 
 	logger, _ := zap.NewProduction()
-	ca = NewCertAuthority(logger, HOST, PORT)
+	ca, _ = NewCertAuthority(logger, HOST, PORT)
 	httpmock.ActivateNonDefault(ca.client.GetClient())
   server = echo.New()
   ca.Register(server)
@@ -0,0 +1,189 @@
+package authority
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Cealgull/Middleware/internal/proto"
+	"github.com/Cealgull/Middleware/internal/utils"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultChallengeTTL = 2 * time.Minute
+	defaultMaxNonces    = 100_000
+	nonceSweepInterval  = 30 * time.Second
+)
+
+var errNonceStoreFull = errors.New("too many pending challenges")
+
+// maxChallengeSkew bounds how far the signed timestamp may drift from the
+// server clock.
+const maxChallengeSkew = 2 * time.Minute
+
+type Challenge struct {
+	Nonce     string    `json:"nonce"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// nonceStore hands out single use nonces that expire after ttl. At most max
+// nonces are pending at once, and expired ones are swept by run.
+type nonceStore struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	max    int
+	nonces map[string]time.Time
+	now    func() time.Time
+}
+
+func newNonceStore(ttl time.Duration) *nonceStore {
+	return &nonceStore{ttl: ttl, max: defaultMaxNonces, nonces: map[string]time.Time{}, now: time.Now}
+}
+
+func (n *nonceStore) issue() (*Challenge, error) {
+
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(n.nonces) >= n.max {
+		return nil, errNonceStoreFull
+	}
+
+	challenge := &Challenge{
+		Nonce:     base64.RawURLEncoding.EncodeToString(b),
+		ExpiresAt: n.now().Add(n.ttl),
+	}
+
+	n.nonces[challenge.Nonce] = challenge.ExpiresAt
+
+	return challenge, nil
+}
+
+// sweep drops the expired nonces.
+func (n *nonceStore) sweep() {
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := n.now()
+
+	for nonce, expires := range n.nonces {
+		if !now.Before(expires) {
+			delete(n.nonces, nonce)
+		}
+	}
+}
+
+// run sweeps on every interval until ctx is cancelled.
+func (n *nonceStore) run(ctx context.Context, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.sweep()
+		}
+	}
+}
+
+// consume reports whether nonce was issued and is still live, and burns it
+// either way so that a nonce is never checked twice.
+func (n *nonceStore) consume(nonce string) bool {
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	expires, ok := n.nonces[nonce]
+	delete(n.nonces, nonce)
+
+	return ok && n.now().Before(expires)
+}
+
+// ChallengeMessage is what a client signs to log in: the nonce, the unix
+// timestamp in seconds and the origin of the request, separated by newlines.
+func ChallengeMessage(nonce string, timestamp string, origin string) []byte {
+	return []byte(nonce + "\n" + timestamp + "\n" + origin)
+}
+
+// requestOrigin is the Origin header sent by browsers, or the scheme and
+// host the request was made to otherwise.
+func requestOrigin(c echo.Context) string {
+	if origin := c.Request().Header.Get(echo.HeaderOrigin); origin != "" {
+		return origin
+	}
+	return c.Scheme() + "://" + c.Request().Host
+}
+
+// allowedOrigin tells whether the origin of the request is one of the
+// configured origins. Any origin is allowed when none is configured.
+func (ca *CertAuthority) allowedOrigin(origin string) bool {
+	return len(ca.session.AllowedOrigins) == 0 || utils.Contains(ca.session.AllowedOrigins, origin)
+}
+
+// verifyChallenge checks the nonce and timestamp headers of a login attempt
+// and returns the message its signature must cover.
+func (ca *CertAuthority) verifyChallenge(c echo.Context) ([]byte, proto.MiddlewareError) {
+
+	nonce := c.Request().Header.Get("nonce")
+	timestamp := c.Request().Header.Get("timestamp")
+
+	if nonce == "" || timestamp == "" {
+		return nil, challengeMissingError
+	}
+
+	origin := requestOrigin(c)
+
+	if !ca.allowedOrigin(origin) {
+		return nil, challengeOriginError
+	}
+
+	if !ca.nonces.consume(nonce) {
+		return nil, challengeInvalidError
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+
+	if err != nil {
+		return nil, challengeInvalidError
+	}
+
+	if skew := ca.nonces.now().Sub(time.Unix(seconds, 0)); skew > maxChallengeSkew || skew < -maxChallengeSkew {
+		return nil, challengeInvalidError
+	}
+
+	return ChallengeMessage(nonce, timestamp, origin), nil
+}
+
+func (ca *CertAuthority) issueChallenge(c echo.Context) error {
+
+	if !ca.allowedOrigin(requestOrigin(c)) {
+		return c.JSON(challengeOriginError.Status(), challengeOriginError.Message())
+	}
+
+	challenge, err := ca.nonces.issue()
+
+	if errors.Is(err, errNonceStoreFull) {
+		return c.JSON(challengeUnavailableError.Status(), challengeUnavailableError.Message())
+	} else if err != nil {
+		return c.JSON(certInternalError.Status(), certInternalError.Message())
+	}
+
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+	return c.JSON(http.StatusOK, challenge)
+}
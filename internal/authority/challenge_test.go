@@ -0,0 +1,151 @@
+package authority
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNonceStore(t *testing.T) {
+
+	now := time.Unix(1700000000, 0)
+	nonces := newNonceStore(time.Minute)
+	nonces.now = func() time.Time { return now }
+
+	a, err := nonces.issue()
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(time.Minute), a.ExpiresAt)
+
+	b, _ := nonces.issue()
+	assert.NotEqual(t, a.Nonce, b.Nonce)
+
+	assert.True(t, nonces.consume(a.Nonce))
+	assert.False(t, nonces.consume(a.Nonce))
+	assert.False(t, nonces.consume("unknown"))
+
+	now = now.Add(time.Minute)
+	assert.False(t, nonces.consume(b.Nonce))
+
+	// expired nonces are dropped by the sweep
+	nonces.sweep()
+	assert.Empty(t, nonces.nonces)
+	nonces.issue()
+	now = now.Add(2 * time.Minute)
+	nonces.issue()
+	nonces.sweep()
+	assert.Len(t, nonces.nonces, 1)
+
+	nonces.max = 2
+	_, err = nonces.issue()
+	assert.NoError(t, err)
+	_, err = nonces.issue()
+	assert.ErrorIs(t, err, errNonceStoreFull)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	now = now.Add(time.Hour)
+	go nonces.run(ctx, time.Millisecond)
+	assert.Eventually(t, func() bool {
+		nonces.mu.Lock()
+		defer nonces.mu.Unlock()
+		return len(nonces.nonces) == 0
+	}, time.Second, time.Millisecond)
+	cancel()
+}
+
+func TestIssueChallenge(t *testing.T) {
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/challenge", nil)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "no-store", rec.Header().Get(echo.HeaderCacheControl))
+
+	challenge := Challenge{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &challenge))
+	assert.NotEmpty(t, challenge.Nonce)
+	assert.True(t, challenge.ExpiresAt.After(time.Now()))
+
+	ca.session.AllowedOrigins = []string{"https://cealgull.org"}
+	defer func() { ca.session.AllowedOrigins = nil }()
+
+	issue := func(origin string) int {
+		req := httptest.NewRequest(http.MethodPost, "/auth/challenge", nil)
+		req.Header.Set(echo.HeaderOrigin, origin)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, issue("https://cealgull.org"))
+	assert.Equal(t, http.StatusForbidden, issue("https://evil.example"))
+
+	max := ca.nonces.max
+	ca.nonces.max = 0
+	defer func() { ca.nonces.max = max }()
+	assert.Equal(t, http.StatusServiceUnavailable, issue("https://cealgull.org"))
+}
+
+func TestVerifyChallenge(t *testing.T) {
+
+	request := func(nonce string, timestamp string, origin string) echo.Context {
+		req := httptest.NewRequest(http.MethodPost, "/auth/login", nil)
+		req.Header.Set("nonce", nonce)
+		req.Header.Set("timestamp", timestamp)
+		if origin != "" {
+			req.Header.Set(echo.HeaderOrigin, origin)
+		}
+		return server.NewContext(req, httptest.NewRecorder())
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	_, err := ca.verifyChallenge(request("", now, ""))
+	assert.IsType(t, &ChallengeMissingError{}, err)
+
+	challenge, _ := ca.nonces.issue()
+	_, err = ca.verifyChallenge(request(challenge.Nonce, "", ""))
+	assert.IsType(t, &ChallengeMissingError{}, err)
+
+	message, err := ca.verifyChallenge(request(challenge.Nonce, now, "https://cealgull.org"))
+	assert.Nil(t, err)
+	assert.Equal(t, ChallengeMessage(challenge.Nonce, now, "https://cealgull.org"), message)
+
+	_, err = ca.verifyChallenge(request(challenge.Nonce, now, ""))
+	assert.IsType(t, &ChallengeInvalidError{}, err)
+
+	stale := strconv.FormatInt(time.Now().Add(-maxChallengeSkew-time.Minute).Unix(), 10)
+	challenge, _ = ca.nonces.issue()
+	_, err = ca.verifyChallenge(request(challenge.Nonce, stale, ""))
+	assert.IsType(t, &ChallengeInvalidError{}, err)
+	assert.Equal(t, http.StatusUnauthorized, err.Status())
+
+	challenge, _ = ca.nonces.issue()
+	_, err = ca.verifyChallenge(request(challenge.Nonce, "yesterday", ""))
+	assert.IsType(t, &ChallengeInvalidError{}, err)
+
+	challenge, _ = ca.nonces.issue()
+	message, _ = ca.verifyChallenge(request(challenge.Nonce, now, ""))
+	assert.Equal(t, ChallengeMessage(challenge.Nonce, now, "http://example.com"), message)
+
+	ca.session.AllowedOrigins = []string{"https://cealgull.org"}
+	defer func() { ca.session.AllowedOrigins = nil }()
+
+	challenge, _ = ca.nonces.issue()
+	_, err = ca.verifyChallenge(request(challenge.Nonce, now, ""))
+	assert.IsType(t, &ChallengeOriginError{}, err)
+	_, err = ca.verifyChallenge(request(challenge.Nonce, now, "https://evil.example"))
+	assert.IsType(t, &ChallengeOriginError{}, err)
+	assert.Equal(t, http.StatusForbidden, err.Status())
+
+	message, err = ca.verifyChallenge(request(challenge.Nonce, now, "https://cealgull.org"))
+	assert.Nil(t, err)
+	assert.Equal(t, ChallengeMessage(challenge.Nonce, now, "https://cealgull.org"), message)
+}
@@ -12,8 +12,18 @@ type CertUnauthorizedError struct{}
 type CertInternalError struct{}
 type CertMissingError struct{}
 type SignatureDecodeError struct{}
-type SignatureMissingError struct{}
 type SignatureVerificationError struct{}
+type ChallengeMissingError struct{}
+type ChallengeInvalidError struct{}
+type ChallengeOriginError struct{}
+type ChallengeUnavailableError struct{}
+type CertRevokedError struct{}
+type TokenInvalidError struct{}
+type TokenScopeError struct{}
+type TokenRequestError struct{}
+type TokenNotFoundError struct{}
+type SessionNotFoundError struct{}
+type SessionRequestError struct{}
 
 func (e *CertInternalError) Error() string {
 	return "Cert: Internal Server Error."
@@ -30,6 +40,36 @@ func (e *CertInternalError) Message() *proto.ResponseMessage {
 	}
 }
 
+func (e *CertDecodeError) Error() string {
+	return "Cert: Cert Decode Error. Please send a PEM encoded x509 certificate."
+}
+
+func (e *CertDecodeError) Status() int {
+	return http.StatusBadRequest
+}
+
+func (e *CertDecodeError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "C1002",
+		Message: e.Error(),
+	}
+}
+
+func (e *CertFormatError) Error() string {
+	return "Cert: Cert Format Error. Only ed25519 keys are supported."
+}
+
+func (e *CertFormatError) Status() int {
+	return http.StatusBadRequest
+}
+
+func (e *CertFormatError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "C1004",
+		Message: e.Error(),
+	}
+}
+
 func (e *CertMissingError) Error() string {
 	return "Cert: Cert Missing Error. Please verify your body."
 }
@@ -75,32 +115,182 @@ func (e *SignatureDecodeError) Message() *proto.ResponseMessage {
 	}
 }
 
-func (e *SignatureMissingError) Error() string {
+func (e *SignatureVerificationError) Error() string {
 	return "Signature: Signature Missing Error. Please verify your headers."
 }
 
-func (e *SignatureMissingError) Status() int {
+func (e *SignatureVerificationError) Status() int {
 	return http.StatusBadRequest
 }
 
-func (e *SignatureMissingError) Message() *proto.ResponseMessage {
+func (e *SignatureVerificationError) Message() *proto.ResponseMessage {
 	return &proto.ResponseMessage{
 		Code:    "S1002",
 		Message: e.Error(),
 	}
 }
 
-func (e *SignatureVerificationError) Error() string {
-	return "Signature: Signature Missing Error. Please verify your headers."
+func (e *ChallengeMissingError) Error() string {
+	return "Challenge: Nonce Or Timestamp Missing. Please request /auth/challenge first."
 }
 
-func (e *SignatureVerificationError) Status() int {
+func (e *ChallengeMissingError) Status() int {
 	return http.StatusBadRequest
 }
 
-func (e *SignatureVerificationError) Message() *proto.ResponseMessage {
+func (e *ChallengeMissingError) Message() *proto.ResponseMessage {
 	return &proto.ResponseMessage{
-		Code:    "S1002",
+		Code:    "S1003",
+		Message: e.Error(),
+	}
+}
+
+func (e *ChallengeInvalidError) Error() string {
+	return "Challenge: Nonce Expired, Already Used Or Timestamp Out Of Range."
+}
+
+func (e *ChallengeInvalidError) Status() int {
+	return http.StatusUnauthorized
+}
+
+func (e *ChallengeInvalidError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "S1004",
+		Message: e.Error(),
+	}
+}
+
+func (e *ChallengeOriginError) Error() string {
+	return "Challenge: Origin Not Allowed."
+}
+
+func (e *ChallengeOriginError) Status() int {
+	return http.StatusForbidden
+}
+
+func (e *ChallengeOriginError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "S1005",
+		Message: e.Error(),
+	}
+}
+
+func (e *ChallengeUnavailableError) Error() string {
+	return "Challenge: Too Many Pending Challenges. Please retry later."
+}
+
+func (e *ChallengeUnavailableError) Status() int {
+	return http.StatusServiceUnavailable
+}
+
+func (e *ChallengeUnavailableError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "S1006",
+		Message: e.Error(),
+	}
+}
+
+func (e *CertRevokedError) Error() string {
+	return "Cert: Certificate Revoked."
+}
+
+func (e *CertRevokedError) Status() int {
+	return http.StatusUnauthorized
+}
+
+func (e *CertRevokedError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "A0244",
+		Message: e.Error(),
+	}
+}
+
+func (e *SessionNotFoundError) Error() string {
+	return "Session: Session Not Found."
+}
+
+func (e *SessionNotFoundError) Status() int {
+	return http.StatusNotFound
+}
+
+func (e *SessionNotFoundError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "A0241",
+		Message: e.Error(),
+	}
+}
+
+func (e *SessionRequestError) Error() string {
+	return "Session: Session Request Decode Error. Please verify your body."
+}
+
+func (e *SessionRequestError) Status() int {
+	return http.StatusBadRequest
+}
+
+func (e *SessionRequestError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "A0242",
+		Message: e.Error(),
+	}
+}
+
+func (e *TokenInvalidError) Error() string {
+	return "Token: Invalid Or Expired API Token."
+}
+
+func (e *TokenInvalidError) Status() int {
+	return http.StatusUnauthorized
+}
+
+func (e *TokenInvalidError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "A0245",
+		Message: e.Error(),
+	}
+}
+
+func (e *TokenScopeError) Error() string {
+	return "Token: API Token Scope Does Not Allow This Request."
+}
+
+func (e *TokenScopeError) Status() int {
+	return http.StatusForbidden
+}
+
+func (e *TokenScopeError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "A0246",
+		Message: e.Error(),
+	}
+}
+
+func (e *TokenRequestError) Error() string {
+	return "Token: Token Request Decode Error. Please verify your body."
+}
+
+func (e *TokenRequestError) Status() int {
+	return http.StatusBadRequest
+}
+
+func (e *TokenRequestError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "A0247",
+		Message: e.Error(),
+	}
+}
+
+func (e *TokenNotFoundError) Error() string {
+	return "Token: API Token Not Found."
+}
+
+func (e *TokenNotFoundError) Status() int {
+	return http.StatusNotFound
+}
+
+func (e *TokenNotFoundError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "A0248",
 		Message: e.Error(),
 	}
 }
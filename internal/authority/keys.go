@@ -0,0 +1,181 @@
+package authority
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Cealgull/Middleware/internal/config"
+	"github.com/gorilla/sessions"
+)
+
+const defaultSessionMaxAge = 3600
+
+const minSessionHashKeySize = 32
+
+var errSessionKeyTooShort = errors.New("session hash key must be at least 32 bytes long")
+var errSessionBlockKeySize = errors.New("session block key must be 16, 24 or 32 bytes long")
+var errSessionSameSite = errors.New("session sameSite must be one of lax, strict or none")
+var errSessionStoreKind = errors.New("session store must be one of database or cookie")
+var errSessionStoreNoDB = errors.New("database session store requires an offchain store")
+
+// SessionKey signs session cookies with Hash and encrypts them with Block.
+type SessionKey struct {
+	Hash  []byte
+	Block []byte
+}
+
+// ParseSessionKey reads a key written as base64 "hash[:block]". Without a
+// block key, one is derived from the hash key so cookies are always
+// encrypted.
+func ParseSessionKey(encoded string) (*SessionKey, error) {
+
+	hashPart, blockPart, found := strings.Cut(strings.TrimSpace(encoded), ":")
+
+	hash, err := base64.StdEncoding.DecodeString(hashPart)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hash) < minSessionHashKeySize {
+		return nil, errSessionKeyTooShort
+	}
+
+	key := &SessionKey{Hash: hash}
+
+	if !found {
+		mac := hmac.New(sha256.New, hash)
+		mac.Write([]byte("cealgull session encryption"))
+		key.Block = mac.Sum(nil)
+		return key, nil
+	}
+
+	if key.Block, err = base64.StdEncoding.DecodeString(blockPart); err != nil {
+		return nil, err
+	}
+
+	switch len(key.Block) {
+	case 16, 24, 32:
+		return key, nil
+	}
+
+	return nil, errSessionBlockKeySize
+}
+
+// LoadSessionKeys returns the keys listed in the configuration followed by
+// those in the key file, one per line. The first key signs new cookies and
+// every key is accepted when reading them, so keys are rotated by adding a
+// new key on top and dropping the old one once MaxAge has passed.
+func LoadSessionKeys(cfg *config.SessionConfig) ([]*SessionKey, error) {
+
+	encoded := append([]string{}, cfg.Keys...)
+
+	if cfg.KeyFile != "" {
+
+		f, err := os.Open(cfg.KeyFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				encoded = append(encoded, line)
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := make([]*SessionKey, len(encoded))
+
+	for i, e := range encoded {
+		key, err := ParseSessionKey(e)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+
+	return keys, nil
+}
+
+func sessionOptions(cfg *config.SessionConfig) (*sessions.Options, error) {
+
+	options := &sessions.Options{
+		Path:     "/",
+		Domain:   cfg.Domain,
+		MaxAge:   cfg.MaxAge,
+		Secure:   cfg.Secure,
+		HttpOnly: true,
+	}
+
+	if options.MaxAge <= 0 {
+		options.MaxAge = defaultSessionMaxAge
+	}
+
+	switch strings.ToLower(cfg.SameSite) {
+	case "", "lax":
+		options.SameSite = http.SameSiteLaxMode
+	case "strict":
+		options.SameSite = http.SameSiteStrictMode
+	case "none":
+		// browsers drop SameSite=None cookies that are not Secure
+		options.SameSite = http.SameSiteNoneMode
+		options.Secure = true
+	default:
+		return nil, errSessionSameSite
+	}
+
+	return options, nil
+}
+
+// sessionKeyPairs flattens the keys into hash and block pairs, falling back
+// to a random key when none is configured so that no deployment ever signs
+// with a well-known secret.
+func sessionKeyPairs(keys []*SessionKey) ([][]byte, error) {
+
+	if len(keys) == 0 {
+
+		hash := make([]byte, 64)
+		block := make([]byte, 32)
+
+		if _, err := rand.Read(hash); err != nil {
+			return nil, err
+		}
+
+		if _, err := rand.Read(block); err != nil {
+			return nil, err
+		}
+
+		keys = []*SessionKey{{Hash: hash, Block: block}}
+	}
+
+	pairs := make([][]byte, 0, 2*len(keys))
+
+	for _, key := range keys {
+		pairs = append(pairs, key.Hash, key.Block)
+	}
+
+	return pairs, nil
+}
+
+func newCookieStore(pairs [][]byte, options *sessions.Options) *sessions.CookieStore {
+	store := sessions.NewCookieStore(pairs...)
+	store.Options = options
+	store.MaxAge(options.MaxAge)
+	return store
+}
@@ -0,0 +1,163 @@
+package authority
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Cealgull/Middleware/internal/config"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func encodeKey(size int, fill byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(fill), size)))
+}
+
+func TestParseSessionKey(t *testing.T) {
+
+	key, err := ParseSessionKey(encodeKey(32, 'a'))
+	assert.NoError(t, err)
+	assert.Len(t, key.Block, 32)
+
+	key, err = ParseSessionKey(encodeKey(64, 'a') + ":" + encodeKey(16, 'b'))
+	assert.NoError(t, err)
+	assert.Len(t, key.Hash, 64)
+	assert.Len(t, key.Block, 16)
+
+	_, err = ParseSessionKey(encodeKey(16, 'a'))
+	assert.ErrorIs(t, err, errSessionKeyTooShort)
+
+	_, err = ParseSessionKey(encodeKey(32, 'a') + ":" + encodeKey(20, 'b'))
+	assert.ErrorIs(t, err, errSessionBlockKeySize)
+
+	_, err = ParseSessionKey("not base64")
+	assert.Error(t, err)
+
+	_, err = ParseSessionKey(encodeKey(32, 'a') + ":not base64")
+	assert.Error(t, err)
+}
+
+func TestLoadSessionKeys(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "session.keys")
+	assert.NoError(t, os.WriteFile(file, []byte("# rotated in\n"+encodeKey(32, 'b')+"\n\n"+encodeKey(32, 'c')+"\n"), 0o600))
+
+	keys, err := LoadSessionKeys(&config.SessionConfig{Keys: []string{encodeKey(32, 'a')}, KeyFile: file})
+	assert.NoError(t, err)
+	assert.Len(t, keys, 3)
+	assert.Equal(t, byte('a'), keys[0].Hash[0])
+	assert.Equal(t, byte('c'), keys[2].Hash[0])
+
+	_, err = LoadSessionKeys(&config.SessionConfig{KeyFile: filepath.Join(t.TempDir(), "missing")})
+	assert.Error(t, err)
+
+	_, err = LoadSessionKeys(&config.SessionConfig{Keys: []string{"short"}})
+	assert.Error(t, err)
+}
+
+func TestSessionOptions(t *testing.T) {
+
+	options, err := sessionOptions(&config.SessionConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, defaultSessionMaxAge, options.MaxAge)
+	assert.Equal(t, http.SameSiteLaxMode, options.SameSite)
+	assert.True(t, options.HttpOnly)
+	assert.False(t, options.Secure)
+
+	options, err = sessionOptions(&config.SessionConfig{MaxAge: 60, SameSite: "Strict", Domain: "cealgull.org"})
+	assert.NoError(t, err)
+	assert.Equal(t, 60, options.MaxAge)
+	assert.Equal(t, http.SameSiteStrictMode, options.SameSite)
+	assert.Equal(t, "cealgull.org", options.Domain)
+
+	options, err = sessionOptions(&config.SessionConfig{SameSite: "none"})
+	assert.NoError(t, err)
+	assert.Equal(t, http.SameSiteNoneMode, options.SameSite)
+	assert.True(t, options.Secure)
+
+	_, err = sessionOptions(&config.SessionConfig{SameSite: "sometimes"})
+	assert.ErrorIs(t, err, errSessionSameSite)
+}
+
+func TestSessionKeyRotation(t *testing.T) {
+
+	logger, _ := zap.NewProduction()
+
+	oldCA, err := NewCertAuthority(logger, HOST, PORT, WithSessionConfig(&config.SessionConfig{
+		Keys:   []string{encodeKey(32, 'a')},
+		MaxAge: 120,
+	}))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/login", nil)
+	rec := httptest.NewRecorder()
+	c := server.NewContext(req, rec)
+	c.Set("_session_store", oldCA.store)
+	assert.NoError(t, oldCA.signSession(c, "0x123456789", ""))
+
+	cookie := rec.Result().Cookies()[0]
+	assert.Equal(t, 120, cookie.MaxAge)
+	assert.True(t, cookie.HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+
+	// the cookie is encrypted, so the wallet cannot be read off it
+	raw, _ := base64.URLEncoding.DecodeString(cookie.Value)
+	assert.NotContains(t, string(raw), "0x123456789")
+
+	wallet := func(ca *CertAuthority) (string, error) {
+		req := httptest.NewRequest(http.MethodGet, "/api/user", nil)
+		req.AddCookie(cookie)
+		c := server.NewContext(req, httptest.NewRecorder())
+		c.Set("_session_store", ca.store)
+		s, err := session.Get("session", c)
+		w, _ := s.Values["wallet"].(string)
+		return w, err
+	}
+
+	rotated, err := NewCertAuthority(logger, HOST, PORT, WithSessionConfig(&config.SessionConfig{
+		Keys: []string{encodeKey(32, 'b'), encodeKey(32, 'a')},
+	}))
+	assert.NoError(t, err)
+
+	w, err := wallet(rotated)
+	assert.NoError(t, err)
+	assert.Equal(t, "0x123456789", w)
+
+	retired, err := NewCertAuthority(logger, HOST, PORT, WithSessionConfig(&config.SessionConfig{
+		Keys: []string{encodeKey(32, 'b')},
+	}))
+	assert.NoError(t, err)
+
+	w, err = wallet(retired)
+	assert.Error(t, err)
+	assert.Empty(t, w)
+}
+
+func TestNewCertAuthoritySessionConfig(t *testing.T) {
+
+	logger, _ := zap.NewProduction()
+
+	_, err := NewCertAuthority(logger, HOST, PORT, WithSessionConfig(&config.SessionConfig{Keys: []string{"short"}}))
+	assert.Error(t, err)
+
+	_, err = NewCertAuthority(logger, HOST, PORT, WithSessionConfig(&config.SessionConfig{SameSite: "sometimes"}))
+	assert.Error(t, err)
+
+	// without keys every authority gets its own random key
+	a, _ := NewCertAuthority(logger, HOST, PORT)
+	b, _ := NewCertAuthority(logger, HOST, PORT)
+
+	encoded, err := securecookie.EncodeMulti("session", map[interface{}]interface{}{"wallet": "0x1"}, a.store.(*sessions.CookieStore).Codecs...)
+	assert.NoError(t, err)
+
+	values := map[interface{}]interface{}{}
+	assert.Error(t, securecookie.DecodeMulti("session", encoded, &values, b.store.(*sessions.CookieStore).Codecs...))
+}
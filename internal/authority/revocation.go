@@ -0,0 +1,220 @@
+package authority
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Cealgull/Middleware/internal/config"
+	. "github.com/Cealgull/Middleware/internal/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm/clause"
+)
+
+const defaultRevocationInterval = 5 * time.Minute
+
+var errRevocationFetch = errors.New("verify service did not return a revocation list")
+
+// revocations holds the serials, in hex, of the certificates on the latest
+// revocation list.
+type revocations struct {
+	mu       sync.RWMutex
+	serials  map[string]time.Time
+	interval time.Duration
+	load     func() ([]byte, error)
+}
+
+func (r *revocations) contains(serial string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.serials[serial]
+	return ok
+}
+
+// replace swaps in a new list and returns the serials that were not on the
+// previous one.
+func (r *revocations) replace(serials map[string]time.Time) []string {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	added := []string{}
+
+	for serial := range serials {
+		if _, ok := r.serials[serial]; !ok {
+			added = append(added, serial)
+		}
+	}
+
+	r.serials = serials
+	return added
+}
+
+// parseRevocationList reads a PEM or DER encoded X.509 CRL.
+func parseRevocationList(data []byte) (map[string]time.Time, error) {
+
+	if b, _ := pem.Decode(data); b != nil {
+		data = b.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	serials := make(map[string]time.Time, len(crl.RevokedCertificates))
+
+	for _, revoked := range crl.RevokedCertificates {
+		serials[revoked.SerialNumber.Text(16)] = revoked.RevocationTime
+	}
+
+	return serials, nil
+}
+
+// withRevocationConfig checks certificates against the CRL of the Verify
+// service, or against a local CRL file when one is configured.
+func withRevocationConfig(cfg *config.RevocationConfig) CertAuthorityOption {
+	return func(ca *CertAuthority) error {
+
+		if !cfg.Enabled {
+			ca.revocations = nil
+			return nil
+		}
+
+		r := &revocations{serials: map[string]time.Time{}, interval: cfg.Interval}
+
+		if r.interval <= 0 {
+			r.interval = defaultRevocationInterval
+		}
+
+		if cfg.CRLFile != "" {
+			file := cfg.CRLFile
+			r.load = func() ([]byte, error) { return os.ReadFile(file) }
+		} else {
+			r.load = func() ([]byte, error) {
+				resp, err := ca.client.R().Get(ca.crlEndpoint)
+				if err != nil {
+					return nil, err
+				}
+				if resp.StatusCode() != http.StatusOK {
+					return nil, errRevocationFetch
+				}
+				return resp.Body(), nil
+			}
+		}
+
+		ca.revocations = r
+		return nil
+	}
+}
+
+func (ca *CertAuthority) isRevoked(cert *x509.Certificate) bool {
+	return ca.revocations != nil && ca.revocations.contains(cert.SerialNumber.Text(16))
+}
+
+// recordCert remembers the wallet behind a certificate that just logged in.
+func (ca *CertAuthority) recordCert(cert *x509.Certificate) {
+
+	if ca.db == nil {
+		return
+	}
+
+	now := time.Now()
+
+	record := WalletCert{
+		Serial:     cert.SerialNumber.Text(16),
+		Wallet:     cert.Subject.CommonName,
+		CreatedAt:  now,
+		LastSeenAt: now,
+	}
+
+	err := ca.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "serial"}},
+		DoUpdates: clause.AssignmentColumns([]string{"wallet", "last_seen_at"}),
+	}).Create(&record).Error
+
+	if err != nil {
+		ca.logger.Warn("Failed to record certificate", zap.String("wallet", record.Wallet), zap.Error(err))
+	}
+}
+
+// refreshRevocations loads the revocation list, then signs out, drops the
+// API tokens of and bans every wallet whose certificate has newly been
+// revoked. A list that cannot be loaded leaves the previous one in place.
+func (ca *CertAuthority) refreshRevocations() error {
+
+	data, err := ca.revocations.load()
+
+	if err != nil {
+		return err
+	}
+
+	serials, err := parseRevocationList(data)
+
+	if err != nil {
+		return err
+	}
+
+	added := ca.revocations.replace(serials)
+
+	if len(added) == 0 || ca.db == nil {
+		return nil
+	}
+
+	certs := []*WalletCert{}
+
+	if err := ca.db.Where("serial IN ?", added).Find(&certs).Error; err != nil {
+		return err
+	}
+
+	for _, cert := range certs {
+
+		if err := ca.db.Model(cert).Update("revoked_at", serials[cert.Serial]).Error; err != nil {
+			return err
+		}
+
+		if err := ca.db.Model(&User{}).Where("wallet = ?", cert.Wallet).Update("banned", true).Error; err != nil {
+			return err
+		}
+
+		if err := ca.db.Where("wallet = ?", cert.Wallet).Delete(&APIToken{}).Error; err != nil {
+			return err
+		}
+
+		if ca.sessions != nil {
+			if _, err := ca.sessions.RevokeAll(cert.Wallet); err != nil {
+				return err
+			}
+		}
+
+		ca.logger.Info("Certificate revoked", zap.String("wallet", cert.Wallet), zap.String("serial", cert.Serial))
+	}
+
+	return nil
+}
+
+// watchRevocations refreshes the revocation list every interval until ctx
+// is done.
+func (ca *CertAuthority) watchRevocations(ctx context.Context) {
+
+	ticker := time.NewTicker(ca.revocations.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := ca.refreshRevocations(); err != nil {
+			ca.logger.Warn("Failed to refresh revocation list", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
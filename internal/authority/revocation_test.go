@@ -0,0 +1,181 @@
+package authority
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cealgull/Middleware/internal/config"
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// generateCRL returns a PEM encoded CRL revoking serials.
+func generateCRL(t *testing.T, serials ...*big.Int) []byte {
+
+	pub, priv, _ := ed25519.GenerateKey(nil)
+
+	issuer := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Cealgull Verify"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		SubjectKeyId:          []byte{1, 2, 3, 4},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, issuer, issuer, pub, priv)
+	assert.NoError(t, err)
+	issuer, _ = x509.ParseCertificate(der)
+
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+
+	for _, serial := range serials {
+		template.RevokedCertificates = append(template.RevokedCertificates, pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: time.Unix(1700000000, 0),
+		})
+	}
+
+	crl, err := x509.CreateRevocationList(rand.Reader, template, issuer, priv)
+	assert.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl})
+}
+
+func TestParseRevocationList(t *testing.T) {
+
+	crl := generateCRL(t, big.NewInt(0x2a), big.NewInt(0xff))
+
+	serials, err := parseRevocationList(crl)
+	assert.NoError(t, err)
+	assert.Len(t, serials, 2)
+	assert.Contains(t, serials, "2a")
+	assert.Contains(t, serials, "ff")
+
+	b, _ := pem.Decode(crl)
+	serials, err = parseRevocationList(b.Bytes)
+	assert.NoError(t, err)
+	assert.Len(t, serials, 2)
+
+	_, err = parseRevocationList([]byte("not a crl"))
+	assert.Error(t, err)
+}
+
+func TestRevocationsReplace(t *testing.T) {
+
+	r := &revocations{serials: map[string]time.Time{}}
+
+	assert.ElementsMatch(t, []string{"1", "2"}, r.replace(map[string]time.Time{"1": {}, "2": {}}))
+	assert.ElementsMatch(t, []string{"3"}, r.replace(map[string]time.Time{"1": {}, "3": {}}))
+	assert.False(t, r.contains("2"))
+	assert.True(t, r.contains("3"))
+}
+
+func TestRefreshRevocationsFromFile(t *testing.T) {
+
+	ca, db, e := newSessionCA(t)
+
+	file := filepath.Join(t.TempDir(), "verify.crl")
+	assert.NoError(t, os.WriteFile(file, generateCRL(t), 0o600))
+
+	assert.NoError(t, withRevocationConfig(&config.RevocationConfig{Enabled: true, CRLFile: file})(ca))
+	assert.NoError(t, ca.refreshRevocations())
+
+	priv, pemcert := generateCert(t)
+	b, _ := pem.Decode([]byte(pemcert))
+	cert, _ := x509.ParseCertificate(b.Bytes)
+
+	// the wallet logs in with the certificate on two devices
+	ca.recordCert(cert)
+	login(t, ca, e, "Cealgull", "Phone")
+	login(t, ca, e, "Cealgull", "Laptop")
+	assert.NoError(t, db.Create(&User{Username: "cealgull", Wallet: "Cealgull"}).Error)
+	assert.NoError(t, db.Create(&APIToken{Wallet: "Cealgull", Name: "bot", Prefix: "cgt_", Hash: "hash", Scopes: ScopeRead, ExpiresAt: time.Now().Add(time.Hour)}).Error)
+
+	assert.False(t, ca.sessionRevoked(map[interface{}]interface{}{"serial": "1"}))
+
+	assert.NoError(t, os.WriteFile(file, generateCRL(t, cert.SerialNumber), 0o600))
+	assert.NoError(t, ca.refreshRevocations())
+
+	user := User{}
+	db.Where("wallet = ?", "Cealgull").First(&user)
+	assert.True(t, user.Banned)
+
+	record := WalletCert{}
+	db.First(&record, "serial = ?", "1")
+	assert.NotNil(t, record.RevokedAt)
+
+	var count int64
+	db.Model(&Session{}).Where("wallet = ?", "Cealgull").Count(&count)
+	assert.Zero(t, count)
+
+	db.Model(&APIToken{}).Where("wallet = ?", "Cealgull").Count(&count)
+	assert.Zero(t, count)
+
+	assert.True(t, ca.sessionRevoked(map[interface{}]interface{}{"serial": "1"}))
+
+	message := []byte("message")
+	_, err := ca.validateCert(sign(priv, message), CACert{Cert: pemcert}, message)
+
+	var _ = err.Message()
+	var _ = err.Status()
+
+	assert.IsType(t, &CertRevokedError{}, err)
+
+	// a broken list keeps the previous one
+	assert.NoError(t, os.WriteFile(file, []byte("garbage"), 0o600))
+	assert.Error(t, ca.refreshRevocations())
+	assert.True(t, ca.isRevoked(cert))
+}
+
+func TestRefreshRevocationsFromVerify(t *testing.T) {
+
+	logger, _ := zap.NewProduction()
+
+	crl := generateCRL(t, big.NewInt(0x2a))
+	status := http.StatusOK
+
+	verify := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/cert/crl", r.URL.Path)
+		w.WriteHeader(status)
+		w.Write(crl)
+	}))
+	defer verify.Close()
+
+	ca, err := NewCertAuthority(logger, HOST, PORT, WithVerifyConfig(&config.VerifyConfig{
+		Retries:    -1,
+		Revocation: config.RevocationConfig{Enabled: true},
+	}))
+	assert.NoError(t, err)
+	ca.crlEndpoint = verify.URL + "/cert/crl"
+
+	assert.NoError(t, ca.refreshRevocations())
+	assert.True(t, ca.revocations.contains("2a"))
+	assert.Equal(t, defaultRevocationInterval, ca.revocations.interval)
+
+	status = http.StatusServiceUnavailable
+	assert.ErrorIs(t, ca.refreshRevocations(), errRevocationFetch)
+	assert.True(t, ca.revocations.contains("2a"))
+
+	disabled, err := NewCertAuthority(logger, HOST, PORT)
+	assert.NoError(t, err)
+	assert.Nil(t, disabled.revocations)
+	assert.False(t, disabled.sessionRevoked(map[interface{}]interface{}{"serial": "2a"}))
+}
@@ -1,61 +1,254 @@
 package authority
 
 import (
+	"net/http"
+	"time"
 
-	"github.com/gorilla/sessions"
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/proto"
+	"github.com/Cealgull/Middleware/internal/rest"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
 )
 
-var signatureMissingError *SignatureMissingError = &SignatureMissingError{}
-var certMissingError *CertMissingError = &CertMissingError{}
+const sessionCleanupInterval = 10 * time.Minute
 
-func (ca *CertAuthority) signSession(c echo.Context, wallet string) error {
+var certMissingError *CertMissingError = &CertMissingError{}
+var challengeMissingError *ChallengeMissingError = &ChallengeMissingError{}
+var challengeInvalidError *ChallengeInvalidError = &ChallengeInvalidError{}
+var challengeOriginError *ChallengeOriginError = &ChallengeOriginError{}
+var challengeUnavailableError *ChallengeUnavailableError = &ChallengeUnavailableError{}
+var certInternalError *CertInternalError = &CertInternalError{}
+var certUnauthorizedError *CertUnauthorizedError = &CertUnauthorizedError{}
+var certRevokedError *CertRevokedError = &CertRevokedError{}
+var certDecodeError *CertDecodeError = &CertDecodeError{}
+var certFormatError *CertFormatError = &CertFormatError{}
+var signatureDecodeError *SignatureDecodeError = &SignatureDecodeError{}
+var signatureVerificationError *SignatureVerificationError = &SignatureVerificationError{}
+var sessionNotFoundError *SessionNotFoundError = &SessionNotFoundError{}
+var sessionRequestError *SessionRequestError = &SessionRequestError{}
+var tokenInvalidError *TokenInvalidError = &TokenInvalidError{}
+var tokenScopeError *TokenScopeError = &TokenScopeError{}
+var tokenRequestError *TokenRequestError = &TokenRequestError{}
+var tokenNotFoundError *TokenNotFoundError = &TokenNotFoundError{}
+var success *proto.Success = &proto.Success{}
+
+func (ca *CertAuthority) signSession(c echo.Context, wallet string, serial string) error {
 	s, _ := session.Get("session", c)
-	s.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   3600, // 60 minutes for testing
-		HttpOnly: true,
-	}
+	options := *ca.options
+	s.Options = &options
 	s.Values["authorized"] = true
 	s.Values["wallet"] = wallet
+	s.Values["serial"] = serial
 	return s.Save(c.Request(), c.Response())
 }
 
+// sessionRevoked reports whether the certificate the session was signed
+// with has been revoked since.
+func (ca *CertAuthority) sessionRevoked(values map[interface{}]interface{}) bool {
+	serial, ok := values["serial"].(string)
+	return ok && ca.revocations != nil && ca.revocations.contains(serial)
+}
+
+// ValidateSession identifies the caller of every request and enforces the
+// policy declared for its route. Public routes never look at credentials.
 func (ca *CertAuthority) ValidateSession(next echo.HandlerFunc) echo.HandlerFunc {
 
 	return func(c echo.Context) error {
-		// Skip filtering for special endpoints
-		if c.Path() == "/" && c.Request().Method == "GET" {
+
+		policy := rest.PolicyOf(c)
+
+		if policy == rest.AuthPublic {
 			return next(c)
 		}
 
-		s, _ := session.Get("session", c)
+		id, err := ca.identify(c, policy)
+
+		if err != nil {
+			return c.JSON(err.Status(), err.Message())
+		}
+
+		if id != nil {
+			rest.SetIdentity(c, id)
+		}
+
+		if err := policy.Check(id); err != nil {
+			return c.JSON(err.Status(), err.Message())
+		}
 
-		if v, ok := s.Values["authorized"].(bool); c.Request().URL.RequestURI() == "/auth/login" || !ok || !v {
+		return next(c)
+	}
+}
 
-			var reqcert CACert
+// identify resolves the caller from an API token, a certificate login or
+// the session, in that order. Credentials that are sent but do not hold up
+// are an error even where the route allows anonymous calls.
+func (ca *CertAuthority) identify(c echo.Context, policy rest.AuthPolicy) (*rest.Identity, proto.MiddlewareError) {
 
-			if c.Bind(&reqcert) != nil {
-				return c.JSON(certMissingError.Status(), certMissingError.Message())
-			}
+	// Bots authenticate every request with an API token instead of a
+	// session, so no session is created for them.
+	if secret, ok := bearerToken(c); ok {
 
-			signature := c.Request().Header.Get("signature")
+		token, err := ca.authenticateToken(c, secret, policy)
 
-			if signature == "" {
-				return c.JSON(signatureMissingError.Status(), signatureMissingError.Message())
-			}
+		if err != nil {
+			return nil, err
+		}
 
-			cert, err := ca.validateCert(signature, reqcert)
+		c.Set(TokenContextKey, token)
 
-			if err != nil {
-				return c.JSON(err.Status(), err.Message())
-			}
+		return &rest.Identity{
+			Wallet: token.Wallet,
+			Admin:  ca.IsAdmin(token.Wallet) && token.HasScope(ScopeModerate),
+		}, nil
+	}
+
+	if signature := c.Request().Header.Get("signature"); signature != "" {
+		return ca.login(c, signature)
+	}
+
+	s, _ := session.Get("session", c)
 
-			var _ = ca.signSession(c, cert.Subject.CommonName)
+	authorized, _ := s.Values["authorized"].(bool)
+	wallet, _ := s.Values["wallet"].(string)
 
+	if !authorized || wallet == "" || ca.sessionRevoked(s.Values) {
+		return nil, nil
+	}
+
+	return &rest.Identity{Wallet: wallet, Admin: ca.IsAdmin(wallet)}, nil
+}
+
+// login signs a session for the certificate in the body once the signature
+// over the login challenge checks out.
+func (ca *CertAuthority) login(c echo.Context, signature string) (*rest.Identity, proto.MiddlewareError) {
+
+	var reqcert CACert
+
+	if c.Bind(&reqcert) != nil || reqcert.Cert == "" {
+		return nil, certMissingError
+	}
+
+	message, err := ca.verifyChallenge(c)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := ca.validateCert(signature, reqcert, message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ca.recordCert(cert)
+
+	wallet := cert.Subject.CommonName
+
+	var _ = ca.signSession(c, wallet, cert.SerialNumber.Text(16))
+
+	return &rest.Identity{Wallet: wallet, Admin: ca.IsAdmin(wallet)}, nil
+}
+
+func (ca *CertAuthority) listSessions(c echo.Context) error {
+
+	s, _ := session.Get("session", c)
+	wallet := rest.WalletOf(c)
+
+	list, err := ca.sessions.Sessions(wallet)
+
+	if err != nil {
+		ca.logger.Error("Failed to list sessions", zap.String("wallet", wallet), zap.Error(err))
+		return c.JSON(certInternalError.Status(), certInternalError.Message())
+	}
+
+	for _, row := range list {
+		row.Current = row.Token == s.ID
+	}
+
+	return c.JSON(http.StatusOK, list)
+}
+
+// revokeSessions revokes one session of the caller by id, or all of them.
+// Revoking the current session also clears its cookie.
+func (ca *CertAuthority) revokeSessions(c echo.Context) error {
+
+	type RevokeRequest struct {
+		ID  uint `json:"id"`
+		All bool `json:"all"`
+	}
+
+	request := RevokeRequest{}
+
+	if err := c.Bind(&request); err != nil || (request.ID == 0 && !request.All) {
+		return c.JSON(sessionRequestError.Status(), sessionRequestError.Message())
+	}
+
+	wallet := rest.WalletOf(c)
+
+	if request.All {
+		if _, err := ca.sessions.RevokeAll(wallet); err != nil {
+			ca.logger.Error("Failed to revoke sessions", zap.String("wallet", wallet), zap.Error(err))
+			return c.JSON(certInternalError.Status(), certInternalError.Message())
 		}
+	} else {
 
-		return next(c)
+		found, err := ca.sessions.Revoke(wallet, request.ID)
+
+		if err != nil {
+			ca.logger.Error("Failed to revoke session", zap.String("wallet", wallet), zap.Error(err))
+			return c.JSON(certInternalError.Status(), certInternalError.Message())
+		}
+
+		if !found {
+			return c.JSON(sessionNotFoundError.Status(), sessionNotFoundError.Message())
+		}
+	}
+
+	ca.clearRevokedSession(c)
+
+	return c.JSON(success.Status(), success.Message())
+}
+
+// revokeWalletSessions lets an admin sign a wallet out everywhere, e.g.
+// once it has been banned. The route is declared admin only.
+func (ca *CertAuthority) revokeWalletSessions(c echo.Context) error {
+
+	type RevokeRequest struct {
+		Wallet string `json:"wallet"`
+	}
+
+	request := RevokeRequest{}
+
+	if err := c.Bind(&request); err != nil || request.Wallet == "" {
+		return c.JSON(sessionRequestError.Status(), sessionRequestError.Message())
+	}
+
+	revoked, err := ca.sessions.RevokeAll(request.Wallet)
+
+	if err != nil {
+		ca.logger.Error("Failed to revoke sessions", zap.String("wallet", request.Wallet), zap.Error(err))
+		return c.JSON(certInternalError.Status(), certInternalError.Message())
 	}
+
+	ca.logger.Info("Revoked sessions", zap.String("wallet", request.Wallet), zap.Int64("count", revoked))
+
+	ca.clearRevokedSession(c)
+
+	return c.JSON(success.Status(), success.Message())
+}
+
+// clearRevokedSession expires the cookie of the current session when its
+// row is gone.
+func (ca *CertAuthority) clearRevokedSession(c echo.Context) {
+
+	s, _ := session.Get("session", c)
+
+	if s.ID == "" || ca.sessions.Exists(s.ID) {
+		return
+	}
+
+	s.Options.MaxAge = -1
+	var _ = s.Save(c.Request(), c.Response())
 }
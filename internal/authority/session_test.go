@@ -5,8 +5,11 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/Cealgull/Middleware/internal/rest"
 	"github.com/gorilla/sessions"
 	"github.com/jarcoal/httpmock"
 	"github.com/labstack/echo-contrib/session"
@@ -33,6 +36,7 @@ func generateRequest(method string, url string, sig string, cert string) echo.Co
 
 	c := server.NewContext(req, rec)
 	c.SetPath(url)
+	c.SetHandler(methodOKhandler)
 	return c
 }
 
@@ -49,6 +53,8 @@ func TestValidateSession(t *testing.T) {
 	v := ca.ValidateSession(methodOKhandler)
 	v = s(v)
 
+	rest.Declare(server, rest.AuthPublic, server.GET("/", methodOKhandler))
+
 	c := generateRequest("GET", "/", "", "")
 	err := v(c)
 
@@ -58,9 +64,13 @@ func TestValidateSession(t *testing.T) {
 	c = generateRequest("POST", "/auth/login", "", "")
 	err = v(c)
 	assert.NoError(t, err)
-	assert.Equal(t, http.StatusBadRequest, c.Response().Status)
+	assert.Equal(t, http.StatusUnauthorized, c.Response().Status)
+
+	priv, cert := generateCert(t)
 
-	sig, cert := generateCert(t)
+	challenge, _ := ca.nonces.issue()
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := sign(priv, ChallengeMessage(challenge.Nonce, timestamp, "http://example.com"))
 
 	c = generateRequest("POST", "/auth/login", sig, "")
 	err = v(c)
@@ -70,20 +80,46 @@ func TestValidateSession(t *testing.T) {
 	c = generateRequest("POST", "/auth/login", "", cert)
 	err = v(c)
 	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, c.Response().Status)
+
+	c = generateRequest("POST", "/auth/login", sig, cert)
+	err = v(c)
+	assert.NoError(t, err)
 	assert.Equal(t, http.StatusBadRequest, c.Response().Status)
 
-  _, cert2 := generateCert(t)
-  
-	c = generateRequest("POST", "/auth/login", sig, cert2)
+	_, cert2 := generateCert(t)
+
+	c = withChallenge(generateRequest("POST", "/auth/login", sig, cert2), challenge.Nonce, timestamp)
 	err = v(c)
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusBadRequest, c.Response().Status)
 
-	c = generateRequest("POST", "/auth/login", sig, cert)
+	// the failed attempt burnt the nonce
+	c = withChallenge(generateRequest("POST", "/auth/login", sig, cert), challenge.Nonce, timestamp)
+	err = v(c)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, c.Response().Status)
+
+	challenge, _ = ca.nonces.issue()
+	sig = sign(priv, ChallengeMessage(challenge.Nonce, timestamp, "http://example.com"))
+
+	c = withChallenge(generateRequest("POST", "/auth/login", sig, cert), challenge.Nonce, timestamp)
 	err = v(c)
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, c.Response().Status)
 
 	sess, _ := session.Get("session", c)
 	assert.True(t, sess.Values["authorized"].(bool))
+
+	// a captured signature cannot be replayed
+	c = withChallenge(generateRequest("POST", "/auth/login", sig, cert), challenge.Nonce, timestamp)
+	err = v(c)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, c.Response().Status)
+}
+
+func withChallenge(c echo.Context, nonce string, timestamp string) echo.Context {
+	c.Request().Header.Set("nonce", nonce)
+	c.Request().Header.Set("timestamp", timestamp)
+	return c
 }
@@ -0,0 +1,222 @@
+package authority
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"time"
+
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"gorm.io/gorm"
+)
+
+// sessionTouchInterval bounds how often LastSeenAt is written back.
+const sessionTouchInterval = time.Minute
+
+const maxUserAgentLength = 256
+
+// DBStore is a gorilla sessions.Store keeping session values in the offchain
+// store. Cookies only carry the signed and encrypted session token.
+type DBStore struct {
+	db      *gorm.DB
+	codecs  []securecookie.Codec
+	Options *sessions.Options
+	now     func() time.Time
+	ip      func(r *http.Request) string
+}
+
+func NewDBStore(db *gorm.DB, options *sessions.Options, keyPairs ...[]byte) *DBStore {
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	for _, codec := range codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(options.MaxAge)
+		}
+	}
+	return &DBStore{db: db, codecs: codecs, Options: options, now: time.Now, ip: directIP}
+}
+
+func (s *DBStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *DBStore) New(r *http.Request, name string) (*sessions.Session, error) {
+
+	session := sessions.NewSession(s, name)
+	options := *s.Options
+	session.Options = &options
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+
+	if err != nil {
+		return session, nil
+	}
+
+	token := ""
+
+	if err := securecookie.DecodeMulti(name, c.Value, &token, s.codecs...); err != nil {
+		return session, err
+	}
+
+	row := Session{}
+	now := s.now()
+
+	if tx := s.db.Where("token = ? AND expires_at > ?", token, now).Limit(1).Find(&row); tx.Error != nil || tx.RowsAffected == 0 {
+		return session, tx.Error
+	}
+
+	if err := (securecookie.GobEncoder{}).Deserialize(row.Data, &session.Values); err != nil {
+		return session, err
+	}
+
+	session.ID = token
+	session.IsNew = false
+
+	if now.Sub(row.LastSeenAt) > sessionTouchInterval {
+		s.db.Model(&row).Update("last_seen_at", now)
+	}
+
+	return session, nil
+}
+
+// Save persists the session and refreshes its cookie. A session revoked
+// while the request was in flight is not brought back.
+func (s *DBStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.db.Where("token = ?", session.ID).Delete(&Session{}).Error; err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	data, err := (securecookie.GobEncoder{}).Serialize(session.Values)
+
+	if err != nil {
+		return err
+	}
+
+	now := s.now()
+	wallet, _ := session.Values["wallet"].(string)
+
+	row := Session{
+		Token:      session.ID,
+		Wallet:     wallet,
+		Data:       data,
+		UserAgent:  truncate(r.UserAgent(), maxUserAgentLength),
+		IP:         s.ip(r),
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(time.Duration(session.Options.MaxAge) * time.Second),
+	}
+
+	if session.ID == "" {
+
+		token := make([]byte, 32)
+
+		if _, err := rand.Read(token); err != nil {
+			return err
+		}
+
+		session.ID = base64.RawURLEncoding.EncodeToString(token)
+		row.Token = session.ID
+
+		if err := s.db.Create(&row).Error; err != nil {
+			return err
+		}
+
+	} else {
+
+		tx := s.db.Model(&Session{}).Where("token = ?", session.ID).Updates(map[string]interface{}{
+			"wallet":       row.Wallet,
+			"data":         row.Data,
+			"ip":           row.IP,
+			"last_seen_at": row.LastSeenAt,
+			"expires_at":   row.ExpiresAt,
+		})
+
+		if tx.Error != nil {
+			return tx.Error
+		}
+
+		if tx.RowsAffected == 0 {
+			return nil
+		}
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Sessions lists the live sessions of wallet, most recently used first.
+func (s *DBStore) Sessions(wallet string) ([]*Session, error) {
+	sessions := []*Session{}
+	err := s.db.Where("wallet = ? AND expires_at > ?", wallet, s.now()).
+		Order("last_seen_at DESC").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// Revoke deletes the session id of wallet and reports whether it existed.
+func (s *DBStore) Revoke(wallet string, id uint) (bool, error) {
+	tx := s.db.Where("id = ? AND wallet = ?", id, wallet).Delete(&Session{})
+	return tx.RowsAffected != 0, tx.Error
+}
+
+// RevokeAll deletes every session of wallet.
+func (s *DBStore) RevokeAll(wallet string) (int64, error) {
+	tx := s.db.Where("wallet = ?", wallet).Delete(&Session{})
+	return tx.RowsAffected, tx.Error
+}
+
+// Exists reports whether the session with token is still live.
+func (s *DBStore) Exists(token string) bool {
+	var count int64
+	s.db.Model(&Session{}).Where("token = ? AND expires_at > ?", token, s.now()).Count(&count)
+	return count != 0
+}
+
+// Cleanup deletes expired sessions every interval until ctx is done.
+func (s *DBStore) Cleanup(ctx context.Context, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.db.Where("expires_at <= ?", s.now()).Delete(&Session{})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// directIP is the address of the connection, used unless the server tells
+// client IPs otherwise.
+func directIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,234 @@
+package authority
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cealgull/Middleware/internal/config"
+	"github.com/Cealgull/Middleware/internal/fabric/offchain"
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/rest"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func newSessionCA(t *testing.T, admins ...string) (*CertAuthority, *gorm.DB, *echo.Echo) {
+
+	db, err := offchain.NewOffchainStore(sqlite.Open("file::memory:"), &config.PostgresGormConfig{})
+	assert.NoError(t, err)
+
+	logger, _ := zap.NewProduction()
+
+	ca, err := NewCertAuthority(logger, HOST, PORT,
+		WithSessionConfig(&config.SessionConfig{Keys: []string{encodeKey(32, 'a')}}),
+		WithOffchainStore(db),
+		WithAdmins(admins),
+	)
+	assert.NoError(t, err)
+
+	e := echo.New()
+	e.IPExtractor, err = rest.NewIPExtractor([]string{"192.0.2.0/24", "10.0.0.2/32"})
+	assert.NoError(t, err)
+	assert.NoError(t, ca.Register(e))
+
+	return ca, db, e
+}
+
+// login signs a session for wallet the way a successful /auth/login does.
+func login(t *testing.T, ca *CertAuthority, e *echo.Echo, wallet string, agent string) *http.Cookie {
+	req := httptest.NewRequest(http.MethodPost, "/auth/login", nil)
+	req.Header.Set("User-Agent", agent)
+	req.Header.Set("X-Forwarded-For", "10.0.0.1, 10.0.0.2")
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("_session_store", ca.store)
+	assert.NoError(t, ca.signSession(c, wallet, ""))
+	return rec.Result().Cookies()[0]
+}
+
+func do(e *echo.Echo, method string, path string, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.AddCookie(cookie)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestNewCertAuthoritySessionStore(t *testing.T) {
+
+	logger, _ := zap.NewProduction()
+
+	ca, _, _ := newSessionCA(t)
+	assert.IsType(t, &DBStore{}, ca.store)
+
+	cookie, err := NewCertAuthority(logger, HOST, PORT, WithSessionConfig(&config.SessionConfig{Store: "cookie"}), WithOffchainStore(ca.db))
+	assert.NoError(t, err)
+	assert.Nil(t, cookie.sessions)
+
+	_, err = NewCertAuthority(logger, HOST, PORT, WithSessionConfig(&config.SessionConfig{Store: "database"}))
+	assert.ErrorIs(t, err, errSessionStoreNoDB)
+
+	_, err = NewCertAuthority(logger, HOST, PORT, WithSessionConfig(&config.SessionConfig{Store: "redis"}))
+	assert.ErrorIs(t, err, errSessionStoreKind)
+}
+
+func TestDBStore(t *testing.T) {
+
+	ca, db, e := newSessionCA(t)
+
+	cookie := login(t, ca, e, "0x123456789", "Firefox")
+
+	row := Session{}
+	assert.NoError(t, db.First(&row).Error)
+	assert.Equal(t, "0x123456789", row.Wallet)
+	assert.Equal(t, "Firefox", row.UserAgent)
+	assert.Equal(t, "10.0.0.1", row.IP)
+
+	// the cookie carries an opaque token rather than the values
+	assert.NotContains(t, cookie.Value, row.Token)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/user", nil)
+	req.AddCookie(cookie)
+	c := e.NewContext(req, httptest.NewRecorder())
+	c.Set("_session_store", ca.store)
+	s, err := session.Get("session", c)
+	assert.NoError(t, err)
+	assert.False(t, s.IsNew)
+	assert.Equal(t, "0x123456789", s.Values["wallet"])
+
+	// a deleted row is not resurrected by a late save
+	db.Where("1 = 1").Delete(&Session{})
+	rec := httptest.NewRecorder()
+	assert.NoError(t, s.Save(req, rec))
+	assert.Empty(t, rec.Result().Cookies())
+	assert.False(t, ca.sessions.Exists(s.ID))
+
+	req = httptest.NewRequest(http.MethodGet, "/api/user", nil)
+	req.AddCookie(cookie)
+	c = e.NewContext(req, httptest.NewRecorder())
+	c.Set("_session_store", ca.store)
+	s, _ = session.Get("session", c)
+	assert.True(t, s.IsNew)
+	assert.Nil(t, s.Values["wallet"])
+}
+
+func TestListAndRevokeSessions(t *testing.T) {
+
+	ca, db, e := newSessionCA(t)
+
+	phone := login(t, ca, e, "0x123456789", "Phone")
+	laptop := login(t, ca, e, "0x123456789", "Laptop")
+	login(t, ca, e, "0x987654321", "Other")
+
+	t.Run("List sessions of the caller only", func(t *testing.T) {
+		rec := do(e, http.MethodGet, "/auth/sessions", "", laptop)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		list := []map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+		assert.Len(t, list, 2)
+
+		for _, s := range list {
+			assert.Equal(t, s["device"] == "Laptop", s["current"])
+			assert.NotContains(t, s, "token")
+		}
+	})
+
+	t.Run("Revoke with empty body", func(t *testing.T) {
+		rec := do(e, http.MethodPost, "/auth/sessions/revoke", "{}", laptop)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Revoke session of another wallet", func(t *testing.T) {
+		other := Session{}
+		db.Where("wallet = ?", "0x987654321").First(&other)
+		rec := do(e, http.MethodPost, "/auth/sessions/revoke", `{"id":`+jsonID(other.ID)+`}`, laptop)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("Revoke another device", func(t *testing.T) {
+		target := Session{}
+		db.Where("user_agent = ?", "Phone").First(&target)
+		rec := do(e, http.MethodPost, "/auth/sessions/revoke", `{"id":`+jsonID(target.ID)+`}`, laptop)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Empty(t, rec.Result().Cookies())
+
+		var count int64
+		db.Model(&Session{}).Where("wallet = ?", "0x123456789").Count(&count)
+		assert.Equal(t, int64(1), count)
+
+		// the revoked device has to authenticate again
+		rec = do(e, http.MethodGet, "/auth/sessions", "", phone)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("Revoke all sessions", func(t *testing.T) {
+		rec := do(e, http.MethodPost, "/auth/sessions/revoke", `{"all":true}`, laptop)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, -1, rec.Result().Cookies()[0].MaxAge)
+
+		var count int64
+		db.Model(&Session{}).Count(&count)
+		assert.Equal(t, int64(1), count)
+	})
+}
+
+func TestRevokeWalletSessions(t *testing.T) {
+
+	ca, db, e := newSessionCA(t, "0xadmin")
+
+	admin := login(t, ca, e, "0xadmin", "Admin")
+	user := login(t, ca, e, "0x123456789", "User")
+	login(t, ca, e, "0x123456789", "User")
+
+	rec := do(e, http.MethodPost, "/auth/sessions/revoke/wallet", `{"wallet":"0xadmin"}`, user)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = do(e, http.MethodPost, "/auth/sessions/revoke/wallet", `{}`, admin)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = do(e, http.MethodPost, "/auth/sessions/revoke/wallet", `{"wallet":"0x123456789"}`, admin)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var count int64
+	db.Model(&Session{}).Where("wallet = ?", "0x123456789").Count(&count)
+	assert.Equal(t, int64(0), count)
+	assert.True(t, ca.IsAdmin("0xadmin"))
+	assert.False(t, ca.IsAdmin("0x123456789"))
+}
+
+func TestDBStoreCleanup(t *testing.T) {
+
+	ca, db, e := newSessionCA(t)
+	login(t, ca, e, "0x123456789", "Firefox")
+	login(t, ca, e, "0x123456789", "Chrome")
+
+	db.Model(&Session{}).Where("user_agent = ?", "Chrome").Update("expires_at", ca.sessions.now().Add(-1))
+
+	list, err := ca.sessions.Sessions("0x123456789")
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ca.sessions.Cleanup(ctx, time.Hour)
+
+	var count int64
+	db.Model(&Session{}).Count(&count)
+	assert.Equal(t, int64(1), count)
+}
+
+func jsonID(id uint) string {
+	b, _ := json.Marshal(id)
+	return string(b)
+}
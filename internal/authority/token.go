@@ -0,0 +1,214 @@
+package authority
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/proto"
+	"github.com/Cealgull/Middleware/internal/rest"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	tokenPrefix      = "cgt_"
+	defaultTokenTTL  = 30 * 24 * time.Hour
+	maxTokenTTL      = 365 * 24 * time.Hour
+	maxTokenName     = 64
+	tokenTouchPeriod = time.Minute
+)
+
+// TokenContextKey holds the *models.APIToken of requests authenticated with
+// a bearer token.
+const TokenContextKey = "apiToken"
+
+var knownScopes = map[string]bool{ScopeRead: true, ScopePost: true, ScopeModerate: true}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// requiredScope is the scope a bearer token needs for a request. Admin
+// routes need moderate, reads only need read and anything that acts for the
+// wallet needs post. The rest of /auth is left to cookie sessions so that a
+// token can never mint tokens or sign in.
+func requiredScope(policy rest.AuthPolicy, method string, path string) string {
+	switch {
+	case policy == rest.AuthAdmin:
+		return ScopeModerate
+	case strings.HasPrefix(path, "/auth/"):
+		return ""
+	case method == http.MethodGet || method == http.MethodHead || strings.Contains(path, "/query/"):
+		return ScopeRead
+	default:
+		return ScopePost
+	}
+}
+
+func bearerToken(c echo.Context) (string, bool) {
+	header := c.Request().Header.Get(echo.HeaderAuthorization)
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:]), true
+	}
+	return "", false
+}
+
+// authenticateToken resolves a bearer token and checks it may be used for
+// the request.
+func (ca *CertAuthority) authenticateToken(c echo.Context, secret string, policy rest.AuthPolicy) (*APIToken, proto.MiddlewareError) {
+
+	if ca.db == nil || !strings.HasPrefix(secret, tokenPrefix) {
+		return nil, tokenInvalidError
+	}
+
+	token := APIToken{}
+	now := time.Now()
+
+	tx := ca.db.Where("hash = ? AND expires_at > ?", hashToken(secret), now).Limit(1).Find(&token)
+
+	if tx.Error != nil || tx.RowsAffected == 0 {
+		return nil, tokenInvalidError
+	}
+
+	scope := requiredScope(policy, c.Request().Method, c.Path())
+
+	if scope == "" || !token.HasScope(scope) {
+		return nil, tokenScopeError
+	}
+
+	if scope == ScopeModerate && !ca.IsAdmin(token.Wallet) {
+		return nil, tokenScopeError
+	}
+
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > tokenTouchPeriod {
+		ca.db.Model(&token).Update("last_used_at", now)
+	}
+
+	return &token, nil
+}
+
+func (ca *CertAuthority) listTokens(c echo.Context) error {
+
+	wallet := rest.WalletOf(c)
+
+	tokens := []*APIToken{}
+
+	if err := ca.db.Where("wallet = ? AND expires_at > ?", wallet, time.Now()).
+		Order("created_at DESC").Find(&tokens).Error; err != nil {
+		ca.logger.Error("Failed to list tokens", zap.String("wallet", wallet), zap.Error(err))
+		return c.JSON(certInternalError.Status(), certInternalError.Message())
+	}
+
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// mintToken creates a token for the caller. The secret is only ever
+// returned in this response.
+func (ca *CertAuthority) mintToken(c echo.Context) error {
+
+	type MintRequest struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		ExpiresIn int64    `json:"expiresIn"`
+	}
+
+	request := MintRequest{}
+
+	if err := c.Bind(&request); err != nil {
+		return c.JSON(tokenRequestError.Status(), tokenRequestError.Message())
+	}
+
+	ttl := time.Duration(request.ExpiresIn) * time.Second
+
+	if ttl == 0 {
+		ttl = defaultTokenTTL
+	}
+
+	if request.Name == "" || len(request.Name) > maxTokenName || len(request.Scopes) == 0 || ttl < 0 || ttl > maxTokenTTL {
+		return c.JSON(tokenRequestError.Status(), tokenRequestError.Message())
+	}
+
+	wallet := rest.WalletOf(c)
+
+	scopes := map[string]bool{}
+
+	for _, scope := range request.Scopes {
+		if !knownScopes[scope] {
+			return c.JSON(tokenRequestError.Status(), tokenRequestError.Message())
+		}
+		if scope == ScopeModerate && !ca.IsAdmin(wallet) {
+			return c.JSON(tokenScopeError.Status(), tokenScopeError.Message())
+		}
+		scopes[scope] = true
+	}
+
+	sorted := make([]string, 0, len(scopes))
+
+	for scope := range scopes {
+		sorted = append(sorted, scope)
+	}
+
+	sort.Strings(sorted)
+
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return c.JSON(certInternalError.Status(), certInternalError.Message())
+	}
+
+	secret := tokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	token := APIToken{
+		Wallet:    wallet,
+		Name:      request.Name,
+		Prefix:    secret[:len(tokenPrefix)+6],
+		Hash:      hashToken(secret),
+		Scopes:    strings.Join(sorted, ","),
+		ExpiresAt: time.Now().Add(ttl),
+	}
+
+	if err := ca.db.Create(&token).Error; err != nil {
+		ca.logger.Error("Failed to mint token", zap.String("wallet", wallet), zap.Error(err))
+		return c.JSON(certInternalError.Status(), certInternalError.Message())
+	}
+
+	token.Secret = secret
+
+	return c.JSON(http.StatusOK, &token)
+}
+
+func (ca *CertAuthority) revokeToken(c echo.Context) error {
+
+	type RevokeRequest struct {
+		ID uint `json:"id"`
+	}
+
+	request := RevokeRequest{}
+
+	if err := c.Bind(&request); err != nil || request.ID == 0 {
+		return c.JSON(tokenRequestError.Status(), tokenRequestError.Message())
+	}
+
+	wallet := rest.WalletOf(c)
+
+	tx := ca.db.Where("id = ? AND wallet = ?", request.ID, wallet).Delete(&APIToken{})
+
+	if tx.Error != nil {
+		ca.logger.Error("Failed to revoke token", zap.String("wallet", wallet), zap.Error(tx.Error))
+		return c.JSON(certInternalError.Status(), certInternalError.Message())
+	}
+
+	if tx.RowsAffected == 0 {
+		return c.JSON(tokenNotFoundError.Status(), tokenNotFoundError.Message())
+	}
+
+	return c.JSON(success.Status(), success.Message())
+}
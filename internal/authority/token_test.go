@@ -0,0 +1,177 @@
+package authority
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/rest"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func walletHandler(c echo.Context) error {
+	return c.String(http.StatusOK, rest.WalletOf(c))
+}
+
+func bearer(e *echo.Echo, method string, path string, body string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func mint(t *testing.T, e *echo.Echo, cookie *http.Cookie, body string) (int, map[string]interface{}) {
+	rec := do(e, http.MethodPost, "/auth/tokens", body, cookie)
+	minted := map[string]interface{}{}
+	json.Unmarshal(rec.Body.Bytes(), &minted)
+	return rec.Code, minted
+}
+
+func TestRequiredScope(t *testing.T) {
+	assert.Equal(t, ScopeRead, requiredScope(rest.AuthRequired, http.MethodGet, "/api/content/:cid"))
+	assert.Equal(t, ScopeRead, requiredScope(rest.AuthRequired, http.MethodPost, "/api/topic/query/list"))
+	assert.Equal(t, ScopePost, requiredScope(rest.AuthRequired, http.MethodPost, "/api/topic/invoke/create"))
+	assert.Equal(t, ScopePost, requiredScope(rest.AuthRequired, http.MethodPost, "/api/upload"))
+	assert.Equal(t, ScopeModerate, requiredScope(rest.AuthAdmin, http.MethodPost, "/auth/sessions/revoke/wallet"))
+	assert.Empty(t, requiredScope(rest.AuthRequired, http.MethodPost, "/auth/tokens"))
+	assert.Empty(t, requiredScope(rest.AuthRequired, http.MethodPost, "/auth/login"))
+}
+
+func TestMintAndUseToken(t *testing.T) {
+
+	ca, db, e := newSessionCA(t)
+
+	e.GET("/api/content/:cid", walletHandler)
+	e.POST("/api/topic/query/list", walletHandler)
+	e.POST("/api/topic/invoke/create", walletHandler)
+
+	cookie := login(t, ca, e, "0x123456789", "Firefox")
+
+	t.Run("Mint with invalid requests", func(t *testing.T) {
+		for _, body := range []string{
+			`{"scopes":["read"]}`,
+			`{"name":"bot"}`,
+			`{"name":"bot","scopes":["write"]}`,
+			`{"name":"bot","scopes":["read"],"expiresIn":-1}`,
+			`{"name":"bot","scopes":["read"],"expiresIn":100000000}`,
+			`{"name":"` + strings.Repeat("a", maxTokenName+1) + `","scopes":["read"]}`,
+		} {
+			code, _ := mint(t, e, cookie, body)
+			assert.Equal(t, http.StatusBadRequest, code, body)
+		}
+	})
+
+	t.Run("Moderate scope is for admins only", func(t *testing.T) {
+		code, _ := mint(t, e, cookie, `{"name":"bot","scopes":["moderate"]}`)
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+
+	code, reader := mint(t, e, cookie, `{"name":"reader","scopes":["read","read"],"expiresIn":3600}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []interface{}{"read"}, reader["scopes"])
+
+	readToken := reader["token"].(string)
+	assert.True(t, strings.HasPrefix(readToken, tokenPrefix))
+	assert.True(t, strings.HasPrefix(readToken, reader["prefix"].(string)))
+
+	stored := APIToken{}
+	db.First(&stored)
+	assert.Equal(t, hashToken(readToken), stored.Hash)
+	assert.NotContains(t, stored.Hash, readToken)
+
+	_, poster := mint(t, e, cookie, `{"name":"poster","scopes":["post","read"]}`)
+	postToken := poster["token"].(string)
+	expires, _ := time.Parse(time.RFC3339Nano, poster["expiresAt"].(string))
+	assert.WithinDuration(t, time.Now().Add(defaultTokenTTL), expires, time.Minute)
+
+	t.Run("Read only token", func(t *testing.T) {
+		rec := bearer(e, http.MethodGet, "/api/content/bafy", "", readToken)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "0x123456789", rec.Body.String())
+
+		rec = bearer(e, http.MethodPost, "/api/topic/query/list", "{}", readToken)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		rec = bearer(e, http.MethodPost, "/api/topic/invoke/create", "{}", readToken)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("Post on behalf of the wallet", func(t *testing.T) {
+		rec := bearer(e, http.MethodPost, "/api/topic/invoke/create", "{}", postToken)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "0x123456789", rec.Body.String())
+
+		// no session is created for bots
+		assert.Empty(t, rec.Result().Cookies())
+	})
+
+	t.Run("Tokens cannot manage tokens", func(t *testing.T) {
+		rec := bearer(e, http.MethodPost, "/auth/tokens", `{"name":"bot","scopes":["post"]}`, postToken)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("Unknown and expired tokens", func(t *testing.T) {
+		rec := bearer(e, http.MethodGet, "/api/content/bafy", "", tokenPrefix+"unknown")
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+		rec = bearer(e, http.MethodGet, "/api/content/bafy", "", "unknown")
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+		db.Model(&APIToken{}).Where("name = ?", "reader").Update("expires_at", time.Now().Add(-time.Second))
+		rec = bearer(e, http.MethodGet, "/api/content/bafy", "", readToken)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("List and revoke", func(t *testing.T) {
+		rec := do(e, http.MethodGet, "/auth/tokens", "", cookie)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		list := []map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+		assert.Len(t, list, 1)
+		assert.NotContains(t, list[0], "token")
+
+		other := login(t, ca, e, "0x987654321", "Chrome")
+		rec = do(e, http.MethodPost, "/auth/tokens/revoke", `{"id":`+jsonID(uint(poster["id"].(float64)))+`}`, other)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+
+		rec = do(e, http.MethodPost, "/auth/tokens/revoke", `{}`, cookie)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+		rec = do(e, http.MethodPost, "/auth/tokens/revoke", `{"id":`+jsonID(uint(poster["id"].(float64)))+`}`, cookie)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		rec = bearer(e, http.MethodPost, "/api/topic/invoke/create", "{}", postToken)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+}
+
+func TestModerationToken(t *testing.T) {
+
+	ca, db, e := newSessionCA(t, "0xadmin")
+
+	admin := login(t, ca, e, "0xadmin", "Admin")
+	login(t, ca, e, "0x123456789", "User")
+
+	code, minted := mint(t, e, admin, `{"name":"moderator","scopes":["moderate"]}`)
+	assert.Equal(t, http.StatusOK, code)
+
+	rec := bearer(e, http.MethodPost, "/auth/sessions/revoke/wallet", `{"wallet":"0x123456789"}`, minted["token"].(string))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var count int64
+	db.Model(&Session{}).Where("wallet = ?", "0x123456789").Count(&count)
+	assert.Zero(t, count)
+
+	// a token outlives the admin rights it was minted with
+	delete(ca.admins, "0xadmin")
+	rec = bearer(e, http.MethodPost, "/auth/sessions/revoke/wallet", `{"wallet":"0x123456789"}`, minted["token"].(string))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
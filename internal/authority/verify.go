@@ -0,0 +1,213 @@
+package authority
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Cealgull/Middleware/internal/config"
+	"github.com/Cealgull/Middleware/internal/proto"
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	defaultVerifyTimeout   = 5 * time.Second
+	defaultVerifyRetries   = 2
+	defaultCertCacheTTL    = 10 * time.Minute
+	defaultCertCacheSize   = 4096
+	verifyRetryWaitTime    = 100 * time.Millisecond
+	verifyRetryMaxWaitTime = time.Second
+)
+
+var errEmptyCABundle = errors.New("ca bundle contains no certificates")
+
+type fingerprint [sha256.Size]byte
+
+type certCacheEntry struct {
+	fp      fingerprint
+	expires time.Time
+}
+
+// certCache remembers the fingerprints of verified certificates for ttl.
+// Entries all live equally long, so the oldest one is always the first to
+// expire and the one evicted once size is reached.
+type certCache struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	size  int
+	items map[fingerprint]*list.Element
+	order *list.List
+	now   func() time.Time
+}
+
+func newCertCache(ttl time.Duration, size int) *certCache {
+	return &certCache{
+		ttl:   ttl,
+		size:  size,
+		items: map[fingerprint]*list.Element{},
+		order: list.New(),
+		now:   time.Now,
+	}
+}
+
+func (cc *certCache) contains(fp fingerprint) bool {
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	el, ok := cc.items[fp]
+
+	if !ok {
+		return false
+	}
+
+	if cc.now().Before(el.Value.(*certCacheEntry).expires) {
+		return true
+	}
+
+	cc.order.Remove(el)
+	delete(cc.items, fp)
+
+	return false
+}
+
+func (cc *certCache) add(fp fingerprint) {
+
+	if cc.size <= 0 || cc.ttl <= 0 {
+		return
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if el, ok := cc.items[fp]; ok {
+		cc.order.Remove(el)
+	}
+
+	for cc.order.Len() >= cc.size {
+		oldest := cc.order.Remove(cc.order.Front()).(*certCacheEntry)
+		delete(cc.items, oldest.fp)
+	}
+
+	cc.items[fp] = cc.order.PushBack(&certCacheEntry{fp: fp, expires: cc.now().Add(cc.ttl)})
+}
+
+func (cc *certCache) remove(fp fingerprint) {
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if el, ok := cc.items[fp]; ok {
+		cc.order.Remove(el)
+		delete(cc.items, fp)
+	}
+}
+
+// WithVerifyConfig bounds the calls to the Verify service, caches what it
+// has verified, checks revocation when enabled and, with a CA bundle,
+// verifies certificates locally instead.
+// Zero values select the defaults and negative ones turn retries or the
+// cache off.
+func WithVerifyConfig(cfg *config.VerifyConfig) CertAuthorityOption {
+	return func(ca *CertAuthority) error {
+
+		timeout, retries := cfg.Timeout, cfg.Retries
+
+		if timeout <= 0 {
+			timeout = defaultVerifyTimeout
+		}
+
+		if retries == 0 {
+			retries = defaultVerifyRetries
+		} else if retries < 0 {
+			retries = 0
+		}
+
+		ca.client.
+			SetTimeout(timeout).
+			SetRetryCount(retries).
+			SetRetryWaitTime(verifyRetryWaitTime).
+			SetRetryMaxWaitTime(verifyRetryMaxWaitTime).
+			AddRetryCondition(func(r *resty.Response, err error) bool {
+				return err != nil || r.StatusCode() >= http.StatusInternalServerError
+			})
+
+		ttl, size := cfg.CacheTTL, cfg.CacheSize
+
+		if ttl == 0 {
+			ttl = defaultCertCacheTTL
+		}
+
+		if size == 0 {
+			size = defaultCertCacheSize
+		}
+
+		ca.verified = newCertCache(ttl, size)
+
+		if err := withRevocationConfig(&cfg.Revocation)(ca); err != nil {
+			return err
+		}
+
+		if cfg.CABundle == "" {
+			return nil
+		}
+
+		bundle, err := os.ReadFile(cfg.CABundle)
+
+		if err != nil {
+			return err
+		}
+
+		roots := x509.NewCertPool()
+
+		if !roots.AppendCertsFromPEM(bundle) {
+			return errEmptyCABundle
+		}
+
+		ca.roots = roots
+		return nil
+	}
+}
+
+// trustCert reports whether cert was issued by Verify, checking the pinned
+// bundle when there is one and asking the Verify service otherwise.
+func (ca *CertAuthority) trustCert(cert *x509.Certificate, reqcert CACert) proto.MiddlewareError {
+
+	fp := fingerprint(sha256.Sum256(cert.Raw))
+
+	if ca.verified.contains(fp) {
+		return nil
+	}
+
+	if ca.roots != nil {
+
+		_, err := cert.Verify(x509.VerifyOptions{
+			Roots:     ca.roots,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+
+		if err != nil {
+			return certUnauthorizedError
+		}
+
+	} else {
+
+		resp, err := ca.client.R().SetBody(reqcert).Post(ca.endpoint)
+
+		if err != nil {
+			return certInternalError
+		}
+
+		if resp.StatusCode() != http.StatusOK {
+			return certUnauthorizedError
+		}
+	}
+
+	ca.verified.add(fp)
+	return nil
+}
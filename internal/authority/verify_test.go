@@ -0,0 +1,128 @@
+package authority
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cealgull/Middleware/internal/config"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestCertCache(t *testing.T) {
+
+	now := time.Unix(1700000000, 0)
+	cc := newCertCache(time.Minute, 2)
+	cc.now = func() time.Time { return now }
+
+	a, b, c := fingerprint{1}, fingerprint{2}, fingerprint{3}
+
+	cc.add(a)
+	cc.add(b)
+	assert.True(t, cc.contains(a))
+	assert.True(t, cc.contains(b))
+
+	// the oldest entry makes room
+	cc.add(c)
+	assert.False(t, cc.contains(a))
+	assert.True(t, cc.contains(c))
+
+	cc.remove(c)
+	assert.False(t, cc.contains(c))
+
+	now = now.Add(time.Minute)
+	assert.False(t, cc.contains(b))
+	assert.Zero(t, cc.order.Len())
+
+	disabled := newCertCache(-1, 2)
+	disabled.add(a)
+	assert.False(t, disabled.contains(a))
+}
+
+// generateIssuedCert returns a CA bundle and a key and certificate issued by
+// that CA.
+func generateIssuedCert(t *testing.T) ([]byte, ed25519.PrivateKey, string) {
+
+	caPub, caPriv, _ := ed25519.GenerateKey(nil)
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Cealgull Verify"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caPub, caPriv)
+	assert.NoError(t, err)
+
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	pub, priv, _ := ed25519.GenerateKey(nil)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "0x123456789"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, pub, caPriv)
+	assert.NoError(t, err)
+
+	bundle := pem.EncodeToMemory(&pem.Block{Type: CERT, Bytes: caDER})
+	cert := pem.EncodeToMemory(&pem.Block{Type: CERT, Bytes: der})
+
+	return bundle, priv, string(cert)
+}
+
+func TestWithVerifyConfigBundle(t *testing.T) {
+
+	logger, _ := zap.NewProduction()
+
+	bundle, priv, pemcert := generateIssuedCert(t)
+
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(file, bundle, 0o600))
+
+	local, err := NewCertAuthority(logger, HOST, PORT, WithVerifyConfig(&config.VerifyConfig{
+		Timeout:  time.Millisecond,
+		Retries:  -1,
+		CABundle: file,
+	}))
+	assert.NoError(t, err)
+
+	message := []byte("message")
+
+	cert, err := local.validateCert(sign(priv, message), CACert{Cert: pemcert}, message)
+	assert.Nil(t, err)
+	assert.Equal(t, "0x123456789", cert.Subject.CommonName)
+
+	b, _ := pem.Decode([]byte(pemcert))
+	assert.True(t, local.verified.contains(sha256.Sum256(b.Bytes)))
+
+	// self-signed certificates are not in the bundle
+	other, othercert := generateCert(t)
+	_, err = local.validateCert(sign(other, message), CACert{Cert: othercert}, message)
+	assert.IsType(t, &CertUnauthorizedError{}, err)
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	assert.NoError(t, os.WriteFile(empty, []byte("no certificates here"), 0o600))
+
+	_, err = NewCertAuthority(logger, HOST, PORT, WithVerifyConfig(&config.VerifyConfig{CABundle: empty}))
+	assert.ErrorIs(t, err, errEmptyCABundle)
+
+	_, err = NewCertAuthority(logger, HOST, PORT, WithVerifyConfig(&config.VerifyConfig{CABundle: filepath.Join(t.TempDir(), "missing.pem")}))
+	assert.Error(t, err)
+}
@@ -1,5 +1,7 @@
 package config
 
+import "time"
+
 type GatewayConfig struct {
 	MspID        string `yaml:"mspID"`
 	Channel      string `yaml:"channel"`
@@ -18,14 +20,134 @@ type PostgresGormConfig struct {
 	Prometheus PrometheusConfig `yaml:"prometheus"`
 }
 
+type MediaConfig struct {
+	MaxSize       int64    `yaml:"maxSize"`
+	ThumbnailSize int      `yaml:"thumbnailSize"`
+	Types         []string `yaml:"types"`
+}
+
+type PinningConfig struct {
+	Interval    time.Duration `yaml:"interval"`
+	GracePeriod time.Duration `yaml:"gracePeriod"`
+}
+
+type CacheConfig struct {
+	MemorySize   int64         `yaml:"memorySize"`
+	MaxEntrySize int64         `yaml:"maxEntrySize"`
+	DiskPath     string        `yaml:"diskPath"`
+	DiskSize     int64         `yaml:"diskSize"`
+	Timeout      time.Duration `yaml:"timeout"`
+	FetchTimeout time.Duration `yaml:"fetchTimeout"`
+}
+
+type FilesystemStorageConfig struct {
+	Root string `yaml:"root"`
+}
+
+type S3StorageConfig struct {
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	AccessKey string `yaml:"accessKey"`
+	SecretKey string `yaml:"secretKey"`
+}
+
 type IPFSConfig struct {
-	Host string `yaml:"host"`
-	Port int    `yaml:"port"`
+	Backend        string                  `yaml:"backend"`
+	Host           string                  `yaml:"host"`
+	Port           int                     `yaml:"port"`
+	Filesystem     FilesystemStorageConfig `yaml:"filesystem"`
+	S3             S3StorageConfig         `yaml:"s3"`
+	MaxUploadSize  int64                   `yaml:"maxUploadSize"`
+	MaxContentSize int64                   `yaml:"maxContentSize"`
+	EncryptionKey  string                  `yaml:"encryptionKey"`
+	Media          MediaConfig             `yaml:"media"`
+	Pinning        PinningConfig           `yaml:"pinning"`
+	Cache          CacheConfig             `yaml:"cache"`
+}
+
+type MessagingConfig struct {
+	Anchor bool `yaml:"anchor"`
+}
+
+type RateLimitBudget struct {
+	Wallet int `yaml:"wallet"`
+	IP     int `yaml:"ip"`
+}
+
+type RedisConfig struct {
+	Addr     string        `yaml:"addr"`
+	Password string        `yaml:"password"`
+	DB       int           `yaml:"db"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+type RateLimitConfig struct {
+	Enabled bool            `yaml:"enabled"`
+	Store   string          `yaml:"store"`
+	Window  time.Duration   `yaml:"window"`
+	Query   RateLimitBudget `yaml:"query"`
+	Invoke  RateLimitBudget `yaml:"invoke"`
+	Upload  RateLimitBudget `yaml:"upload"`
+	Redis   RedisConfig     `yaml:"redis"`
+}
+
+type TransactionsConfig struct {
+	Retention          time.Duration `yaml:"retention"`
+	StatusTimeout      time.Duration `yaml:"statusTimeout"`
+	ConsistencyTimeout time.Duration `yaml:"consistencyTimeout"`
+}
+
+type IdempotencyConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	Store          string        `yaml:"store"`
+	Window         time.Duration `yaml:"window"`
+	PendingTimeout time.Duration `yaml:"pendingTimeout"`
+	MaxBodySize    int64         `yaml:"maxBodySize"`
+	Redis          RedisConfig   `yaml:"redis"`
+}
+
+type ScreeningConfig struct {
+	BannedWords     []string      `yaml:"bannedWords"`
+	MaxLinks        int           `yaml:"maxLinks"`
+	NewAccountAge   time.Duration `yaml:"newAccountAge"`
+	DuplicateWindow time.Duration `yaml:"duplicateWindow"`
+	HoldScore       float64       `yaml:"holdScore"`
+	RejectScore     float64       `yaml:"rejectScore"`
+}
+
+type PublicConfig struct {
+	MaxAge time.Duration `yaml:"maxAge"`
+}
+
+type SessionConfig struct {
+	Store    string   `yaml:"store"`
+	Keys     []string `yaml:"keys"`
+	KeyFile  string   `yaml:"keyFile"`
+	MaxAge   int      `yaml:"maxAge"`
+	Secure   bool     `yaml:"secure"`
+	SameSite string   `yaml:"sameSite"`
+	Domain   string   `yaml:"domain"`
+
+	AllowedOrigins []string `yaml:"allowedOrigins"`
+	MaxChallenges  int      `yaml:"maxChallenges"`
 }
 
 type VerifyConfig struct {
-	Host string `yaml:"host"`
-	Port int    `yaml:"port"`
+	Host       string           `yaml:"host"`
+	Port       int              `yaml:"port"`
+	Timeout    time.Duration    `yaml:"timeout"`
+	Retries    int              `yaml:"retries"`
+	CacheTTL   time.Duration    `yaml:"cacheTTL"`
+	CacheSize  int              `yaml:"cacheSize"`
+	CABundle   string           `yaml:"caBundle"`
+	Revocation RevocationConfig `yaml:"revocation"`
+}
+
+type RevocationConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	CRLFile  string        `yaml:"crlFile"`
 }
 
 type PrometheusConfig struct {
@@ -34,10 +156,22 @@ type PrometheusConfig struct {
 }
 
 type MiddlewareConfig struct {
-	Host     string            `yaml:"host"`
-	Port     int               `yaml:"port"`
-	IPFS     IPFSConfig        `yaml:"ipfs"`
-	Postgres PostgresGormConfig `yaml:"postgres"`
-	Gateway  GatewayConfig     `yaml:"gateway"`
-	Verify   VerifyConfig      `yaml:"verify"`
+	Host         string             `yaml:"host"`
+	Port         int                `yaml:"port"`
+	IPFS         IPFSConfig         `yaml:"ipfs"`
+	Postgres     PostgresGormConfig `yaml:"postgres"`
+	Gateway      GatewayConfig      `yaml:"gateway"`
+	Verify       VerifyConfig       `yaml:"verify"`
+	Session      SessionConfig      `yaml:"session"`
+	Messaging    MessagingConfig    `yaml:"messaging"`
+	Public       PublicConfig       `yaml:"public"`
+	RateLimit    RateLimitConfig    `yaml:"rateLimit"`
+	Screening    ScreeningConfig    `yaml:"screening"`
+	Idempotency  IdempotencyConfig  `yaml:"idempotency"`
+	Transactions TransactionsConfig `yaml:"transactions"`
+	Admins       []string           `yaml:"admins"`
+
+	// TrustedProxies are the CIDR ranges whose X-Forwarded-For entries are
+	// believed when telling the IP of a client.
+	TrustedProxies []string `yaml:"trustedProxies"`
 }
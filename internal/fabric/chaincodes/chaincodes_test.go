@@ -5,9 +5,9 @@ import (
 
 	"github.com/Cealgull/Middleware/internal/config"
 	"github.com/Cealgull/Middleware/internal/fabric/offchain"
+	"github.com/Cealgull/Middleware/internal/rest"
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gorilla/sessions"
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
 	"gorm.io/driver/mysql"
@@ -22,8 +22,7 @@ var sqliteDB *gorm.DB
 func newMockSignedContext(c echo.Context) echo.Context {
 
 	c.Set("_session_store", sessions.NewCookieStore([]byte("secret")))
-	s, _ := session.Get("session", c)
-	s.Values["wallet"] = "0x123456789"
+	rest.SetIdentity(c, &rest.Identity{Wallet: "0x123456789"})
 
 	return c
 }
@@ -0,0 +1,240 @@
+package chaincodes
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Cealgull/Middleware/internal/fabric/common"
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/rest"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	HeaderConsistencyToken = "X-Consistency-Token"
+
+	defaultConsistencyTimeout = 3 * time.Second
+	consistencyPollInterval   = 100 * time.Millisecond
+	appliedTxRetention        = 24 * time.Hour
+)
+
+// Consistency gives wallets read-your-writes. Invokes answer with the ID of
+// their transaction as a consistency token, the event pipeline records the
+// transactions it applied off-chain, and queries sent with the token wait
+// until its transaction is applied.
+type Consistency struct {
+	db       *gorm.DB
+	timeout  time.Duration
+	interval time.Duration
+	logger   *zap.Logger
+
+	mu      sync.Mutex
+	waiters map[string][]chan struct{}
+	applies int
+
+	// commitStatus waits for the commit of a submitted transaction.
+	commitStatus func(commit *client.Commit) (*client.Status, error)
+}
+
+type ConsistencyOption func(s *Consistency)
+
+// WithConsistencyTimeout bounds how long a query waits for its token.
+func WithConsistencyTimeout(timeout time.Duration) ConsistencyOption {
+	return func(s *Consistency) {
+		if timeout > 0 {
+			s.timeout = timeout
+		}
+	}
+}
+
+func NewConsistency(logger *zap.Logger, db *gorm.DB, options ...ConsistencyOption) *Consistency {
+
+	s := Consistency{
+		db:       db,
+		timeout:  defaultConsistencyTimeout,
+		interval: consistencyPollInterval,
+		logger:   logger,
+		waiters:  map[string][]chan struct{}{},
+		commitStatus: func(commit *client.Commit) (*client.Status, error) {
+			return commit.Status()
+		},
+	}
+
+	for _, option := range options {
+		option(&s)
+	}
+
+	return &s
+}
+
+// applied records that the event of transaction id was processed and wakes
+// the queries waiting for it.
+func (s *Consistency) applied(id string, chaincode string, eventName string, block uint64) {
+
+	if s == nil || id == "" {
+		return
+	}
+
+	tx := AppliedTransaction{
+		TransactionID: id,
+		Chaincode:     chaincode,
+		EventName:     eventName,
+		BlockNumber:   block,
+	}
+
+	if err := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&tx).Error; err != nil {
+		s.logger.Error("Failed to record applied transaction", zap.String("id", id), zap.Error(err))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ch := range s.waiters[id] {
+		close(ch)
+	}
+
+	delete(s.waiters, id)
+
+	if s.applies++; s.applies%txSweepEvery == 0 {
+		if err := s.db.Where("created_at < ?", time.Now().Add(-appliedTxRetention)).Delete(&AppliedTransaction{}).Error; err != nil {
+			s.logger.Warn("Failed to prune applied transactions", zap.Error(err))
+		}
+	}
+}
+
+func (s *Consistency) subscribe(id string) chan struct{} {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch := make(chan struct{})
+	s.waiters[id] = append(s.waiters[id], ch)
+
+	return ch
+}
+
+func (s *Consistency) unsubscribe(id string, ch chan struct{}) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	waiters := s.waiters[id]
+
+	for i, w := range waiters {
+		if w == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+
+	if len(waiters) == 0 {
+		delete(s.waiters, id)
+	} else {
+		s.waiters[id] = waiters
+	}
+}
+
+// wait blocks until transaction id is applied or the timeout elapses. The
+// store is polled as well, since another instance may have applied it.
+func (s *Consistency) wait(ctx context.Context, id string) error {
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	ch := s.subscribe(id)
+	defer s.unsubscribe(id, ch)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		var count int64
+
+		if err := s.db.WithContext(ctx).Model(&AppliedTransaction{}).Where("transaction_id = ?", id).Count(&count).Error; err != nil && ctx.Err() == nil {
+			return err
+		}
+
+		if count > 0 {
+			return nil
+		}
+
+		select {
+		case <-ch:
+			return nil
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// validToken tells whether token looks like a transaction ID, that is the
+// hex encoding of a SHA-256 digest.
+func validToken(token string) bool {
+	b, err := hex.DecodeString(token)
+	return err == nil && len(b) == 32
+}
+
+// Wait holds a query sent with a consistency token until the token's
+// transaction is applied off-chain. Queries without a token or a wallet, or
+// behind a nil Consistency, are served right away, so that anonymous
+// callers can't make queries wait.
+func (s *Consistency) Wait(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		token := c.Request().Header.Get(HeaderConsistencyToken)
+
+		if s == nil || token == "" || rest.WalletOf(c) == "" {
+			return next(c)
+		}
+
+		if !validToken(token) {
+			return c.JSON(chaincodeQueryParameterError.Status(), chaincodeQueryParameterError.Message())
+		}
+
+		if err := s.wait(c.Request().Context(), token); err != nil {
+			s.logger.Debug("Consistency token not applied", zap.String("token", token), zap.Error(err))
+			return c.JSON(chaincodeConsistencyTimeoutError.Status(), chaincodeConsistencyTimeoutError.Message())
+		}
+
+		return next(c)
+	}
+}
+
+// consistentContract hands invokes a contract that waits for the commit as
+// Submit does, and sends the transaction ID back as consistency token.
+type consistentContract struct {
+	common.Contract
+	consistency *Consistency
+	c           echo.Context
+}
+
+func (s *consistentContract) Submit(transactionName string, options ...client.ProposalOption) ([]byte, error) {
+
+	result, commit, err := s.Contract.SubmitAsync(transactionName, options...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := s.consistency.commitStatus(commit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !status.Successful {
+		return nil, fmt.Errorf("transaction %s failed to commit with status code %d (%s)", status.TransactionID, int32(status.Code), status.Code.String())
+	}
+
+	s.c.Response().Header().Set(HeaderConsistencyToken, commit.TransactionID())
+
+	return result, nil
+}
@@ -0,0 +1,201 @@
+package chaincodes
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/rest"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	fabricmock "github.com/Cealgull/Middleware/internal/fabric/common/mocks"
+)
+
+func txID(c string) string {
+	return strings.Repeat(c, 64)
+}
+
+func TestConsistency(t *testing.T) {
+
+	db := newSqliteDB()
+	consistency := NewConsistency(logger, db, WithConsistencyTimeout(200*time.Millisecond))
+	consistency.interval = 10 * time.Millisecond
+
+	// every connection to an in-memory database opens a database of its own
+	conn, _ := db.DB()
+	conn.SetMaxOpenConns(1)
+
+	t.Run("Applied transactions", func(t *testing.T) {
+		consistency.applied(txID("a"), "topic", "CreateTopic", 3)
+		consistency.applied(txID("a"), "topic", "CreateTopic", 3)
+
+		var count int64
+		db.Model(&AppliedTransaction{}).Where("transaction_id = ?", txID("a")).Count(&count)
+		assert.Equal(t, int64(1), count)
+
+		assert.NoError(t, consistency.wait(context.Background(), txID("a")))
+	})
+
+	t.Run("Waiting for the event pipeline", func(t *testing.T) {
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			consistency.applied(txID("b"), "post", "CreatePost", 4)
+		}()
+
+		assert.NoError(t, consistency.wait(context.Background(), txID("b")))
+		assert.Empty(t, consistency.waiters)
+	})
+
+	t.Run("Applied by another instance", func(t *testing.T) {
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			db.Create(&AppliedTransaction{TransactionID: txID("c"), Chaincode: "post", EventName: "CreatePost"})
+		}()
+
+		assert.NoError(t, consistency.wait(context.Background(), txID("c")))
+	})
+
+	t.Run("Waiting times out", func(t *testing.T) {
+		assert.ErrorIs(t, consistency.wait(context.Background(), txID("d")), context.DeadlineExceeded)
+		assert.Empty(t, consistency.waiters)
+	})
+
+	t.Run("Nil consistency ignores events", func(t *testing.T) {
+		var none *Consistency
+		none.applied(txID("e"), "topic", "CreateTopic", 5)
+	})
+}
+
+func TestConsistencyWait(t *testing.T) {
+
+	consistency := NewConsistency(logger, newSqliteDB(), WithConsistencyTimeout(50*time.Millisecond))
+	consistency.applied(txID("a"), "topic", "CreateTopic", 3)
+
+	m := NewChaincodeMiddleware(logger, fabricmock.NewMockNetwork(t), nil,
+		WithChaincodeQueryGet("private", func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		}),
+		WithChaincodeQueryGet("optional", func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		}, rest.AuthOptional),
+		WithChaincodeQueryGet("public", func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		}, rest.AuthPublic),
+		WithConsistency(consistency),
+	)
+
+	e := echo.New()
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if wallet := c.Request().Header.Get("wallet"); wallet != "" {
+				rest.SetIdentity(c, &rest.Identity{Wallet: wallet})
+			}
+			return next(c)
+		}
+	})
+
+	m.Register(e.Group("/api/plug"), e)
+
+	query := func(route string, wallet string, token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/plug/query/"+route, nil)
+		req.Header.Set("wallet", wallet)
+		if token != "" {
+			req.Header.Set(HeaderConsistencyToken, token)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	t.Run("Authenticated queries honour tokens", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, query("private", "0x1", ""))
+		assert.Equal(t, http.StatusOK, query("private", "0x1", txID("a")))
+		assert.Equal(t, http.StatusBadRequest, query("private", "0x1", "not-a-transaction"))
+		assert.Equal(t, http.StatusGatewayTimeout, query("private", "0x1", txID("b")))
+		assert.Equal(t, http.StatusGatewayTimeout, query("optional", "0x1", txID("b")))
+	})
+
+	t.Run("Anonymous queries ignore tokens", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, query("public", "0x1", txID("b")))
+		assert.Equal(t, http.StatusOK, query("public", "", "not-a-transaction"))
+		assert.Equal(t, http.StatusOK, query("optional", "", txID("b")))
+	})
+}
+
+func TestConsistentInvoke(t *testing.T) {
+
+	db := newSqliteDB()
+
+	contract := fabricmock.NewMockContract()
+	contract.On("ChaincodeName").Return("plug")
+
+	status := &client.Status{Successful: true, Code: peer.TxValidationCode_VALID}
+
+	consistency := NewConsistency(logger, db)
+	consistency.commitStatus = func(commit *client.Commit) (*client.Status, error) {
+		if status == nil {
+			return nil, errors.New("commit status unavailable")
+		}
+		return status, nil
+	}
+
+	m := NewChaincodeMiddleware(logger, fabricmock.NewMockNetwork(t), contract,
+		WithChaincodeInvoke("create", invokeCreateTag(logger, db)),
+		WithConsistency(consistency),
+	)
+
+	e := echo.New()
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			rest.SetIdentity(c, &rest.Identity{Wallet: "0x123456789"})
+			return next(c)
+		}
+	})
+
+	m.Register(e.Group("/api/tag"), e)
+
+	invoke := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/tag/invoke/create", strings.NewReader(`{"name":"tag"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("Invoke answers with a consistency token", func(t *testing.T) {
+		contract.On("SubmitAsync", "CreateTag", mock.Anything).Return([]byte{}, &client.Commit{}, nil).Once()
+
+		rec := invoke()
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Header(), HeaderConsistencyToken)
+	})
+
+	t.Run("Invalid transaction", func(t *testing.T) {
+		status = &client.Status{Code: peer.TxValidationCode_MVCC_READ_CONFLICT}
+		contract.On("SubmitAsync", "CreateTag", mock.Anything).Return([]byte{}, &client.Commit{}, nil).Once()
+
+		rec := invoke()
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+		assert.NotContains(t, rec.Header(), HeaderConsistencyToken)
+	})
+
+	t.Run("Commit status unavailable", func(t *testing.T) {
+		status = nil
+		contract.On("SubmitAsync", "CreateTag", mock.Anything).Return([]byte{}, &client.Commit{}, nil).Once()
+
+		rec := invoke()
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+		assert.NotContains(t, rec.Header(), HeaderConsistencyToken)
+	})
+
+	contract.AssertNotCalled(t, "Submit", mock.Anything, mock.Anything)
+}
@@ -133,7 +133,101 @@ func (f *ChaincodeNotFoundError) Message() *proto.ResponseMessage {
 	}
 }
 
+type ChaincodeClosedError struct {
+	field string
+}
+
+func (f *ChaincodeClosedError) Error() string {
+	return "Chaincode: Closed " + f.field
+}
+
+func (f *ChaincodeClosedError) Status() int {
+	return http.StatusBadRequest
+}
+
+func (f *ChaincodeClosedError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "C1009",
+		Message: f.Error(),
+	}
+}
+
+type ChaincodeTooFrequentError struct {
+	field string
+}
+
+func (f *ChaincodeTooFrequentError) Error() string {
+	return "Chaincode: Too frequent changes to " + f.field
+}
+
+func (f *ChaincodeTooFrequentError) Status() int {
+	return http.StatusTooManyRequests
+}
+
+func (f *ChaincodeTooFrequentError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "C1010",
+		Message: f.Error(),
+	}
+}
+
+type ChaincodeForbiddenError struct {
+	field string
+}
+
+func (f *ChaincodeForbiddenError) Error() string {
+	return "Chaincode: Forbidden to access " + f.field
+}
+
+func (f *ChaincodeForbiddenError) Status() int {
+	return http.StatusForbidden
+}
+
+func (f *ChaincodeForbiddenError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "C1011",
+		Message: f.Error(),
+	}
+}
+
+type ChaincodeRejectedContentError struct {
+	reason string
+}
+
+func (f *ChaincodeRejectedContentError) Error() string {
+	return "Chaincode: Rejected content, " + f.reason
+}
+
+func (f *ChaincodeRejectedContentError) Status() int {
+	return http.StatusUnprocessableEntity
+}
+
+func (f *ChaincodeRejectedContentError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "C1012",
+		Message: f.Error(),
+	}
+}
+
+type ChaincodeConsistencyTimeoutError struct{}
+
+func (f *ChaincodeConsistencyTimeoutError) Error() string {
+	return "Chaincode: Transaction not yet applied off-chain"
+}
+
+func (f *ChaincodeConsistencyTimeoutError) Status() int {
+	return http.StatusGatewayTimeout
+}
+
+func (f *ChaincodeConsistencyTimeoutError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "C1013",
+		Message: f.Error(),
+	}
+}
+
 var success *proto.Success = &proto.Success{}
 var chaincodeInternalError *ChaincodeInternalError = &ChaincodeInternalError{}
 var chaincodeDeserializationError *ChaincodeDeserializationError = &ChaincodeDeserializationError{}
 var chaincodeQueryParameterError *ChaincodeQueryParameterError = &ChaincodeQueryParameterError{}
+var chaincodeConsistencyTimeoutError *ChaincodeConsistencyTimeoutError = &ChaincodeConsistencyTimeoutError{}
@@ -0,0 +1,104 @@
+package chaincodes
+
+import (
+	"regexp"
+	"strings"
+
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/utils"
+	"gorm.io/gorm"
+)
+
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@(\w{1,32})`)
+
+// parseMentions returns the names mentioned in content in lower case, since
+// usernames are unique regardless of case.
+func parseMentions(content string) []string {
+	names := []string{}
+	for _, m := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		if name := strings.ToLower(m[1]); !utils.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func resolveMentions(tx *gorm.DB, creator string, hash string, content string) ([]*Mention, error) {
+
+	names := parseMentions(content)
+
+	if len(names) == 0 {
+		return []*Mention{}, nil
+	}
+
+	users := []*User{}
+
+	if err := tx.Model(&User{}).Where("LOWER(username) IN ?", names).Find(&users).Error; err != nil {
+		return nil, err
+	}
+
+	return utils.Map(users, func(u *User) *Mention {
+		return &Mention{
+			OwnerHash:       hash,
+			CreatorWallet:   creator,
+			MentionedWallet: u.Wallet,
+		}
+	}), nil
+}
+
+// notifyMentions notifies every mentioned wallet except the author and
+// those listed in notified, which already received a notification.
+func notifyMentions(tx *gorm.DB, source string, mentions []*Mention, notified []string) error {
+
+	notifications := utils.FilterMap(mentions, func(m *Mention) *Notification {
+		return &Notification{
+			RecipientWallet: m.MentionedWallet,
+			ActorWallet:     m.CreatorWallet,
+			Type:            NotificationMention,
+			SourceType:      source,
+			SourceHash:      m.OwnerHash,
+		}
+	}, func(m *Mention) bool {
+		return m.MentionedWallet != m.CreatorWallet && !utils.Contains(notified, m.MentionedWallet)
+	})
+
+	if len(notifications) == 0 {
+		return nil
+	}
+
+	return tx.Create(&notifications).Error
+}
+
+func replaceMentions(tx *gorm.DB, ownerID uint, source string, creator string, hash string, content string) error {
+
+	mentions, err := resolveMentions(tx, creator, hash, content)
+
+	if err != nil {
+		return err
+	}
+
+	previous := []*Mention{}
+
+	if err := tx.Where("owner_id = ? AND owner_type = ?", ownerID, source).Find(&previous).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Where("owner_id = ? AND owner_type = ?", ownerID, source).Delete(&Mention{}).Error; err != nil {
+		return err
+	}
+
+	for _, m := range mentions {
+		m.OwnerID = ownerID
+		m.OwnerType = source
+	}
+
+	if len(mentions) != 0 {
+		if err := tx.Create(&mentions).Error; err != nil {
+			return err
+		}
+	}
+
+	return notifyMentions(tx, source, mentions, utils.Map(previous, func(m *Mention) string {
+		return m.MentionedWallet
+	}))
+}
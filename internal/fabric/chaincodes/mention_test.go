@@ -0,0 +1,87 @@
+package chaincodes
+
+import (
+	"testing"
+
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func prepareMentionData(t *testing.T) *gorm.DB {
+
+	users := []*User{
+		{Username: "Alice", Wallet: "0x123456789"},
+		{Username: "Bob", Wallet: "0x100"},
+		{Username: "Carol", Wallet: "0x200"},
+	}
+
+	db := newSqliteDB()
+	assert.NoError(t, db.Create(&users).Error)
+
+	return db
+}
+
+func TestParseMentions(t *testing.T) {
+
+	t.Run("Parsing Content Without Mentions", func(t *testing.T) {
+		assert.Empty(t, parseMentions("Hello world, alice@example.com"))
+	})
+
+	t.Run("Parsing Content With Mentions", func(t *testing.T) {
+		assert.Equal(t, []string{"bob", "carol"}, parseMentions("@Bob hello, (@Carol) and @@Dave and @bob again"))
+	})
+}
+
+func TestResolveMentions(t *testing.T) {
+
+	db := prepareMentionData(t)
+
+	t.Run("Resolving Mentions With Unknown Users", func(t *testing.T) {
+		mentions, err := resolveMentions(db, "0x123456789", "topic", "@Dave @Eve")
+		assert.NoError(t, err)
+		assert.Empty(t, mentions)
+	})
+
+	t.Run("Resolving Mentions With Success", func(t *testing.T) {
+		mentions, err := resolveMentions(db, "0x123456789", "topic", "@Bob @Carol @Dave")
+		assert.NoError(t, err)
+		assert.Len(t, mentions, 2)
+		assert.Equal(t, "topic", mentions[0].OwnerHash)
+	})
+
+	t.Run("Resolving Mentions Regardless Of Case", func(t *testing.T) {
+		mentions, err := resolveMentions(db, "0x123456789", "topic", "@bob @CAROL")
+		assert.NoError(t, err)
+		assert.Len(t, mentions, 2)
+	})
+}
+
+func TestReplaceMentions(t *testing.T) {
+
+	db := prepareMentionData(t)
+
+	countNotifications := func(wallet string) int64 {
+		var count int64
+		assert.NoError(t, db.Model(&Notification{}).Where("recipient_wallet = ?", wallet).Count(&count).Error)
+		return count
+	}
+
+	t.Run("Replacing Mentions With Self Mention", func(t *testing.T) {
+		assert.NoError(t, replaceMentions(db, 1, "posts", "0x123456789", "post", "@Alice"))
+		assert.Equal(t, int64(0), countNotifications("0x123456789"))
+	})
+
+	t.Run("Replacing Mentions With Success", func(t *testing.T) {
+		assert.NoError(t, replaceMentions(db, 1, "posts", "0x123456789", "post", "@Bob"))
+		assert.NoError(t, replaceMentions(db, 1, "posts", "0x123456789", "post", "@Bob @Carol"))
+
+		mentions := []*Mention{}
+		assert.NoError(t, db.Where("owner_id = ? AND owner_type = ?", 1, "posts").Find(&mentions).Error)
+		assert.Len(t, mentions, 2)
+
+		// Bob was already mentioned before the edit and must not be notified twice
+		assert.Equal(t, int64(1), countNotifications("0x100"))
+		assert.Equal(t, int64(1), countNotifications("0x200"))
+	})
+}
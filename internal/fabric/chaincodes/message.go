@@ -0,0 +1,600 @@
+package chaincodes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Cealgull/Middleware/internal/fabric/common"
+	"github.com/Cealgull/Middleware/internal/ipfs"
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/proto"
+	"github.com/Cealgull/Middleware/internal/rest"
+	"github.com/Cealgull/Middleware/internal/utils"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const maxConversationParticipants = 32
+
+const maxMessageLength = 4096
+
+// conversationHash identifies the conversation between a set of wallets.
+func conversationHash(wallets []string) string {
+	sorted := append([]string{}, wallets...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// validateMessaging checks that sender may message the other wallets: no
+// one involved is banned, and no block list stands between sender and them.
+func validateMessaging(db *gorm.DB, sender string, others []string) proto.MiddlewareError {
+
+	users := []*User{}
+
+	if err := db.Model(&User{}).Where("wallet IN ?", append([]string{sender}, others...)).Find(&users).Error; err != nil {
+		return chaincodeInternalError
+	}
+
+	if len(users) != len(others)+1 {
+		return &ChaincodeNotFoundError{"user"}
+	}
+
+	for _, user := range users {
+		if user.Banned {
+			return &ChaincodeForbiddenError{"messaging"}
+		}
+	}
+
+	var blocks int64
+
+	if err := db.Model(&UserBlock{}).
+		Where("(blocker_wallet IN ? AND blocked_wallet = ?) OR (blocker_wallet = ? AND blocked_wallet IN ?)",
+			others, sender, sender, others).
+		Count(&blocks).Error; err != nil {
+		return chaincodeInternalError
+	}
+
+	if blocks != 0 {
+		return &ChaincodeForbiddenError{"messaging"}
+	}
+
+	return nil
+}
+
+// findConversation loads a conversation with its participants, but only for
+// one of those participants.
+func findConversation(db *gorm.DB, hash string, wallet string) (*Conversation, proto.MiddlewareError) {
+
+	conversation := Conversation{}
+
+	if err := db.Preload("Participants.User").Where("hash = ?", hash).First(&conversation).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &ChaincodeNotFoundError{"conversation"}
+		}
+		return nil, chaincodeInternalError
+	}
+
+	for _, p := range conversation.Participants {
+		if p.UserWallet == wallet {
+			return &conversation, nil
+		}
+	}
+
+	return nil, &ChaincodeNotFoundError{"conversation"}
+}
+
+func otherParticipants(conversation *Conversation, wallet string) []string {
+	return utils.FilterMap(conversation.Participants, func(p *ConversationParticipant) string {
+		return p.UserWallet
+	}, func(p *ConversationParticipant) bool {
+		return p.UserWallet != wallet
+	})
+}
+
+func createConversation(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB) ChaincodeCustom {
+	return func(contract common.Contract, c echo.Context) error {
+
+		type ConversationRequest struct {
+			Participants []string `json:"participants"`
+		}
+
+		conversationRequest := ConversationRequest{}
+
+		if err := c.Bind(&conversationRequest); err != nil {
+			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
+		}
+
+		wallet := rest.WalletOf(c)
+
+		others := []string{}
+
+		for _, participant := range conversationRequest.Participants {
+			if participant != "" && participant != wallet && !utils.Contains(others, participant) {
+				others = append(others, participant)
+			}
+		}
+
+		if len(others) == 0 || len(others) >= maxConversationParticipants {
+			chaincodeFieldValidationError := ChaincodeFieldValidationError{"participants"}
+			return c.JSON(chaincodeFieldValidationError.Status(), chaincodeFieldValidationError.Message())
+		}
+
+		if err := validateMessaging(db, wallet, others); err != nil {
+			return c.JSON(err.Status(), err.Message())
+		}
+
+		type ConversationResponse struct {
+			Hash string `json:"hash"`
+		}
+
+		hash := conversationHash(append(others, wallet))
+
+		if err := db.Model(&Conversation{}).Where("hash = ?", hash).First(&Conversation{}).Error; err == nil {
+			return c.JSON(success.Status(), &ConversationResponse{Hash: hash})
+		}
+
+		key, err := ipfs.NewKey()
+
+		if err != nil {
+			return c.JSON(err.Status(), err.Message())
+		}
+
+		conversation := Conversation{
+			Hash:          hash,
+			Key:           key,
+			CreatorWallet: wallet,
+			Participants: utils.Map(append(others, wallet), func(w string) *ConversationParticipant {
+				return &ConversationParticipant{UserWallet: w}
+			}),
+		}
+
+		if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&conversation).Error; err != nil {
+			return c.JSON(chaincodeInternalError.Status(), chaincodeInternalError.Message())
+		}
+
+		return c.JSON(success.Status(), &ConversationResponse{Hash: hash})
+	}
+}
+
+// notifyMessage notifies the participants of a conversation other than the
+// sender of a new message.
+func notifyMessage(tx *gorm.DB, conversation string, sender string, recipients []string) error {
+
+	notifications := utils.Map(recipients, func(recipient string) *Notification {
+		return &Notification{
+			RecipientWallet: recipient,
+			ActorWallet:     sender,
+			Type:            NotificationMessage,
+			SourceType:      "conversations",
+			SourceHash:      conversation,
+		}
+	})
+
+	if len(notifications) == 0 {
+		return nil
+	}
+
+	return tx.Create(&notifications).Error
+}
+
+// sendMessage stores a message sealed with the conversation key. When
+// anchoring is enabled the hash of the sealed message is submitted to the
+// ledger, and the other participants are notified once the anchor event
+// comes back. Otherwise they are notified right away.
+func sendMessage(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB, anchor bool) ChaincodeCustom {
+	return func(contract common.Contract, c echo.Context) error {
+
+		type MessageRequest struct {
+			Conversation string `json:"conversation"`
+			Content      string `json:"content"`
+		}
+
+		messageRequest := MessageRequest{}
+
+		if err := c.Bind(&messageRequest); err != nil {
+			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
+		}
+
+		if messageRequest.Content == "" || len(messageRequest.Content) > maxMessageLength {
+			chaincodeFieldValidationError := ChaincodeFieldValidationError{"content"}
+			return c.JSON(chaincodeFieldValidationError.Status(), chaincodeFieldValidationError.Message())
+		}
+
+		wallet := rest.WalletOf(c)
+
+		conversation, err := findConversation(db, messageRequest.Conversation, wallet)
+
+		if err != nil {
+			return c.JSON(err.Status(), err.Message())
+		}
+
+		others := otherParticipants(conversation, wallet)
+
+		if err := validateMessaging(db, wallet, others); err != nil {
+			return c.JSON(err.Status(), err.Message())
+		}
+
+		content, err := ipfs.Seal(conversation.Key, []byte(messageRequest.Content))
+
+		if err != nil {
+			return c.JSON(err.Status(), err.Message())
+		}
+
+		sum := sha256.Sum256(content)
+
+		message := Message{
+			Hash:           hex.EncodeToString(sum[:]),
+			ConversationID: conversation.ID,
+			SenderWallet:   wallet,
+			Content:        content,
+		}
+
+		// The message is stored before it is anchored, so that the anchor
+		// event always finds it.
+		if err := db.Transaction(func(tx *gorm.DB) error {
+
+			if err := tx.Create(&message).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(&ConversationParticipant{}).
+				Where("conversation_id = ? AND user_wallet = ?", conversation.ID, wallet).
+				Update("last_read_id", message.ID).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(conversation).Update("updated_at", time.Now()).Error; err != nil {
+				return err
+			}
+
+			if anchor {
+				return nil
+			}
+
+			return notifyMessage(tx, conversation.Hash, wallet, others)
+
+		}); err != nil {
+			return c.JSON(chaincodeInternalError.Status(), chaincodeInternalError.Message())
+		}
+
+		if anchor {
+
+			b, _ := json.Marshal(&MessageBlock{
+				Hash:         message.Hash,
+				Conversation: conversation.Hash,
+				Sender:       wallet,
+			})
+
+			if _, err := contract.Submit("AnchorMessage", client.WithBytesArguments(b)); err != nil {
+				var _ = db.Delete(&message).Error
+				chaincodeInvokeFailure := ChaincodeInvokeFailureError{"AnchorMessage"}
+				return c.JSON(chaincodeInvokeFailure.Status(), chaincodeInvokeFailure.Message())
+			}
+		}
+
+		type MessageResponse struct {
+			Hash string `json:"hash"`
+		}
+
+		return c.JSON(success.Status(), &MessageResponse{Hash: message.Hash})
+	}
+}
+
+// anchorMessageCallback marks an anchored message and notifies the other
+// participants of its conversation, once per message.
+func anchorMessageCallback(logger *zap.Logger, db *gorm.DB) ChaincodeEventCallback {
+	return func(payload []byte) error {
+
+		messageBlock := MessageBlock{}
+
+		if err := json.Unmarshal(payload, &messageBlock); err != nil {
+			return err
+		}
+
+		return db.Transaction(func(tx *gorm.DB) error {
+
+			result := tx.Model(&Message{}).
+				Where("hash = ? AND anchored = ?", messageBlock.Hash, false).
+				Update("anchored", true)
+
+			if result.Error != nil || result.RowsAffected == 0 {
+				return result.Error
+			}
+
+			conversation, err := findConversation(tx, messageBlock.Conversation, messageBlock.Sender)
+
+			if err != nil {
+				return err
+			}
+
+			return notifyMessage(tx, conversation.Hash, messageBlock.Sender, otherParticipants(conversation, messageBlock.Sender))
+		})
+	}
+}
+
+func readConversation(logger *zap.Logger, db *gorm.DB) ChaincodeCustom {
+	return func(contract common.Contract, c echo.Context) error {
+
+		type ReadRequest struct {
+			Conversation string `json:"conversation"`
+		}
+
+		readRequest := ReadRequest{}
+
+		if err := c.Bind(&readRequest); err != nil {
+			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
+		}
+
+		wallet := rest.WalletOf(c)
+
+		conversation, err := findConversation(db, readRequest.Conversation, wallet)
+
+		if err != nil {
+			return c.JSON(err.Status(), err.Message())
+		}
+
+		if err := db.Transaction(func(tx *gorm.DB) error {
+
+			if err := tx.Model(&ConversationParticipant{}).
+				Where("conversation_id = ? AND user_wallet = ?", conversation.ID, wallet).
+				Update("last_read_id", tx.Model(&Message{}).
+					Select("COALESCE(MAX(id), 0)").
+					Where("conversation_id = ?", conversation.ID)).Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&Notification{}).
+				Where("recipient_wallet = ? AND type = ? AND source_hash = ?", wallet, NotificationMessage, conversation.Hash).
+				Update("read", true).Error
+
+		}); err != nil {
+			return c.JSON(chaincodeInternalError.Status(), chaincodeInternalError.Message())
+		}
+
+		return c.JSON(success.Status(), success.Message())
+	}
+}
+
+func blockUser(logger *zap.Logger, db *gorm.DB) ChaincodeCustom {
+	return func(contract common.Contract, c echo.Context) error {
+
+		type BlockRequest struct {
+			Wallet string `json:"wallet"`
+		}
+
+		blockRequest := BlockRequest{}
+
+		if err := c.Bind(&blockRequest); err != nil {
+			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
+		}
+
+		wallet := rest.WalletOf(c)
+
+		if blockRequest.Wallet == "" || blockRequest.Wallet == wallet {
+			chaincodeFieldValidationError := ChaincodeFieldValidationError{"wallet"}
+			return c.JSON(chaincodeFieldValidationError.Status(), chaincodeFieldValidationError.Message())
+		}
+
+		if err := db.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&UserBlock{BlockerWallet: wallet, BlockedWallet: blockRequest.Wallet}).Error; err != nil {
+			return c.JSON(chaincodeInternalError.Status(), chaincodeInternalError.Message())
+		}
+
+		return c.JSON(success.Status(), success.Message())
+	}
+}
+
+func unblockUser(logger *zap.Logger, db *gorm.DB) ChaincodeCustom {
+	return func(contract common.Contract, c echo.Context) error {
+
+		type UnblockRequest struct {
+			Wallet string `json:"wallet"`
+		}
+
+		unblockRequest := UnblockRequest{}
+
+		if err := c.Bind(&unblockRequest); err != nil {
+			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
+		}
+
+		wallet := rest.WalletOf(c)
+
+		if err := db.Where("blocker_wallet = ? AND blocked_wallet = ?", wallet, unblockRequest.Wallet).
+			Delete(&UserBlock{}).Error; err != nil {
+			return c.JSON(chaincodeInternalError.Status(), chaincodeInternalError.Message())
+		}
+
+		return c.JSON(success.Status(), success.Message())
+	}
+}
+
+func queryConversations(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
+	return func(c echo.Context) error {
+
+		wallet := rest.WalletOf(c)
+
+		conversations := []*Conversation{}
+
+		if err := db.Preload("Participants.User").
+			Where("id IN (?)", db.Model(&ConversationParticipant{}).Select("conversation_id").Where("user_wallet = ?", wallet)).
+			Order("updated_at DESC").
+			Find(&conversations).Error; err != nil {
+			return c.JSON(chaincodeInternalError.Status(), chaincodeInternalError.Message())
+		}
+
+		type ConversationResponse struct {
+			Hash         string                     `json:"hash"`
+			Participants []*ConversationParticipant `json:"participants"`
+			Unread       int64                      `json:"unread"`
+			CreatedAt    time.Time                  `json:"createdAt"`
+			UpdatedAt    time.Time                  `json:"updatedAt"`
+		}
+
+		response := make([]*ConversationResponse, len(conversations))
+
+		for i, conversation := range conversations {
+
+			response[i] = &ConversationResponse{
+				Hash:         conversation.Hash,
+				Participants: conversation.Participants,
+				CreatedAt:    conversation.CreatedAt,
+				UpdatedAt:    conversation.UpdatedAt,
+			}
+
+			if err := db.Model(&Message{}).
+				Joins("JOIN conversation_participants ON conversation_participants.conversation_id = messages.conversation_id").
+				Where("messages.conversation_id = ? AND conversation_participants.user_wallet = ?", conversation.ID, wallet).
+				Where("messages.id > conversation_participants.last_read_id AND messages.sender_wallet <> ?", wallet).
+				Count(&response[i].Unread).Error; err != nil {
+				return c.JSON(chaincodeInternalError.Status(), chaincodeInternalError.Message())
+			}
+		}
+
+		return c.JSON(success.Status(), response)
+	}
+}
+
+func queryMessages(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB) ChaincodeQuery {
+	return func(c echo.Context) error {
+
+		type MessageQuery struct {
+			Conversation string `json:"conversation"`
+			PageOrdinal  int    `json:"pageOrdinal"`
+			PageSize     int    `json:"pageSize"`
+		}
+
+		q := MessageQuery{}
+
+		if c.Bind(&q) != nil {
+			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
+		}
+
+		if q.PageOrdinal <= 0 || q.PageSize <= 0 {
+			return c.JSON(chaincodeQueryParameterError.Status(), chaincodeQueryParameterError.Message())
+		}
+
+		wallet := rest.WalletOf(c)
+
+		conversation, err := findConversation(db, q.Conversation, wallet)
+
+		if err != nil {
+			return c.JSON(err.Status(), err.Message())
+		}
+
+		messages := []*Message{}
+
+		if err := db.Where("conversation_id = ?", conversation.ID).
+			Scopes(paginate(q.PageOrdinal, q.PageSize)).
+			Order("id DESC").
+			Find(&messages).Error; err != nil {
+			return c.JSON(chaincodeInternalError.Status(), chaincodeInternalError.Message())
+		}
+
+		type MessageResponse struct {
+			Hash      string    `json:"hash"`
+			Sender    string    `json:"sender"`
+			Content   string    `json:"content"`
+			Anchored  bool      `json:"anchored"`
+			CreatedAt time.Time `json:"createdAt"`
+		}
+
+		response := make([]*MessageResponse, len(messages))
+
+		for i, message := range messages {
+
+			content, err := ipfs.Open(conversation.Key, message.Content)
+
+			if err != nil {
+				return c.JSON(err.Status(), err.Message())
+			}
+
+			response[i] = &MessageResponse{
+				Hash:      message.Hash,
+				Sender:    message.SenderWallet,
+				Content:   string(content),
+				Anchored:  message.Anchored,
+				CreatedAt: message.CreatedAt,
+			}
+		}
+
+		return c.JSON(success.Status(), response)
+	}
+}
+
+func queryUnread(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
+	return func(c echo.Context) error {
+
+		wallet := rest.WalletOf(c)
+
+		var unread int64
+
+		if err := db.Model(&Message{}).
+			Joins("JOIN conversation_participants ON conversation_participants.conversation_id = messages.conversation_id").
+			Where("conversation_participants.user_wallet = ?", wallet).
+			Where("messages.id > conversation_participants.last_read_id AND messages.sender_wallet <> ?", wallet).
+			Count(&unread).Error; err != nil {
+			return c.JSON(chaincodeInternalError.Status(), chaincodeInternalError.Message())
+		}
+
+		type UnreadResponse struct {
+			Unread int64 `json:"unread"`
+		}
+
+		return c.JSON(success.Status(), &UnreadResponse{Unread: unread})
+	}
+}
+
+func queryBlocks(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
+	return func(c echo.Context) error {
+
+		wallet := rest.WalletOf(c)
+
+		blocked := []string{}
+
+		if err := db.Model(&UserBlock{}).
+			Where("blocker_wallet = ?", wallet).
+			Order("created_at DESC").
+			Pluck("blocked_wallet", &blocked).Error; err != nil {
+			return c.JSON(chaincodeInternalError.Status(), chaincodeInternalError.Message())
+		}
+
+		return c.JSON(success.Status(), blocked)
+	}
+}
+
+// NewMessageChaincodeMiddleware serves direct messages. Messages live off
+// chain, and only their hashes are anchored on the ledger when anchor is
+// set, which is the only case the message chaincode is attached.
+func NewMessageChaincodeMiddleware(logger *zap.Logger, net common.Network, ipfs *ipfs.IPFSManager, db *gorm.DB, anchor bool) *ChaincodeMiddleware {
+
+	var contract common.Contract
+
+	options := []ChaincodeMiddlewareOption{
+		WithChaincodeCustom("/api/message/send", sendMessage(logger, ipfs, db, anchor)),
+		WithChaincodeCustom("/api/message/create", createConversation(logger, ipfs, db)),
+		WithChaincodeCustom("/api/message/read", readConversation(logger, db)),
+		WithChaincodeCustom("/api/message/block", blockUser(logger, db)),
+		WithChaincodeCustom("/api/message/unblock", unblockUser(logger, db)),
+
+		WithChaincodeQueryGet("conversations", queryConversations(logger, db)),
+		WithChaincodeQueryPost("messages", queryMessages(logger, ipfs, db)),
+		WithChaincodeQueryGet("unread", queryUnread(logger, db)),
+		WithChaincodeQueryGet("blocks", queryBlocks(logger, db)),
+	}
+
+	if anchor {
+		contract = net.GetContract("message")
+		options = append(options, WithChaincodeEvent("AnchorMessage", anchorMessageCallback(logger, db)))
+	}
+
+	return NewChaincodeMiddleware(logger, net, contract, options...)
+}
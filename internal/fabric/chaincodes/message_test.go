@@ -0,0 +1,305 @@
+package chaincodes
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Cealgull/Middleware/internal/ipfs"
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/rest"
+	"github.com/gorilla/sessions"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"gorm.io/gorm"
+
+	fabricmock "github.com/Cealgull/Middleware/internal/fabric/common/mocks"
+)
+
+func prepareMessageData(t *testing.T) (*gorm.DB, *ipfs.IPFSManager) {
+
+	db := newSqliteDB()
+
+	users := []*User{
+		{Username: "Alice", Wallet: "0xAlice"},
+		{Username: "Bob", Wallet: "0xBob"},
+		{Username: "Carol", Wallet: "0xCarol"},
+		{Username: "Mallory", Wallet: "0xMallory", Banned: true},
+	}
+
+	assert.NoError(t, db.Create(&users).Error)
+
+	key := make([]byte, 32)
+	var _, _ = rand.Read(key)
+
+	mgr, err := ipfs.NewIPFSManager(logger,
+		ipfs.WithFilesystem(t.TempDir()),
+		ipfs.WithEncryptionKey(base64.StdEncoding.EncodeToString(key)),
+	)
+	assert.NoError(t, err)
+
+	return db, mgr
+}
+
+func newWalletSignedContext(c echo.Context, wallet string) echo.Context {
+	c.Set("_session_store", sessions.NewCookieStore([]byte("secret")))
+	rest.SetIdentity(c, &rest.Identity{Wallet: wallet})
+	return c
+}
+
+func callMessaging(handler func(c echo.Context) error, method string, wallet string, body interface{}) *httptest.ResponseRecorder {
+
+	b, _ := json.Marshal(body)
+
+	req := httptest.NewRequest(method, "/", bytes.NewReader(b))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+
+	var _ = handler(newWalletSignedContext(server.NewContext(req, rec), wallet))
+	return rec
+}
+
+func invokeMessaging(invoke ChaincodeCustom, contract *fabricmock.MockContract, wallet string, body interface{}) *httptest.ResponseRecorder {
+	return callMessaging(func(c echo.Context) error { return invoke(contract, c) }, http.MethodPost, wallet, body)
+}
+
+func TestConversationHash(t *testing.T) {
+	assert.Equal(t, conversationHash([]string{"0xAlice", "0xBob"}), conversationHash([]string{"0xBob", "0xAlice"}))
+	assert.NotEqual(t, conversationHash([]string{"0xAlice", "0xBob"}), conversationHash([]string{"0xAlice", "0xCarol"}))
+}
+
+func TestDirectMessaging(t *testing.T) {
+
+	db, mgr := prepareMessageData(t)
+	contract := fabricmock.NewMockContract()
+
+	create := createConversation(logger, mgr, db)
+	send := sendMessage(logger, mgr, db, false)
+	read := readConversation(logger, db)
+
+	type Hash struct {
+		Hash string `json:"hash"`
+	}
+
+	conversation := Hash{}
+
+	t.Run("Creating Conversation", func(t *testing.T) {
+
+		rec := invokeMessaging(create, contract, "0xAlice", map[string]interface{}{"participants": []string{"0xBob", "0xAlice", "0xBob"}})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &conversation))
+		assert.Equal(t, conversationHash([]string{"0xAlice", "0xBob"}), conversation.Hash)
+
+		rec = invokeMessaging(create, contract, "0xBob", map[string]interface{}{"participants": []string{"0xAlice"}})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), conversation.Hash)
+
+		var count int64
+		db.Model(&Conversation{}).Count(&count)
+		assert.Equal(t, int64(1), count)
+	})
+
+	t.Run("Creating Invalid Conversation", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, invokeMessaging(create, contract, "0xAlice", []int{1}).Code)
+		assert.Equal(t, http.StatusBadRequest, invokeMessaging(create, contract, "0xAlice", map[string]interface{}{"participants": []string{"0xAlice"}}).Code)
+		assert.Equal(t, http.StatusBadRequest, invokeMessaging(create, contract, "0xAlice", map[string]interface{}{"participants": []string{"0xNobody"}}).Code)
+		assert.Equal(t, http.StatusForbidden, invokeMessaging(create, contract, "0xAlice", map[string]interface{}{"participants": []string{"0xMallory"}}).Code)
+		assert.Equal(t, http.StatusForbidden, invokeMessaging(create, contract, "0xMallory", map[string]interface{}{"participants": []string{"0xAlice"}}).Code)
+	})
+
+	t.Run("Sending Messages", func(t *testing.T) {
+
+		rec := invokeMessaging(send, contract, "0xAlice", map[string]string{"conversation": conversation.Hash, "content": "hello bob"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		rec = invokeMessaging(send, contract, "0xAlice", map[string]string{"conversation": conversation.Hash, "content": "are you there"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		message := Message{}
+		assert.NoError(t, db.First(&message).Error)
+		assert.NotContains(t, string(message.Content), "hello bob")
+		assert.False(t, message.Anchored)
+
+		notifications := []*Notification{}
+		assert.NoError(t, db.Where("recipient_wallet = ? AND type = ?", "0xBob", NotificationMessage).Find(&notifications).Error)
+		assert.Len(t, notifications, 2)
+		assert.Equal(t, conversation.Hash, notifications[0].SourceHash)
+
+		assert.Equal(t, http.StatusBadRequest, invokeMessaging(send, contract, "0xAlice", map[string]string{"conversation": conversation.Hash}).Code)
+		assert.Equal(t, http.StatusBadRequest, invokeMessaging(send, contract, "0xAlice", []int{1}).Code)
+		assert.Equal(t, http.StatusBadRequest, invokeMessaging(send, contract, "0xCarol", map[string]string{"conversation": conversation.Hash, "content": "hi"}).Code)
+	})
+
+	t.Run("Unread Counts", func(t *testing.T) {
+
+		rec := callMessaging(queryUnread(logger, db), http.MethodGet, "0xBob", nil)
+		assert.JSONEq(t, `{"unread":2}`, rec.Body.String())
+
+		rec = callMessaging(queryUnread(logger, db), http.MethodGet, "0xAlice", nil)
+		assert.JSONEq(t, `{"unread":0}`, rec.Body.String())
+
+		type ConversationResponse struct {
+			Hash         string `json:"hash"`
+			Unread       int64  `json:"unread"`
+			Participants []struct {
+				Username string `json:"username"`
+			} `json:"participants"`
+		}
+
+		conversations := []*ConversationResponse{}
+		rec = callMessaging(queryConversations(logger, db), http.MethodGet, "0xBob", nil)
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &conversations))
+		assert.Len(t, conversations, 1)
+		assert.Equal(t, int64(2), conversations[0].Unread)
+		assert.Len(t, conversations[0].Participants, 2)
+
+		assert.Equal(t, http.StatusOK, invokeMessaging(read, contract, "0xBob", map[string]string{"conversation": conversation.Hash}).Code)
+
+		rec = callMessaging(queryUnread(logger, db), http.MethodGet, "0xBob", nil)
+		assert.JSONEq(t, `{"unread":0}`, rec.Body.String())
+
+		var unread int64
+		db.Model(&Notification{}).Where("recipient_wallet = ? AND read = ?", "0xBob", false).Count(&unread)
+		assert.Equal(t, int64(0), unread)
+
+		assert.Equal(t, http.StatusBadRequest, invokeMessaging(read, contract, "0xCarol", map[string]string{"conversation": conversation.Hash}).Code)
+		assert.Equal(t, http.StatusBadRequest, invokeMessaging(read, contract, "0xCarol", []int{1}).Code)
+	})
+
+	t.Run("Reading Messages", func(t *testing.T) {
+
+		type MessageResponse struct {
+			Sender  string `json:"sender"`
+			Content string `json:"content"`
+		}
+
+		messages := []*MessageResponse{}
+		rec := callMessaging(queryMessages(logger, mgr, db), http.MethodPost, "0xBob",
+			map[string]interface{}{"conversation": conversation.Hash, "pageOrdinal": 1, "pageSize": 10})
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &messages))
+		assert.Equal(t, []*MessageResponse{{"0xAlice", "are you there"}, {"0xAlice", "hello bob"}}, messages)
+
+		assert.Equal(t, http.StatusBadRequest, callMessaging(queryMessages(logger, mgr, db), http.MethodPost, "0xBob",
+			map[string]interface{}{"conversation": conversation.Hash}).Code)
+		assert.Equal(t, http.StatusBadRequest, callMessaging(queryMessages(logger, mgr, db), http.MethodPost, "0xBob", []int{1}).Code)
+		assert.Equal(t, http.StatusBadRequest, callMessaging(queryMessages(logger, mgr, db), http.MethodPost, "0xCarol",
+			map[string]interface{}{"conversation": conversation.Hash, "pageOrdinal": 1, "pageSize": 10}).Code)
+	})
+
+	t.Run("Blocking", func(t *testing.T) {
+
+		block := blockUser(logger, db)
+		unblock := unblockUser(logger, db)
+
+		assert.Equal(t, http.StatusOK, invokeMessaging(block, contract, "0xBob", map[string]string{"wallet": "0xAlice"}).Code)
+		assert.Equal(t, http.StatusOK, invokeMessaging(block, contract, "0xBob", map[string]string{"wallet": "0xAlice"}).Code)
+		assert.Equal(t, http.StatusBadRequest, invokeMessaging(block, contract, "0xBob", map[string]string{"wallet": "0xBob"}).Code)
+		assert.Equal(t, http.StatusBadRequest, invokeMessaging(block, contract, "0xBob", []int{1}).Code)
+
+		rec := callMessaging(queryBlocks(logger, db), http.MethodGet, "0xBob", nil)
+		assert.JSONEq(t, `["0xAlice"]`, rec.Body.String())
+
+		assert.Equal(t, http.StatusForbidden, invokeMessaging(send, contract, "0xAlice", map[string]string{"conversation": conversation.Hash, "content": "hello?"}).Code)
+		assert.Equal(t, http.StatusForbidden, invokeMessaging(send, contract, "0xBob", map[string]string{"conversation": conversation.Hash, "content": "go away"}).Code)
+		assert.Equal(t, http.StatusForbidden, invokeMessaging(create, contract, "0xAlice", map[string]interface{}{"participants": []string{"0xBob", "0xCarol"}}).Code)
+
+		assert.Equal(t, http.StatusOK, invokeMessaging(unblock, contract, "0xBob", map[string]string{"wallet": "0xAlice"}).Code)
+		assert.Equal(t, http.StatusBadRequest, invokeMessaging(unblock, contract, "0xBob", []int{1}).Code)
+		assert.Equal(t, http.StatusOK, invokeMessaging(send, contract, "0xAlice", map[string]string{"conversation": conversation.Hash, "content": "hello again"}).Code)
+	})
+
+	t.Run("Banned Participant", func(t *testing.T) {
+		assert.NoError(t, db.Model(&User{}).Where("wallet = ?", "0xBob").Update("banned", true).Error)
+		defer db.Model(&User{}).Where("wallet = ?", "0xBob").Update("banned", false)
+
+		assert.Equal(t, http.StatusForbidden, invokeMessaging(send, contract, "0xAlice", map[string]string{"conversation": conversation.Hash, "content": "hello?"}).Code)
+	})
+}
+
+func TestAnchoredMessaging(t *testing.T) {
+
+	db, mgr := prepareMessageData(t)
+	contract := fabricmock.NewMockContract()
+
+	create := createConversation(logger, mgr, db)
+	send := sendMessage(logger, mgr, db, true)
+
+	rec := invokeMessaging(create, contract, "0xAlice", map[string]interface{}{"participants": []string{"0xBob", "0xCarol"}})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	hash := conversationHash([]string{"0xAlice", "0xBob", "0xCarol"})
+
+	contract.On("Submit", "AnchorMessage", mock.Anything).Return([]byte(nil), errors.New("hello world")).Once()
+	rec = invokeMessaging(send, contract, "0xAlice", map[string]string{"conversation": hash, "content": "hello"})
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	var count int64
+	db.Model(&Message{}).Count(&count)
+	assert.Equal(t, int64(0), count)
+
+	contract.On("Submit", "AnchorMessage", mock.Anything).Return([]byte(nil), nil).Once()
+	rec = invokeMessaging(send, contract, "0xAlice", map[string]string{"conversation": hash, "content": "hello"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	message := Message{}
+	assert.NoError(t, db.First(&message).Error)
+	assert.False(t, message.Anchored)
+
+	var notified int64
+	db.Model(&Notification{}).Where("type = ? AND source_hash = ?", NotificationMessage, hash).Count(&notified)
+	assert.Equal(t, int64(0), notified)
+
+	callback := anchorMessageCallback(logger, db)
+	assert.Error(t, callback([]byte("{")))
+
+	b, _ := json.Marshal(&MessageBlock{Hash: message.Hash, Conversation: hash, Sender: "0xAlice"})
+	assert.NoError(t, callback(b))
+	assert.NoError(t, callback(b))
+	assert.NoError(t, db.First(&message).Error)
+	assert.True(t, message.Anchored)
+
+	db.Model(&Notification{}).Where("type = ? AND source_hash = ?", NotificationMessage, hash).Count(&notified)
+	assert.Equal(t, int64(2), notified)
+}
+
+func TestMessagingDisabled(t *testing.T) {
+
+	db, _ := prepareMessageData(t)
+	mgr, _ := ipfs.NewIPFSManager(logger, ipfs.WithFilesystem(t.TempDir()))
+
+	rec := invokeMessaging(createConversation(logger, mgr, db), fabricmock.NewMockContract(), "0xAlice",
+		map[string]interface{}{"participants": []string{"0xBob"}})
+	assert.Equal(t, http.StatusNotImplemented, rec.Code)
+}
+
+func TestMessageChaincodeMiddlewareRegister(t *testing.T) {
+
+	db, mgr := prepareMessageData(t)
+
+	t.Run("Off Chain", func(t *testing.T) {
+		m := NewMessageChaincodeMiddleware(logger, fabricmock.NewMockNetwork(t), mgr, db, false)
+		assert.Empty(t, m.invokes)
+		assert.Empty(t, m.callbacks)
+		assert.Contains(t, m.custom, "/api/message/send")
+		assert.Contains(t, m.custom, "/api/message/create")
+		assert.NoError(t, m.Listen(context.Background()))
+
+		e := echo.New()
+		m.Register(e.Group("/api/message"), e)
+	})
+
+	t.Run("Anchored", func(t *testing.T) {
+		network := fabricmock.NewMockNetwork(t)
+		var _ = network.EXPECT().GetContract("message").Return(&client.Contract{}).Once()
+
+		m := NewMessageChaincodeMiddleware(logger, network, mgr, db, true)
+		assert.Empty(t, m.invokes)
+		assert.Contains(t, m.callbacks, "AnchorMessage")
+	})
+}
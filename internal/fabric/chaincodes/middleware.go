@@ -2,6 +2,8 @@ package chaincodes
 
 import (
 	"github.com/Cealgull/Middleware/internal/fabric/common"
+	"github.com/Cealgull/Middleware/internal/rest"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
 
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
@@ -27,43 +29,114 @@ type ChaincodeMiddleware struct {
 	queryGets  map[string]ChaincodeQuery
 
 	custom map[string]ChaincodeCustom
+
+	// policies holds the auth policy of each route that declared one,
+	// keyed by "/invoke/<action>", "/query/<action>" or the custom location.
+	policies map[string]rest.AuthPolicy
+
+	// tracker follows invokes submitted in async mode, which is only
+	// offered when one is set.
+	tracker *TxTracker
+
+	// consistency records applied transactions and holds queries sent with
+	// a consistency token, when set.
+	consistency *Consistency
+
 	logger *zap.Logger
 }
 
 type ChaincodeMiddlewareOption func(cc *ChaincodeMiddleware) error
 
-func WithChaincodeHandler(action string, eventName string, invoke ChaincodeInvoke, callback ChaincodeEventCallback) ChaincodeMiddlewareOption {
+// declare records the policy of a route. Routes without one require a
+// signed in wallet.
+func (cc *ChaincodeMiddleware) declare(route string, policy []rest.AuthPolicy) {
+	if len(policy) != 0 {
+		cc.policies[route] = policy[0]
+	}
+}
+
+func (cc *ChaincodeMiddleware) policy(route string) rest.AuthPolicy {
+	if policy, ok := cc.policies[route]; ok {
+		return policy
+	}
+	return rest.AuthRequired
+}
+
+func WithChaincodeHandler(action string, eventName string, invoke ChaincodeInvoke, callback ChaincodeEventCallback, policy ...rest.AuthPolicy) ChaincodeMiddlewareOption {
+	return func(cc *ChaincodeMiddleware) error {
+		cc.invokes[action] = invoke
+		cc.callbacks[eventName] = callback
+		cc.declare("/invoke/"+action, policy)
+		return nil
+	}
+}
+
+// WithChaincodeInvoke registers an invoke that has no ledger event to
+// listen for.
+func WithChaincodeInvoke(action string, invoke ChaincodeInvoke, policy ...rest.AuthPolicy) ChaincodeMiddlewareOption {
 	return func(cc *ChaincodeMiddleware) error {
 		cc.invokes[action] = invoke
+		cc.declare("/invoke/"+action, policy)
+		return nil
+	}
+}
+
+// WithChaincodeEvent listens for a ledger event emitted by transactions
+// that are not submitted through an invoke of this middleware.
+func WithChaincodeEvent(eventName string, callback ChaincodeEventCallback) ChaincodeMiddlewareOption {
+	return func(cc *ChaincodeMiddleware) error {
 		cc.callbacks[eventName] = callback
 		return nil
 	}
 }
 
-func WithChaincodeQueryPost(token string, query ChaincodeQuery) ChaincodeMiddlewareOption {
+func WithChaincodeQueryPost(token string, query ChaincodeQuery, policy ...rest.AuthPolicy) ChaincodeMiddlewareOption {
 	return func(cc *ChaincodeMiddleware) error {
 		cc.queryPosts[token] = query
+		cc.declare("/query/"+token, policy)
 		return nil
 	}
 }
 
-func WithChaincodeQueryGet(token string, query ChaincodeQuery) ChaincodeMiddlewareOption {
+func WithChaincodeQueryGet(token string, query ChaincodeQuery, policy ...rest.AuthPolicy) ChaincodeMiddlewareOption {
 	return func(cc *ChaincodeMiddleware) error {
 		cc.queryGets[token] = query
+		cc.declare("/query/"+token, policy)
 		return nil
 	}
 }
 
-func WithChaincodeCustom(location string, custom ChaincodeCustom) ChaincodeMiddlewareOption {
+func WithChaincodeCustom(location string, custom ChaincodeCustom, policy ...rest.AuthPolicy) ChaincodeMiddlewareOption {
 	return func(cc *ChaincodeMiddleware) error {
 		cc.custom[location] = custom
+		cc.declare(location, policy)
 		return nil
 	}
 }
 
+// WithTxTracker lets clients submit invokes without waiting for the commit
+// and follow them with tracker.
+func WithTxTracker(tracker *TxTracker) ChaincodeMiddlewareOption {
+	return func(cc *ChaincodeMiddleware) error {
+		cc.tracker = tracker
+		return nil
+	}
+}
+
+// WithConsistency sends consistency tokens back from invokes and lets
+// queries wait for them.
+func WithConsistency(consistency *Consistency) ChaincodeMiddlewareOption {
+	return func(cc *ChaincodeMiddleware) error {
+		cc.consistency = consistency
+		return nil
+	}
+}
+
+// NewChaincodeMiddleware serves the routes of a chaincode. A middleware
+// without contract only serves queries and custom routes off the offchain
+// store, and listens for no events.
 func NewChaincodeMiddleware(logger *zap.Logger, net common.Network, contract common.Contract, options ...ChaincodeMiddlewareOption) *ChaincodeMiddleware {
 	cc := ChaincodeMiddleware{
-		name:       contract.ChaincodeName(),
 		net:        net,
 		contract:   contract,
 		invokes:    make(map[string]ChaincodeInvoke),
@@ -71,49 +144,77 @@ func NewChaincodeMiddleware(logger *zap.Logger, net common.Network, contract com
 		queryPosts: make(map[string]ChaincodeQuery),
 		queryGets:  make(map[string]ChaincodeQuery),
 		custom:     make(map[string]ChaincodeCustom),
+		policies:   make(map[string]rest.AuthPolicy),
 		logger:     logger,
 	}
 
+	if contract != nil {
+		cc.name = contract.ChaincodeName()
+	}
+
 	for _, option := range options {
 		var _ = option(&cc)
 	}
 	return &cc
 }
 
+// consistent serves query holding it for consistency tokens, which are only
+// honoured on routes that identify the caller.
+func (cc *ChaincodeMiddleware) consistent(policy rest.AuthPolicy, query ChaincodeQuery) echo.HandlerFunc {
+
+	handler := func(c echo.Context) error { return query(c) }
+
+	if policy == rest.AuthPublic {
+		return handler
+	}
+
+	return cc.consistency.Wait(handler)
+}
+
 func (cc *ChaincodeMiddleware) Register(g *echo.Group, e *echo.Echo) {
 
 	i := g.Group("/invoke")
 
 	for action, invoke := range cc.invokes {
-		i.POST("/"+action, func(invoke ChaincodeInvoke) echo.HandlerFunc {
-			return func(c echo.Context) error { return invoke(cc.contract, c) }
-		}(invoke))
+		rest.Declare(e, cc.policy("/invoke/"+action), i.POST("/"+action, func(invoke ChaincodeInvoke) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				switch {
+				case cc.tracker != nil && wantsAsync(c):
+					return invoke(&asyncContract{cc.contract, cc.name, cc.tracker, c}, c)
+				case cc.consistency != nil:
+					return invoke(&consistentContract{cc.contract, cc.consistency, c}, c)
+				}
+				return invoke(cc.contract, c)
+			}
+		}(invoke)))
 	}
 
 	q := g.Group("/query")
 
 	for action, query := range cc.queryPosts {
-		q.POST("/"+action, func(query ChaincodeQuery) echo.HandlerFunc {
-			return func(c echo.Context) error { return query(c) }
-		}(query))
+		policy := cc.policy("/query/" + action)
+		rest.Declare(e, policy, q.POST("/"+action, cc.consistent(policy, query)))
 	}
 
 	for action, query := range cc.queryGets {
-		q.GET("/"+action, func(query ChaincodeQuery) echo.HandlerFunc {
-			return func(c echo.Context) error { return query(c) }
-		}(query))
+		policy := cc.policy("/query/" + action)
+		rest.Declare(e, policy, q.GET("/"+action, cc.consistent(policy, query)))
 	}
 
 	for location, custom := range cc.custom {
-		e.POST(location, func(custom ChaincodeCustom) echo.HandlerFunc {
+		rest.Declare(e, cc.policy(location), e.POST(location, func(custom ChaincodeCustom) echo.HandlerFunc {
 			return func(c echo.Context) error { return custom(cc.contract, c) }
-		}(custom))
+		}(custom)))
 	}
 
 }
 
 func (cc *ChaincodeMiddleware) Listen(ctx context.Context) error {
 
+	if cc.contract == nil {
+		return nil
+	}
+
 	ch, err := cc.net.ChaincodeEvents(ctx, cc.contract.ChaincodeName())
 
 	if err != nil {
@@ -126,13 +227,19 @@ func (cc *ChaincodeMiddleware) Listen(ctx context.Context) error {
 		case event := <-ch:
 			callback, _ := cc.callbacks[event.EventName]
 			cc.logger.Info("Received Ledger Event", zap.String("name", event.EventName))
-			if callback != nil {
-				go func(data []byte) {
-					if err := callback(data); err != nil {
-						cc.logger.Error("Error when calling event callback", zap.Error(err))
-					}
-				}(event.Payload)
+			cc.tracker.committed(event.TransactionID, event.BlockNumber)
+			if callback == nil {
+				cc.consistency.applied(event.TransactionID, cc.name, event.EventName, event.BlockNumber)
+				continue
 			}
+			go func(event *client.ChaincodeEvent) {
+				if err := callback(event.Payload); err != nil {
+					cc.logger.Error("Error when calling event callback", zap.Error(err))
+					return
+				}
+				cc.tracker.indexed(event.TransactionID)
+				cc.consistency.applied(event.TransactionID, cc.name, event.EventName, event.BlockNumber)
+			}(event)
 		}
 	}
 }
@@ -4,12 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/Cealgull/Middleware/internal/fabric/common/mocks"
 	"github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/rest"
 	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/stretchr/testify/assert"
 )
 
 func NewMockChaincodeMiddleware(t *testing.T) (*ChaincodeMiddleware, *mocks.MockNetwork) {
@@ -21,6 +25,17 @@ func NewMockChaincodeMiddleware(t *testing.T) (*ChaincodeMiddleware, *mocks.Mock
 func TestChaincodeMiddlewareRegister(t *testing.T) {
 	var m, _ = NewMockChaincodeMiddleware(t)
 	m.Register(server.Group("/api"), server)
+
+	policyOf := func(method string, path string) rest.AuthPolicy {
+		c := server.NewContext(httptest.NewRequest(method, path, nil), httptest.NewRecorder())
+		server.Router().Find(method, path, c)
+		return rest.PolicyOf(c)
+	}
+
+	assert.Equal(t, rest.AuthOptional, policyOf(http.MethodPost, "/auth/logout"))
+	assert.Equal(t, rest.AuthRequired, policyOf(http.MethodPost, "/auth/login"))
+	assert.Equal(t, rest.AuthRequired, policyOf(http.MethodPost, "/api/invoke/create"))
+	assert.Equal(t, rest.AuthRequired, policyOf(http.MethodPost, "/api/query/profile"))
 }
 
 func TestChaincodeMiddlewareListen(t *testing.T) {
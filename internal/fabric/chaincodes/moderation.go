@@ -0,0 +1,132 @@
+package chaincodes
+
+import (
+	"github.com/Cealgull/Middleware/internal/fabric/common"
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/rest"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+type moderationRequest struct {
+	Hash string `json:"hash"`
+}
+
+// review moves pending held content of source to status, so that only one
+// moderator decides on it.
+func review(db *gorm.DB, source string, hash string, reviewer string, status string) (*HeldContent, error) {
+
+	held := HeldContent{}
+
+	if err := db.Where("hash = ? AND source_type = ? AND status = ?", hash, source, ModerationPending).
+		First(&held).Error; err != nil {
+		return nil, err
+	}
+
+	result := db.Model(&HeldContent{}).
+		Where("id = ? AND status = ?", held.ID, ModerationPending).
+		Updates(map[string]interface{}{"status": status, "reviewer_wallet": reviewer})
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	return &held, nil
+}
+
+// invokeApproveHeld submits held content of source with function, as it
+// would have been without screening.
+func invokeApproveHeld(logger *zap.Logger, db *gorm.DB, source string, function string) ChaincodeInvoke {
+
+	return func(contract common.Contract, c echo.Context) error {
+
+		request := moderationRequest{}
+
+		if err := c.Bind(&request); err != nil {
+			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
+		}
+
+		held, err := review(db, source, request.Hash, rest.WalletOf(c), ModerationApproved)
+
+		if err != nil {
+			chaincodeNotFoundError := ChaincodeNotFoundError{"held content"}
+			return c.JSON(chaincodeNotFoundError.Status(), chaincodeNotFoundError.Message())
+		}
+
+		if _, err := contract.Submit(function, client.WithBytesArguments(held.Block)); err != nil {
+
+			if err := db.Model(held).Updates(map[string]interface{}{"status": ModerationPending, "reviewer_wallet": ""}).Error; err != nil {
+				logger.Error("Failed to return held content to the queue", zap.String("hash", held.Hash), zap.Error(err))
+			}
+
+			chaincodeInvokeFailure := ChaincodeInvokeFailureError{function}
+			return c.JSON(chaincodeInvokeFailure.Status(), chaincodeInvokeFailure.Message())
+		}
+
+		return c.JSON(success.Status(), success.Message())
+	}
+}
+
+func invokeRejectHeld(logger *zap.Logger, db *gorm.DB, source string) ChaincodeInvoke {
+
+	return func(contract common.Contract, c echo.Context) error {
+
+		request := moderationRequest{}
+
+		if err := c.Bind(&request); err != nil {
+			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
+		}
+
+		if _, err := review(db, source, request.Hash, rest.WalletOf(c), ModerationRejected); err != nil {
+			chaincodeNotFoundError := ChaincodeNotFoundError{"held content"}
+			return c.JSON(chaincodeNotFoundError.Status(), chaincodeNotFoundError.Message())
+		}
+
+		return c.JSON(success.Status(), success.Message())
+	}
+}
+
+// queryHeldList lists the moderation queue of source, oldest first.
+func queryHeldList(logger *zap.Logger, db *gorm.DB, source string) ChaincodeQuery {
+
+	return func(c echo.Context) error {
+
+		type HeldQuery struct {
+			PageOrdinal int    `json:"pageOrdinal"`
+			PageSize    int    `json:"pageSize"`
+			Status      string `json:"status"`
+		}
+
+		q := HeldQuery{}
+
+		if c.Bind(&q) != nil {
+			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
+		}
+
+		if q.PageOrdinal <= 0 || q.PageSize <= 0 {
+			return c.JSON(chaincodeQueryParameterError.Status(), chaincodeQueryParameterError.Message())
+		}
+
+		if q.Status == "" {
+			q.Status = ModerationPending
+		}
+
+		held := []*HeldContent{}
+
+		if err := db.Model(&HeldContent{}).
+			Where("source_type = ? AND status = ?", source, q.Status).
+			Scopes(paginate(q.PageOrdinal, q.PageSize)).
+			Order("created_at ASC").
+			Find(&held).Error; err != nil {
+			return c.JSON(chaincodeInternalError.Status(), chaincodeInternalError.Message())
+		}
+
+		return c.JSON(success.Status(), held)
+	}
+}
@@ -0,0 +1,148 @@
+package chaincodes
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Cealgull/Middleware/internal/config"
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	fabricmock "github.com/Cealgull/Middleware/internal/fabric/common/mocks"
+	ipfsmock "github.com/Cealgull/Middleware/internal/ipfs/mocks"
+)
+
+func TestModerationQueue(t *testing.T) {
+
+	type TopicRequest struct {
+		Content  string   `json:"content"`
+		Title    string   `json:"title"`
+		Category string   `json:"category"`
+		Tags     []string `json:"tags"`
+	}
+
+	type TopicResponse struct {
+		Hash string `json:"hash"`
+		Held bool   `json:"held"`
+	}
+
+	storage := ipfsmock.NewMockIPFSStorage(t)
+	storage.EXPECT().Version().Return("abcd", "abcd", nil).Once()
+	storage.On("Add", mock.Anything).Return("held", nil)
+
+	ipfs := NewMockIPFSManager(storage)
+
+	contract := fabricmock.NewMockContract()
+
+	db := prepareTopicData(t)
+
+	screen := NewScreener(db, &config.ScreeningConfig{})
+
+	createTopic := invokeCreateTopic(logger, ipfs, db, screen)
+	approve := invokeApproveHeld(logger, db, "topics", "CreateTopic")
+	reject := invokeRejectHeld(logger, db, "topics")
+	list := queryHeldList(logger, db, "topics")
+
+	call := func(handler func(c echo.Context) error, payload interface{}) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", newJsonRequest(payload))
+		req.Header.Add(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := newMockSignedContext(server.NewContext(req, rec))
+		assert.NoError(t, handler(c))
+		return rec
+	}
+
+	hold := func(content string) string {
+
+		rec := call(func(c echo.Context) error { return createTopic(contract, c) }, &TopicRequest{
+			Content:  content,
+			Title:    "Held topic",
+			Category: "Mihoyo",
+			Tags:     []string{"Genshin Impact"},
+		})
+
+		assert.Equal(t, http.StatusAccepted, rec.Code)
+
+		response := TopicResponse{}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		assert.True(t, response.Held)
+
+		return response.Hash
+	}
+
+	first := hold(strings.Repeat("PLEASE READ THIS ", 3))
+	second := hold(strings.Repeat("READ THIS NOW ", 3))
+
+	t.Run("Creating Held Topic Twice", func(t *testing.T) {
+
+		rec := call(func(c echo.Context) error { return createTopic(contract, c) }, &TopicRequest{
+			Content:  strings.Repeat("PLEASE READ THIS ", 3),
+			Title:    "Held topic",
+			Category: "Mihoyo",
+			Tags:     []string{"Genshin Impact"},
+		})
+
+		assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	})
+
+	t.Run("Listing Held Topics", func(t *testing.T) {
+
+		rec := call(list, map[string]int{"pageOrdinal": 0, "pageSize": 10})
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+		rec = call(list, map[string]int{"pageOrdinal": 1, "pageSize": 10})
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		held := []map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &held))
+		assert.Len(t, held, 2)
+		assert.Equal(t, first, held[0]["hash"])
+		assert.Equal(t, ModerationPending, held[0]["status"])
+	})
+
+	t.Run("Approving Held Topic With Chaincode Failure", func(t *testing.T) {
+
+		contract.On("Submit", "CreateTopic", mock.Anything).Return([]byte(nil), errors.New("Hello world")).Once()
+
+		rec := call(func(c echo.Context) error { return approve(contract, c) }, &moderationRequest{first})
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+		held := HeldContent{}
+		assert.NoError(t, db.Where("hash = ?", first).First(&held).Error)
+		assert.Equal(t, ModerationPending, held.Status)
+	})
+
+	t.Run("Approving Held Topic", func(t *testing.T) {
+
+		contract.On("Submit", "CreateTopic", mock.Anything).Return([]byte{}, nil).Once()
+
+		rec := call(func(c echo.Context) error { return approve(contract, c) }, &moderationRequest{first})
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		held := HeldContent{}
+		assert.NoError(t, db.Where("hash = ?", first).First(&held).Error)
+		assert.Equal(t, ModerationApproved, held.Status)
+		assert.Equal(t, "0x123456789", held.ReviewerWallet)
+
+		rec = call(func(c echo.Context) error { return approve(contract, c) }, &moderationRequest{first})
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Rejecting Held Topic", func(t *testing.T) {
+
+		rec := call(func(c echo.Context) error { return reject(contract, c) }, &moderationRequest{second})
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		rec = call(func(c echo.Context) error { return reject(contract, c) }, &moderationRequest{second})
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+		rec = call(list, map[string]int{"pageOrdinal": 1, "pageSize": 10})
+		assert.Equal(t, "[]\n", rec.Body.String())
+	})
+}
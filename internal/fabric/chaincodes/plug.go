@@ -6,8 +6,8 @@ import (
 	"github.com/Cealgull/Middleware/internal/fabric/common"
 	"github.com/Cealgull/Middleware/internal/ipfs"
 	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/rest"
 	"github.com/hyperledger/fabric-gateway/pkg/client"
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
@@ -28,8 +28,7 @@ func invokeCreateTag(logger *zap.Logger, db *gorm.DB) ChaincodeInvoke {
 			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
 		}
 
-		s, _ := session.Get("session", c)
-		wallet := s.Values["wallet"].(string)
+		wallet := rest.WalletOf(c)
 
 		tagBlock := TagBlock{
 			Name:          tagRequest.Name,
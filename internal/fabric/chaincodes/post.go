@@ -2,23 +2,22 @@ package chaincodes
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/base64"
 	"encoding/json"
+	"net/http"
 	"time"
 
 	"github.com/Cealgull/Middleware/internal/fabric/common"
 	"github.com/Cealgull/Middleware/internal/ipfs"
 	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/rest"
 	"github.com/Cealgull/Middleware/internal/utils"
 	"github.com/hyperledger/fabric-gateway/pkg/client"
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 )
 
-func invokeCreatePost(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB) ChaincodeInvoke {
+func invokeCreatePost(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB, screen *Screener) ChaincodeInvoke {
 	return func(contract common.Contract, c echo.Context) error {
 
 		type PostRequest struct {
@@ -30,8 +29,7 @@ func invokeCreatePost(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB) C
 
 		postRequest := PostRequest{}
 
-		s, _ := session.Get("session", c)
-		wallet := s.Values["wallet"].(string)
+		wallet := rest.WalletOf(c)
 
 		if err := c.Bind(&postRequest); err != nil {
 			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
@@ -41,7 +39,7 @@ func invokeCreatePost(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB) C
 
 		if postRequest.ReplyTo != "" {
 			if err := db.Model(&Post{}).
-				Where("hash = ?", postRequest.ReplyTo).First(&replyPost).Error; err != nil {
+				Scopes(byHash(postRequest.ReplyTo)).First(&replyPost).Error; err != nil {
 				chaincodeFieldValidationError := ChaincodeFieldValidationError{"replyTo"}
 				return c.JSON(chaincodeFieldValidationError.Status(), chaincodeFieldValidationError.Message())
 			}
@@ -50,15 +48,16 @@ func invokeCreatePost(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB) C
 		belongTopic := Topic{}
 
 		if err := db.Model(&Topic{}).
-			Where("hash = ?", postRequest.BelongTo).First(&belongTopic).Error; err != nil {
+			Scopes(byHash(postRequest.BelongTo)).First(&belongTopic).Error; err != nil {
 			chaincodeFieldValidationError := ChaincodeFieldValidationError{"belongTo"}
 			return c.JSON(chaincodeFieldValidationError.Status(), chaincodeFieldValidationError.Message())
 		}
 
-		ts := []byte(time.Now().String())
-		ts = append(ts, []byte(wallet)...)
+		verdict, err := screen.screen(wallet, "", postRequest.Content)
 
-		hash := base64.StdEncoding.EncodeToString(sha256.New().Sum(append([]byte(postRequest.Content), ts...)))
+		if err != nil {
+			return c.JSON(err.Status(), err.Message())
+		}
 
 		CID, err := ipfs.Put(bytes.NewReader([]byte(postRequest.Content)))
 
@@ -67,25 +66,58 @@ func invokeCreatePost(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB) C
 		}
 
 		postBlock := PostBlock{
-			Hash:     hash,
-			Creator:  wallet,
-			CID:      CID,
-			ReplyTo:  postRequest.ReplyTo,
-			BelongTo: postRequest.BelongTo,
-			Assets:   postRequest.Images,
+			Creator:   wallet,
+			CID:       CID,
+			BelongTo:  belongTopic.LedgerHash(),
+			Assets:    postRequest.Images,
+			Timestamp: time.Now().UnixNano(),
+		}
+
+		if postRequest.ReplyTo != "" {
+			postBlock.ReplyTo = replyPost.LedgerHash()
 		}
 
+		hash := postBlock.ContentHash()
+		postBlock.Hash = hash
+
 		b, _ := json.Marshal(&postBlock)
 
+		type PostResponse struct {
+			Hash string `json:"hash"`
+			Held bool   `json:"held,omitempty"`
+		}
+
+		if err := screen.reserve(wallet, verdict); err != nil {
+			return c.JSON(err.Status(), err.Message())
+		}
+
+		if verdict.hold {
+
+			held := HeldContent{
+				Hash:          hash,
+				SourceType:    "posts",
+				CreatorWallet: wallet,
+				Content:       postRequest.Content,
+				CID:           CID,
+				Block:         b,
+			}
+
+			if err := screen.hold(&held, verdict); err != nil {
+				var _ = screen.release(wallet, verdict)
+				return c.JSON(err.Status(), err.Message())
+			}
+
+			return c.JSON(http.StatusAccepted, &PostResponse{Hash: hash, Held: true})
+		}
+
 		if _, err := contract.Submit("CreatePost", client.WithBytesArguments(b)); err != nil {
+			if err := screen.release(wallet, verdict); err != nil {
+				logger.Warn("Failed to release post fingerprint", zap.String("hash", hash), zap.Error(err))
+			}
 			chaincodeInvokeFailure := ChaincodeInvokeFailureError{"CreatePost"}
 			return c.JSON(chaincodeInvokeFailure.Status(), chaincodeInvokeFailure.Message())
 		}
 
-		type PostResponse struct {
-			Hash string `json:"hash"`
-		}
-
 		return c.JSON(success.Status(), &PostResponse{Hash: hash})
 	}
 }
@@ -102,20 +134,19 @@ func createPostCallback(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB)
 
 		if postBlock.ReplyTo != "" {
 			if err := db.Model(&Post{}).
-				Where("hash = ?", postBlock.ReplyTo).First(replyPost).Error; err != nil {
+				Scopes(byHash(postBlock.ReplyTo)).First(replyPost).Error; err != nil {
 				return err
 			}
 		} else {
 			replyPost = nil
 		}
 
-		assets := utils.Map(postBlock.Assets, func(image string) *Asset {
-			return &Asset{
-				CreatorWallet: postBlock.Creator,
-				CID:           image,
-				ContentType:   "image/jpeg",
-			}
-		})
+		belongTopic := Topic{}
+
+		if err := db.Model(&Topic{}).
+			Scopes(byHash(postBlock.BelongTo)).First(&belongTopic).Error; err != nil {
+			return err
+		}
 
 		data, err := ipfs.Cat(postBlock.CID)
 
@@ -123,19 +154,32 @@ func createPostCallback(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB)
 			return err
 		}
 
+		assets := utils.Map(postBlock.Assets, func(image string) *Asset {
+			return newAsset(ipfs, postBlock.Creator, image)
+		})
+
 		var _ = assets
 
 		post := Post{
 			Hash:          postBlock.Hash,
 			CreatorWallet: postBlock.Creator,
 			Content:       string(data),
+			CID:           postBlock.CID,
 
-			BelongToHash: postBlock.BelongTo,
+			BelongToHash: belongTopic.Hash,
 			Assets:       assets,
 		}
 
 		return db.Transaction(func(tx *gorm.DB) error {
 
+			mentions, err := resolveMentions(tx, postBlock.Creator, postBlock.Hash, post.Content)
+
+			if err != nil {
+				return err
+			}
+
+			post.Mentions = mentions
+
 			if err := tx.Create(&post).Error; err != nil {
 				return err
 			}
@@ -144,7 +188,7 @@ func createPostCallback(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB)
 				var _ = tx.Model(&post).Association("ReplyTo").Append(replyPost)
 			}
 
-			return nil
+			return notifyMentions(tx, "posts", post.Mentions, nil)
 		})
 	}
 }
@@ -163,12 +207,11 @@ func invokeDeletePost(logger *zap.Logger, db *gorm.DB) ChaincodeInvoke {
 			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
 		}
 
-		s, _ := session.Get("session", c)
-		wallet := s.Values["wallet"].(string)
+		wallet := rest.WalletOf(c)
 
 		post := Post{}
 		if err := db.Model(&Post{}).
-			Where("hash = ?", deleteRequest.Hash).First(&post).Error; err != nil {
+			Scopes(byHash(deleteRequest.Hash)).First(&post).Error; err != nil {
 			return err
 		}
 
@@ -178,7 +221,7 @@ func invokeDeletePost(logger *zap.Logger, db *gorm.DB) ChaincodeInvoke {
 		}
 
 		deleteBlock := DeleteBlock{
-			Hash:    deleteRequest.Hash,
+			Hash:    post.LedgerHash(),
 			Creator: wallet,
 		}
 
@@ -204,7 +247,7 @@ func deletePostCallback(logger *zap.Logger, db *gorm.DB) ChaincodeEventCallback
 		return db.Transaction(func(tx *gorm.DB) error {
 
 			post := Post{}
-			if err := tx.Where("hash = ?", deleteBlock.Hash).First(&post).Error; err != nil {
+			if err := tx.Scopes(byHash(deleteBlock.Hash)).First(&post).Error; err != nil {
 				return err
 			}
 
@@ -228,7 +271,7 @@ func invokeUpdatePost(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB) C
 
 		post := Post{}
 		if err := db.Model(&Post{}).
-			Where("hash = ?", postRequest.Hash).First(&post).Error; err != nil {
+			Scopes(byHash(postRequest.Hash)).First(&post).Error; err != nil {
 			chaincodeFieldValidationError := ChaincodeFieldValidationError{"hash"}
 			return c.JSON(chaincodeFieldValidationError.Status(), chaincodeFieldValidationError.Message())
 		}
@@ -240,7 +283,7 @@ func invokeUpdatePost(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB) C
 		}
 
 		postBlock := PostBlock{
-			Hash:   postRequest.Hash,
+			Hash:   post.LedgerHash(),
 			CID:    CID,
 			Assets: postRequest.Images,
 		}
@@ -271,11 +314,7 @@ func updatePostCallback(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB)
 		}
 
 		assets := utils.FilterMap(postChanged.Assets, func(image string) *Asset {
-			return &Asset{
-				CreatorWallet: postChanged.Creator,
-				CID:           image,
-				ContentType:   "image/jpeg",
-			}
+			return newAsset(ipfs, postChanged.Creator, image)
 		}, func(image string) bool {
 			return image != NONE
 		})
@@ -287,7 +326,7 @@ func updatePostCallback(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB)
 		return db.Transaction(func(tx *gorm.DB) error {
 
 			if err := tx.Model(&Post{}).
-				Where("hash = ?", postChanged.Hash).First(&post).Error; err != nil {
+				Scopes(byHash(postChanged.Hash)).First(&post).Error; err != nil {
 				return err
 			}
 
@@ -295,8 +334,12 @@ func updatePostCallback(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB)
 				var _ = tx.Model(&post).Association("Assets").Replace(&assets)
 			}
 
+			if err := replaceMentions(tx, post.ID, "posts", post.CreatorWallet, post.Hash, string(data)); err != nil {
+				return err
+			}
+
 			return tx.Model(&post).
-				Updates(&Post{Content: string(data)}).Error
+				Updates(&Post{Content: string(data), CID: postChanged.CID}).Error
 
 		})
 	}
@@ -315,15 +358,14 @@ func invokeUpvotePost(logger *zap.Logger, db *gorm.DB) ChaincodeInvoke {
 
 		post := Post{}
 		if err := db.Model(&Post{}).
-			Where("hash = ?", upvoteRequest.Hash).First(&post).Error; err != nil {
+			Scopes(byHash(upvoteRequest.Hash)).First(&post).Error; err != nil {
 			return err
 		}
 
-		s, _ := session.Get("session", c)
-		wallet := s.Values["wallet"].(string)
+		wallet := rest.WalletOf(c)
 
 		upvoteBlock := UpvoteBlock{
-			Hash:    upvoteRequest.Hash,
+			Hash:    post.LedgerHash(),
 			Creator: wallet,
 		}
 		b, _ := json.Marshal(&upvoteBlock)
@@ -351,7 +393,7 @@ func upvotePostCallback(logger *zap.Logger, db *gorm.DB) ChaincodeEventCallback
 		if err := db.Model(&Post{}).
 			Preload("Upvotes").
 			Preload("Downvotes").
-			Where("hash = ?", upvoteBlock.Hash).First(&post).Error; err != nil {
+			Scopes(byHash(upvoteBlock.Hash)).First(&post).Error; err != nil {
 			return err
 		}
 
@@ -395,15 +437,14 @@ func invokeDownvotePost(logger *zap.Logger, db *gorm.DB) ChaincodeInvoke {
 
 		post := Post{}
 		if err := db.Model(&Post{}).
-			Where("hash = ?", downvoteRequest.Hash).First(&post).Error; err != nil {
+			Scopes(byHash(downvoteRequest.Hash)).First(&post).Error; err != nil {
 			return err
 		}
 
-		s, _ := session.Get("session", c)
-		wallet := s.Values["wallet"].(string)
+		wallet := rest.WalletOf(c)
 
 		downvoteBlock := DownvoteBlock{
-			Hash:    downvoteRequest.Hash,
+			Hash:    post.LedgerHash(),
 			Creator: wallet,
 		}
 		b, _ := json.Marshal(&downvoteBlock)
@@ -431,7 +472,7 @@ func downvotePostCallback(logger *zap.Logger, db *gorm.DB) ChaincodeEventCallbac
 		if err := db.Model(&Post{}).
 			Preload("Upvotes").
 			Preload("Downvotes").
-			Where("hash = ?", downvoteBlock.Hash).First(&post).Error; err != nil {
+			Scopes(byHash(downvoteBlock.Hash)).First(&post).Error; err != nil {
 			return err
 		}
 
@@ -465,10 +506,10 @@ func queryPostsList(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
 	return func(c echo.Context) error {
 
 		type QueryRequest struct {
-			PageOrdinal int    `json:"pageOrdinal"`
-			PageSize    int    `json:"pageSize"`
-			BelongTo    string `json:"belongTo"`
-			Creator     string `json:"creator"`
+			PageOrdinal int    `json:"pageOrdinal" query:"pageOrdinal"`
+			PageSize    int    `json:"pageSize" query:"pageSize"`
+			BelongTo    string `json:"belongTo" query:"belongTo"`
+			Creator     string `json:"creator" query:"creator"`
 		}
 
 		q := QueryRequest{}
@@ -477,7 +518,7 @@ func queryPostsList(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
 			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
 		}
 
-		if q.PageOrdinal <= 0 || q.PageSize <= 0 {
+		if !validPage(c, q.PageOrdinal, q.PageSize) {
 			return c.JSON(chaincodeQueryParameterError.Status(), chaincodeQueryParameterError.Message())
 		}
 
@@ -494,6 +535,8 @@ func queryPostsList(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
 				Preload("Downvotes").
 				Preload("BelongTo").
         Preload("Assets").
+				Preload("Mentions").
+				Preload("Mentions.Mentioned").
 				Scopes(paginate(q.PageOrdinal, q.PageSize))
 
 			if q.Creator != "" {
@@ -502,7 +545,7 @@ func queryPostsList(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
 
 			if q.BelongTo != "" {
 				tx = tx.
-					Where("belong_to_hash = ?", q.BelongTo)
+					Where("belong_to_hash IN (?)", db.Unscoped().Model(&Topic{}).Select("hash").Scopes(byHash(q.BelongTo)))
 			}
 
 			tx = tx.Where("deleted_at IS NULL")
@@ -516,10 +559,10 @@ func queryPostsList(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
 	}
 }
 
-func NewPostChaincodeMiddleware(logger *zap.Logger, net common.Network, ipfs *ipfs.IPFSManager, db *gorm.DB) *ChaincodeMiddleware {
+func NewPostChaincodeMiddleware(logger *zap.Logger, net common.Network, ipfs *ipfs.IPFSManager, db *gorm.DB, screen *Screener) *ChaincodeMiddleware {
 	return NewChaincodeMiddleware(logger, net, net.GetContract("post"),
 
-		WithChaincodeHandler("create", "CreatePost", invokeCreatePost(logger, ipfs, db), createPostCallback(logger, ipfs, db)),
+		WithChaincodeHandler("create", "CreatePost", invokeCreatePost(logger, ipfs, db, screen), createPostCallback(logger, ipfs, db)),
 		WithChaincodeHandler("update", "UpdatePost", invokeUpdatePost(logger, ipfs, db), updatePostCallback(logger, ipfs, db)),
 
 		WithChaincodeHandler("upvote", "UpvotePost", invokeUpvotePost(logger, db), upvotePostCallback(logger, db)),
@@ -527,5 +570,9 @@ func NewPostChaincodeMiddleware(logger *zap.Logger, net common.Network, ipfs *ip
 		WithChaincodeHandler("delete", "DeletePost", invokeDeletePost(logger, db), deletePostCallback(logger, db)),
 
 		WithChaincodeQueryPost("list", queryPostsList(logger, db)),
+
+		WithChaincodeInvoke("approve", invokeApproveHeld(logger, db, "posts", "CreatePost"), rest.AuthAdmin),
+		WithChaincodeInvoke("reject", invokeRejectHeld(logger, db, "posts"), rest.AuthAdmin),
+		WithChaincodeQueryPost("held", queryHeldList(logger, db, "posts"), rest.AuthAdmin),
 	)
 }
@@ -109,7 +109,7 @@ func TestInvokeCreatePost(t *testing.T) {
 
 	db := preparePostData(t)
 
-	createPost := invokeCreatePost(logger, ipfs, db)
+	createPost := invokeCreatePost(logger, ipfs, db, nil)
 
 	t.Run("Creating Post With Unmarshal Error", func(t *testing.T) {
 
@@ -574,11 +574,17 @@ func TestUpdatePostCallback(t *testing.T) {
 	t.Run("Creating Post Callback with success", func(t *testing.T) {
 
 		storage.EXPECT().Cat(postBlock.CID).Return(reader, nil)
+		storage.EXPECT().Cat("abcd").Return(io.NopCloser(bytes.NewReader([]byte("plain text"))), nil)
 
 		b, _ := json.Marshal(&postBlock)
 
 		err := updatePost(b)
 		assert.NoError(t, err)
+
+		asset := Asset{}
+		assert.NoError(t, db.Where(&Asset{CID: "abcd"}).Last(&asset).Error)
+		assert.Equal(t, "text/plain", asset.ContentType)
+		assert.Empty(t, asset.Thumbnail)
 	})
 
 	t.Run("Creating Post Callback with hash not found", func(t *testing.T) {
@@ -939,6 +945,6 @@ func TestNewPostChaincodeMiddleware(t *testing.T) {
 
 	db := newSqliteDB()
 	network.EXPECT().GetContract("post").Return(&client.Contract{}).Once()
-	var _ = NewPostChaincodeMiddleware(logger, network, ipfs, db)
+	var _ = NewPostChaincodeMiddleware(logger, network, ipfs, db, nil)
 
 }
@@ -0,0 +1,142 @@
+package chaincodes
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Cealgull/Middleware/internal/rest"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPublicMaxAge = time.Minute
+	maxPublicPageSize   = 100
+)
+
+// PublicEndpoint serves a read-only view of the forum under /api/public to
+// guests and crawlers. It runs the same queries as the chaincode routes and
+// lets clients and shared caches keep the responses for maxAge.
+type PublicEndpoint struct {
+	logger *zap.Logger
+	db     *gorm.DB
+	maxAge time.Duration
+}
+
+// NewPublicEndpoint caches responses for maxAge, or a minute when zero.
+// A negative maxAge turns caching off.
+func NewPublicEndpoint(logger *zap.Logger, db *gorm.DB, maxAge time.Duration) *PublicEndpoint {
+
+	if maxAge == 0 {
+		maxAge = defaultPublicMaxAge
+	}
+
+	return &PublicEndpoint{
+		logger: logger,
+		db:     db,
+		maxAge: maxAge,
+	}
+}
+
+func (p *PublicEndpoint) Register(e *echo.Echo) error {
+
+	g := e.Group("/api/public")
+
+	rest.Declare(e, rest.AuthPublic,
+		g.GET("/topics", p.cached(paged(queryTopicsList(p.logger, p.db)))),
+		g.GET("/topics/:hash", p.cached(queryTopicGet(p.logger, p.db))),
+		g.GET("/posts", p.cached(paged(queryPostsList(p.logger, p.db)))),
+		g.GET("/categories", p.cached(queryCategories(p.logger, p.db))),
+		g.GET("/tags", p.cached(queryTags(p.logger, p.db))),
+		g.GET("/users/:wallet", p.cached(queryPublicProfile(p.logger, p.db))),
+	)
+
+	return nil
+}
+
+// maxPageSizeKey holds the largest page size the list queries serve.
+const maxPageSizeKey = "_max_page_size"
+
+// paged bounds the page size anonymous callers may ask for. The list
+// queries check the bound once they bound their parameters, wherever those
+// came from.
+func paged(query ChaincodeQuery) ChaincodeQuery {
+	return func(c echo.Context) error {
+		c.Set(maxPageSizeKey, maxPublicPageSize)
+		return query(c)
+	}
+}
+
+// validPage tells whether a page ordinal and size are positive and the size
+// within the bound set by paged, if any.
+func validPage(c echo.Context, pageOrdinal int, pageSize int) bool {
+	if limit, ok := c.Get(maxPageSizeKey).(int); ok && pageSize > limit {
+		return false
+	}
+	return pageOrdinal > 0 && pageSize > 0
+}
+
+// bufferedWriter holds back a response until it is known whether the
+// client already has it.
+type bufferedWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// cached tags successful responses with an ETag over their body and answers
+// 304 Not Modified when the client sends it back.
+func (p *PublicEndpoint) cached(query ChaincodeQuery) echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		res := c.Response()
+		w := &bufferedWriter{ResponseWriter: res.Writer, status: http.StatusOK}
+
+		res.Writer = w
+		err := query(c)
+		res.Writer = w.ResponseWriter
+
+		if err != nil {
+			return err
+		}
+
+		if w.status == http.StatusOK {
+
+			sum := sha256.Sum256(w.body.Bytes())
+			etag := `W/"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+
+			header := res.Header()
+			header.Set("ETag", etag)
+
+			if p.maxAge > 0 {
+				header.Set(echo.HeaderCacheControl, "public, max-age="+strconv.Itoa(int(p.maxAge.Seconds())))
+			} else {
+				header.Set(echo.HeaderCacheControl, "no-cache")
+			}
+
+			if c.Request().Header.Get("If-None-Match") == etag {
+				header.Del(echo.HeaderContentType)
+				res.Status = http.StatusNotModified
+				res.Writer.WriteHeader(http.StatusNotModified)
+				return nil
+			}
+		}
+
+		res.Writer.WriteHeader(w.status)
+		_, err = res.Writer.Write(w.body.Bytes())
+		return err
+	}
+}
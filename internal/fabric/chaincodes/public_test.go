@@ -0,0 +1,115 @@
+package chaincodes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/rest"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func get(e *echo.Echo, path string, etag string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPublicEndpoint(t *testing.T) {
+
+	db := prepareTopicData(t)
+	assert.NoError(t, db.Create(&Profile{Balance: 42, UserWallet: func(s string) *string { return &s }("0x123456789")}).Error)
+
+	e := echo.New()
+	assert.NoError(t, NewPublicEndpoint(logger, db, 0).Register(e))
+
+	t.Run("Routes are public", func(t *testing.T) {
+		for _, path := range []string{
+			"/api/public/topics", "/api/public/topics/:hash", "/api/public/posts",
+			"/api/public/categories", "/api/public/tags", "/api/public/users/:wallet",
+		} {
+			c := e.NewContext(httptest.NewRequest(http.MethodGet, path, nil), httptest.NewRecorder())
+			e.Router().Find(http.MethodGet, path, c)
+			assert.Equal(t, rest.AuthPublic, rest.PolicyOf(c), path)
+		}
+	})
+
+	t.Run("List topics from query parameters", func(t *testing.T) {
+		rec := get(e, "/api/public/topics?pageOrdinal=1&pageSize=2", "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "public, max-age=60", rec.Header().Get(echo.HeaderCacheControl))
+		assert.NotEmpty(t, rec.Header().Get("ETag"))
+
+		topics := []map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &topics))
+		assert.Len(t, topics, 2)
+	})
+
+	t.Run("Unchanged responses are not sent again", func(t *testing.T) {
+		etag := get(e, "/api/public/tags", "").Header().Get("ETag")
+
+		rec := get(e, "/api/public/tags", etag)
+		assert.Equal(t, http.StatusNotModified, rec.Code)
+		assert.Empty(t, rec.Body.Bytes())
+
+		rec = get(e, "/api/public/tags", `W/"stale"`)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NotEmpty(t, rec.Body.Bytes())
+	})
+
+	t.Run("Page size is bounded", func(t *testing.T) {
+		rec := get(e, "/api/public/posts?pageOrdinal=1&pageSize=1000", "")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/public/topics", strings.NewReader(`{"pageOrdinal":1,"pageSize":1000}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec = httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Errors are not cached", func(t *testing.T) {
+		rec := get(e, "/api/public/topics/topic5", "")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Empty(t, rec.Header().Get("ETag"))
+
+		rec = get(e, "/api/public/topics/topic1", "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("Profiles leave out the balance", func(t *testing.T) {
+		rec := get(e, "/api/public/users/0x123456789", "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		profile := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &profile))
+		assert.Equal(t, "0x123456789", profile["wallet"])
+		assert.NotContains(t, profile, "balance")
+
+		// the owner still sees it
+		owner, _ := loadProfile(db, "0x123456789")
+		b, _ := json.Marshal(owner)
+		assert.Contains(t, string(b), `"balance":42`)
+
+		rec = get(e, "/api/public/users/0x404", "")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Caching can be turned off", func(t *testing.T) {
+		e := echo.New()
+		assert.NoError(t, NewPublicEndpoint(logger, db, -time.Second).Register(e))
+
+		rec := get(e, "/api/public/categories", "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "no-cache", rec.Header().Get(echo.HeaderCacheControl))
+	})
+}
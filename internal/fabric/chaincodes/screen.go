@@ -0,0 +1,313 @@
+package chaincodes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/Cealgull/Middleware/internal/config"
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/proto"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultMaxLinks        = 2
+	defaultNewAccountAge   = 7 * 24 * time.Hour
+	defaultDuplicateWindow = 24 * time.Hour
+	defaultHoldScore       = 0.5
+	defaultRejectScore     = 0.9
+)
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+
+// ContentScorer rates how likely content is spam, from 0 for clean content
+// to 1 for certain spam.
+type ContentScorer interface {
+	Score(wallet string, title string, content string) float64
+}
+
+// ContentScorerFunc adapts a function to a ContentScorer.
+type ContentScorerFunc func(wallet string, title string, content string) float64
+
+func (f ContentScorerFunc) Score(wallet string, title string, content string) float64 {
+	return f(wallet, title, content)
+}
+
+// shoutingScorer holds content written mostly in capitals.
+var shoutingScorer = ContentScorerFunc(func(wallet string, title string, content string) float64 {
+
+	letters, upper := 0, 0
+
+	for _, r := range title + content {
+		if unicode.IsLetter(r) && (unicode.IsUpper(r) || unicode.IsLower(r)) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+
+	if letters < 20 || upper*10 < letters*8 {
+		return 0
+	}
+
+	return 0.6
+})
+
+// Screener checks topics and posts before they are submitted. Content with
+// banned words, too many links from a new account or sent twice by the same
+// wallet is rejected, and content the scorers find suspicious is held for
+// moderators.
+type Screener struct {
+	db              *gorm.DB
+	banned          *regexp.Regexp
+	maxLinks        int
+	newAccountAge   time.Duration
+	duplicateWindow time.Duration
+	holdScore       float64
+	rejectScore     float64
+	scorers         []ContentScorer
+	now             func() time.Time
+
+	mu       sync.Mutex
+	reserves int
+}
+
+type ScreenerOption func(s *Screener)
+
+// WithContentScorer adds a scorer to the built-in ones. The highest score
+// of all scorers decides.
+func WithContentScorer(scorer ContentScorer) ScreenerOption {
+	return func(s *Screener) {
+		s.scorers = append(s.scorers, scorer)
+	}
+}
+
+// bannedPattern matches any of words case-insensitively. Words starting or
+// ending in a letter or digit only match whole words.
+func bannedPattern(words []string) *regexp.Regexp {
+
+	alternatives := []string{}
+
+	for _, word := range words {
+
+		word = strings.TrimSpace(word)
+
+		if word == "" {
+			continue
+		}
+
+		pattern := regexp.QuoteMeta(word)
+		runes := []rune(word)
+
+		if isWordRune(runes[0]) {
+			pattern = `\b` + pattern
+		}
+
+		if isWordRune(runes[len(runes)-1]) {
+			pattern = pattern + `\b`
+		}
+
+		alternatives = append(alternatives, pattern)
+	}
+
+	if len(alternatives) == 0 {
+		return nil
+	}
+
+	return regexp.MustCompile(`(?i)(?:` + strings.Join(alternatives, "|") + `)`)
+}
+
+func isWordRune(r rune) bool {
+	return r < unicode.MaxASCII && (r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// NewScreener screens with the given configuration, where zero values pick
+// the defaults and a negative link limit lifts it.
+func NewScreener(db *gorm.DB, cfg *config.ScreeningConfig, options ...ScreenerOption) *Screener {
+
+	s := Screener{
+		db:              db,
+		banned:          bannedPattern(cfg.BannedWords),
+		maxLinks:        cfg.MaxLinks,
+		newAccountAge:   cfg.NewAccountAge,
+		duplicateWindow: cfg.DuplicateWindow,
+		holdScore:       cfg.HoldScore,
+		rejectScore:     cfg.RejectScore,
+		scorers:         []ContentScorer{shoutingScorer},
+		now:             time.Now,
+	}
+
+	if s.maxLinks == 0 {
+		s.maxLinks = defaultMaxLinks
+	}
+
+	if s.newAccountAge <= 0 {
+		s.newAccountAge = defaultNewAccountAge
+	}
+
+	if s.duplicateWindow <= 0 {
+		s.duplicateWindow = defaultDuplicateWindow
+	}
+
+	if s.holdScore <= 0 {
+		s.holdScore = defaultHoldScore
+	}
+
+	if s.rejectScore <= 0 {
+		s.rejectScore = defaultRejectScore
+	}
+
+	for _, option := range options {
+		option(&s)
+	}
+
+	return &s
+}
+
+// screening is the outcome of screening accepted content.
+type screening struct {
+	digest string
+	bucket int64
+	hold   bool
+	reason string
+	score  float64
+}
+
+// fingerprint digests content ignoring case and spacing, so that trivial
+// edits still count as the same content.
+func fingerprint(title string, content string) string {
+	normalized := strings.Join(strings.Fields(strings.ToLower(title+"\n"+content)), " ")
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// screen rejects content with an error or tells whether to hold it. A nil
+// Screener accepts everything.
+func (s *Screener) screen(wallet string, title string, content string) (*screening, proto.MiddlewareError) {
+
+	if s == nil {
+		return &screening{}, nil
+	}
+
+	text := title + "\n" + content
+
+	if s.banned != nil && s.banned.MatchString(text) {
+		return nil, &ChaincodeRejectedContentError{"banned words"}
+	}
+
+	if s.maxLinks >= 0 && len(linkPattern.FindAllStringIndex(text, s.maxLinks+1)) > s.maxLinks {
+
+		user := User{}
+
+		if err := s.db.Model(&User{}).Where("wallet = ?", wallet).First(&user).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, chaincodeInternalError
+		}
+
+		// Wallets without a profile count as new accounts.
+		if user.CreatedAt.IsZero() || s.now().Sub(user.CreatedAt) < s.newAccountAge {
+			return nil, &ChaincodeRejectedContentError{"too many links"}
+		}
+	}
+
+	result := screening{digest: fingerprint(title, content)}
+
+	var duplicates int64
+
+	if err := s.db.Model(&ContentFingerprint{}).
+		Where("creator_wallet = ? AND digest = ? AND created_at > ?", wallet, result.digest, s.now().Add(-s.duplicateWindow)).
+		Count(&duplicates).Error; err != nil {
+		return nil, chaincodeInternalError
+	}
+
+	if duplicates != 0 {
+		return nil, &ChaincodeRejectedContentError{"duplicate content"}
+	}
+
+	for _, scorer := range s.scorers {
+		if score := scorer.Score(wallet, title, content); score > result.score {
+			result.score = score
+		}
+	}
+
+	if result.score >= s.rejectScore {
+		return nil, &ChaincodeRejectedContentError{"spam"}
+	}
+
+	if result.score >= s.holdScore {
+		result.hold = true
+		result.reason = "suspected spam"
+	}
+
+	return &result, nil
+}
+
+// reserve records the fingerprint of content about to be submitted or held.
+// Fingerprints are unique per wallet and duplicate window, so of concurrent
+// requests with the same content only one gets through.
+func (s *Screener) reserve(wallet string, result *screening) proto.MiddlewareError {
+
+	if s == nil {
+		return nil
+	}
+
+	now := s.now()
+	result.bucket = now.UnixNano() / int64(s.duplicateWindow)
+
+	reserved := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&ContentFingerprint{
+		CreatorWallet: wallet,
+		Digest:        result.digest,
+		Bucket:        result.bucket,
+		CreatedAt:     now,
+	})
+
+	if reserved.Error != nil {
+		return chaincodeInternalError
+	}
+
+	if reserved.RowsAffected == 0 {
+		return &ChaincodeRejectedContentError{"duplicate content"}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.reserves++; s.reserves%txSweepEvery == 0 {
+		var _ = s.db.Where("created_at < ?", now.Add(-s.duplicateWindow)).Delete(&ContentFingerprint{}).Error
+	}
+
+	return nil
+}
+
+// release forgets a reserved fingerprint whose content was not accepted, so
+// that it can be sent again.
+func (s *Screener) release(wallet string, result *screening) error {
+
+	if s == nil {
+		return nil
+	}
+
+	return s.db.Where("creator_wallet = ? AND digest = ? AND bucket = ?", wallet, result.digest, result.bucket).
+		Delete(&ContentFingerprint{}).Error
+}
+
+// hold puts content in the moderation queue instead of submitting block.
+func (s *Screener) hold(held *HeldContent, result *screening) proto.MiddlewareError {
+
+	held.Reason = result.reason
+	held.Score = result.score
+	held.Status = ModerationPending
+
+	if err := s.db.Create(held).Error; err != nil {
+		return chaincodeInternalError
+	}
+
+	return nil
+}
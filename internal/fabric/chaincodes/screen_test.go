@@ -0,0 +1,143 @@
+package chaincodes
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cealgull/Middleware/internal/config"
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestScreener(t *testing.T) {
+
+	db := newSqliteDB()
+
+	assert.NoError(t, db.Create(&[]*User{
+		{Username: "veteran", Wallet: "0xveteran", CreatedAt: time.Now().Add(-30 * 24 * time.Hour)},
+		{Username: "newcomer", Wallet: "0xnewcomer"},
+	}).Error)
+
+	screen := NewScreener(db, &config.ScreeningConfig{
+		BannedWords: []string{"casino", "免费"},
+	})
+
+	rejected := func(t *testing.T, err error, reason string) {
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), reason)
+		assert.Equal(t, http.StatusUnprocessableEntity, err.(*ChaincodeRejectedContentError).Status())
+	}
+
+	t.Run("Screening Banned Words", func(t *testing.T) {
+
+		_, err := screen.screen("0xveteran", "Best CASINO in town", "")
+		rejected(t, err, "banned words")
+
+		_, err = screen.screen("0xveteran", "", "领取免费礼包")
+		rejected(t, err, "banned words")
+
+		result, err := screen.screen("0xveteran", "", "casinos are only banned as a whole word")
+		assert.Nil(t, err)
+		assert.False(t, result.hold)
+	})
+
+	t.Run("Screening Links From New Accounts", func(t *testing.T) {
+
+		content := "see https://a.example, www.b.example and http://c.example"
+
+		_, err := screen.screen("0xnewcomer", "", content)
+		rejected(t, err, "too many links")
+
+		_, err = screen.screen("0xunknown", "", content)
+		rejected(t, err, "too many links")
+
+		_, err = screen.screen("0xveteran", "", content)
+		assert.Nil(t, err)
+
+		_, err = screen.screen("0xnewcomer", "", "only https://a.example and https://b.example")
+		assert.Nil(t, err)
+	})
+
+	t.Run("Screening Duplicates", func(t *testing.T) {
+
+		result, err := screen.screen("0xveteran", "Title", "Some  content")
+		assert.Nil(t, err)
+		assert.Nil(t, screen.reserve("0xveteran", result))
+
+		_, err = screen.screen("0xveteran", "title", "some content\n")
+		rejected(t, err, "duplicate content")
+
+		_, err = screen.screen("0xnewcomer", "Title", "Some content")
+		assert.Nil(t, err)
+
+		screen.now = func() time.Time { return time.Now().Add(2 * defaultDuplicateWindow) }
+		defer func() { screen.now = time.Now }()
+
+		_, err = screen.screen("0xveteran", "Title", "Some content")
+		assert.Nil(t, err)
+	})
+
+	t.Run("Reserving Concurrent Duplicates", func(t *testing.T) {
+
+		first, err := screen.screen("0xveteran", "", "sent twice at once")
+		assert.Nil(t, err)
+		second, err := screen.screen("0xveteran", "", "sent twice at once")
+		assert.Nil(t, err)
+
+		assert.Nil(t, screen.reserve("0xveteran", first))
+		rejected(t, screen.reserve("0xveteran", second), "duplicate content")
+
+		assert.NoError(t, screen.release("0xveteran", first))
+		assert.Nil(t, screen.reserve("0xveteran", second))
+	})
+
+	t.Run("Pruning Fingerprints", func(t *testing.T) {
+
+		stale := ContentFingerprint{CreatorWallet: "0xstale", Digest: "stale", CreatedAt: time.Now().Add(-2 * defaultDuplicateWindow)}
+		assert.NoError(t, db.Create(&stale).Error)
+
+		screen.reserves = txSweepEvery - 1
+
+		result, err := screen.screen("0xveteran", "", "pruning the stale fingerprints")
+		assert.Nil(t, err)
+		assert.Nil(t, screen.reserve("0xveteran", result))
+
+		assert.ErrorIs(t, db.First(&ContentFingerprint{}, stale.ID).Error, gorm.ErrRecordNotFound)
+	})
+
+	t.Run("Screening Scores", func(t *testing.T) {
+
+		result, err := screen.screen("0xveteran", "", strings.Repeat("LOUD AND CLEAR ", 4))
+		assert.Nil(t, err)
+		assert.True(t, result.hold)
+
+		scored := NewScreener(db, &config.ScreeningConfig{}, WithContentScorer(ContentScorerFunc(
+			func(wallet string, title string, content string) float64 {
+				if strings.Contains(content, "spam") {
+					return 1
+				}
+				return 0
+			})))
+
+		_, err = scored.screen("0xveteran", "", "spam spam spam")
+		rejected(t, err, "spam")
+
+		result, err = scored.screen("0xveteran", "", "ham")
+		assert.Nil(t, err)
+		assert.False(t, result.hold)
+	})
+
+	t.Run("Screening Without Screener", func(t *testing.T) {
+
+		var none *Screener
+
+		result, err := none.screen("0xveteran", "", "casino")
+		assert.Nil(t, err)
+		assert.False(t, result.hold)
+		assert.Nil(t, none.reserve("0xveteran", result))
+		assert.NoError(t, none.release("0xveteran", result))
+	})
+}
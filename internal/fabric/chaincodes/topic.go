@@ -2,17 +2,18 @@ package chaincodes
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"net/http"
 	"time"
 
 	"github.com/Cealgull/Middleware/internal/fabric/common"
 	"github.com/Cealgull/Middleware/internal/ipfs"
 	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/proto"
+	"github.com/Cealgull/Middleware/internal/rest"
 	"github.com/Cealgull/Middleware/internal/utils"
 	"github.com/hyperledger/fabric-gateway/pkg/client"
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
@@ -20,7 +21,28 @@ import (
 
 const NONE = "~~NONE~~"
 
-func invokeCreateTopic(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB) ChaincodeInvoke {
+const maxPollOptions = 16
+
+func validatePoll(poll *PollBlock) proto.MiddlewareError {
+
+	if poll == nil {
+		return nil
+	}
+
+	if len(poll.Options) < 2 || len(poll.Options) > maxPollOptions || !poll.CloseAt.After(time.Now()) {
+		return &ChaincodeFieldValidationError{"poll"}
+	}
+
+	for _, option := range poll.Options {
+		if option == "" {
+			return &ChaincodeFieldValidationError{"poll"}
+		}
+	}
+
+	return nil
+}
+
+func invokeCreateTopic(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB, screen *Screener) ChaincodeInvoke {
 
 	return func(contract common.Contract, c echo.Context) error {
 
@@ -30,12 +52,13 @@ func invokeCreateTopic(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB)
 			Title    string   `json:"title"`
 			Category string   `json:"category"`
 			Tags     []string `json:"tags"`
+
+			Poll *PollBlock `json:"poll"`
 		}
 
 		topicRequest := TopicRequest{}
 
-		s, _ := session.Get("session", c)
-		wallet := s.Values["wallet"].(string)
+		wallet := rest.WalletOf(c)
 
 		if err := c.Bind(&topicRequest); err != nil {
 			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
@@ -49,10 +72,15 @@ func invokeCreateTopic(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB)
 			return c.JSON(err.Status(), err.Message())
 		}
 
-		ts := []byte(time.Now().String())
-		ts = append(ts, []byte(wallet)...)
+		if err := validatePoll(topicRequest.Poll); err != nil {
+			return c.JSON(err.Status(), err.Message())
+		}
 
-		hash := base64.StdEncoding.EncodeToString(sha256.New().Sum(append([]byte(topicRequest.Content), ts...)))
+		verdict, err := screen.screen(wallet, topicRequest.Title, topicRequest.Content)
+
+		if err != nil {
+			return c.JSON(err.Status(), err.Message())
+		}
 
 		CID, err := ipfs.Put(bytes.NewReader([]byte(topicRequest.Content)))
 
@@ -61,26 +89,58 @@ func invokeCreateTopic(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB)
 		}
 
 		topicBlock := TopicBlock{
-			Title:    topicRequest.Title,
-			CID:      CID,
-			Hash:     hash,
-			Creator:  wallet,
-			Category: topicRequest.Category,
-			Tags:     topicRequest.Tags,
-			Images:   topicRequest.Images,
+			Title:     topicRequest.Title,
+			CID:       CID,
+			Creator:   wallet,
+			Category:  topicRequest.Category,
+			Tags:      topicRequest.Tags,
+			Images:    topicRequest.Images,
+			Poll:      topicRequest.Poll,
+			Timestamp: time.Now().UnixNano(),
 		}
 
+		hash := topicBlock.ContentHash()
+		topicBlock.Hash = hash
+
 		b, _ := json.Marshal(&topicBlock)
 
+		type TopicResponse struct {
+			Hash string `json:"hash"`
+			Held bool   `json:"held,omitempty"`
+		}
+
+		if err := screen.reserve(wallet, verdict); err != nil {
+			return c.JSON(err.Status(), err.Message())
+		}
+
+		if verdict.hold {
+
+			held := HeldContent{
+				Hash:          hash,
+				SourceType:    "topics",
+				CreatorWallet: wallet,
+				Title:         topicRequest.Title,
+				Content:       topicRequest.Content,
+				CID:           CID,
+				Block:         b,
+			}
+
+			if err := screen.hold(&held, verdict); err != nil {
+				var _ = screen.release(wallet, verdict)
+				return c.JSON(err.Status(), err.Message())
+			}
+
+			return c.JSON(http.StatusAccepted, &TopicResponse{Hash: hash, Held: true})
+		}
+
 		if _, err := contract.Submit("CreateTopic", client.WithBytesArguments(b)); err != nil {
+			if err := screen.release(wallet, verdict); err != nil {
+				logger.Warn("Failed to release topic fingerprint", zap.String("hash", hash), zap.Error(err))
+			}
 			chaincodeInvokeFailure := ChaincodeInvokeFailureError{"CreateTopic"}
 			return c.JSON(chaincodeInvokeFailure.Status(), chaincodeInvokeFailure.Message())
 		}
 
-		type TopicResponse struct {
-			Hash string `json:"hash"`
-		}
-
 		return c.JSON(success.Status(), &TopicResponse{Hash: hash})
 	}
 }
@@ -93,14 +153,6 @@ func createTopicCallback(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB
 
 		var _ = json.Unmarshal(payload, &topicBlock)
 
-		assets := utils.Map(topicBlock.Images, func(image string) *Asset {
-			return &Asset{
-				CreatorWallet: topicBlock.Creator,
-				CID:           image,
-				ContentType:   "image/jpeg",
-			}
-		})
-
 		tagsAssigned := utils.Map(topicBlock.Tags, func(t string) *TagRelation {
 			return &TagRelation{
 				TagName: t,
@@ -113,23 +165,48 @@ func createTopicCallback(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB
 			return err
 		}
 
+		assets := utils.Map(topicBlock.Images, func(image string) *Asset {
+			return newAsset(ipfs, topicBlock.Creator, image)
+		})
+
 		return db.Transaction(func(tx *gorm.DB) error {
 
 			topic := Topic{
 				Hash:             topicBlock.Hash,
 				Title:            topicBlock.Title,
 				Content:          string(data),
+				CID:              topicBlock.CID,
 				CreatorWallet:    topicBlock.Creator,
 				CategoryAssigned: &CategoryRelation{CategoryName: topicBlock.Category},
 				TagsAssigned:     tagsAssigned,
 				Assets:           assets,
 			}
 
+			if poll := topicBlock.Poll; poll != nil {
+				options := make([]*PollOption, len(poll.Options))
+				for i, content := range poll.Options {
+					options[i] = &PollOption{Ordinal: uint(i), Content: content}
+				}
+				topic.Poll = &Poll{
+					MultiChoice: poll.MultiChoice,
+					CloseAt:     poll.CloseAt,
+					Options:     options,
+				}
+			}
+
+			mentions, err := resolveMentions(tx, topicBlock.Creator, topicBlock.Hash, topic.Content)
+
+			if err != nil {
+				return err
+			}
+
+			topic.Mentions = mentions
+
 			if err := tx.Create(&topic).Error; err != nil {
 				return err
 			}
 
-			return nil
+			return notifyMentions(tx, "topics", topic.Mentions, nil)
 		})
 	}
 }
@@ -148,12 +225,11 @@ func invokeDeleteTopic(logger *zap.Logger, db *gorm.DB) ChaincodeInvoke {
 			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
 		}
 
-		s, _ := session.Get("session", c)
-		wallet := s.Values["wallet"].(string)
+		wallet := rest.WalletOf(c)
 
 		topic := Topic{}
 		if err := db.Model(&Topic{}).
-			Where("hash = ?", deleteRequest.Hash).First(&topic).Error; err != nil {
+			Scopes(byHash(deleteRequest.Hash)).First(&topic).Error; err != nil {
 			return err
 		}
 
@@ -163,7 +239,7 @@ func invokeDeleteTopic(logger *zap.Logger, db *gorm.DB) ChaincodeInvoke {
 		}
 
 		deleteBlock := DeleteBlock{
-			Hash:    deleteRequest.Hash,
+			Hash:    topic.LedgerHash(),
 			Creator: wallet,
 		}
 
@@ -189,7 +265,7 @@ func deleteTopicCallback(logger *zap.Logger, db *gorm.DB) ChaincodeEventCallback
 		return db.Transaction(func(tx *gorm.DB) error {
 
 			topic := Topic{}
-			if err := tx.Where("hash = ?", deleteBlock.Hash).First(&topic).Error; err != nil {
+			if err := tx.Scopes(byHash(deleteBlock.Hash)).First(&topic).Error; err != nil {
 				return err
 			}
 
@@ -224,7 +300,7 @@ func invokeUpdateTopic(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB)
 
 		topic := Topic{}
 		if err := db.Model(&Topic{}).
-			Where("hash = ?", topicRequest.Hash).First(&topic).Error; err != nil {
+			Scopes(byHash(topicRequest.Hash)).First(&topic).Error; err != nil {
 			return err
 		}
 
@@ -236,7 +312,7 @@ func invokeUpdateTopic(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB)
 
 		topicBlock := TopicBlock{
 			Title:    topicRequest.Title,
-			Hash:     topicRequest.Hash,
+			Hash:     topic.LedgerHash(),
 			CID:      CID,
 			Images:   topicRequest.Images,
 			Category: topicRequest.Category,
@@ -276,11 +352,7 @@ func updateTopicCallback(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB
 		})
 
 		assets := utils.FilterMap(topicChanged.Images, func(image string) *Asset {
-			return &Asset{
-				CreatorWallet: topicChanged.Creator,
-				CID:           image,
-				ContentType:   "image/jpeg",
-			}
+			return newAsset(ipfs, topicChanged.Creator, image)
 		}, func(t string) bool {
 			return t != NONE
 		})
@@ -290,12 +362,17 @@ func updateTopicCallback(logger *zap.Logger, ipfs *ipfs.IPFSManager, db *gorm.DB
 		return db.Transaction(func(tx *gorm.DB) error {
 
 			if err := tx.Model(&Topic{}).
-				Where("hash = ?", topicChanged.Hash).First(&topic).Error; err != nil {
+				Scopes(byHash(topicChanged.Hash)).First(&topic).Error; err != nil {
 				return err
 			}
 
 			topic.Title = topicChanged.Title
 			topic.Content = string(data)
+			topic.CID = topicChanged.CID
+
+			if err := replaceMentions(tx, topic.ID, "topics", topic.CreatorWallet, topic.Hash, topic.Content); err != nil {
+				return err
+			}
 
 			if topicChanged.Category != "" {
 				var _ = tx.Model(&topic).
@@ -331,15 +408,14 @@ func invokeUpvoteTopic(logger *zap.Logger, db *gorm.DB) ChaincodeInvoke {
 
 		topic := Topic{}
 		if err := db.Model(&Topic{}).
-			Where("hash = ?", upvoteRequest.Hash).First(&topic).Error; err != nil {
+			Scopes(byHash(upvoteRequest.Hash)).First(&topic).Error; err != nil {
 			return err
 		}
 
-		s, _ := session.Get("session", c)
-		wallet := s.Values["wallet"].(string)
+		wallet := rest.WalletOf(c)
 
 		upvoteBlock := UpvoteBlock{
-			Hash:    upvoteRequest.Hash,
+			Hash:    topic.LedgerHash(),
 			Creator: wallet,
 		}
 		b, _ := json.Marshal(&upvoteBlock)
@@ -367,7 +443,7 @@ func upvoteTopicCallback(logger *zap.Logger, db *gorm.DB) ChaincodeEventCallback
 		if err := db.Model(&Topic{}).
 			Preload("Upvotes").
 			Preload("Downvotes").
-			Where("hash = ?", upvoteBlock.Hash).First(&topic).Error; err != nil {
+			Scopes(byHash(upvoteBlock.Hash)).First(&topic).Error; err != nil {
 			return err
 		}
 
@@ -411,15 +487,14 @@ func invokeDownvoteTopic(logger *zap.Logger, db *gorm.DB) ChaincodeInvoke {
 
 		topic := Topic{}
 		if err := db.Model(&Topic{}).
-			Where("hash = ?", downvoteRequest.Hash).First(&topic).Error; err != nil {
+			Scopes(byHash(downvoteRequest.Hash)).First(&topic).Error; err != nil {
 			return err
 		}
 
-		s, _ := session.Get("session", c)
-		wallet := s.Values["wallet"].(string)
+		wallet := rest.WalletOf(c)
 
 		downvoteBlock := DownvoteBlock{
-			Hash:    downvoteRequest.Hash,
+			Hash:    topic.LedgerHash(),
 			Creator: wallet,
 		}
 		b, _ := json.Marshal(&downvoteBlock)
@@ -447,7 +522,7 @@ func downvoteTopicCallback(logger *zap.Logger, db *gorm.DB) ChaincodeEventCallba
 		if err := db.Model(&Topic{}).
 			Preload("Upvotes").
 			Preload("Downvotes").
-			Where("hash = ?", downvoteBlock.Hash).First(&topic).Error; err != nil {
+			Scopes(byHash(downvoteBlock.Hash)).First(&topic).Error; err != nil {
 			return err
 		}
 
@@ -477,6 +552,132 @@ func downvoteTopicCallback(logger *zap.Logger, db *gorm.DB) ChaincodeEventCallba
 	}
 }
 
+func invokeVoteTopic(logger *zap.Logger, db *gorm.DB) ChaincodeInvoke {
+	return func(contract common.Contract, c echo.Context) error {
+		type VoteRequest struct {
+			Hash    string `json:"hash"`
+			Options []uint `json:"options"`
+		}
+
+		voteRequest := VoteRequest{}
+		if err := c.Bind(&voteRequest); err != nil {
+			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
+		}
+
+		topic := Topic{}
+		if err := db.Model(&Topic{}).
+			Preload("Poll").
+			Preload("Poll.Options").
+			Scopes(byHash(voteRequest.Hash)).First(&topic).Error; err != nil {
+			chaincodeNotFoundError := ChaincodeNotFoundError{"topic"}
+			return c.JSON(chaincodeNotFoundError.Status(), chaincodeNotFoundError.Message())
+		}
+
+		if topic.Poll == nil {
+			chaincodeNotFoundError := ChaincodeNotFoundError{"poll"}
+			return c.JSON(chaincodeNotFoundError.Status(), chaincodeNotFoundError.Message())
+		}
+
+		if topic.Poll.Closed() {
+			chaincodeClosedError := ChaincodeClosedError{"poll"}
+			return c.JSON(chaincodeClosedError.Status(), chaincodeClosedError.Message())
+		}
+
+		chosen := map[uint]bool{}
+		for _, o := range voteRequest.Options {
+			if o >= uint(len(topic.Poll.Options)) || chosen[o] {
+				chaincodeFieldValidationError := ChaincodeFieldValidationError{"options"}
+				return c.JSON(chaincodeFieldValidationError.Status(), chaincodeFieldValidationError.Message())
+			}
+			chosen[o] = true
+		}
+
+		if len(chosen) == 0 || (!topic.Poll.MultiChoice && len(chosen) != 1) {
+			chaincodeFieldValidationError := ChaincodeFieldValidationError{"options"}
+			return c.JSON(chaincodeFieldValidationError.Status(), chaincodeFieldValidationError.Message())
+		}
+
+		wallet := rest.WalletOf(c)
+
+		if err := db.Model(&PollVote{}).
+			Where("poll_id = ? AND voter_wallet = ?", topic.Poll.ID, wallet).
+			First(&PollVote{}).Error; err == nil {
+			chaincodeDuplicatedError := ChaincodeDuplicatedError{"vote"}
+			return c.JSON(chaincodeDuplicatedError.Status(), chaincodeDuplicatedError.Message())
+		}
+
+		voteBlock := VoteBlock{
+			Hash:    topic.LedgerHash(),
+			Creator: wallet,
+			Options: voteRequest.Options,
+		}
+		b, _ := json.Marshal(&voteBlock)
+
+		// The chaincode rejects a second vote from the same wallet, the
+		// check above only saves an endorsement round trip.
+		if _, err := contract.Submit("VoteTopic", client.WithBytesArguments(b)); err != nil {
+			chaincodeInvokeFailure := ChaincodeInvokeFailureError{"VoteTopic"}
+			return c.JSON(chaincodeInvokeFailure.Status(), chaincodeInvokeFailure.Message())
+		}
+
+		return c.JSON(success.Status(), success.Message())
+	}
+}
+
+func voteTopicCallback(logger *zap.Logger, db *gorm.DB) ChaincodeEventCallback {
+
+	return func(payload []byte) error {
+
+		voteBlock := VoteBlock{}
+
+		if err := json.Unmarshal(payload, &voteBlock); err != nil {
+			return err
+		}
+
+		return db.Transaction(func(tx *gorm.DB) error {
+
+			topic := Topic{}
+
+			if err := tx.Model(&Topic{}).
+				Preload("Poll").
+				Scopes(byHash(voteBlock.Hash)).First(&topic).Error; err != nil {
+				return err
+			}
+
+			if topic.Poll == nil {
+				return errors.New("topic has no poll attached")
+			}
+
+			if err := tx.Model(&PollVote{}).
+				Where("poll_id = ? AND voter_wallet = ?", topic.Poll.ID, voteBlock.Creator).
+				First(&PollVote{}).Error; err == nil {
+				return nil
+			}
+
+			for _, o := range voteBlock.Options {
+
+				vote := PollVote{
+					PollID:      topic.Poll.ID,
+					Ordinal:     o,
+					VoterWallet: voteBlock.Creator,
+				}
+
+				if err := tx.Create(&vote).Error; err != nil {
+					return err
+				}
+
+				if err := tx.Model(&PollOption{}).
+					Where("poll_id = ? AND ordinal = ?", topic.Poll.ID, o).
+					Update("count", gorm.Expr("count + ?", 1)).Error; err != nil {
+					return err
+				}
+			}
+
+			return tx.Model(topic.Poll).Update("voters", gorm.Expr("voters + ?", 1)).Error
+		})
+	}
+}
+
 func queryCategories(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
 	return func(c echo.Context) error {
 		categories := []*Category{}
@@ -498,7 +699,7 @@ func queryTags(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
 func queryTopicGet(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
 	return func(c echo.Context) error {
 		type QueryRequest struct {
-			Hash string `json:"hash"`
+			Hash string `json:"hash" param:"hash"`
 		}
 
 		q := QueryRequest{}
@@ -518,7 +719,11 @@ func queryTopicGet(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
 				Preload("Upvotes").
 				Preload("Downvotes").
 				Preload("Assets").
-				Where("hash = ?", q.Hash)
+				Preload("Poll").
+				Preload("Poll.Options", func(db *gorm.DB) *gorm.DB { return db.Order("ordinal") }).
+				Preload("Mentions").
+				Preload("Mentions.Mentioned").
+				Scopes(byHash(q.Hash))
 
 			if err := tx.First(&topic).Error; err != nil {
 				return err
@@ -541,11 +746,11 @@ func queryTopicsList(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
 	return func(c echo.Context) error {
 
 		type QueryRequest struct {
-			PageOrdinal int      `json:"pageOrdinal"`
-			PageSize    int      `json:"pageSize"`
-			Category    string   `json:"category"`
-			Creator     string   `json:"creator"`
-			Tags        []string `json:"tags"`
+			PageOrdinal int      `json:"pageOrdinal" query:"pageOrdinal"`
+			PageSize    int      `json:"pageSize" query:"pageSize"`
+			Category    string   `json:"category" query:"category"`
+			Creator     string   `json:"creator" query:"creator"`
+			Tags        []string `json:"tags" query:"tags"`
 		}
 
 		q := QueryRequest{}
@@ -554,7 +759,7 @@ func queryTopicsList(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
 			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
 		}
 
-		if q.PageOrdinal <= 0 || q.PageSize <= 0 {
+		if !validPage(c, q.PageOrdinal, q.PageSize) {
 			return c.JSON(chaincodeQueryParameterError.Status(), chaincodeQueryParameterError.Message())
 		}
 
@@ -584,6 +789,10 @@ func queryTopicsList(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
 				Preload("Upvotes").
 				Preload("Downvotes").
 				Preload("Assets").
+				Preload("Poll").
+				Preload("Poll.Options", func(db *gorm.DB) *gorm.DB { return db.Order("ordinal") }).
+				Preload("Mentions").
+				Preload("Mentions.Mentioned").
 				Scopes(paginate(q.PageOrdinal, q.PageSize))
 
 			tx = tx.Where("deleted_at IS NULL")
@@ -596,19 +805,24 @@ func queryTopicsList(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
 	}
 }
 
-func NewTopicChaincodeMiddleware(logger *zap.Logger, net common.Network, ipfs *ipfs.IPFSManager, db *gorm.DB) *ChaincodeMiddleware {
+func NewTopicChaincodeMiddleware(logger *zap.Logger, net common.Network, ipfs *ipfs.IPFSManager, db *gorm.DB, screen *Screener) *ChaincodeMiddleware {
 	return NewChaincodeMiddleware(logger, net, net.GetContract("topic"),
 
-		WithChaincodeHandler("create", "CreateTopic", invokeCreateTopic(logger, ipfs, db), createTopicCallback(logger, ipfs, db)),
+		WithChaincodeHandler("create", "CreateTopic", invokeCreateTopic(logger, ipfs, db, screen), createTopicCallback(logger, ipfs, db)),
 		WithChaincodeHandler("update", "UpdateTopic", invokeUpdateTopic(logger, ipfs, db), updateTopicCallback(logger, ipfs, db)),
 
 		WithChaincodeHandler("delete", "DeleteTopic", invokeDeleteTopic(logger, db), deleteTopicCallback(logger, db)),
 
 		WithChaincodeHandler("upvote", "UpvoteTopic", invokeUpvoteTopic(logger, db), upvoteTopicCallback(logger, db)),
 		WithChaincodeHandler("downvote", "DownvoteTopic", invokeDownvoteTopic(logger, db), downvoteTopicCallback(logger, db)),
+		WithChaincodeHandler("vote", "VoteTopic", invokeVoteTopic(logger, db), voteTopicCallback(logger, db)),
 
-		WithChaincodeQueryGet("categories", queryCategories(logger, db)),
-		WithChaincodeQueryGet("tags", queryTags(logger, db)),
+		WithChaincodeQueryGet("categories", queryCategories(logger, db), rest.AuthPublic),
+		WithChaincodeQueryGet("tags", queryTags(logger, db), rest.AuthPublic),
 		WithChaincodeQueryPost("list", queryTopicsList(logger, db)),
+
+		WithChaincodeInvoke("approve", invokeApproveHeld(logger, db, "topics", "CreateTopic"), rest.AuthAdmin),
+		WithChaincodeInvoke("reject", invokeRejectHeld(logger, db, "topics"), rest.AuthAdmin),
+		WithChaincodeQueryPost("held", queryHeldList(logger, db, "topics"), rest.AuthAdmin),
 	)
 }
@@ -5,13 +5,17 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"image"
+	"image/png"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/Cealgull/Middleware/internal/ipfs"
 	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/utils"
 	"github.com/hyperledger/fabric-gateway/pkg/client"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
@@ -107,6 +111,8 @@ func TestInvokeCreateTopic(t *testing.T) {
 		Title    string   `json:"title"`
 		Category string   `json:"category"`
 		Tags     []string `json:"tags"`
+
+		Poll *PollBlock `json:"poll"`
 	}
 
 	payload := TopicRequest{
@@ -126,7 +132,7 @@ func TestInvokeCreateTopic(t *testing.T) {
 
 	db := prepareTopicData(t)
 
-	createTopic := invokeCreateTopic(logger, ipfs, db)
+	createTopic := invokeCreateTopic(logger, ipfs, db, nil)
 
 	t.Run("Creating Topic With Unmarshal Error", func(t *testing.T) {
 
@@ -216,6 +222,79 @@ func TestInvokeCreateTopic(t *testing.T) {
 
 	})
 
+	t.Run("Creating Topic With Invalid Poll", func(t *testing.T) {
+
+		payload.Poll = &PollBlock{
+			Options: []string{"Only one option"},
+			CloseAt: time.Now().Add(time.Hour),
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/api/topic/invoke/CreateTopic", newJsonRequest(&payload))
+		req.Header.Add(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		c := server.NewContext(req, rec)
+		c = newMockSignedContext(c)
+
+		err := createTopic(contract, c)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+		payload.Poll.Options = []string{"Genshin Impact", ""}
+
+		req = httptest.NewRequest(http.MethodPost, "/api/topic/invoke/CreateTopic", newJsonRequest(&payload))
+		req.Header.Add(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec = httptest.NewRecorder()
+
+		c = server.NewContext(req, rec)
+		c = newMockSignedContext(c)
+
+		err = createTopic(contract, c)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+		payload.Poll.Options = []string{"Genshin Impact", "Honkai Impact"}
+		payload.Poll.CloseAt = time.Now().Add(-time.Hour)
+
+		req = httptest.NewRequest(http.MethodPost, "/api/topic/invoke/CreateTopic", newJsonRequest(&payload))
+		req.Header.Add(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec = httptest.NewRecorder()
+
+		c = server.NewContext(req, rec)
+		c = newMockSignedContext(c)
+
+		err = createTopic(contract, c)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+		payload.Poll = nil
+	})
+
+	t.Run("Creating Topic With Poll", func(t *testing.T) {
+
+		payload.Poll = &PollBlock{
+			Options:     []string{"Genshin Impact", "Honkai Impact"},
+			MultiChoice: true,
+			CloseAt:     time.Now().Add(time.Hour),
+		}
+
+		storage.On("Add", mock.Anything).Return("base64", nil)
+
+		req := httptest.NewRequest(http.MethodPost, "/api/topic/invoke/CreateTopic", newJsonRequest(&payload))
+		req.Header.Add(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		c := server.NewContext(req, rec)
+		c = newMockSignedContext(c)
+
+		contract.On("Submit", "CreateTopic", mock.Anything).Return([]byte(nil), nil).Once()
+		err := createTopic(contract, c)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		payload.Poll = nil
+	})
+
 	t.Run("Creating Topic With Success", func(t *testing.T) {
 
 		payload.Images = []string{base64.StdEncoding.EncodeToString([]byte("base64Error&*"))}
@@ -233,6 +312,10 @@ func TestInvokeCreateTopic(t *testing.T) {
 		err := createTopic(contract, c)
 		assert.NoError(t, err)
 		assert.Equal(t, http.StatusOK, rec.Code)
+
+		response := map[string]string{}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		assert.True(t, IsContentHash(response["hash"]))
 	})
 }
 
@@ -294,6 +377,50 @@ func TestCreateTopicCallback(t *testing.T) {
 		assert.NoError(t, err)
 	})
 
+	t.Run("Creating Topic Callback with poll", func(t *testing.T) {
+
+		storage.EXPECT().Cat(topicBlock.CID).Return(io.NopCloser(bytes.NewReader([]byte("document"))), nil)
+		topicBlock.Hash = "poll"
+		topicBlock.Poll = &PollBlock{
+			Options: []string{"Genshin Impact", "Honkai Impact"},
+			CloseAt: time.Now().Add(time.Hour),
+		}
+
+		b, _ := json.Marshal(&topicBlock)
+
+		err := createTopic(b)
+		assert.NoError(t, err)
+
+		topic := Topic{}
+		assert.NoError(t, db.Preload("Poll").Preload("Poll.Options").Where("hash = ?", "poll").First(&topic).Error)
+		assert.NotNil(t, topic.Poll)
+		assert.Len(t, topic.Poll.Options, 2)
+	})
+
+	t.Run("Creating Topic Callback with mentions", func(t *testing.T) {
+
+		topicBlock.CID = "mention"
+		topicBlock.Hash = "mention"
+		storage.EXPECT().Cat(topicBlock.CID).Return(io.NopCloser(bytes.NewReader([]byte("Hello @User and @Admin"))), nil)
+		topicBlock.Poll = nil
+
+		b, _ := json.Marshal(&topicBlock)
+
+		err := createTopic(b)
+		assert.NoError(t, err)
+
+		topic := Topic{}
+		assert.NoError(t, db.Preload("Mentions").Preload("Mentions.Mentioned").Where("hash = ?", "mention").First(&topic).Error)
+		assert.Len(t, topic.Mentions, 2)
+
+		b, _ = json.Marshal(&topic)
+		assert.Contains(t, string(b), `"link":"/user/0x1000000"`)
+
+		var count int64
+		assert.NoError(t, db.Model(&Notification{}).Where("source_hash = ?", "mention").Count(&count).Error)
+		assert.Equal(t, int64(1), count)
+	})
+
 }
 
 func TestInvokeDeleteTopic(t *testing.T) {
@@ -601,12 +728,29 @@ func TestUpdateTopicCallback(t *testing.T) {
 
 	t.Run("Update Topic Callback with success", func(t *testing.T) {
 
+		img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+		buf := bytes.Buffer{}
+		var _ = png.Encode(&buf, img)
+
 		storage.EXPECT().Cat(topicBlock.CID).Return(reader, nil)
+		storage.EXPECT().Cat("abcd").Return(io.NopCloser(&buf), nil).Once()
+		storage.EXPECT().Add(mock.Anything).Return("thumb", nil).Once()
 
 		b, _ := json.Marshal(&topicBlock)
 
 		err := updateTopic(b)
 		assert.NoError(t, err)
+
+		asset := Asset{}
+		assert.NoError(t, db.Where(&Asset{CID: "abcd"}).Last(&asset).Error)
+		assert.Equal(t, "image/png", asset.ContentType)
+		assert.Equal(t, "thumb", asset.Thumbnail)
+		assert.Equal(t, 4, asset.Width)
+		assert.Equal(t, 2, asset.Height)
+
+		topic := Topic{}
+		assert.NoError(t, db.Where("hash = ?", topicBlock.Hash).First(&topic).Error)
+		assert.Equal(t, topicBlock.CID, topic.CID)
 	})
 
 }
@@ -881,6 +1025,180 @@ func TestDownvoteTopicCallback(t *testing.T) {
 
 }
 
+func preparePollData(t *testing.T, multiChoice bool, closeAt time.Time) *gorm.DB {
+
+	db := prepareTopicData(t)
+
+	assert.NoError(t, db.Create(&Topic{
+		Hash:          "poll",
+		Title:         "This is a testing poll",
+		CreatorWallet: "0x123456789",
+		Content:       "Hello world",
+		Poll: &Poll{
+			MultiChoice: multiChoice,
+			CloseAt:     closeAt,
+			Options: []*PollOption{
+				{Ordinal: 0, Content: "Genshin Impact"},
+				{Ordinal: 1, Content: "Honkai Impact"},
+				{Ordinal: 2, Content: "Zenless Zone Zero"},
+			},
+		},
+	}).Error)
+
+	return db
+}
+
+func TestInvokeVoteTopic(t *testing.T) {
+	type VoteRequest struct {
+		Hash    string `json:"hash"`
+		Options []uint `json:"options"`
+	}
+
+	payload := VoteRequest{
+		Hash:    "poll",
+		Options: []uint{1},
+	}
+
+	contract := fabricmock.NewMockContract()
+
+	db := preparePollData(t, false, time.Now().Add(time.Hour))
+
+	voteTopic := invokeVoteTopic(logger, db)
+
+	invoke := func(payload interface{}) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/topic/invoke/vote", newJsonRequest(payload))
+		req.Header.Add(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+
+		c := server.NewContext(req, rec)
+		c = newMockSignedContext(c)
+
+		assert.NoError(t, voteTopic(contract, c))
+		return rec
+	}
+
+	t.Run("Voting Topic With Unmarshal Error", func(t *testing.T) {
+
+		req := httptest.NewRequest(http.MethodPost, "/api/topic/invoke/vote", bytes.NewReader([]byte{1, 2, 3}))
+		rec := httptest.NewRecorder()
+
+		c := server.NewContext(req, rec)
+		c = newMockSignedContext(c)
+
+		err := voteTopic(contract, c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Voting Topic With Hash Error", func(t *testing.T) {
+		payload.Hash = "a111"
+		assert.Equal(t, http.StatusBadRequest, invoke(&payload).Code)
+		payload.Hash = "poll"
+	})
+
+	t.Run("Voting Topic Without Poll", func(t *testing.T) {
+		payload.Hash = "topic1"
+		assert.Equal(t, http.StatusBadRequest, invoke(&payload).Code)
+		payload.Hash = "poll"
+	})
+
+	t.Run("Voting Topic With Invalid Options", func(t *testing.T) {
+
+		payload.Options = []uint{3}
+		assert.Equal(t, http.StatusBadRequest, invoke(&payload).Code)
+
+		payload.Options = []uint{}
+		assert.Equal(t, http.StatusBadRequest, invoke(&payload).Code)
+
+		payload.Options = []uint{0, 0}
+		assert.Equal(t, http.StatusBadRequest, invoke(&payload).Code)
+
+		payload.Options = []uint{0, 1}
+		assert.Equal(t, http.StatusBadRequest, invoke(&payload).Code)
+
+		payload.Options = []uint{1}
+	})
+
+	t.Run("Voting Topic With Chaincode Network Failure", func(t *testing.T) {
+		contract.On("Submit", "VoteTopic", mock.Anything).Return([]byte(nil), errors.New("Hello world")).Once()
+		assert.Equal(t, http.StatusInternalServerError, invoke(&payload).Code)
+	})
+
+	t.Run("Voting Topic With Success", func(t *testing.T) {
+		contract.On("Submit", "VoteTopic", mock.Anything).Return([]byte(nil), nil).Once()
+		assert.Equal(t, http.StatusOK, invoke(&payload).Code)
+	})
+
+	t.Run("Voting Topic Twice", func(t *testing.T) {
+		b, _ := json.Marshal(&VoteBlock{Hash: "poll", Creator: "0x123456789", Options: []uint{1}})
+		assert.NoError(t, voteTopicCallback(logger, db)(b))
+		assert.Equal(t, http.StatusBadRequest, invoke(&payload).Code)
+	})
+
+	t.Run("Voting Topic With Closed Poll", func(t *testing.T) {
+		db := preparePollData(t, false, time.Now().Add(-time.Hour))
+		voteTopic = invokeVoteTopic(logger, db)
+		assert.Equal(t, http.StatusBadRequest, invoke(&payload).Code)
+	})
+}
+
+func TestVoteTopicCallback(t *testing.T) {
+
+	voteBlock := VoteBlock{
+		Hash:    "poll",
+		Creator: "0x123456789",
+		Options: []uint{0, 2},
+	}
+
+	db := preparePollData(t, true, time.Now().Add(time.Hour))
+
+	voteTopic := voteTopicCallback(logger, db)
+
+	t.Run("Voting Topic Callback with Unmarshal Error", func(t *testing.T) {
+		assert.Error(t, voteTopic([]byte{1, 2, 3}))
+	})
+
+	t.Run("Voting Topic Callback with hash not found", func(t *testing.T) {
+		voteBlock.Hash = "unknown"
+
+		b, _ := json.Marshal(&voteBlock)
+
+		assert.Error(t, voteTopic(b))
+		voteBlock.Hash = "poll"
+	})
+
+	t.Run("Voting Topic Callback without poll", func(t *testing.T) {
+		voteBlock.Hash = "topic1"
+
+		b, _ := json.Marshal(&voteBlock)
+
+		assert.Error(t, voteTopic(b))
+		voteBlock.Hash = "poll"
+	})
+
+	t.Run("Voting Topic Callback with success", func(t *testing.T) {
+
+		b, _ := json.Marshal(&voteBlock)
+
+		assert.NoError(t, voteTopic(b))
+
+		// Replaying the same event must not count the wallet twice
+		assert.NoError(t, voteTopic(b))
+
+		topic := Topic{}
+		assert.NoError(t, db.Preload("Poll").
+			Preload("Poll.Options", func(db *gorm.DB) *gorm.DB { return db.Order("ordinal") }).
+			Where("hash = ?", "poll").First(&topic).Error)
+
+		assert.Equal(t, uint(1), topic.Poll.Voters)
+		assert.Equal(t, []uint{1, 0, 1}, utils.Map(topic.Poll.Options, func(o *PollOption) uint { return o.Count }))
+
+		b, _ = json.Marshal(&topic)
+		assert.Contains(t, string(b), `"voters":1`)
+	})
+}
+
 func TestQueryCategories(t *testing.T) {
 	t.Run("Querying Categories With Success", func(t *testing.T) {
 
@@ -1052,6 +1370,6 @@ func TestNewTopicChaincodeMiddleware(t *testing.T) {
 
 	db := newSqliteDB()
 	network.EXPECT().GetContract("topic").Return(&client.Contract{}).Once()
-	var _ = NewTopicChaincodeMiddleware(logger, network, ipfs, db)
+	var _ = NewTopicChaincodeMiddleware(logger, network, ipfs, db, nil)
 
 }
@@ -0,0 +1,322 @@
+package chaincodes
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cealgull/Middleware/internal/fabric/common"
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/rest"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	TxPending   = "pending"
+	TxCommitted = "committed"
+	TxInvalid   = "invalid"
+	TxIndexed   = "indexed"
+
+	HeaderTransactionID = "X-Transaction-Id"
+
+	defaultTxRetention     = time.Hour
+	defaultTxStatusTimeout = 2 * time.Second
+	txSweepEvery           = 256
+)
+
+// commitStatus asks the gateway for the status of a submitted transaction,
+// blocking until it is committed or ctx is done.
+type commitStatus func(ctx context.Context) (*client.Status, error)
+
+type trackedTx struct {
+	id        string
+	wallet    string
+	chaincode string
+	status    string
+	code      string
+	block     uint64
+	commit    commitStatus
+	seen      time.Time
+}
+
+// TxTracker follows the transactions submitted in async mode from the
+// orderer to the off-chain store. Transactions are kept in memory for the
+// retention period, so their status is served by the instance that
+// submitted them.
+type TxTracker struct {
+	mu            sync.Mutex
+	txs           map[string]*trackedTx
+	updates       int
+	retention     time.Duration
+	statusTimeout time.Duration
+	db            *gorm.DB
+	logger        *zap.Logger
+	now           func() time.Time
+}
+
+type TxTrackerOption func(t *TxTracker)
+
+func WithTxRetention(retention time.Duration) TxTrackerOption {
+	return func(t *TxTracker) {
+		if retention > 0 {
+			t.retention = retention
+		}
+	}
+}
+
+// WithTxStatusTimeout bounds how long a status request waits for the
+// gateway before answering that the transaction is pending.
+func WithTxStatusTimeout(timeout time.Duration) TxTrackerOption {
+	return func(t *TxTracker) {
+		if timeout > 0 {
+			t.statusTimeout = timeout
+		}
+	}
+}
+
+// WithTxStore reads whether transactions were indexed from the applied
+// transactions in the off-chain store, so that it is known whichever
+// instance received the ledger event.
+func WithTxStore(db *gorm.DB) TxTrackerOption {
+	return func(t *TxTracker) {
+		t.db = db
+	}
+}
+
+func NewTxTracker(logger *zap.Logger, options ...TxTrackerOption) *TxTracker {
+
+	t := TxTracker{
+		txs:           map[string]*trackedTx{},
+		retention:     defaultTxRetention,
+		statusTimeout: defaultTxStatusTimeout,
+		logger:        logger,
+		now:           time.Now,
+	}
+
+	for _, option := range options {
+		option(&t)
+	}
+
+	return &t
+}
+
+// entry returns the transaction with id, creating it when unknown. The
+// caller holds the lock.
+func (t *TxTracker) entry(id string) *trackedTx {
+
+	now := t.now()
+
+	if t.updates++; t.updates%txSweepEvery == 0 {
+		for k, tx := range t.txs {
+			if now.Sub(tx.seen) >= t.retention {
+				delete(t.txs, k)
+			}
+		}
+	}
+
+	tx, ok := t.txs[id]
+
+	if !ok {
+		tx = &trackedTx{id: id, status: TxPending}
+		t.txs[id] = tx
+	}
+
+	tx.seen = now
+
+	return tx
+}
+
+// track starts following a transaction. Ledger events of transactions that
+// are not tracked are ignored, so a status missed before tracking started
+// is asked from the gateway instead.
+func (t *TxTracker) track(id string, wallet string, chaincode string, commit commitStatus) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tx := t.entry(id)
+	tx.wallet = wallet
+	tx.chaincode = chaincode
+	tx.commit = commit
+}
+
+// committed records that the ledger event of a transaction was received.
+func (t *TxTracker) committed(id string, block uint64) {
+
+	if t == nil || id == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tx, ok := t.txs[id]
+
+	if !ok {
+		return
+	}
+
+	tx.block = block
+
+	if tx.status == TxPending {
+		tx.status = TxCommitted
+	}
+}
+
+// indexed records that the event callback stored the transaction off-chain.
+func (t *TxTracker) indexed(id string) {
+
+	if t == nil || id == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if tx, ok := t.txs[id]; ok {
+		tx.status = TxIndexed
+	}
+}
+
+// status is a snapshot of the transaction id submitted by wallet. Pending
+// transactions are looked up at the gateway first.
+func (t *TxTracker) status(ctx context.Context, id string, wallet string) (*trackedTx, bool) {
+
+	t.mu.Lock()
+	tx, ok := t.txs[id]
+
+	if !ok || tx.wallet != wallet || t.now().Sub(tx.seen) >= t.retention {
+		t.mu.Unlock()
+		return nil, false
+	}
+
+	commit, pending, indexed := tx.commit, tx.status == TxPending, tx.status == TxIndexed
+	t.mu.Unlock()
+
+	if !indexed && t.db != nil {
+
+		applied := AppliedTransaction{}
+
+		if err := t.db.WithContext(ctx).Where("transaction_id = ?", id).Take(&applied).Error; err == nil {
+			t.mu.Lock()
+			tx.status = TxIndexed
+			tx.block = applied.BlockNumber
+			t.mu.Unlock()
+			pending = false
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			t.logger.Warn("Failed to look up applied transaction", zap.String("id", id), zap.Error(err))
+		}
+	}
+
+	if pending && commit != nil {
+
+		ctx, cancel := context.WithTimeout(ctx, t.statusTimeout)
+		status, err := commit(ctx)
+		cancel()
+
+		t.mu.Lock()
+
+		switch {
+		case err != nil:
+			t.logger.Debug("Transaction status unknown", zap.String("id", id), zap.Error(err))
+		case tx.status != TxPending:
+		case status.Successful:
+			tx.status = TxCommitted
+			tx.block = status.BlockNumber
+		default:
+			tx.status = TxInvalid
+			tx.code = status.Code.String()
+			tx.block = status.BlockNumber
+		}
+
+		t.mu.Unlock()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	snapshot := *tx
+	return &snapshot, true
+}
+
+func (t *TxTracker) queryTx(c echo.Context) error {
+
+	tx, ok := t.status(c.Request().Context(), c.Param("id"), rest.WalletOf(c))
+
+	if !ok {
+		chaincodeNotFoundError := ChaincodeNotFoundError{"transaction"}
+		return c.JSON(chaincodeNotFoundError.Status(), chaincodeNotFoundError.Message())
+	}
+
+	type TxResponse struct {
+		TransactionID string `json:"transactionId"`
+		Chaincode     string `json:"chaincode"`
+		Status        string `json:"status"`
+		Code          string `json:"code,omitempty"`
+		BlockNumber   uint64 `json:"blockNumber,omitempty"`
+	}
+
+	return c.JSON(success.Status(), &TxResponse{
+		TransactionID: tx.id,
+		Chaincode:     tx.chaincode,
+		Status:        tx.status,
+		Code:          tx.code,
+		BlockNumber:   tx.block,
+	})
+}
+
+// Register serves the status of transactions at /api/tx/:id to the wallets
+// that submitted them.
+func (t *TxTracker) Register(e *echo.Echo) error {
+	rest.Declare(e, rest.AuthRequired, e.GET("/api/tx/:id", t.queryTx))
+	return nil
+}
+
+// wantsAsync tells whether the client asked not to wait for the commit with
+// "Prefer: respond-async".
+func wantsAsync(c echo.Context) bool {
+	for _, prefer := range c.Request().Header.Values("Prefer") {
+		for _, token := range strings.Split(prefer, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// asyncContract hands invokes a contract that submits without waiting for
+// the commit. The transaction is tracked and its ID sent back in a header.
+type asyncContract struct {
+	common.Contract
+	chaincode string
+	tracker   *TxTracker
+	c         echo.Context
+}
+
+func (a *asyncContract) Submit(transactionName string, options ...client.ProposalOption) ([]byte, error) {
+
+	result, commit, err := a.Contract.SubmitAsync(transactionName, options...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	id := commit.TransactionID()
+
+	a.tracker.track(id, rest.WalletOf(a.c), a.chaincode, func(ctx context.Context) (*client.Status, error) {
+		return commit.StatusWithContext(ctx)
+	})
+
+	header := a.c.Response().Header()
+	header.Set(HeaderTransactionID, id)
+	header.Set(HeaderConsistencyToken, id)
+	header.Set("Preference-Applied", "respond-async")
+
+	return result, nil
+}
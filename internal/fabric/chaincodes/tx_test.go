@@ -0,0 +1,223 @@
+package chaincodes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/rest"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	fabricmock "github.com/Cealgull/Middleware/internal/fabric/common/mocks"
+)
+
+func TestTxTracker(t *testing.T) {
+
+	tracker := NewTxTracker(logger, WithTxStatusTimeout(20*time.Millisecond), WithTxRetention(time.Minute))
+
+	blocking := func(ctx context.Context) (*client.Status, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	t.Run("Pending until the gateway answers", func(t *testing.T) {
+
+		tracker.track("tx1", "0x1", "topic", blocking)
+
+		tx, ok := tracker.status(context.Background(), "tx1", "0x1")
+		assert.True(t, ok)
+		assert.Equal(t, TxPending, tx.status)
+		assert.Equal(t, "topic", tx.chaincode)
+
+		tracker.track("tx1", "0x1", "topic", func(ctx context.Context) (*client.Status, error) {
+			return &client.Status{Successful: true, Code: peer.TxValidationCode_VALID, BlockNumber: 7}, nil
+		})
+
+		tx, _ = tracker.status(context.Background(), "tx1", "0x1")
+		assert.Equal(t, TxCommitted, tx.status)
+		assert.Equal(t, uint64(7), tx.block)
+
+		tracker.indexed("tx1")
+
+		tx, _ = tracker.status(context.Background(), "tx1", "0x1")
+		assert.Equal(t, TxIndexed, tx.status)
+	})
+
+	t.Run("Invalid transactions", func(t *testing.T) {
+
+		tracker.track("tx2", "0x1", "post", func(ctx context.Context) (*client.Status, error) {
+			return &client.Status{Code: peer.TxValidationCode_MVCC_READ_CONFLICT, BlockNumber: 8}, nil
+		})
+
+		tx, _ := tracker.status(context.Background(), "tx2", "0x1")
+		assert.Equal(t, TxInvalid, tx.status)
+		assert.Equal(t, "MVCC_READ_CONFLICT", tx.code)
+	})
+
+	t.Run("Events of untracked transactions", func(t *testing.T) {
+
+		tracker.committed("tx3", 9)
+		tracker.indexed("tx3")
+
+		_, ok := tracker.txs["tx3"]
+		assert.False(t, ok)
+
+		tracker.track("tx3", "0x1", "topic", func(ctx context.Context) (*client.Status, error) {
+			return &client.Status{Successful: true, Code: peer.TxValidationCode_VALID, BlockNumber: 9}, nil
+		})
+
+		tx, _ := tracker.status(context.Background(), "tx3", "0x1")
+		assert.Equal(t, TxCommitted, tx.status)
+		assert.Equal(t, uint64(9), tx.block)
+	})
+
+	t.Run("Indexed by another instance", func(t *testing.T) {
+
+		db := newSqliteDB()
+		stored := NewTxTracker(logger, WithTxStatusTimeout(20*time.Millisecond), WithTxStore(db))
+
+		stored.track("tx4", "0x1", "topic", blocking)
+
+		tx, _ := stored.status(context.Background(), "tx4", "0x1")
+		assert.Equal(t, TxPending, tx.status)
+
+		assert.NoError(t, db.Create(&AppliedTransaction{TransactionID: "tx4", Chaincode: "topic", EventName: "CreateTopic", BlockNumber: 10}).Error)
+
+		tx, _ = stored.status(context.Background(), "tx4", "0x1")
+		assert.Equal(t, TxIndexed, tx.status)
+		assert.Equal(t, uint64(10), tx.block)
+	})
+
+	t.Run("Only the submitter sees a transaction", func(t *testing.T) {
+
+		_, ok := tracker.status(context.Background(), "tx1", "0x2")
+		assert.False(t, ok)
+
+		_, ok = tracker.status(context.Background(), "unknown", "0x1")
+		assert.False(t, ok)
+	})
+
+	t.Run("Transactions expire", func(t *testing.T) {
+
+		tracker.now = func() time.Time { return time.Now().Add(time.Hour) }
+		defer func() { tracker.now = time.Now }()
+
+		_, ok := tracker.status(context.Background(), "tx1", "0x1")
+		assert.False(t, ok)
+	})
+
+	t.Run("Nil tracker ignores events", func(t *testing.T) {
+		var none *TxTracker
+		none.committed("tx1", 1)
+		none.indexed("tx1")
+	})
+}
+
+func TestAsyncInvoke(t *testing.T) {
+
+	db := newSqliteDB()
+
+	contract := fabricmock.NewMockContract()
+	contract.On("ChaincodeName").Return("plug")
+
+	tracker := NewTxTracker(logger)
+
+	network := fabricmock.NewMockNetwork(t)
+
+	m := NewChaincodeMiddleware(logger, network, contract,
+		WithChaincodeInvoke("create", invokeCreateTag(logger, db)),
+		WithTxTracker(tracker),
+	)
+
+	e := echo.New()
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			rest.SetIdentity(c, &rest.Identity{Wallet: "0x123456789"})
+			return next(c)
+		}
+	})
+
+	m.Register(e.Group("/api/tag"), e)
+	assert.NoError(t, tracker.Register(e))
+
+	invoke := func(prefer string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/tag/invoke/create", strings.NewReader(`{"name":"tag"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if prefer != "" {
+			req.Header.Set("Prefer", prefer)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("Invoking without async mode waits for the commit", func(t *testing.T) {
+
+		contract.On("Submit", "CreateTag", mock.Anything).Return([]byte{}, nil).Once()
+
+		rec := invoke("")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Empty(t, rec.Header().Get("Preference-Applied"))
+	})
+
+	t.Run("Invoking in async mode", func(t *testing.T) {
+
+		contract.On("SubmitAsync", "CreateTag", mock.Anything).Return([]byte{}, &client.Commit{}, nil).Once()
+
+		rec := invoke("wait=10, respond-async")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "respond-async", rec.Header().Get("Preference-Applied"))
+		assert.Contains(t, rec.Header(), HeaderTransactionID)
+
+		contract.AssertNumberOfCalls(t, "Submit", 1)
+		contract.AssertNumberOfCalls(t, "SubmitAsync", 1)
+	})
+
+	t.Run("Querying transaction", func(t *testing.T) {
+
+		tracker.track("tx", "0x123456789", "plug", func(ctx context.Context) (*client.Status, error) {
+			return &client.Status{Successful: true, Code: peer.TxValidationCode_VALID, BlockNumber: 3}, nil
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/api/tx/tx", nil)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		response := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		assert.Equal(t, "tx", response["transactionId"])
+		assert.Equal(t, TxCommitted, response["status"])
+		assert.Equal(t, "plug", response["chaincode"])
+		assert.Equal(t, float64(3), response["blockNumber"])
+	})
+
+	t.Run("Invoking in async mode with endorsement failure", func(t *testing.T) {
+
+		contract.On("SubmitAsync", "CreateTag", mock.Anything).Return([]byte(nil), nil, errors.New("endorsement failed")).Once()
+
+		rec := invoke("respond-async")
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+		assert.Empty(t, rec.Header().Get(HeaderTransactionID))
+	})
+
+	t.Run("Querying unknown transaction", func(t *testing.T) {
+
+		req := httptest.NewRequest(http.MethodGet, "/api/tx/unknown", nil)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
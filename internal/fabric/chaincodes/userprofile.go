@@ -4,11 +4,13 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
-
+	"regexp"
 	"time"
 
 	"github.com/Cealgull/Middleware/internal/fabric/common"
 	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/proto"
+	"github.com/Cealgull/Middleware/internal/rest"
 	"github.com/Cealgull/Middleware/internal/utils"
 	"github.com/hyperledger/fabric-gateway/pkg/client"
 	"github.com/labstack/echo-contrib/session"
@@ -19,22 +21,71 @@ import (
 	// "gorm.io/hints"
 )
 
+var usernamePattern = regexp.MustCompile(`^\w{3,20}$`)
+
+const usernameChangeInterval = 30 * 24 * time.Hour
+
+func validateUsername(db *gorm.DB, username string, wallet string) proto.MiddlewareError {
+
+	if !usernamePattern.MatchString(username) {
+		return &ChaincodeFieldValidationError{"username"}
+	}
+
+	if err := db.Model(&User{}).
+		Where("LOWER(username) = LOWER(?) AND wallet <> ?", username, wallet).
+		First(&User{}).Error; err == nil {
+		return &ChaincodeDuplicatedError{"username"}
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return chaincodeInternalError
+	}
+
+	return nil
+}
+
+// claimedError tells why writing the username of wallet failed, which is
+// most likely the unique index on lower(username) rejecting it.
+func claimedError(db *gorm.DB, username string, wallet string) proto.MiddlewareError {
+
+	if err := validateUsername(db, username, wallet); err != nil {
+		return err
+	}
+
+	if err := db.Model(&User{}).Where("wallet = ?", wallet).First(&User{}).Error; err == nil {
+		return &ChaincodeDuplicatedError{"User"}
+	}
+
+	return chaincodeInternalError
+}
+
 func invokeCreateUser(logger *zap.Logger, db *gorm.DB) ChaincodeInvoke {
 	return func(contract common.Contract, c echo.Context) error {
 
-		s, _ := session.Get("session", c)
+		type RegisterRequest struct {
+			Username  string `json:"username"`
+			Signature string `json:"signature"`
+		}
+
+		registerRequest := RegisterRequest{}
+
+		if err := c.Bind(&registerRequest); err != nil {
+			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
+		}
 
-		wallet := s.Values["wallet"].(string)
+		wallet := rest.WalletOf(c)
 
 		if err := db.Model(&User{}).Where(&User{Wallet: wallet}).First(&User{}).Error; err == nil {
 			chaincodeDuplicateError := ChaincodeDuplicatedError{"User"}
 			return c.JSON(chaincodeDuplicateError.Status(), chaincodeDuplicateError.Message())
 		}
 
+		if err := validateUsername(db, registerRequest.Username, wallet); err != nil {
+			return c.JSON(err.Status(), err.Message())
+		}
+
 		block := ProfileBlock{
-			Username:  "Alice",
+			Username:  registerRequest.Username,
 			Wallet:    wallet,
-			Signature: "Alice's signature",
+			Signature: registerRequest.Signature,
 			Muted:     false,
 			Banned:    false,
 		}
@@ -43,11 +94,6 @@ func invokeCreateUser(logger *zap.Logger, db *gorm.DB) ChaincodeInvoke {
 
 		b, _ := json.Marshal(&block)
 
-		if _, err := contract.Submit("CreateUser", client.WithBytesArguments(b)); err != nil {
-			chaincodeInvokeFailure := ChaincodeInvokeFailureError{"CreateUser"}
-			return c.JSON(chaincodeInvokeFailure.Status(), chaincodeInvokeFailure.Message())
-		}
-
 		user := User{
 			Username:            block.Username,
 			Wallet:              block.Wallet,
@@ -58,6 +104,24 @@ func invokeCreateUser(logger *zap.Logger, db *gorm.DB) ChaincodeInvoke {
 			ActiveBadgeRelation: nil,
 		}
 
+		// The user is written before submitting, so that of two wallets
+		// registering the same name only one gets past the unique index. The
+		// event callback completes it, and it is removed when submitting fails.
+		if err := db.Create(&User{Username: user.Username, Wallet: user.Wallet}).Error; err != nil {
+			err := claimedError(db, block.Username, wallet)
+			return c.JSON(err.Status(), err.Message())
+		}
+
+		if _, err := contract.Submit("CreateUser", client.WithBytesArguments(b)); err != nil {
+			if err := db.Unscoped().
+				Where("wallet = ? AND NOT EXISTS (SELECT 1 FROM profiles WHERE profiles.user_wallet = users.wallet)", wallet).
+				Delete(&User{}).Error; err != nil {
+				logger.Warn("Failed to release username", zap.String("wallet", wallet), zap.Error(err))
+			}
+			chaincodeInvokeFailure := ChaincodeInvokeFailureError{"CreateUser"}
+			return c.JSON(chaincodeInvokeFailure.Status(), chaincodeInvokeFailure.Message())
+		}
+
 		profile := Profile{
 			Signature:   block.Signature,
 			Balance:     block.Balance,
@@ -90,9 +154,28 @@ func invokeUpdateUser(logger *zap.Logger, db *gorm.DB) ChaincodeInvoke {
 			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
 		}
 
-		s, _ := session.Get("session", c)
+		profile.Wallet = rest.WalletOf(c)
+
+		user := User{}
 
-		profile.Wallet = s.Values["wallet"].(string)
+		if err := db.Model(&User{}).Where("wallet = ?", profile.Wallet).First(&user).Error; err != nil {
+			chaincodeNotFoundError := ChaincodeNotFoundError{"user"}
+			return c.JSON(chaincodeNotFoundError.Status(), chaincodeNotFoundError.Message())
+		}
+
+		if profile.Username != "" && profile.Username != user.Username {
+
+			if err := validateUsername(db, profile.Username, profile.Wallet); err != nil {
+				return c.JSON(err.Status(), err.Message())
+			}
+
+			if err := db.Model(&UsernameHistory{}).
+				Where("user_wallet = ? AND created_at > ?", profile.Wallet, time.Now().Add(-usernameChangeInterval)).
+				First(&UsernameHistory{}).Error; err == nil {
+				chaincodeTooFrequentError := ChaincodeTooFrequentError{"username"}
+				return c.JSON(chaincodeTooFrequentError.Status(), chaincodeTooFrequentError.Message())
+			}
+		}
 
 		err := db.Transaction(func(tx *gorm.DB) error {
 			var userProfile Profile
@@ -129,9 +212,10 @@ func invokeUpdateUser(logger *zap.Logger, db *gorm.DB) ChaincodeInvoke {
 
 		b, _ := json.Marshal(&profile)
 
-		_, err = contract.Submit("UpdateUser", client.WithBytesArguments(b))
-
-		if err != nil {
+		// A new username is written by the event callback, which records the
+		// former one. validateUsername has told it free; should another
+		// wallet take it in the meantime, the rename is dropped there.
+		if _, err := contract.Submit("UpdateUser", client.WithBytesArguments(b)); err != nil {
 			chaincodeInvokeFailure := ChaincodeInvokeFailureError{"UpdateUser"}
 			return c.JSON(chaincodeInvokeFailure.Status(), chaincodeInvokeFailure.Message())
 		}
@@ -156,26 +240,33 @@ func createUserCallback(logger *zap.Logger, db *gorm.DB) ChaincodeEventCallback
 
 		return db.Transaction(func(tx *gorm.DB) error {
 
+			// the invoke already wrote the user when it ran on this store
 			user := User{
-				Username:            block.Username,
-				Wallet:              block.Wallet,
-				Avatar:              block.Avatar,
-				Muted:               block.Muted,
-				Banned:              block.Banned,
-				ActiveRoleRelation:  nil,
-				ActiveBadgeRelation: nil,
+				Username: block.Username,
+				Wallet:   block.Wallet,
+				Avatar:   block.Avatar,
+				Muted:    block.Muted,
+				Banned:   block.Banned,
+			}
+
+			if err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "wallet"}},
+				DoUpdates: clause.AssignmentColumns([]string{"username", "avatar", "muted", "banned", "updated_at"}),
+			}).Create(&user).Error; err != nil {
+				return err
 			}
 
 			profile := Profile{
 				Signature:   block.Signature,
 				Balance:     block.Balance,
 				Credibility: block.Credibility,
-				User:        &user,
+				UserWallet:  &user.Wallet,
 			}
 
-			var _ = tx.Create(&profile).Error
-
-			return nil
+			return tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "user_wallet"}},
+				DoUpdates: clause.AssignmentColumns([]string{"signature", "balance", "credibility"}),
+			}).Create(&profile).Error
 		})
 	}
 }
@@ -222,6 +313,30 @@ func updateUserCallback(logger *zap.Logger, db *gorm.DB) ChaincodeEventCallback
 			profile.ID = prevProfile.ID
 			user.ID = prevProfile.User.ID
 
+			if user.Username != "" && user.Username != prevProfile.User.Username {
+
+				// A name taken by another wallet since the invoke checked it
+				// leaves the former one in place.
+				if err := tx.Transaction(func(tx *gorm.DB) error {
+
+					if err := tx.Create(&UsernameHistory{
+						UserWallet: profileChanged.Wallet,
+						Username:   prevProfile.User.Username,
+					}).Error; err != nil {
+						return err
+					}
+
+					return tx.Model(&User{}).Where("id = ?", user.ID).Update("username", user.Username).Error
+
+				}); err != nil {
+					logger.Warn("Failed to rename user",
+						zap.String("wallet", profileChanged.Wallet),
+						zap.String("username", user.Username), zap.Error(err))
+				}
+
+				user.Username = ""
+			}
+
 			var _ = tx.Updates(&profile).Error
 			var _ = tx.Updates(&user).Error
 
@@ -246,8 +361,7 @@ func updateUserCallback(logger *zap.Logger, db *gorm.DB) ChaincodeEventCallback
 
 func authLogin(logger *zap.Logger, db *gorm.DB) ChaincodeCustom {
 	return func(contract common.Contract, c echo.Context) error {
-		s, _ := session.Get("session", c)
-		wallet := s.Values["wallet"].(string)
+		wallet := rest.WalletOf(c)
 
 		profile := Profile{}
 
@@ -259,7 +373,8 @@ func authLogin(logger *zap.Logger, db *gorm.DB) ChaincodeCustom {
 			First(&profile).Error; err == nil {
 			return c.JSON(http.StatusOK, &profile)
 		} else if errors.Is(err, gorm.ErrRecordNotFound) {
-			return invokeCreateUser(logger, db)(contract, c)
+			chaincodeNotFoundError := ChaincodeNotFoundError{"user"}
+			return c.JSON(chaincodeNotFoundError.Status(), chaincodeNotFoundError.Message())
 		} else {
 			return c.JSON(chaincodeInternalError.Status(), chaincodeInternalError.Message())
 		}
@@ -293,21 +408,48 @@ func queryProfile(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
 			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
 		}
 
-		profile := Profile{}
+		profile, err := loadProfile(db, profileQuery.Wallet)
 
-		if err := db.
-			Preload(clause.Associations).
-			Preload("User.ActiveBadgeRelation").
-			Preload("User.ActiveRoleRelation").
-			Where("user_wallet = ?", profileQuery.Wallet).
-			First(&profile).Error; err != nil {
+		if err != nil {
 			return c.JSON(chaincodeInternalError.Status(), chaincodeInternalError.Message())
 		}
 
-		return c.JSON(success.Status(), &profile)
+		return c.JSON(success.Status(), profile)
 	}
 }
 
+// queryPublicProfile serves the profile of the wallet in the path without
+// its private fields.
+func queryPublicProfile(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
+	return func(c echo.Context) error {
+
+		profile, err := loadProfile(db, c.Param("wallet"))
+
+		if err != nil {
+			chaincodeNotFoundError := ChaincodeNotFoundError{"user"}
+			return c.JSON(chaincodeNotFoundError.Status(), chaincodeNotFoundError.Message())
+		}
+
+		return c.JSON(success.Status(), (*PublicProfile)(profile))
+	}
+}
+
+func loadProfile(db *gorm.DB, wallet string) (*Profile, error) {
+
+	profile := Profile{}
+
+	if err := db.
+		Preload(clause.Associations).
+		Preload("User.ActiveBadgeRelation").
+		Preload("User.ActiveRoleRelation").
+		Where("user_wallet = ?", wallet).
+		First(&profile).Error; err != nil {
+		return nil, err
+	}
+
+	return &profile, nil
+}
+
 func queryUser(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
 	return func(c echo.Context) error {
 
@@ -400,6 +542,106 @@ func queryStatistics(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
 
 }
 
+func queryUsername(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
+	return func(c echo.Context) error {
+
+		type UsernameQuery struct {
+			Username string `json:"username"`
+		}
+
+		q := UsernameQuery{}
+
+		if c.Bind(&q) != nil {
+			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
+		}
+
+		type UsernameResponse struct {
+			Username  string `json:"username"`
+			Available bool   `json:"available"`
+		}
+
+		wallet := rest.WalletOf(c)
+
+		return c.JSON(success.Status(), &UsernameResponse{
+			Username:  q.Username,
+			Available: validateUsername(db, q.Username, wallet) == nil,
+		})
+	}
+}
+
+func queryMentions(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
+	return func(c echo.Context) error {
+
+		type MentionQuery struct {
+			Wallet      string `json:"wallet"`
+			PageOrdinal int    `json:"pageOrdinal"`
+			PageSize    int    `json:"pageSize"`
+		}
+
+		q := MentionQuery{}
+
+		if c.Bind(&q) != nil {
+			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
+		}
+
+		if q.PageOrdinal <= 0 || q.PageSize <= 0 {
+			return c.JSON(chaincodeQueryParameterError.Status(), chaincodeQueryParameterError.Message())
+		}
+
+		mentions := []*Mention{}
+
+		if err := db.Model(&Mention{}).
+			Preload("Mentioned").
+			Where("mentioned_wallet = ?", q.Wallet).
+			Scopes(paginate(q.PageOrdinal, q.PageSize)).
+			Order("created_at DESC").
+			Find(&mentions).Error; err != nil {
+			return c.JSON(chaincodeInternalError.Status(), chaincodeInternalError.Message())
+		}
+
+		return c.JSON(success.Status(), mentions)
+	}
+}
+
+func queryNotifications(logger *zap.Logger, db *gorm.DB) ChaincodeQuery {
+	return func(c echo.Context) error {
+
+		type NotificationQuery struct {
+			PageOrdinal int  `json:"pageOrdinal"`
+			PageSize    int  `json:"pageSize"`
+			Unread      bool `json:"unread"`
+		}
+
+		q := NotificationQuery{}
+
+		if c.Bind(&q) != nil {
+			return c.JSON(chaincodeDeserializationError.Status(), chaincodeDeserializationError.Message())
+		}
+
+		if q.PageOrdinal <= 0 || q.PageSize <= 0 {
+			return c.JSON(chaincodeQueryParameterError.Status(), chaincodeQueryParameterError.Message())
+		}
+
+		wallet := rest.WalletOf(c)
+
+		notifications := []*Notification{}
+
+		tx := db.Model(&Notification{}).Where("recipient_wallet = ?", wallet)
+
+		if q.Unread {
+			tx = tx.Where("read = ?", false)
+		}
+
+		if err := tx.Scopes(paginate(q.PageOrdinal, q.PageSize)).
+			Order("created_at DESC").
+			Find(&notifications).Error; err != nil {
+			return c.JSON(chaincodeInternalError.Status(), chaincodeInternalError.Message())
+		}
+
+		return c.JSON(success.Status(), notifications)
+	}
+}
+
 func NewUserProfileMiddleware(logger *zap.Logger, net common.Network, db *gorm.DB) *ChaincodeMiddleware {
 
 	return NewChaincodeMiddleware(logger, net, net.GetContract("userprofile"),
@@ -410,8 +652,11 @@ func NewUserProfileMiddleware(logger *zap.Logger, net common.Network, db *gorm.D
 		WithChaincodeQueryPost("profile", queryProfile(logger, db)),
 		WithChaincodeQueryPost("view", queryUser(logger, db)),
 		WithChaincodeQueryPost("statistics", queryStatistics(logger, db)),
+		WithChaincodeQueryPost("username", queryUsername(logger, db)),
+		WithChaincodeQueryPost("mentions", queryMentions(logger, db)),
+		WithChaincodeQueryPost("notifications", queryNotifications(logger, db)),
 
 		WithChaincodeCustom("/auth/login", authLogin(logger, db)),
-		WithChaincodeCustom("/auth/logout", authLogin(logger, db)),
+		WithChaincodeCustom("/auth/logout", authLogout(logger, db), rest.AuthOptional),
 	)
 }
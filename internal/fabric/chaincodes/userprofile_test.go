@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/Cealgull/Middleware/internal/fabric/common/mocks"
 	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/rest"
 	"github.com/hyperledger/fabric-gateway/pkg/client"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
@@ -29,57 +31,83 @@ var mockInvokeResult []byte = []byte{1, 2, 3, 4}
 
 func TestInvokeCreateUser(t *testing.T) {
 
+	type RegisterRequest struct {
+		Username  string `json:"username"`
+		Signature string `json:"signature"`
+	}
+
 	contract := mocks.NewMockContract()
 
 	db := newSqliteDB()
 
-	i := invokeCreateUser(logger, db)
+	assert.NoError(t, db.Create(&User{Username: "Bob", Wallet: "0x100"}).Error)
 
-	t.Run("Invoke Creating User Normally", func(t *testing.T) {
+	i := invokeCreateUser(logger, db)
 
-		req := httptest.NewRequest(http.MethodPost, "/api/user/invoke/create", nil)
+	invoke := func(payload interface{}) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/user/invoke/create", newJsonRequest(payload))
+		req.Header.Add(echo.HeaderContentType, echo.MIMEApplicationJSON)
 		rec := httptest.NewRecorder()
 		c := server.NewContext(req, rec)
 		c = newMockSignedContext(c)
 
-		var _ = contract.On("Submit", "CreateUser", mock.Anything).Return(mockInvokeResult, nil).Once()
-		err := i(contract, c)
-		assert.True(t, contract.AssertExpectations(t))
-
-		assert.NoError(t, err)
-		assert.Equal(t, http.StatusOK, rec.Code)
-	})
+		assert.NoError(t, i(contract, c))
+		return rec
+	}
 
-	t.Run("Invoke Creating User Error", func(t *testing.T) {
+	t.Run("Invoke Creating User With Unmarshal Error", func(t *testing.T) {
 
-		req := httptest.NewRequest(http.MethodPost, "/api/user/invoke/create", nil)
+		req := httptest.NewRequest(http.MethodPost, "/api/user/invoke/create", bytes.NewReader([]byte{1, 2, 3}))
+		req.Header.Add(echo.HeaderContentType, echo.MIMEApplicationJSON)
 		rec := httptest.NewRecorder()
 		c := server.NewContext(req, rec)
 		c = newMockSignedContext(c)
 
+		assert.NoError(t, i(contract, c))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Invoke Creating User With Invalid Username", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, invoke(&RegisterRequest{Username: "Al"}).Code)
+		assert.Equal(t, http.StatusBadRequest, invoke(&RegisterRequest{Username: "Alice Bob"}).Code)
+		assert.Equal(t, http.StatusBadRequest, invoke(&RegisterRequest{Username: "bob"}).Code)
+	})
+
+	t.Run("Invoke Creating User Error", func(t *testing.T) {
+
 		var _ = contract.On("Submit", "CreateUser", mock.Anything).Return([]byte(nil), errors.New("Submit Failure")).Once()
-		err := i(contract, c)
+		assert.Equal(t, http.StatusInternalServerError, invoke(&RegisterRequest{Username: "Alice"}).Code)
 
-		assert.NoError(t, err)
-		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+		assert.ErrorIs(t, db.Where("wallet = ?", "0x123456789").First(&User{}).Error, gorm.ErrRecordNotFound)
+	})
+
+	t.Run("Invoke Creating User Normally", func(t *testing.T) {
+
+		var _ = contract.On("Submit", "CreateUser", mock.Anything).Return(mockInvokeResult, nil).Once()
+		rec := invoke(&RegisterRequest{Username: "Alice", Signature: "Hello world"})
+		assert.True(t, contract.AssertExpectations(t))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"username":"Alice"`)
 
+		user := User{}
+		assert.NoError(t, db.Where("wallet = ?", "0x123456789").First(&user).Error)
+		assert.Equal(t, "Alice", user.Username)
 	})
 
 	t.Run("Invoke Creating User Duplicated", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, invoke(&RegisterRequest{Username: "Carol"}).Code)
+	})
 
-		req := httptest.NewRequest(http.MethodPost, "/api/user/invoke/create", nil)
-		rec := httptest.NewRecorder()
-		c := server.NewContext(req, rec)
-		c = newMockSignedContext(c)
-
-		assert.NoError(t, db.Create(&User{Wallet: "0x123456789"}).Error)
+	t.Run("Username claimed by a concurrent registration", func(t *testing.T) {
 
-		var _ = contract.On("Submit", "CreateUser", mock.Anything).Return([]byte(nil), errors.New("Submit Failure")).Once()
-		err := i(contract, c)
+		assert.Error(t, db.Create(&User{Username: "ALICE", Wallet: "0x200"}).Error)
 
-		assert.NoError(t, err)
-		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		err := claimedError(db, "ALICE", "0x200")
+		assert.Equal(t, &ChaincodeDuplicatedError{"username"}, err)
 
+		err = claimedError(db, "Dave", "0x123456789")
+		assert.Equal(t, &ChaincodeDuplicatedError{"User"}, err)
 	})
 }
 
@@ -189,6 +217,70 @@ func TestInvokeUpdateUser(t *testing.T) {
 
 	})
 
+	t.Run("Invoke Updating User With Rename", func(t *testing.T) {
+
+		assert.NoError(t, db.Create(&User{Username: "Bob", Wallet: "0x100"}).Error)
+
+		rename := func(username string) int {
+			profileChanged.Username = username
+			req := httptest.NewRequest(http.MethodPost, "/api/user/invoke/update", newJsonRequest(&profileChanged))
+			req.Header.Add(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+			rec := httptest.NewRecorder()
+
+			c := server.NewContext(req, rec)
+			c = newMockSignedContext(c)
+			assert.NoError(t, u(contract, c))
+			profileChanged.Username = "Alice"
+			return rec.Code
+		}
+
+		assert.Equal(t, http.StatusBadRequest, rename("BOB"))
+		assert.Equal(t, http.StatusBadRequest, rename("no spaces allowed"))
+
+		contract.On("Submit", "UpdateUser", mock.Anything).Return([]byte(nil), errors.New("Invoke Failure")).Once()
+		assert.Equal(t, http.StatusInternalServerError, rename("Alice2"))
+		assert.ErrorIs(t, db.Where("user_wallet = ?", "0x123456789").First(&UsernameHistory{}).Error, gorm.ErrRecordNotFound)
+
+		contract.On("Submit", "UpdateUser", mock.Anything).Return(mockInvokeResult, nil).Once()
+		assert.Equal(t, http.StatusOK, rename("Alice2"))
+
+		// the rename is written by the event callback, once
+		renamed := User{}
+		assert.NoError(t, db.Where("wallet = ?", "0x123456789").First(&renamed).Error)
+		assert.Equal(t, "Alice", renamed.Username)
+
+		payload, _ := json.Marshal(&ProfileChanged{Username: "Alice2", Wallet: "0x123456789"})
+		assert.NoError(t, updateUserCallback(logger, db)(payload))
+
+		assert.NoError(t, db.Where("wallet = ?", "0x123456789").First(&renamed).Error)
+		assert.Equal(t, "Alice2", renamed.Username)
+
+		var history int64
+		assert.NoError(t, db.Model(&UsernameHistory{}).Where("user_wallet = ?", "0x123456789").Count(&history).Error)
+		assert.Equal(t, int64(1), history)
+
+		assert.Equal(t, http.StatusTooManyRequests, rename("Alice3"))
+
+		assert.NoError(t, db.Model(&renamed).Update("username", "Alice").Error)
+		assert.NoError(t, db.Where("user_wallet = ?", "0x123456789").Delete(&UsernameHistory{}).Error)
+	})
+
+	t.Run("Invoke Updating User Not Registered", func(t *testing.T) {
+
+		req := httptest.NewRequest(http.MethodPost, "/api/user/invoke/update", newJsonRequest(&profileChanged))
+		req.Header.Add(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+		rec := httptest.NewRecorder()
+
+		c := server.NewContext(req, rec)
+		c = newMockSignedContext(c)
+		rest.SetIdentity(c, &rest.Identity{Wallet: "0x999"})
+
+		assert.NoError(t, u(contract, c))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
 	t.Run("Invoke Updating User With Failure", func(t *testing.T) {
 
 		req := httptest.NewRequest(http.MethodPost, "/api/user/invoke/update", newJsonRequest(&profileChanged))
@@ -261,11 +353,9 @@ func TestAuthLogin(t *testing.T) {
 		c := server.NewContext(req, rec)
 		c = newMockSignedContext(c)
 
-		var _ = contract.On("Submit", "CreateUser", mock.Anything).Return(mockInvokeResult, nil).Once()
-
 		err := login(contract, c)
 		assert.NoError(t, err)
-		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
 	})
 }
 
@@ -315,6 +405,21 @@ func TestCreateUserCallback(t *testing.T) {
 		assert.NoError(t, err)
 	})
 
+	t.Run("Creating user reserved by the invoke", func(t *testing.T) {
+		db := newSqliteDB()
+		createUser := createUserCallback(logger, db)
+
+		assert.NoError(t, db.Create(&User{Username: block.Username, Wallet: block.Wallet}).Error)
+
+		assert.NoError(t, createUser(b))
+		assert.NoError(t, createUser(b))
+
+		profile, err := loadProfile(db, block.Wallet)
+		assert.NoError(t, err)
+		assert.Equal(t, "Alice", profile.User.Username)
+		assert.Equal(t, "null", profile.User.Avatar)
+	})
+
 	t.Run("Creating user with json unmarshal error", func(t *testing.T) {
 		createUser := createUserCallback(logger, nil)
 		err := createUser([]byte("abcd"))
@@ -414,6 +519,58 @@ func TestUpdateUserCallback(t *testing.T) {
 
 	})
 
+	t.Run("Updating user with new username", func(t *testing.T) {
+
+		db := newSqliteDB()
+
+		updateUser := updateUserCallback(logger, db)
+		createUser := createUserCallback(logger, db)
+
+		b, _ := json.Marshal(&profile)
+		assert.NoError(t, createUser(b))
+
+		renamed := profileChanged
+		renamed.Username = "Alice2"
+		renamed.ActiveBadge = ""
+		renamed.ActiveRole = ""
+
+		b, _ = json.Marshal(&renamed)
+		assert.NoError(t, updateUser(b))
+
+		history := []*UsernameHistory{}
+		assert.NoError(t, db.Where("user_wallet = ?", profile.Wallet).Find(&history).Error)
+		assert.Len(t, history, 1)
+		assert.Equal(t, "Alice", history[0].Username)
+	})
+
+	t.Run("Updating user with a username taken meanwhile", func(t *testing.T) {
+
+		db := newSqliteDB()
+
+		updateUser := updateUserCallback(logger, db)
+		createUser := createUserCallback(logger, db)
+
+		b, _ := json.Marshal(&profile)
+		assert.NoError(t, createUser(b))
+		assert.NoError(t, db.Create(&User{Username: "alice2", Wallet: "0x100"}).Error)
+
+		renamed := profileChanged
+		renamed.Username = "Alice2"
+		renamed.Signature = "renamed"
+		renamed.ActiveBadge = ""
+		renamed.ActiveRole = ""
+
+		b, _ = json.Marshal(&renamed)
+		assert.NoError(t, updateUser(b))
+
+		updated, err := loadProfile(db, profile.Wallet)
+		assert.NoError(t, err)
+		assert.Equal(t, "Alice", updated.User.Username)
+		assert.Equal(t, "renamed", updated.Signature)
+
+		assert.ErrorIs(t, db.Where("user_wallet = ?", profile.Wallet).First(&UsernameHistory{}).Error, gorm.ErrRecordNotFound)
+	})
+
 	t.Run("Updating user with failure", func(t *testing.T) {
 
 		db := newSqliteDB()
@@ -619,6 +776,137 @@ func TestQueryStatistics(t *testing.T) {
 	})
 }
 
+func TestQueryUsername(t *testing.T) {
+
+	type UsernameQuery struct {
+		Username string `json:"username"`
+	}
+
+	db := prepareMentionData(t)
+
+	query := queryUsername(logger, db)
+
+	t.Run("Querying Username With Unmarshal Error", func(t *testing.T) {
+
+		req := httptest.NewRequest(http.MethodPost, "/api/user/query/username", bytes.NewReader([]byte{1, 2, 3, 4}))
+		rec := httptest.NewRecorder()
+		c := newMockSignedContext(server.NewContext(req, rec))
+
+		var _ = query(c)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	for username, available := range map[string]bool{"alice": true, "bob": false, "Dave": true, "x": false} {
+
+		t.Run("Querying Username "+username, func(t *testing.T) {
+
+			req := httptest.NewRequest(http.MethodPost, "/api/user/query/username", newJsonRequest(&UsernameQuery{Username: username}))
+			req.Header.Add(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := newMockSignedContext(server.NewContext(req, rec))
+
+			var _ = query(c)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Contains(t, rec.Body.String(), fmt.Sprintf(`"available":%t`, available))
+		})
+	}
+}
+
+func TestQueryMentions(t *testing.T) {
+
+	type MentionQuery struct {
+		Wallet      string `json:"wallet"`
+		PageOrdinal int    `json:"pageOrdinal"`
+		PageSize    int    `json:"pageSize"`
+	}
+
+	db := prepareMentionData(t)
+	assert.NoError(t, replaceMentions(db, 1, "topics", "0x123456789", "topic", "@Bob"))
+
+	query := queryMentions(logger, db)
+
+	t.Run("Querying Mentions With Unmarshal Error", func(t *testing.T) {
+
+		req := httptest.NewRequest(http.MethodPost, "/api/user/query/mentions", bytes.NewReader([]byte{1, 2, 3, 4}))
+		rec := httptest.NewRecorder()
+		c := server.NewContext(req, rec)
+
+		var _ = query(c)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Querying Mentions With Illegal PageOrdinal", func(t *testing.T) {
+
+		req := httptest.NewRequest(http.MethodPost, "/api/user/query/mentions", newJsonRequest(&MentionQuery{Wallet: "0x100"}))
+		req.Header.Add(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := server.NewContext(req, rec)
+
+		var _ = query(c)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Querying Mentions With Success", func(t *testing.T) {
+
+		req := httptest.NewRequest(http.MethodPost, "/api/user/query/mentions", newJsonRequest(&MentionQuery{Wallet: "0x100", PageOrdinal: 1, PageSize: 10}))
+		req.Header.Add(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := server.NewContext(req, rec)
+
+		var _ = query(c)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"username":"Bob"`)
+		assert.Contains(t, rec.Body.String(), `"hash":"topic"`)
+	})
+}
+
+func TestQueryNotifications(t *testing.T) {
+
+	type NotificationQuery struct {
+		PageOrdinal int  `json:"pageOrdinal"`
+		PageSize    int  `json:"pageSize"`
+		Unread      bool `json:"unread"`
+	}
+
+	db := prepareMentionData(t)
+	assert.NoError(t, replaceMentions(db, 1, "topics", "0x100", "topic", "@Alice"))
+
+	query := queryNotifications(logger, db)
+
+	t.Run("Querying Notifications With Unmarshal Error", func(t *testing.T) {
+
+		req := httptest.NewRequest(http.MethodPost, "/api/user/query/notifications", bytes.NewReader([]byte{1, 2, 3, 4}))
+		rec := httptest.NewRecorder()
+		c := newMockSignedContext(server.NewContext(req, rec))
+
+		var _ = query(c)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Querying Notifications With Illegal PageOrdinal", func(t *testing.T) {
+
+		req := httptest.NewRequest(http.MethodPost, "/api/user/query/notifications", newJsonRequest(&NotificationQuery{}))
+		req.Header.Add(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := newMockSignedContext(server.NewContext(req, rec))
+
+		var _ = query(c)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Querying Notifications With Success", func(t *testing.T) {
+
+		req := httptest.NewRequest(http.MethodPost, "/api/user/query/notifications", newJsonRequest(&NotificationQuery{PageOrdinal: 1, PageSize: 10, Unread: true}))
+		req.Header.Add(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := newMockSignedContext(server.NewContext(req, rec))
+
+		var _ = query(c)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"type":"mention"`)
+	})
+}
+
 func TestNewProfileMiddleware(t *testing.T) {
 	network := mocks.NewMockNetwork(t)
 	db := newSqliteDB()
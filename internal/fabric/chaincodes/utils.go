@@ -3,6 +3,8 @@ package chaincodes
 import (
 	"reflect"
 
+	"github.com/Cealgull/Middleware/internal/ipfs"
+	. "github.com/Cealgull/Middleware/internal/models"
 	"github.com/Cealgull/Middleware/internal/proto"
 	"gorm.io/gorm"
 )
@@ -27,3 +29,35 @@ func paginate(pageOrdinal int, pageSize int) func(db *gorm.DB) *gorm.DB{
     return db.Offset((pageOrdinal - 1) * pageSize).Limit(pageSize)
   }
 }
+
+// byHash matches the topic or post with hash, which may also be the hash it
+// had before content hashing.
+func byHash(hash string) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if hash == "" {
+			return db.Where("hash = ?", hash)
+		}
+		return db.Where("(hash = ? OR legacy_hash = ?)", hash, hash)
+	}
+}
+
+// newAsset records an attachment with the metadata sniffed by the media
+// pipeline, falling back to an opaque type when the payload is unreadable.
+func newAsset(ipfs *ipfs.IPFSManager, creator string, cid string) *Asset {
+
+	asset := &Asset{
+		CreatorWallet: creator,
+		CID:           cid,
+		ContentType:   "application/octet-stream",
+	}
+
+	if media, err := ipfs.Inspect(cid); err == nil {
+		asset.ContentType = media.ContentType
+		asset.Thumbnail = media.Thumbnail
+		asset.Width = media.Width
+		asset.Height = media.Height
+		asset.Size = media.Size
+	}
+
+	return asset
+}
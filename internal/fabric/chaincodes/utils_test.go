@@ -42,3 +42,53 @@ func TestValidate(t *testing.T) {
 	})
 
 }
+
+func TestContentHash(t *testing.T) {
+
+	block := TopicBlock{Title: "title", Creator: "0x1", CID: "cid", Tags: []string{"a", "b"}, Timestamp: 1}
+	hash := block.ContentHash()
+
+	assert.True(t, IsContentHash(hash))
+	assert.Len(t, hash, ContentHashLength)
+	assert.False(t, IsContentHash("dG9waWM+/w=="))
+
+	t.Run("Hashing is deterministic", func(t *testing.T) {
+		voted := block
+		voted.Hash, voted.Upvotes = hash, []string{"0x2"}
+		assert.Equal(t, hash, voted.ContentHash())
+	})
+
+	t.Run("Hashing covers every field", func(t *testing.T) {
+		later := block
+		later.Timestamp = 2
+		assert.NotEqual(t, hash, later.ContentHash())
+
+		reordered := block
+		reordered.Tags = []string{"b", "a"}
+		assert.NotEqual(t, hash, reordered.ContentHash())
+
+		post := PostBlock{Creator: "0x1", CID: "cid", Timestamp: 1}
+		assert.NotEqual(t, hash, post.ContentHash())
+	})
+}
+
+func TestByHash(t *testing.T) {
+
+	db := newSqliteDB()
+
+	user := &User{Username: "Admin", Wallet: "0x123456789"}
+	assert.NoError(t, db.Create(user).Error)
+
+	hash := RehashLegacy("topics", "bGVnYWN5+/w==")
+	assert.NoError(t, db.Create(&Topic{Hash: hash, LegacyHash: "bGVnYWN5+/w==", Title: "t", CreatorWallet: user.Wallet, Content: "c"}).Error)
+	assert.NoError(t, db.Create(&Topic{Hash: "other", Title: "t", CreatorWallet: user.Wallet, Content: "c"}).Error)
+
+	for _, h := range []string{hash, "bGVnYWN5+/w=="} {
+		topic := Topic{}
+		assert.NoError(t, db.Scopes(byHash(h)).First(&topic).Error)
+		assert.Equal(t, hash, topic.Hash)
+		assert.Equal(t, "bGVnYWN5+/w==", topic.LedgerHash())
+	}
+
+	assert.Error(t, db.Scopes(byHash("")).First(&Topic{}).Error)
+}
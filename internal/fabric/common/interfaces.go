@@ -11,5 +11,8 @@ type Network interface {
 
 type Contract interface {
 	Submit(transactionName string, options ...client.ProposalOption) ([]byte, error)
+	// SubmitAsync returns once the transaction is endorsed and sent to the
+	// orderer. The commit tells its status later on.
+	SubmitAsync(transactionName string, options ...client.ProposalOption) ([]byte, *client.Commit, error)
 	ChaincodeName() string
 }
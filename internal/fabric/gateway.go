@@ -10,7 +10,6 @@ import (
 
 	"github.com/Cealgull/Middleware/internal/config"
 	"github.com/Cealgull/Middleware/internal/fabric/chaincodes"
-	"github.com/Cealgull/Middleware/internal/fabric/offchain"
 	"github.com/Cealgull/Middleware/internal/ipfs"
 	"github.com/hyperledger/fabric-gateway/pkg/client"
 	"github.com/hyperledger/fabric-gateway/pkg/identity"
@@ -24,6 +23,9 @@ import (
 type GatewayMiddleware struct {
 	db     *gorm.DB
 	cm     map[string]*chaincodes.ChaincodeMiddleware
+	public *chaincodes.PublicEndpoint
+	txs    *chaincodes.TxTracker
+	pins   *ipfs.PinReconciler
 	logger *zap.Logger
 }
 
@@ -126,15 +128,7 @@ func initNetwork(config *config.GatewayConfig) (*client.Network, error) {
 	return gateway.GetNetwork(config.Channel), nil
 }
 
-func NewGatewayMiddleware(logger *zap.Logger, ipfs *ipfs.IPFSManager, config *config.MiddlewareConfig) (*GatewayMiddleware, error) {
-
-	dialector := offchain.NewPostgresDialector(offchain.WithPostgresGormConfig(&config.Postgres))
-
-	db, err := offchain.NewOffchainStore(dialector, &config.Postgres)
-
-	if err != nil {
-		return nil, err
-	}
+func NewGatewayMiddleware(logger *zap.Logger, mgr *ipfs.IPFSManager, db *gorm.DB, config *config.MiddlewareConfig) (*GatewayMiddleware, error) {
 
 	network, err := initNetwork(&config.Gateway)
 
@@ -145,15 +139,41 @@ func NewGatewayMiddleware(logger *zap.Logger, ipfs *ipfs.IPFSManager, config *co
 	cm := make(map[string]*chaincodes.ChaincodeMiddleware)
 
 	cm["user"] = chaincodes.NewUserProfileMiddleware(logger, network, db)
-	cm["topic"] = chaincodes.NewTopicChaincodeMiddleware(logger, network, ipfs, db)
-	cm["post"] = chaincodes.NewPostChaincodeMiddleware(logger, network, ipfs, db)
-	cm["tag"] = chaincodes.NewTagChaincodeMiddleware(logger, network, ipfs, db)
-	cm["category"] = chaincodes.NewCategoryChaincodeMiddleware(logger, network, ipfs, db)
-	cm["categoryGroup"] = chaincodes.NewCategoryGroupChaincodeMiddleware(logger, network, ipfs, db)
+	screen := chaincodes.NewScreener(db, &config.Screening)
+
+	cm["topic"] = chaincodes.NewTopicChaincodeMiddleware(logger, network, mgr, db, screen)
+	cm["post"] = chaincodes.NewPostChaincodeMiddleware(logger, network, mgr, db, screen)
+	cm["tag"] = chaincodes.NewTagChaincodeMiddleware(logger, network, mgr, db)
+	cm["category"] = chaincodes.NewCategoryChaincodeMiddleware(logger, network, mgr, db)
+	cm["categoryGroup"] = chaincodes.NewCategoryGroupChaincodeMiddleware(logger, network, mgr, db)
+	cm["message"] = chaincodes.NewMessageChaincodeMiddleware(logger, network, mgr, db, config.Messaging.Anchor)
+
+	txs := chaincodes.NewTxTracker(logger,
+		chaincodes.WithTxRetention(config.Transactions.Retention),
+		chaincodes.WithTxStatusTimeout(config.Transactions.StatusTimeout),
+		chaincodes.WithTxStore(db),
+	)
+
+	consistency := chaincodes.NewConsistency(logger, db,
+		chaincodes.WithConsistencyTimeout(config.Transactions.ConsistencyTimeout),
+	)
+
+	for _, m := range cm {
+		var _ = chaincodes.WithTxTracker(txs)(m)
+		var _ = chaincodes.WithConsistency(consistency)(m)
+	}
+
+	pins := ipfs.NewPinReconciler(logger, mgr, db,
+		ipfs.WithPinInterval(config.IPFS.Pinning.Interval),
+		ipfs.WithPinGracePeriod(config.IPFS.Pinning.GracePeriod),
+	)
 
 	return &GatewayMiddleware{
 		db:     db,
 		cm:     cm,
+		public: chaincodes.NewPublicEndpoint(logger, db, config.Public.MaxAge),
+		txs:    txs,
+		pins:   pins,
 		logger: logger,
 	}, nil
 
@@ -168,5 +188,15 @@ func (g *GatewayMiddleware) Register(e *echo.Echo) error {
 		}(m)
 	}
 
+	if err := g.public.Register(e); err != nil {
+		return err
+	}
+
+	if err := g.txs.Register(e); err != nil {
+		return err
+	}
+
+	go g.pins.Run(context.Background())
+
 	return nil
 }
@@ -2,6 +2,7 @@ package offchain
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/Cealgull/Middleware/internal/config"
 	. "github.com/Cealgull/Middleware/internal/models"
@@ -35,6 +36,132 @@ func NewPostgresDialector(options ...PostgresOption) gorm.Dialector {
 	return postgres.New(dialector)
 }
 
+// usernameIndex makes usernames unique regardless of case. It settles
+// concurrent claims of the same name, which the lookup in the invokes can't.
+const usernameIndex = "idx_users_username_lower"
+
+// dedupeUsernames renames users sharing a username before the unique
+// indexes on users.username are created, so older databases still migrate.
+func dedupeUsernames(db *gorm.DB) error {
+
+	if !db.Migrator().HasTable(&User{}) || db.Migrator().HasIndex(&User{}, usernameIndex) {
+		return nil
+	}
+
+	users := []*User{}
+
+	if err := db.Unscoped().Order("id").Find(&users).Error; err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+
+	for _, u := range users {
+		if key := strings.ToLower(u.Username); seen[key] {
+			if err := db.Unscoped().Model(u).UpdateColumn("username", fmt.Sprintf("%s_%d", u.Username, u.ID)).Error; err != nil {
+				return err
+			}
+		} else {
+			seen[key] = true
+		}
+	}
+
+	return nil
+}
+
+// dropLegacyFingerprints drops content fingerprints recorded before they
+// were keyed by duplicate window. They only serve to catch duplicates for a
+// window, and may hold duplicates the unique key would reject.
+func dropLegacyFingerprints(db *gorm.DB) error {
+
+	if !db.Migrator().HasTable(&ContentFingerprint{}) || db.Migrator().HasColumn(&ContentFingerprint{}, "Bucket") {
+		return nil
+	}
+
+	return db.Migrator().DropTable(&ContentFingerprint{})
+}
+
+// rehashLegacyContent gives topics and posts created before content hashing
+// their content hash. The former hash is kept in LegacyHash, where lookups
+// still find it and from where invokes take the ledger key, and the rows
+// referring to the former hash are updated.
+func rehashLegacyContent(db *gorm.DB) error {
+
+	topics := []*Topic{}
+	posts := []*Post{}
+
+	if err := db.Unscoped().Select("id", "hash").
+		Where("legacy_hash = ? AND LENGTH(hash) <> ?", "", ContentHashLength).Find(&topics).Error; err != nil {
+		return err
+	}
+
+	if err := db.Unscoped().Select("id", "hash").
+		Where("legacy_hash = ? AND hash IS NOT NULL AND hash <> ? AND LENGTH(hash) <> ?", "", "", ContentHashLength).Find(&posts).Error; err != nil {
+		return err
+	}
+
+	if len(topics) == 0 && len(posts) == 0 {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+
+		// posts refer to topics by hash
+		constrained := tx.Migrator().HasConstraint(&Post{}, "BelongTo")
+
+		if constrained {
+			if err := tx.Migrator().DropConstraint(&Post{}, "BelongTo"); err != nil {
+				return err
+			}
+		}
+
+		rehash := func(model interface{}, source string, id uint, legacy string) error {
+
+			hash := RehashLegacy(source, legacy)
+
+			if err := tx.Unscoped().Model(model).Where("id = ?", id).
+				Updates(map[string]interface{}{"hash": hash, "legacy_hash": legacy}).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(&Mention{}).Where("owner_type = ? AND owner_hash = ?", source, legacy).
+				Update("owner_hash", hash).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Model(&Notification{}).Where("source_type = ? AND source_hash = ?", source, legacy).
+				Update("source_hash", hash).Error; err != nil {
+				return err
+			}
+
+			if source == "topics" {
+				return tx.Unscoped().Model(&Post{}).Where("belong_to_hash = ?", legacy).
+					Update("belong_to_hash", hash).Error
+			}
+
+			return nil
+		}
+
+		for _, t := range topics {
+			if err := rehash(&Topic{}, "topics", t.ID, t.Hash); err != nil {
+				return err
+			}
+		}
+
+		for _, p := range posts {
+			if err := rehash(&Post{}, "posts", p.ID, p.Hash); err != nil {
+				return err
+			}
+		}
+
+		if constrained {
+			return tx.Migrator().CreateConstraint(&Post{}, "BelongTo")
+		}
+
+		return nil
+	})
+}
+
 func NewOffchainStore(dialector gorm.Dialector, config *config.PostgresGormConfig) (*gorm.DB, error) {
 
 	db, err := gorm.Open(dialector, &gorm.Config{
@@ -46,6 +173,14 @@ func NewOffchainStore(dialector gorm.Dialector, config *config.PostgresGormConfi
 		return nil, err
 	}
 
+	if err := dedupeUsernames(db); err != nil {
+		return nil, err
+	}
+
+	if err := dropLegacyFingerprints(db); err != nil {
+		return nil, err
+	}
+
 	if err := db.AutoMigrate(
 
 		Role{},
@@ -53,11 +188,32 @@ func NewOffchainStore(dialector gorm.Dialector, config *config.PostgresGormConfi
 		Upvote{},
 		Downvote{},
 		Asset{},
+		MediaInfo{},
+		UploadedContent{},
+		OrphanedContent{},
+		PrivateContent{},
+		PrivateContentReader{},
 
 		User{},
 		Profile{},
 		Topic{},
+		Poll{},
+		PollOption{},
+		PollVote{},
+		UsernameHistory{},
 		Post{},
+		Mention{},
+		Notification{},
+		Conversation{},
+		ConversationParticipant{},
+		Message{},
+		UserBlock{},
+		Session{},
+		WalletCert{},
+		APIToken{},
+		HeldContent{},
+		ContentFingerprint{},
+		AppliedTransaction{},
 		Tag{},
 		TagRelation{},
 		OwnedToken{},
@@ -72,6 +228,14 @@ func NewOffchainStore(dialector gorm.Dialector, config *config.PostgresGormConfi
 		return nil, err
 	}
 
+	if err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS " + usernameIndex + " ON users (LOWER(username))").Error; err != nil {
+		return nil, err
+	}
+
+	if err := rehashLegacyContent(db); err != nil {
+		return nil, err
+	}
+
 	if config.Prometheus.Enabled {
 		var _ = db.Use(prometheus.New(
 			prometheus.Config{
@@ -4,9 +4,11 @@ import (
 	"testing"
 
 	"github.com/Cealgull/Middleware/internal/config"
+	"github.com/Cealgull/Middleware/internal/models"
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/assert"
 	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
 )
 
 func TestMain(m *testing.M) {
@@ -44,3 +46,98 @@ func TestNewOffchainStore(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+func TestDedupeUsernames(t *testing.T) {
+
+	db, err := gorm.Open(sqlite.Open("file:dedupe?mode=memory&cache=shared"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Exec("CREATE TABLE users (id integer PRIMARY KEY, username text, wallet text, deleted_at datetime)").Error)
+	assert.NoError(t, db.Exec("INSERT INTO users (username, wallet) VALUES ('Alice', '0x1'), ('alice', '0x2'), ('Bob', '0x3')").Error)
+
+	assert.NoError(t, dedupeUsernames(db))
+
+	usernames := []string{}
+	assert.NoError(t, db.Table("users").Order("id").Pluck("username", &usernames).Error)
+	assert.Equal(t, []string{"Alice", "alice_2", "Bob"}, usernames)
+}
+
+func TestUsernameIndex(t *testing.T) {
+
+	db, err := NewOffchainStore(sqlite.Open("file:usernames?mode=memory&cache=shared"), &config.PostgresGormConfig{})
+	assert.NoError(t, err)
+
+	assert.True(t, db.Migrator().HasIndex(&models.User{}, usernameIndex))
+	assert.NoError(t, db.Create(&models.User{Username: "Alice", Wallet: "0x1"}).Error)
+	assert.Error(t, db.Create(&models.User{Username: "alice", Wallet: "0x2"}).Error)
+}
+
+func TestDropLegacyFingerprints(t *testing.T) {
+
+	db, err := gorm.Open(sqlite.Open("file:fingerprints?mode=memory&cache=shared"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Exec("CREATE TABLE content_fingerprints (id integer PRIMARY KEY, creator_wallet text, digest text, created_at datetime)").Error)
+	assert.NoError(t, db.Exec("INSERT INTO content_fingerprints (creator_wallet, digest) VALUES ('0x1', 'd'), ('0x1', 'd')").Error)
+
+	db, err = NewOffchainStore(db.Dialector, &config.PostgresGormConfig{})
+	assert.NoError(t, err)
+
+	var count int64
+	assert.NoError(t, db.Model(&models.ContentFingerprint{}).Count(&count).Error)
+	assert.Equal(t, int64(0), count)
+
+	assert.NoError(t, db.Create(&models.ContentFingerprint{CreatorWallet: "0x1", Digest: "d", Bucket: 1}).Error)
+	assert.Error(t, db.Create(&models.ContentFingerprint{CreatorWallet: "0x1", Digest: "d", Bucket: 1}).Error)
+	assert.NoError(t, db.Create(&models.ContentFingerprint{CreatorWallet: "0x1", Digest: "d", Bucket: 2}).Error)
+}
+
+func TestRehashLegacyContent(t *testing.T) {
+
+	db, err := NewOffchainStore(sqlite.Open("file:rehash?mode=memory&cache=shared"), &config.PostgresGormConfig{})
+	assert.NoError(t, err)
+	assert.NoError(t, db.Exec("PRAGMA foreign_keys = ON").Error)
+
+	legacyTopic := "dG9waWMgY29udGVudA+/dGltZQ=="
+	legacyPost := "cG9zdCBjb250ZW50/dGltZQ=="
+
+	assert.NoError(t, db.Create(&models.User{Username: "Alice", Wallet: "0x1"}).Error)
+	assert.NoError(t, db.Create(&models.Topic{Hash: legacyTopic, Title: "legacy", CreatorWallet: "0x1", Content: "topic content"}).Error)
+	assert.NoError(t, db.Create(&models.Post{Hash: legacyPost, CreatorWallet: "0x1", Content: "post content", BelongToHash: legacyTopic}).Error)
+	assert.NoError(t, db.Create(&models.Mention{OwnerID: 1, OwnerType: "posts", OwnerHash: legacyPost, CreatorWallet: "0x1", MentionedWallet: "0x1"}).Error)
+	assert.NoError(t, db.Create(&models.Notification{RecipientWallet: "0x1", ActorWallet: "0x1", Type: models.NotificationMention, SourceType: "topics", SourceHash: legacyTopic}).Error)
+
+	current := models.TopicBlock{Title: "current", Creator: "0x1", Timestamp: 1}.ContentHash()
+	assert.NoError(t, db.Create(&models.Topic{Hash: current, Title: "current", CreatorWallet: "0x1", Content: "content"}).Error)
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, rehashLegacyContent(db))
+	}
+
+	topic := models.Topic{}
+	assert.NoError(t, db.Where("legacy_hash = ?", legacyTopic).First(&topic).Error)
+	assert.Equal(t, models.RehashLegacy("topics", legacyTopic), topic.Hash)
+	assert.True(t, models.IsContentHash(topic.Hash))
+	assert.Equal(t, legacyTopic, topic.LedgerHash())
+
+	post := models.Post{}
+	assert.NoError(t, db.Where("legacy_hash = ?", legacyPost).First(&post).Error)
+	assert.Equal(t, models.RehashLegacy("posts", legacyPost), post.Hash)
+	assert.Equal(t, topic.Hash, post.BelongToHash)
+
+	mention := models.Mention{}
+	assert.NoError(t, db.First(&mention).Error)
+	assert.Equal(t, post.Hash, mention.OwnerHash)
+
+	notification := models.Notification{}
+	assert.NoError(t, db.First(&notification).Error)
+	assert.Equal(t, topic.Hash, notification.SourceHash)
+
+	unchanged := models.Topic{}
+	assert.NoError(t, db.Where("hash = ?", current).First(&unchanged).Error)
+	assert.Empty(t, unchanged.LegacyHash)
+	assert.Equal(t, current, unchanged.LedgerHash())
+
+	assert.True(t, db.Migrator().HasConstraint(&models.Post{}, "BelongTo"))
+	assert.Error(t, db.Create(&models.Post{Hash: "orphan", CreatorWallet: "0x1", Content: "c", BelongToHash: "missing"}).Error)
+}
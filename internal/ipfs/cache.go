@@ -0,0 +1,239 @@
+package ipfs
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cealgull",
+		Subsystem: "ipfs_cache",
+		Name:      "requests_total",
+		Help:      "Content cache lookups by result.",
+	}, []string{"result"})
+
+	cacheBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cealgull",
+		Subsystem: "ipfs_cache",
+		Name:      "bytes",
+		Help:      "Bytes held by each content cache tier.",
+	}, []string{"tier"})
+)
+
+func init() {
+	prometheus.MustRegister(cacheRequests, cacheBytes)
+}
+
+// cidPattern guards the disk tier against keys that are not plain CIDs.
+var cidPattern = regexp.MustCompile(`^[A-Za-z0-9]{1,128}$`)
+
+type CacheStats struct {
+	MemoryHits uint64 `json:"memoryHits"`
+	DiskHits   uint64 `json:"diskHits"`
+	Misses     uint64 `json:"misses"`
+}
+
+type lruEntry struct {
+	cid  string
+	size int64
+	data []byte
+}
+
+// sizedLRU evicts the least recently used entries once their total size
+// goes over maxBytes.
+type sizedLRU struct {
+	maxBytes int64
+	bytes    int64
+	items    map[string]*list.Element
+	order    *list.List
+	evict    func(e *lruEntry)
+}
+
+func newSizedLRU(maxBytes int64, evict func(e *lruEntry)) *sizedLRU {
+	return &sizedLRU{
+		maxBytes: maxBytes,
+		items:    map[string]*list.Element{},
+		order:    list.New(),
+		evict:    evict,
+	}
+}
+
+func (l *sizedLRU) get(cid string) (*lruEntry, bool) {
+	if el, ok := l.items[cid]; ok {
+		l.order.MoveToFront(el)
+		return el.Value.(*lruEntry), true
+	}
+	return nil, false
+}
+
+func (l *sizedLRU) remove(cid string) {
+	if el, ok := l.items[cid]; ok {
+		e := l.order.Remove(el).(*lruEntry)
+		delete(l.items, cid)
+		l.bytes -= e.size
+		if l.evict != nil {
+			l.evict(e)
+		}
+	}
+}
+
+func (l *sizedLRU) add(e *lruEntry) bool {
+
+	if e.size > l.maxBytes {
+		return false
+	}
+
+	if el, ok := l.items[e.cid]; ok {
+		l.order.MoveToFront(el)
+		return true
+	}
+
+	l.items[e.cid] = l.order.PushFront(e)
+	l.bytes += e.size
+
+	for l.bytes > l.maxBytes {
+		l.remove(l.order.Back().Value.(*lruEntry).cid)
+	}
+
+	return true
+}
+
+// contentCache is a read-through cache keyed by CID. Content behind a CID
+// never changes, so entries are only ever evicted, never invalidated.
+type contentCache struct {
+	mu           sync.Mutex
+	maxEntrySize int64
+	memory       *sizedLRU
+	disk         *sizedLRU
+	dir          string
+
+	memoryHits atomic.Uint64
+	diskHits   atomic.Uint64
+	misses     atomic.Uint64
+}
+
+func newContentCache(memorySize int64, maxEntrySize int64, dir string, diskSize int64) (*contentCache, error) {
+
+	c := &contentCache{
+		maxEntrySize: maxEntrySize,
+		memory:       newSizedLRU(memorySize, nil),
+	}
+
+	if dir == "" || diskSize <= 0 {
+		return c, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	c.dir = dir
+	c.disk = newSizedLRU(diskSize, func(e *lruEntry) {
+		var _ = os.Remove(filepath.Join(dir, e.cid))
+	})
+
+	files, err := os.ReadDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		info, err := f.Info()
+		if err != nil || !info.Mode().IsRegular() || !cidPattern.MatchString(f.Name()) {
+			continue
+		}
+		if !c.disk.add(&lruEntry{cid: f.Name(), size: info.Size()}) {
+			var _ = os.Remove(filepath.Join(dir, f.Name()))
+		}
+	}
+
+	cacheBytes.WithLabelValues("disk").Set(float64(c.disk.bytes))
+
+	return c, nil
+}
+
+func (c *contentCache) get(cid string) ([]byte, bool) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.memory.get(cid); ok {
+		c.memoryHits.Add(1)
+		cacheRequests.WithLabelValues("memory_hit").Inc()
+		return e.data, true
+	}
+
+	if c.disk != nil {
+		if _, ok := c.disk.get(cid); ok {
+			if data, err := os.ReadFile(filepath.Join(c.dir, cid)); err == nil {
+				c.diskHits.Add(1)
+				cacheRequests.WithLabelValues("disk_hit").Inc()
+				c.memory.add(&lruEntry{cid: cid, size: int64(len(data)), data: data})
+				cacheBytes.WithLabelValues("memory").Set(float64(c.memory.bytes))
+				return data, true
+			}
+			c.disk.remove(cid)
+		}
+	}
+
+	c.misses.Add(1)
+	cacheRequests.WithLabelValues("miss").Inc()
+
+	return nil, false
+}
+
+func (c *contentCache) put(cid string, data []byte) {
+
+	size := int64(len(data))
+
+	if size > c.maxEntrySize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.memory.add(&lruEntry{cid: cid, size: size, data: data})
+	cacheBytes.WithLabelValues("memory").Set(float64(c.memory.bytes))
+
+	if c.disk == nil || size > c.disk.maxBytes || !cidPattern.MatchString(cid) {
+		return
+	}
+
+	if _, ok := c.disk.get(cid); ok {
+		return
+	}
+
+	tmp, err := os.CreateTemp(c.dir, ".tmp-*")
+
+	if err != nil {
+		return
+	}
+
+	_, writeErr := tmp.Write(data)
+	closeErr := tmp.Close()
+
+	if writeErr != nil || closeErr != nil || os.Rename(tmp.Name(), filepath.Join(c.dir, cid)) != nil {
+		var _ = os.Remove(tmp.Name())
+		return
+	}
+
+	c.disk.add(&lruEntry{cid: cid, size: size})
+	cacheBytes.WithLabelValues("disk").Set(float64(c.disk.bytes))
+}
+
+func (c *contentCache) stats() CacheStats {
+	return CacheStats{
+		MemoryHits: c.memoryHits.Load(),
+		DiskHits:   c.diskHits.Load(),
+		Misses:     c.misses.Load(),
+	}
+}
@@ -0,0 +1,212 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSizedLRU(t *testing.T) {
+
+	evicted := []string{}
+	l := newSizedLRU(10, func(e *lruEntry) { evicted = append(evicted, e.cid) })
+
+	assert.True(t, l.add(&lruEntry{cid: "a", size: 4}))
+	assert.True(t, l.add(&lruEntry{cid: "b", size: 4}))
+	assert.False(t, l.add(&lruEntry{cid: "c", size: 11}))
+
+	var _, _ = l.get("a")
+	assert.True(t, l.add(&lruEntry{cid: "a", size: 4}))
+	assert.True(t, l.add(&lruEntry{cid: "d", size: 4}))
+
+	assert.Equal(t, []string{"b"}, evicted)
+	assert.Equal(t, int64(8), l.bytes)
+
+	_, ok := l.get("b")
+	assert.False(t, ok)
+}
+
+func TestContentCache(t *testing.T) {
+
+	t.Run("Memory Only", func(t *testing.T) {
+		c, err := newContentCache(8, 4, "", 0)
+		assert.NoError(t, err)
+
+		c.put("QmA", []byte("abc"))
+		c.put("QmB", []byte("too large"))
+
+		data, ok := c.get("QmA")
+		assert.True(t, ok)
+		assert.Equal(t, "abc", string(data))
+
+		_, ok = c.get("QmB")
+		assert.False(t, ok)
+
+		assert.Equal(t, CacheStats{MemoryHits: 1, Misses: 1}, c.stats())
+	})
+
+	t.Run("Disk Tier", func(t *testing.T) {
+		dir := t.TempDir()
+
+		c, err := newContentCache(4, 4, dir, 8)
+		assert.NoError(t, err)
+
+		c.put("QmA", []byte("abc"))
+		c.put("QmB", []byte("def"))
+		c.put("../escape", []byte("x"))
+
+		_, err = os.Stat(filepath.Join(dir, "QmA"))
+		assert.NoError(t, err)
+
+		data, ok := c.get("QmA")
+		assert.True(t, ok)
+		assert.Equal(t, "abc", string(data))
+		assert.Equal(t, uint64(1), c.stats().DiskHits)
+
+		c.put("QmC", []byte("ghi"))
+		_, err = os.Stat(filepath.Join(dir, "QmB"))
+		assert.True(t, os.IsNotExist(err))
+
+		var _ = os.WriteFile(filepath.Join(dir, "QmLarge"), []byte("0123456789"), 0o600)
+		var _ = os.WriteFile(filepath.Join(dir, "not-a-cid"), []byte("x"), 0o600)
+
+		reloaded, err := newContentCache(4, 4, dir, 8)
+		assert.NoError(t, err)
+
+		data, ok = reloaded.get("QmC")
+		assert.True(t, ok)
+		assert.Equal(t, "ghi", string(data))
+
+		_, err = os.Stat(filepath.Join(dir, "QmLarge"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Disk Entry Removed Externally", func(t *testing.T) {
+		dir := t.TempDir()
+
+		c, err := newContentCache(1, 4, dir, 8)
+		assert.NoError(t, err)
+
+		c.put("QmA", []byte("abc"))
+		var _ = os.Remove(filepath.Join(dir, "QmA"))
+
+		_, ok := c.get("QmA")
+		assert.False(t, ok)
+	})
+
+	t.Run("Unusable Directory", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "file")
+		var _ = os.WriteFile(file, []byte("x"), 0o600)
+
+		_, err := newContentCache(4, 4, file, 8)
+		assert.Error(t, err)
+	})
+}
+
+func TestCatCache(t *testing.T) {
+
+	t.Run("Read Through", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+		assert.NoError(t, WithContentCache(1024, 1024, "", 0)(mgr))
+
+		s.EXPECT().Cat("QmZv").Return(io.NopCloser(strings.NewReader("hello world")), nil).Once()
+
+		for i := 0; i < 3; i++ {
+			data, err := mgr.Cat("QmZv")
+			assert.NoError(t, err)
+			assert.Equal(t, "hello world", string(data))
+		}
+
+		assert.Equal(t, CacheStats{MemoryHits: 2, Misses: 1}, mgr.CacheStats())
+	})
+
+	t.Run("Without Cache", func(t *testing.T) {
+		_, mgr := newMockIPFSManager(t)
+		assert.NoError(t, WithContentCache(0, 0, "", 0)(mgr))
+		assert.Equal(t, CacheStats{}, mgr.CacheStats())
+	})
+
+	t.Run("Cache Initialization Failure", func(t *testing.T) {
+		_, mgr := newMockIPFSManager(t)
+		file := filepath.Join(t.TempDir(), "file")
+		var _ = os.WriteFile(file, []byte("x"), 0o600)
+		assert.Error(t, WithContentCache(1024, 1024, file, 1024)(mgr))
+		assert.Nil(t, mgr.cache)
+	})
+
+	t.Run("Timeout Still Warms Cache", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+		var _ = WithCatTimeout(time.Millisecond)(mgr)
+		var _ = WithContentCache(1024, 1024, "", 0)(mgr)
+
+		release := make(chan struct{})
+		s.EXPECT().Cat("QmZv").RunAndReturn(func(string) (io.ReadCloser, error) {
+			<-release
+			return io.NopCloser(strings.NewReader("hello world")), nil
+		}).Once()
+
+		_, err := mgr.Cat("QmZv")
+		assert.IsType(t, storageTimeoutError, err)
+		var _ = err.Status()
+		var _ = err.Message()
+
+		close(release)
+
+		data, err := mgr.CatContext(context.Background(), "QmZv")
+		assert.NoError(t, err)
+		assert.Equal(t, "hello world", string(data))
+	})
+
+	t.Run("Abandoned Fetch", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+		var _ = WithFetchTimeout(time.Millisecond)(mgr)
+		var _ = WithContentCache(1024, 0, "", 0)(mgr)
+
+		release := make(chan struct{})
+		defer close(release)
+
+		s.EXPECT().Cat("QmZv").RunAndReturn(func(string) (io.ReadCloser, error) {
+			<-release
+			return io.NopCloser(strings.NewReader("hello world")), nil
+		}).Once()
+		s.EXPECT().Cat("QmZv").Return(io.NopCloser(strings.NewReader("hello world")), nil).Once()
+
+		_, err := mgr.CatContext(context.Background(), "QmZv")
+		assert.IsType(t, storageTimeoutError, err)
+
+		mgr.mu.Lock()
+		assert.Empty(t, mgr.inflight)
+		mgr.mu.Unlock()
+
+		var _ = WithFetchTimeout(time.Minute)(mgr)
+
+		data, err := mgr.Cat("QmZv")
+		assert.NoError(t, err)
+		assert.Equal(t, "hello world", string(data))
+		assert.Equal(t, int64(defaultMaxCacheEntrySize), mgr.cache.maxEntrySize)
+
+		_, ok := mgr.cache.get("QmZv")
+		assert.True(t, ok)
+	})
+
+	t.Run("Read Failure", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+		s.EXPECT().Cat("QmZv").Return(io.NopCloser(&failingReader{}), nil).Once()
+
+		_, err := mgr.Cat("QmZv")
+		assert.IsType(t, ipfsBackendError, err)
+	})
+}
+
+type failingReader struct{}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("hello world")
+}
@@ -0,0 +1,252 @@
+package ipfs
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/rest"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	// rangeSkipLen is how far ahead a read may be served by discarding from
+	// the open stream rather than reopening it at the offset.
+	rangeSkipLen = 64 << 10
+	// maxRangeDiscard is how much is discarded at most to reach an offset on
+	// backends that can't read from one.
+	maxRangeDiscard = 4 << 20
+)
+
+var (
+	errNegativePosition = errors.New("seek to a negative position")
+	errRangeUnavailable = errors.New("range too far into content")
+)
+
+// RangeStorage is implemented by storage backends that read content from an
+// offset without reading what comes before it.
+type RangeStorage interface {
+	CatFrom(cid string, offset int64) (io.ReadCloser, error)
+}
+
+func WithOffchainStore(db *gorm.DB) IPFSManagerOption {
+	return func(mgr *IPFSManager) error {
+		mgr.db = db
+		return nil
+	}
+}
+
+func WithMaxContentSize(maxSize int64) IPFSManagerOption {
+	return func(mgr *IPFSManager) error {
+		if maxSize > 0 {
+			mgr.maxContentSize = maxSize
+		}
+		return nil
+	}
+}
+
+// resolve looks a CID up in the offchain store and reports its content type
+// and size when known. Only CIDs referenced by an asset, a thumbnail, an
+// avatar or a badge are served.
+func (m *IPFSManager) resolve(cid string) (string, int64, bool) {
+
+	if m.db == nil {
+		return "", 0, false
+	}
+
+	asset := Asset{}
+
+	if err := m.db.Where("c_id = ? OR thumbnail = ?", cid, cid).First(&asset).Error; err == nil {
+		switch {
+		case asset.CID == cid:
+			return asset.ContentType, int64(asset.Size), true
+		case asset.ContentType == "image/jpeg":
+			return "image/jpeg", 0, true
+		default:
+			return "image/png", 0, true
+		}
+	}
+
+	var count int64
+
+	if m.db.Model(&User{}).Where("avatar = ?", cid).Count(&count); count == 0 {
+		m.db.Model(&Badge{}).Where("c_id = ?", cid).Count(&count)
+	}
+
+	return "", 0, count != 0
+}
+
+func (m *IPFSManager) content(c echo.Context) error {
+
+	cid := c.Param("cid")
+
+	contentType, size, ok := "", int64(0), cidPattern.MatchString(cid)
+
+	if ok {
+		if private, found, err := m.private(cid, rest.WalletOf(c)); err != nil {
+			return c.JSON(err.Status(), err.Message())
+		} else if found {
+			return m.servePrivate(c, private)
+		}
+
+		contentType, size, ok = m.resolve(cid)
+	}
+
+	if !ok {
+		err := &StorageFileNotFoundError{}
+		return c.JSON(err.Status(), err.Message())
+	}
+
+	if size > m.maxContentSize {
+		return c.JSON(mediaTooLargeError.Status(), mediaTooLargeError.Message())
+	}
+
+	etag := `"` + cid + `"`
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderCacheControl, "private, max-age=31536000, immutable")
+	header.Set("ETag", etag)
+	header.Set(echo.HeaderXContentTypeOptions, "nosniff")
+
+	if c.Request().Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	if size <= 0 {
+		return m.streamContent(c, cid, contentType)
+	}
+
+	seeker := &catSeeker{storage: m.storage, cid: cid, size: size}
+	defer seeker.Close()
+
+	header.Set(echo.HeaderContentType, contentType)
+	http.ServeContent(c.Response(), c.Request(), "", time.Time{}, seeker)
+
+	return nil
+}
+
+// streamContent serves a CID of unknown size as it comes from the storage
+// backend. The limit is only known to be exceeded up front for payloads
+// shorter than the sniffed head, otherwise the response is cut short.
+func (m *IPFSManager) streamContent(c echo.Context, cid string, contentType string) error {
+
+	r, err := m.storage.Cat(cid)
+
+	if err != nil {
+		err := &StorageFileNotFoundError{}
+		return c.JSON(err.Status(), err.Message())
+	}
+
+	defer r.Close()
+
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, _ := br.Peek(sniffLen)
+
+	if len(head) < sniffLen && int64(len(head)) > m.maxContentSize {
+		return c.JSON(mediaTooLargeError.Status(), mediaTooLargeError.Message())
+	}
+
+	if contentType == "" {
+		contentType = sniff(head)
+	}
+
+	if err := c.Stream(http.StatusOK, contentType, &limitedReader{r: br, limit: m.maxContentSize}); err != nil {
+		m.logger.Warn("Content stream aborted", zap.String("cid", cid), zap.Error(err))
+	}
+
+	return nil
+}
+
+// catSeeker streams a CID of known size from the storage backend, reopening
+// the stream at the position a range starts from. Backends that can't read
+// from an offset are read from the start, up to maxRangeDiscard ahead.
+type catSeeker struct {
+	storage IPFSStorage
+	cid     string
+	size    int64
+	pos     int64
+	offset  int64
+	r       io.ReadCloser
+}
+
+func (s *catSeeker) Seek(offset int64, whence int) (int64, error) {
+
+	pos := s.pos
+
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos += offset
+	case io.SeekEnd:
+		pos = s.size + offset
+	}
+
+	if pos < 0 {
+		return s.pos, errNegativePosition
+	}
+
+	s.pos = pos
+	return pos, nil
+}
+
+func (s *catSeeker) Read(p []byte) (int, error) {
+
+	ranged, canRange := s.storage.(RangeStorage)
+
+	if s.r != nil && (s.pos < s.offset || canRange && s.pos-s.offset > rangeSkipLen) {
+		var _ = s.r.Close()
+		s.r = nil
+	}
+
+	if s.r == nil {
+
+		var r io.ReadCloser
+		var err error
+
+		if canRange {
+			r, err = ranged.CatFrom(s.cid, s.pos)
+		} else {
+			r, err = s.storage.Cat(s.cid)
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		s.r, s.offset = r, 0
+
+		if canRange {
+			s.offset = s.pos
+		}
+	}
+
+	if s.pos > s.offset {
+		if s.pos-s.offset > maxRangeDiscard {
+			return 0, errRangeUnavailable
+		}
+		n, err := io.CopyN(io.Discard, s.r, s.pos-s.offset)
+		s.offset += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := s.r.Read(p)
+	s.pos += int64(n)
+	s.offset += int64(n)
+
+	return n, err
+}
+
+func (s *catSeeker) Close() error {
+	if s.r != nil {
+		return s.r.Close()
+	}
+	return nil
+}
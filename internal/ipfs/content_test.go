@@ -0,0 +1,222 @@
+package ipfs
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Cealgull/Middleware/internal/config"
+	"github.com/Cealgull/Middleware/internal/fabric/offchain"
+	. "github.com/Cealgull/Middleware/internal/ipfs/mocks"
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func prepareContentData(t *testing.T) *gorm.DB {
+
+	db, err := offchain.NewOffchainStore(sqlite.Open("file::memory:"), &config.PostgresGormConfig{})
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.Create(&User{Username: "Alice", Wallet: "0x123456789", Avatar: "QmAvatar"}).Error)
+
+	assets := []*Asset{
+		{CID: "QmImage", Thumbnail: "QmThumb", ContentType: "image/png", Size: 11, CreatorWallet: "0x123456789"},
+		{CID: "QmPhoto", Thumbnail: "QmPhotoThumb", ContentType: "image/jpeg", Size: 11, CreatorWallet: "0x123456789"},
+		{CID: "QmHuge", ContentType: "video/mp4", Size: 1 << 40, CreatorWallet: "0x123456789"},
+	}
+	assert.NoError(t, db.Create(&assets).Error)
+
+	return db
+}
+
+func getContent(mgr *IPFSManager, cid string, header map[string]string) *httptest.ResponseRecorder {
+
+	req := httptest.NewRequest(http.MethodGet, "/api/content/"+cid, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+
+	c := server.NewContext(req, rec)
+	c.SetParamNames("cid")
+	c.SetParamValues(cid)
+
+	var _ = mgr.content(c)
+	return rec
+}
+
+// rangeStorage reads content from an offset, recording the offsets read.
+type rangeStorage struct {
+	*MockIPFSStorage
+	offsets []int64
+}
+
+func (s *rangeStorage) CatFrom(cid string, offset int64) (io.ReadCloser, error) {
+	s.offsets = append(s.offsets, offset)
+	return io.NopCloser(strings.NewReader("hello world"[offset:])), nil
+}
+
+func TestContent(t *testing.T) {
+
+	db := prepareContentData(t)
+
+	t.Run("Unknown CID", func(t *testing.T) {
+		_, mgr := newMockIPFSManager(t)
+		var _ = WithOffchainStore(db)(mgr)
+
+		assert.Equal(t, http.StatusNotFound, getContent(mgr, "QmUnknown", nil).Code)
+		assert.Equal(t, http.StatusNotFound, getContent(mgr, "..", nil).Code)
+	})
+
+	t.Run("Without Offchain Store", func(t *testing.T) {
+		_, mgr := newMockIPFSManager(t)
+		assert.Equal(t, http.StatusNotFound, getContent(mgr, "QmImage", nil).Code)
+	})
+
+	t.Run("Full Asset", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+		var _ = WithOffchainStore(db)(mgr)
+		s.EXPECT().Cat("QmImage").Return(io.NopCloser(strings.NewReader("hello world")), nil).Once()
+
+		rec := getContent(mgr, "QmImage", nil)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "hello world", rec.Body.String())
+		assert.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+		assert.Equal(t, `"QmImage"`, rec.Header().Get("ETag"))
+		assert.Contains(t, rec.Header().Get("Cache-Control"), "immutable")
+	})
+
+	t.Run("Range Of Asset", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+		var _ = WithOffchainStore(db)(mgr)
+		s.EXPECT().Cat("QmImage").Return(io.NopCloser(strings.NewReader("hello world")), nil).Once()
+
+		rec := getContent(mgr, "QmImage", map[string]string{"Range": "bytes=6-"})
+		assert.Equal(t, http.StatusPartialContent, rec.Code)
+		assert.Equal(t, "world", rec.Body.String())
+		assert.Equal(t, "bytes 6-10/11", rec.Header().Get("Content-Range"))
+	})
+
+	t.Run("Range Read From Offset", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+		var _ = WithOffchainStore(db)(mgr)
+		ranged := &rangeStorage{MockIPFSStorage: s}
+		var _ = WithIPFSStorage(ranged)(mgr)
+
+		rec := getContent(mgr, "QmImage", map[string]string{"Range": "bytes=6-"})
+		assert.Equal(t, http.StatusPartialContent, rec.Code)
+		assert.Equal(t, "world", rec.Body.String())
+		assert.Equal(t, []int64{6}, ranged.offsets)
+	})
+
+	t.Run("Range Too Far Without Offsets", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+		var _ = WithOffchainStore(db)(mgr)
+		var _ = WithMaxContentSize(1 << 41)(mgr)
+		s.EXPECT().Cat("QmHuge").Return(io.NopCloser(strings.NewReader("")), nil).Once()
+
+		rec := getContent(mgr, "QmHuge", map[string]string{"Range": "bytes=1099511627000-"})
+		assert.Empty(t, rec.Body.String())
+	})
+
+	t.Run("Not Modified", func(t *testing.T) {
+		_, mgr := newMockIPFSManager(t)
+		var _ = WithOffchainStore(db)(mgr)
+
+		rec := getContent(mgr, "QmImage", map[string]string{"If-None-Match": `"QmImage"`})
+		assert.Equal(t, http.StatusNotModified, rec.Code)
+	})
+
+	t.Run("Too Large", func(t *testing.T) {
+		_, mgr := newMockIPFSManager(t)
+		var _ = WithOffchainStore(db)(mgr)
+		var _ = WithMaxContentSize(1 << 20)(mgr)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, getContent(mgr, "QmHuge", nil).Code)
+	})
+
+	t.Run("Thumbnails", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+		var _ = WithOffchainStore(db)(mgr)
+		s.EXPECT().Cat("QmThumb").Return(io.NopCloser(strings.NewReader("png")), nil).Once()
+		s.EXPECT().Cat("QmPhotoThumb").Return(io.NopCloser(strings.NewReader("jpeg")), nil).Once()
+
+		assert.Equal(t, "image/png", getContent(mgr, "QmThumb", nil).Header().Get("Content-Type"))
+		assert.Equal(t, "image/jpeg", getContent(mgr, "QmPhotoThumb", nil).Header().Get("Content-Type"))
+	})
+
+	t.Run("Avatar Sniffed", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+		var _ = WithOffchainStore(db)(mgr)
+		s.EXPECT().Cat("QmAvatar").Return(io.NopCloser(strings.NewReader(string(encodePNG(t, 1, 1)))), nil).Once()
+
+		rec := getContent(mgr, "QmAvatar", nil)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+	})
+
+	t.Run("Avatar Too Large", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+		var _ = WithOffchainStore(db)(mgr)
+		var _ = WithMaxContentSize(4)(mgr)
+		s.EXPECT().Cat("QmAvatar").Return(io.NopCloser(strings.NewReader("hello world")), nil).Once()
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, getContent(mgr, "QmAvatar", nil).Code)
+	})
+
+	t.Run("Avatar Exceeding Limit While Streaming", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+		var _ = WithOffchainStore(db)(mgr)
+		var _ = WithMaxContentSize(sniffLen + 16)(mgr)
+		s.EXPECT().Cat("QmAvatar").Return(io.NopCloser(strings.NewReader(strings.Repeat("a", 2*sniffLen))), nil).Once()
+
+		rec := getContent(mgr, "QmAvatar", nil)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, sniffLen+16, rec.Body.Len())
+	})
+
+	t.Run("Avatar Backend Failure", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+		var _ = WithOffchainStore(db)(mgr)
+		s.EXPECT().Cat("QmAvatar").Return(nil, errors.New("hello world")).Once()
+
+		assert.Equal(t, http.StatusNotFound, getContent(mgr, "QmAvatar", nil).Code)
+	})
+}
+
+func TestCatSeeker(t *testing.T) {
+
+	s, _ := newMockIPFSManager(t)
+	s.EXPECT().Cat("QmZv").Return(io.NopCloser(strings.NewReader("hello world")), nil).Once()
+	s.EXPECT().Cat("QmZv").Return(io.NopCloser(strings.NewReader("hello world")), nil).Once()
+	s.EXPECT().Cat("QmZv").Return(nil, errors.New("hello world")).Once()
+
+	seeker := &catSeeker{storage: s, cid: "QmZv", size: 11}
+
+	end, err := seeker.Seek(0, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(11), end)
+
+	_, err = seeker.Seek(-20, io.SeekCurrent)
+	assert.Error(t, err)
+
+	var _, _ = seeker.Seek(6, io.SeekStart)
+	buf := make([]byte, 5)
+	n, _ := io.ReadFull(seeker, buf)
+	assert.Equal(t, "world", string(buf[:n]))
+
+	var _, _ = seeker.Seek(0, io.SeekStart)
+	n, _ = io.ReadFull(seeker, buf)
+	assert.Equal(t, "hello", string(buf[:n]))
+	assert.NoError(t, seeker.Close())
+
+	seeker = &catSeeker{storage: s, cid: "QmZv", size: 11}
+	_, err = seeker.Read(buf)
+	assert.Error(t, err)
+	assert.NoError(t, seeker.Close())
+}
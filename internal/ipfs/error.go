@@ -23,6 +23,23 @@ func (e *StorageBackendError) Error() string {
 	return "IPFS: IPFS Storage Backend Error or Timeout."
 }
 
+type StorageTimeoutError struct{}
+
+func (e *StorageTimeoutError) Status() int {
+	return http.StatusGatewayTimeout
+}
+
+func (e *StorageTimeoutError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "I0002",
+		Message: e.Error(),
+	}
+}
+
+func (e *StorageTimeoutError) Error() string {
+	return "IPFS: Timed out reading from the storage backend."
+}
+
 type UploadFileMissingError struct{}
 
 func (e *UploadFileMissingError) Status() int {
@@ -91,8 +108,118 @@ func (e *UploadJSONDecodeError) Message() *proto.ResponseMessage {
   }
 }
 
+type MediaTooLargeError struct{}
+
+func (e *MediaTooLargeError) Status() int {
+  return http.StatusRequestEntityTooLarge
+}
+
+func (e *MediaTooLargeError) Error() string {
+  return "IPFS: Media exceeds the size limit."
+}
+
+func (e *MediaTooLargeError) Message() *proto.ResponseMessage {
+  return &proto.ResponseMessage{
+    Code:    "B0006",
+    Message: e.Error(),
+  }
+}
+
+type MediaTypeUnsupportedError struct{}
+
+func (e *MediaTypeUnsupportedError) Status() int {
+  return http.StatusUnsupportedMediaType
+}
+
+func (e *MediaTypeUnsupportedError) Error() string {
+  return "IPFS: Media type is not supported."
+}
+
+func (e *MediaTypeUnsupportedError) Message() *proto.ResponseMessage {
+  return &proto.ResponseMessage{
+    Code:    "B0007",
+    Message: e.Error(),
+  }
+}
+
+type MediaDecodeError struct{}
+
+func (e *MediaDecodeError) Status() int {
+  return http.StatusBadRequest
+}
+
+func (e *MediaDecodeError) Error() string {
+  return "IPFS: Failed to decode media."
+}
+
+func (e *MediaDecodeError) Message() *proto.ResponseMessage {
+  return &proto.ResponseMessage{
+    Code:    "B0008",
+    Message: e.Error(),
+  }
+}
+
+type UploadReadError struct{}
+
+func (e *UploadReadError) Status() int {
+  return http.StatusBadRequest
+}
+
+func (e *UploadReadError) Error() string {
+  return "IPFS: Failed to read the upload body."
+}
+
+func (e *UploadReadError) Message() *proto.ResponseMessage {
+  return &proto.ResponseMessage{
+    Code:    "B0009",
+    Message: e.Error(),
+  }
+}
+
 var success *proto.Success = &proto.Success{}
 var uploadBase64DecodeError *UploadBase64DecodeError = &UploadBase64DecodeError{}
 var uploadFileMissingError *UploadFileMissingError = &UploadFileMissingError{}
 var uploadJSONDecodeError *UploadJSONDecodeError = &UploadJSONDecodeError{}
 var ipfsBackendError *StorageBackendError = &StorageBackendError{}
+var storageTimeoutError *StorageTimeoutError = &StorageTimeoutError{}
+var mediaTooLargeError *MediaTooLargeError = &MediaTooLargeError{}
+var mediaTypeUnsupportedError *MediaTypeUnsupportedError = &MediaTypeUnsupportedError{}
+var mediaDecodeError *MediaDecodeError = &MediaDecodeError{}
+var uploadReadError *UploadReadError = &UploadReadError{}
+
+type PrivateContentDisabledError struct{}
+
+func (e *PrivateContentDisabledError) Status() int {
+  return http.StatusNotImplemented
+}
+
+func (e *PrivateContentDisabledError) Error() string {
+  return "IPFS: Private content is not enabled on this middleware."
+}
+
+func (e *PrivateContentDisabledError) Message() *proto.ResponseMessage {
+  return &proto.ResponseMessage{
+    Code:    "B0010",
+    Message: e.Error(),
+  }
+}
+
+type ContentAccessDeniedError struct{}
+
+func (e *ContentAccessDeniedError) Status() int {
+  return http.StatusForbidden
+}
+
+func (e *ContentAccessDeniedError) Error() string {
+  return "IPFS: Access to the private content denied."
+}
+
+func (e *ContentAccessDeniedError) Message() *proto.ResponseMessage {
+  return &proto.ResponseMessage{
+    Code:    "B0011",
+    Message: e.Error(),
+  }
+}
+
+var privateContentDisabledError *PrivateContentDisabledError = &PrivateContentDisabledError{}
+var contentAccessDeniedError *ContentAccessDeniedError = &ContentAccessDeniedError{}
@@ -0,0 +1,190 @@
+package ipfs
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ipfs/go-cid"
+	ipfs "github.com/ipfs/go-ipfs-api"
+	"github.com/multiformats/go-multihash"
+)
+
+var errInvalidCID = errors.New("invalid cid")
+
+// rawCID returns the CIDv1 of a raw block with the given sha2-256 digest.
+func rawCID(digest []byte) (string, error) {
+	mh, err := multihash.Encode(digest, multihash.SHA2_256)
+	if err != nil {
+		return "", err
+	}
+	return cid.NewCidV1(cid.Raw, mh).String(), nil
+}
+
+// spool copies payload into a temporary file in dir while hashing it, so the
+// content address is known before the content is committed anywhere.
+func spool(dir string, payload io.Reader) (*os.File, []byte, int64, error) {
+
+	tmp, err := os.CreateTemp(dir, ".spool-*")
+
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), payload)
+
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		var _ = tmp.Close()
+		var _ = os.Remove(tmp.Name())
+		return nil, nil, 0, err
+	}
+
+	return tmp, h.Sum(nil), size, nil
+}
+
+// FilesystemStorage keeps content addressed blocks in a local directory. It
+// is meant for development and CI where running an IPFS node is overkill.
+// Added content is pinned, and unpinning removes the block right away.
+type FilesystemStorage struct {
+	root string
+}
+
+func NewFilesystemStorage(root string) (*FilesystemStorage, error) {
+
+	for _, dir := range []string{"blocks", "pins"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o700); err != nil {
+			return nil, err
+		}
+	}
+
+	return &FilesystemStorage{root: root}, nil
+}
+
+func WithFilesystem(root string) IPFSManagerOption {
+	return func(mgr *IPFSManager) error {
+		fs, err := NewFilesystemStorage(root)
+		if err != nil {
+			return err
+		}
+		mgr.storage = fs
+		return nil
+	}
+}
+
+func (s *FilesystemStorage) path(dir string, cid string) (string, error) {
+	if !cidPattern.MatchString(cid) {
+		return "", errInvalidCID
+	}
+	return filepath.Join(s.root, dir, cid), nil
+}
+
+func (s *FilesystemStorage) Version() (string, string, error) {
+	_, err := os.Stat(filepath.Join(s.root, "blocks"))
+	return "filesystem", "", err
+}
+
+// Add stores payload under its CIDv1. Options of the IPFS shell are ignored.
+func (s *FilesystemStorage) Add(payload io.Reader, opts ...ipfs.AddOpts) (string, error) {
+
+	tmp, digest, _, err := spool(s.root, payload)
+
+	if err != nil {
+		return "", err
+	}
+
+	var _ = tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	cid, err := rawCID(digest)
+
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(s.root, "blocks", cid)); err != nil {
+		return "", err
+	}
+
+	return cid, s.Pin(cid)
+}
+
+func (s *FilesystemStorage) Cat(cid string) (io.ReadCloser, error) {
+
+	path, err := s.path("blocks", cid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(path)
+}
+
+func (s *FilesystemStorage) CatFrom(cid string, offset int64) (io.ReadCloser, error) {
+
+	r, err := s.Cat(cid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := r.(*os.File).Seek(offset, io.SeekStart); err != nil {
+		var _ = r.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (s *FilesystemStorage) Pin(cid string) error {
+
+	block, err := s.path("blocks", cid)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(block); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(s.root, "pins", cid), nil, 0o600)
+}
+
+func (s *FilesystemStorage) Unpin(cid string) error {
+
+	pin, err := s.path("pins", cid)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(pin); err != nil {
+		return err
+	}
+
+	return os.Remove(filepath.Join(s.root, "blocks", cid))
+}
+
+func (s *FilesystemStorage) Pins() (map[string]ipfs.PinInfo, error) {
+
+	entries, err := os.ReadDir(filepath.Join(s.root, "pins"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	pins := map[string]ipfs.PinInfo{}
+
+	for _, e := range entries {
+		pins[e.Name()] = ipfs.PinInfo{Type: "recursive"}
+	}
+
+	return pins, nil
+}
@@ -0,0 +1,90 @@
+package ipfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Cealgull/Middleware/internal/config"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+const helloWorldCID = "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e"
+
+func TestFilesystemStorage(t *testing.T) {
+
+	root := t.TempDir()
+	s, err := NewFilesystemStorage(root)
+	assert.NoError(t, err)
+
+	_, _, err = s.Version()
+	assert.NoError(t, err)
+
+	cid, err := s.Add(strings.NewReader("hello world"))
+	assert.NoError(t, err)
+	assert.Equal(t, helloWorldCID, cid)
+
+	r, err := s.Cat(cid)
+	assert.NoError(t, err)
+	data, _ := io.ReadAll(r)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, "hello world", string(data))
+
+	r, err = s.CatFrom(cid, 6)
+	assert.NoError(t, err)
+	data, _ = io.ReadAll(r)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, "world", string(data))
+
+	pins, err := s.Pins()
+	assert.NoError(t, err)
+	assert.Contains(t, pins, cid)
+
+	_, err = s.Cat("../pins/" + cid)
+	assert.ErrorIs(t, err, errInvalidCID)
+	assert.Error(t, s.Pin("bafkreiunknown"))
+
+	assert.NoError(t, s.Unpin(cid))
+	assert.Error(t, s.Unpin(cid))
+
+	pins, _ = s.Pins()
+	assert.Empty(t, pins)
+
+	_, err = s.Cat(cid)
+	assert.Error(t, err)
+
+	spools, _ := filepath.Glob(filepath.Join(root, ".spool-*"))
+	assert.Empty(t, spools)
+}
+
+func TestStorageConfig(t *testing.T) {
+
+	logger, _ := zap.NewProduction()
+
+	mgr, err := NewIPFSManager(logger, WithStorageConfig(&config.IPFSConfig{
+		Backend:    "filesystem",
+		Filesystem: config.FilesystemStorageConfig{Root: t.TempDir()},
+	}))
+	assert.NoError(t, err)
+	assert.IsType(t, &FilesystemStorage{}, mgr.storage)
+
+	file := filepath.Join(t.TempDir(), "file")
+	assert.NoError(t, os.WriteFile(file, nil, 0o600))
+	_, err = NewIPFSManager(logger, WithStorageConfig(&config.IPFSConfig{
+		Backend:    "filesystem",
+		Filesystem: config.FilesystemStorageConfig{Root: file},
+	}))
+	assert.Error(t, err)
+
+	_, err = NewIPFSManager(logger, WithStorageConfig(&config.IPFSConfig{Backend: "tape"}))
+	assert.Error(t, err)
+
+	mgr = &IPFSManager{}
+	assert.NoError(t, WithStorageConfig(&config.IPFSConfig{Host: "localhost", Port: 5001})(mgr))
+	assert.NotNil(t, mgr.storage)
+	assert.NoError(t, WithStorageConfig(&config.IPFSConfig{Backend: "s3"})(mgr))
+	assert.IsType(t, &S3Storage{}, mgr.storage)
+}
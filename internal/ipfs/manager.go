@@ -2,27 +2,67 @@ package ipfs
 
 import (
 	"bytes"
+	"context"
+	"crypto/cipher"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/Cealgull/Middleware/internal/config"
+	. "github.com/Cealgull/Middleware/internal/models"
 	"github.com/Cealgull/Middleware/internal/proto"
+	"github.com/Cealgull/Middleware/internal/rest"
 	ipfs "github.com/ipfs/go-ipfs-api"
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type IPFSStorage interface {
 	Version() (string, string, error)
 	Add(payload io.Reader, opts ...ipfs.AddOpts) (string, error)
 	Cat(cid string) (io.ReadCloser, error)
+	Pin(cid string) error
+	Unpin(cid string) error
+	Pins() (map[string]ipfs.PinInfo, error)
 }
 
 type IPFSManager struct {
-	storage IPFSStorage
-	logger  *zap.Logger
+	storage       IPFSStorage
+	logger        *zap.Logger
+	maxMediaSize  int64
+	maxUploadSize int64
+	thumbnailSize int
+	mediaTypes    []string
+	catTimeout    time.Duration
+	fetchTimeout  time.Duration
+	cache         *contentCache
+	mu            sync.Mutex
+	inflight      map[string]*catCall
+
+	db             *gorm.DB
+	maxContentSize int64
+	keyWrap        cipher.AEAD
 }
 
+var errNoStorage = errors.New("no storage backend configured")
+
+const (
+	defaultCatTimeout        = 30 * time.Second
+	defaultFetchTimeout      = 2 * time.Minute
+	defaultMaxCacheEntrySize = 4 << 20
+)
+
+// uploadEnvelopeSize leaves room for the JSON or multipart framing around a
+// payload of the maximum upload size.
+const uploadEnvelopeSize = 1 << 16
+
 type IPFSManagerOption func(mgr *IPFSManager) error
 
 func WithIPFSStorage(storage IPFSStorage) IPFSManagerOption {
@@ -35,17 +75,116 @@ func WithIPFSStorage(storage IPFSStorage) IPFSManagerOption {
 func WithUrl(url string, port int) IPFSManagerOption {
 	return func(mgr *IPFSManager) error {
 		sh := ipfs.NewShell(fmt.Sprintf("%s:%d", url, port))
-		mgr.storage = sh
+		mgr.storage = &shellStorage{sh}
+		return nil
+	}
+}
+
+// shellStorage is the IPFS HTTP API.
+type shellStorage struct {
+	*ipfs.Shell
+}
+
+func (s *shellStorage) CatFrom(cid string, offset int64) (io.ReadCloser, error) {
+
+	resp, err := s.Request("cat", cid).Option("offset", offset).Send(context.Background())
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+
+	return resp.Output, nil
+}
+
+// WithStorageConfig picks the storage backend named in the IPFS section of
+// the configuration, defaulting to the IPFS HTTP API.
+func WithStorageConfig(cfg *config.IPFSConfig) IPFSManagerOption {
+	return func(mgr *IPFSManager) error {
+		switch cfg.Backend {
+		case "", "ipfs":
+			return WithUrl(cfg.Host, cfg.Port)(mgr)
+		case "filesystem":
+			return WithFilesystem(cfg.Filesystem.Root)(mgr)
+		case "s3":
+			return WithS3(S3Options(cfg.S3))(mgr)
+		default:
+			return fmt.Errorf("unknown storage backend %q", cfg.Backend)
+		}
+	}
+}
+
+func WithCatTimeout(timeout time.Duration) IPFSManagerOption {
+	return func(mgr *IPFSManager) error {
+		if timeout > 0 {
+			mgr.catTimeout = timeout
+		}
+		return nil
+	}
+}
+
+// WithFetchTimeout bounds the backend read shared by the callers of a CID,
+// which keeps going after they gave up in order to warm the cache.
+func WithFetchTimeout(timeout time.Duration) IPFSManagerOption {
+	return func(mgr *IPFSManager) error {
+		if timeout > 0 {
+			mgr.fetchTimeout = timeout
+		}
+		return nil
+	}
+}
+
+// WithContentCache puts a read-through cache in front of Cat. The disk tier
+// is only used when both dir and diskSize are set.
+func WithContentCache(memorySize int64, maxEntrySize int64, dir string, diskSize int64) IPFSManagerOption {
+	return func(mgr *IPFSManager) error {
+
+		if memorySize <= 0 {
+			return nil
+		}
+
+		if maxEntrySize <= 0 {
+			maxEntrySize = defaultMaxCacheEntrySize
+		}
+
+		cache, err := newContentCache(memorySize, maxEntrySize, dir, diskSize)
+
+		if err != nil {
+			mgr.logger.Warn("Failed to initialize content cache", zap.Error(err))
+			return err
+		}
+
+		mgr.cache = cache
 		return nil
 	}
 }
 
 func NewIPFSManager(logger *zap.Logger, options ...IPFSManagerOption) (*IPFSManager, error) {
 
-	mgr := IPFSManager{logger: logger}
+	mgr := IPFSManager{
+		logger:        logger,
+		maxMediaSize:  defaultMaxMediaSize,
+		maxUploadSize: defaultMaxUploadSize,
+		thumbnailSize: defaultThumbnailSize,
+		mediaTypes:    defaultMediaTypes,
+		catTimeout:    defaultCatTimeout,
+		fetchTimeout:  defaultFetchTimeout,
+		inflight:      map[string]*catCall{},
+
+		maxContentSize: defaultMaxUploadSize,
+	}
 
 	for _, option := range options {
-		var _ = option(&mgr)
+		if err := option(&mgr); err != nil {
+			return nil, err
+		}
+	}
+
+	if mgr.storage == nil {
+		return nil, errNoStorage
 	}
 
 	_, _, err := mgr.storage.Version()
@@ -56,30 +195,223 @@ func NewIPFSManager(logger *zap.Logger, options ...IPFSManagerOption) (*IPFSMana
 	return &mgr, nil
 }
 
+// Put stores payload and, with an offchain store, records the CID as
+// uploaded so that the pin reconciler may unpin it once nothing refers to it.
 func (m *IPFSManager) Put(payload io.Reader) (string, proto.MiddlewareError) {
 	cid, err := m.storage.Add(payload)
 	if err != nil {
 		return "", ipfsBackendError
 	}
+	if m.db != nil {
+		if err := m.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&UploadedContent{CID: cid}).Error; err != nil {
+			m.logger.Warn("Failed to record uploaded content", zap.String("cid", cid), zap.Error(err))
+		}
+	}
 	return cid, nil
 }
 
 func (m *IPFSManager) Cat(cid string) ([]byte, proto.MiddlewareError) {
-	r, err := m.storage.Cat(cid)
-	if err != nil {
-		return nil, &StorageFileNotFoundError{}
+	ctx, cancel := context.WithTimeout(context.Background(), m.catTimeout)
+	defer cancel()
+	return m.CatContext(ctx, cid)
+}
+
+// CatContext reads through the content cache. A read abandoned because of
+// ctx keeps going in the background and still warms the cache.
+func (m *IPFSManager) CatContext(ctx context.Context, cid string) ([]byte, proto.MiddlewareError) {
+
+	if m.cache != nil {
+		if data, ok := m.cache.get(cid); ok {
+			return data, nil
+		}
 	}
-	data, _ := io.ReadAll(r)
 
-	return data, nil
+	call := m.fetch(cid)
+
+	select {
+	case <-call.done:
+		return call.data, call.err
+	case <-ctx.Done():
+		return nil, storageTimeoutError
+	}
+}
+
+func (m *IPFSManager) CacheStats() CacheStats {
+	if m.cache == nil {
+		return CacheStats{}
+	}
+	return m.cache.stats()
+}
+
+type catCall struct {
+	done chan struct{}
+	data []byte
+	err  proto.MiddlewareError
 }
 
+// fetch shares a single backend read between concurrent callers of a CID.
+// The read is bounded by the fetch timeout, after which it is abandoned and
+// the next caller starts over.
+func (m *IPFSManager) fetch(cid string) *catCall {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if call, ok := m.inflight[cid]; ok {
+		return call
+	}
+
+	call := &catCall{done: make(chan struct{})}
+	m.inflight[cid] = call
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), m.fetchTimeout)
+		defer cancel()
+
+		call.data, call.err = m.cat(ctx, cid)
+
+		if call.err == nil && m.cache != nil {
+			m.cache.put(cid, call.data)
+		}
+
+		m.mu.Lock()
+		delete(m.inflight, cid)
+		m.mu.Unlock()
+
+		close(call.done)
+	}()
+
+	return call
+}
+
+// cat reads cid from the backend until ctx is done. The storage interface
+// takes no context, so an abandoned read is cut short by closing its body.
+func (m *IPFSManager) cat(ctx context.Context, cid string) ([]byte, proto.MiddlewareError) {
+
+	var (
+		data []byte
+		err  proto.MiddlewareError
+		mu   sync.Mutex
+		body io.ReadCloser
+		late bool
+	)
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		r, catErr := m.storage.Cat(cid)
+
+		if catErr != nil {
+			err = &StorageFileNotFoundError{}
+			return
+		}
+
+		mu.Lock()
+		body = r
+		if late {
+			var _ = r.Close()
+		}
+		mu.Unlock()
+
+		defer r.Close()
+
+		if data, catErr = io.ReadAll(r); catErr != nil {
+			data, err = nil, ipfsBackendError
+		}
+	}()
+
+	select {
+	case <-done:
+		return data, err
+	case <-ctx.Done():
+		mu.Lock()
+		late = true
+		if body != nil {
+			var _ = body.Close()
+		}
+		mu.Unlock()
+		return nil, storageTimeoutError
+	}
+}
+
+// store keeps an uploaded payload and describes what was stored.
+type store func(r io.Reader) (*Media, proto.MiddlewareError)
+
 func (m *IPFSManager) upload(c echo.Context) error {
+	return m.receive(c, m.Stream)
+}
+
+// receive reads an upload as JSON with a base64 payload, as the "file" field
+// of a multipart form or as a raw body, and hands it to store.
+func (m *IPFSManager) receive(c echo.Context, store store) error {
+
+	req := c.Request()
+	limit := m.maxUploadSize*4/3 + uploadEnvelopeSize
 
-	type UploadResponse struct {
-		Cid string `json:"cid"`
+	if req.ContentLength > limit {
+		return c.JSON(mediaTooLargeError.Status(), mediaTooLargeError.Message())
 	}
 
+	req.Body = http.MaxBytesReader(c.Response(), req.Body, limit)
+
+	contentType := req.Header.Get(echo.HeaderContentType)
+
+	switch {
+	case strings.HasPrefix(contentType, echo.MIMEApplicationJSON):
+		return m.uploadBase64(c, store)
+	case strings.HasPrefix(contentType, echo.MIMEMultipartForm):
+		return m.uploadMultipart(c, store)
+	}
+
+	return m.uploadRaw(c, store)
+}
+
+func (m *IPFSManager) uploadRaw(c echo.Context, store store) error {
+
+	if c.Request().ContentLength > m.maxUploadSize {
+		return c.JSON(mediaTooLargeError.Status(), mediaTooLargeError.Message())
+	}
+
+	if media, err := store(c.Request().Body); err != nil {
+		return c.JSON(err.Status(), err.Message())
+	} else {
+		return c.JSON(success.Status(), media)
+	}
+}
+
+func (m *IPFSManager) uploadMultipart(c echo.Context, store store) error {
+
+	mr, err := c.Request().MultipartReader()
+
+	if err != nil {
+		return c.JSON(uploadFileMissingError.Status(),
+			uploadFileMissingError.Message())
+	}
+
+	for {
+		part, err := mr.NextPart()
+
+		if err != nil {
+			return c.JSON(uploadFileMissingError.Status(),
+				uploadFileMissingError.Message())
+		}
+
+		if part.FormName() != "file" {
+			continue
+		}
+
+		if media, err := store(part); err != nil {
+			return c.JSON(err.Status(), err.Message())
+		} else {
+			return c.JSON(success.Status(), media)
+		}
+	}
+}
+
+func (m *IPFSManager) uploadBase64(c echo.Context, store store) error {
+
 	type UploadRequest struct {
 		Payload string `json:"payload"`
 	}
@@ -103,16 +435,21 @@ func (m *IPFSManager) upload(c echo.Context) error {
 			uploadBase64DecodeError.Message())
 	}
 
-	if cid, err := m.Put(bytes.NewReader(b)); err != nil {
+	if media, err := store(bytes.NewReader(b)); err != nil {
 		return c.JSON(err.Status(), err.Message())
 	} else {
-		uploadResponse := UploadResponse{Cid: cid}
-		return c.JSON(success.Status(), &uploadResponse)
+		return c.JSON(success.Status(), media)
 	}
 
 }
 
 func (im *IPFSManager) Register(echo *echo.Echo) error {
-	echo.POST("/api/upload", im.upload)
+	rest.Declare(echo, rest.AuthRequired,
+		echo.POST("/api/upload", im.upload),
+		echo.POST("/api/upload/private", im.uploadPrivate),
+		echo.POST("/api/content/:cid/readers", im.readers),
+		// private content is only served to its readers
+		echo.GET("/api/content/:cid", im.content),
+	)
 	return nil
 }
@@ -1,14 +1,19 @@
 package ipfs
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 
 	. "github.com/Cealgull/Middleware/internal/ipfs/mocks"
+	shell "github.com/ipfs/go-ipfs-api"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -44,6 +49,10 @@ func TestNewIPFSManager(t *testing.T) {
 	assert.Nil(t, mgr)
 	assert.Error(t, err)
 
+	mgr, err = NewIPFSManager(logger, WithEncryptionKey("not a key"), WithIPFSStorage(NewMockIPFSStorage(t)))
+	assert.Nil(t, mgr)
+	assert.Error(t, err)
+
 	var _, _ = newMockIPFSManager(t)
 }
 
@@ -133,7 +142,7 @@ func TestUpload(t *testing.T) {
 
 		s, mgr := newMockIPFSManager(t)
 
-		payload := strings.NewReader(`{"payload":"aGVsbG8gd29ybGQ="}`)
+		payload := strings.NewReader(`{"payload":"` + base64.StdEncoding.EncodeToString(encodePNG(t, 4, 4)) + `"}`)
 		s.Mock.On("Add", mock.Anything).Return("", errors.New("helloworld")).Once()
 
 		req := httptest.NewRequest(http.MethodPost, "/api/upload", payload)
@@ -149,8 +158,8 @@ func TestUpload(t *testing.T) {
 
 		s, mgr := newMockIPFSManager(t)
 
-		payload := strings.NewReader(`{"payload":"aGVsbG8gd29ybGQ="}`)
-		s.Mock.On("Add", mock.Anything).Return("base64", nil).Once()
+		payload := strings.NewReader(`{"payload":"` + base64.StdEncoding.EncodeToString(encodePNG(t, 4, 4)) + `"}`)
+		s.Mock.On("Add", mock.Anything).Return("base64", nil).Twice()
 
 		req := httptest.NewRequest(http.MethodPost, "/api/upload", payload)
 		req.Header.Set("Content-Type", "application/json")
@@ -161,6 +170,21 @@ func TestUpload(t *testing.T) {
 		assert.Equal(t, http.StatusOK, c.Response().Status)
 	})
 
+	t.Run("Payload with unsupported media type", func(t *testing.T) {
+
+		_, mgr := newMockIPFSManager(t)
+
+		payload := strings.NewReader(`{"payload":"aGVsbG8gd29ybGQ="}`)
+
+		req := httptest.NewRequest(http.MethodPost, "/api/upload", payload)
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+
+		c := server.NewContext(req, rec)
+		var _ = mgr.upload(c)
+		assert.Equal(t, http.StatusUnsupportedMediaType, c.Response().Status)
+	})
+
 	t.Run("Content-type missing", func(t *testing.T) {
 
 		_, mgr := newMockIPFSManager(t)
@@ -178,7 +202,14 @@ func TestUpload(t *testing.T) {
 	t.Run("Payload multipartfile missing error", func(t *testing.T) {
 
 		_, mgr := newMockIPFSManager(t)
-		req := httptest.NewRequest(http.MethodPost, "/api/upload", nil)
+
+		body := bytes.Buffer{}
+		w := multipart.NewWriter(&body)
+		var _ = w.WriteField("name", "avatar.png")
+		var _ = w.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/api/upload", &body)
+		req.Header.Set("Content-Type", w.FormDataContentType())
 		rec := httptest.NewRecorder()
 
 		c := server.NewContext(req, rec)
@@ -187,6 +218,107 @@ func TestUpload(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, http.StatusBadRequest, c.Response().Status)
 	})
+
+	t.Run("Payload multipart with broken boundary", func(t *testing.T) {
+
+		_, mgr := newMockIPFSManager(t)
+
+		req := httptest.NewRequest(http.MethodPost, "/api/upload", strings.NewReader("hello"))
+		req.Header.Set("Content-Type", "multipart/form-data")
+		rec := httptest.NewRecorder()
+
+		c := server.NewContext(req, rec)
+		var _ = mgr.upload(c)
+		assert.Equal(t, http.StatusBadRequest, c.Response().Status)
+	})
+
+	t.Run("Payload multipart success", func(t *testing.T) {
+
+		s, mgr := newMockIPFSManager(t)
+		s.EXPECT().Add(mock.Anything).Return("QmZv", nil).Twice()
+
+		body := bytes.Buffer{}
+		w := multipart.NewWriter(&body)
+		var _ = w.WriteField("name", "avatar.png")
+		part, _ := w.CreateFormFile("file", "avatar.png")
+		var _, _ = part.Write(encodePNG(t, 4, 4))
+		var _ = w.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/api/upload", &body)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		rec := httptest.NewRecorder()
+
+		c := server.NewContext(req, rec)
+		var _ = mgr.upload(c)
+		assert.Equal(t, http.StatusOK, c.Response().Status)
+
+		media := Media{}
+		var _ = json.Unmarshal(rec.Body.Bytes(), &media)
+		assert.Equal(t, "QmZv", media.CID)
+		assert.Equal(t, "image/png", media.ContentType)
+	})
+
+	t.Run("Payload raw stream success", func(t *testing.T) {
+
+		s, mgr := newMockIPFSManager(t)
+		var _ = WithMediaLimits(0, 0, []string{"text/plain"})(mgr)
+		s.EXPECT().Add(mock.Anything).RunAndReturn(func(r io.Reader, _ ...func(*shell.RequestBuilder) error) (string, error) {
+			var _, _ = io.ReadAll(r)
+			return "QmZv", nil
+		}).Once()
+
+		req := httptest.NewRequest(http.MethodPost, "/api/upload", strings.NewReader("hello world"))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		rec := httptest.NewRecorder()
+
+		c := server.NewContext(req, rec)
+		var _ = mgr.upload(c)
+		assert.Equal(t, http.StatusOK, c.Response().Status)
+
+		media := Media{}
+		var _ = json.Unmarshal(rec.Body.Bytes(), &media)
+		assert.Equal(t, "text/plain", media.ContentType)
+		assert.Equal(t, 11, media.Size)
+	})
+
+	t.Run("Payload raw stream exceeding limit", func(t *testing.T) {
+
+		s, mgr := newMockIPFSManager(t)
+		var _ = WithMediaLimits(0, 0, []string{"text/plain"})(mgr)
+		var _ = WithMaxUploadSize(4)(mgr)
+		s.EXPECT().Add(mock.Anything).RunAndReturn(func(r io.Reader, _ ...func(*shell.RequestBuilder) error) (string, error) {
+			_, err := io.ReadAll(r)
+			return "", err
+		}).Once()
+
+		req := httptest.NewRequest(http.MethodPost, "/api/upload", io.NopCloser(strings.NewReader("hello world")))
+		req.ContentLength = -1
+		rec := httptest.NewRecorder()
+
+		c := server.NewContext(req, rec)
+		var _ = mgr.upload(c)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, c.Response().Status)
+	})
+
+	t.Run("Payload with declared length exceeding limit", func(t *testing.T) {
+
+		_, mgr := newMockIPFSManager(t)
+		var _ = WithMaxUploadSize(4)(mgr)
+
+		req := httptest.NewRequest(http.MethodPost, "/api/upload", strings.NewReader("hello world"))
+		rec := httptest.NewRecorder()
+
+		c := server.NewContext(req, rec)
+		var _ = mgr.upload(c)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, c.Response().Status)
+
+		req = httptest.NewRequest(http.MethodPost, "/api/upload", strings.NewReader(strings.Repeat("a", 1<<17)))
+		rec = httptest.NewRecorder()
+
+		c = server.NewContext(req, rec)
+		var _ = mgr.upload(c)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, c.Response().Status)
+	})
 }
 
 func TestRegister(t *testing.T) {
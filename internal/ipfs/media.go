@@ -0,0 +1,659 @@
+package ipfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"strings"
+
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/proto"
+	"github.com/Cealgull/Middleware/internal/utils"
+	"go.uber.org/zap"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultMaxMediaSize  int64 = 8 << 20
+	defaultMaxUploadSize int64 = 64 << 20
+	defaultThumbnailSize int   = 256
+	maxMediaPixels       int   = 40_000_000
+	maxGIFFrames         int   = 256
+	maxAnimationPixels   int   = 80_000_000
+)
+
+// imageTypes are the types the pipeline knows how to decode. Other allowed
+// types are stored as they are.
+var imageTypes = []string{"image/jpeg", "image/png", "image/gif"}
+
+var defaultMediaTypes = imageTypes
+
+const sniffLen = 512
+
+var errMalformedMedia = errors.New("malformed media payload")
+var errUploadTooLarge = errors.New("upload exceeds the size limit")
+
+// Media describes a payload after it went through the media pipeline.
+// CID refers to the metadata-stripped original.
+type Media struct {
+	CID         string `json:"cid"`
+	Thumbnail   string `json:"thumbnail,omitempty"`
+	ContentType string `json:"contentType"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	Size        int    `json:"size"`
+}
+
+func WithMediaLimits(maxSize int64, thumbnailSize int, types []string) IPFSManagerOption {
+	return func(mgr *IPFSManager) error {
+		if maxSize > 0 {
+			mgr.maxMediaSize = maxSize
+		}
+		if thumbnailSize > 0 {
+			mgr.thumbnailSize = thumbnailSize
+		}
+		if len(types) != 0 {
+			mgr.mediaTypes = types
+		}
+		return nil
+	}
+}
+
+func WithMaxUploadSize(maxSize int64) IPFSManagerOption {
+	return func(mgr *IPFSManager) error {
+		if maxSize > 0 {
+			mgr.maxUploadSize = maxSize
+		}
+		return nil
+	}
+}
+
+func sniff(payload []byte) string {
+	contentType := http.DetectContentType(payload)
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return contentType
+}
+
+// Process validates an uploaded payload against the configured limits, strips
+// its metadata and stores both the original and a thumbnail.
+func (m *IPFSManager) Process(payload []byte) (*Media, proto.MiddlewareError) {
+
+	contentType := sniff(payload)
+
+	if !utils.Contains(m.mediaTypes, contentType) {
+		return nil, mediaTypeUnsupportedError
+	}
+
+	if !utils.Contains(imageTypes, contentType) {
+		return m.stream(bytes.NewReader(payload), contentType)
+	}
+
+	if int64(len(payload)) > m.maxMediaSize {
+		return nil, mediaTooLargeError
+	}
+
+	clean, img, err := m.prepare(contentType, payload)
+
+	if err != nil {
+		return nil, err
+	}
+
+	media := &Media{
+		ContentType: contentType,
+		Width:       img.Bounds().Dx(),
+		Height:      img.Bounds().Dy(),
+		Size:        len(clean),
+	}
+
+	if media.CID, err = m.Put(bytes.NewReader(clean)); err != nil {
+		return nil, err
+	}
+
+	if media.Thumbnail, err = m.putThumbnail(contentType, img); err != nil {
+		return nil, err
+	}
+
+	m.record(media)
+
+	return media, nil
+}
+
+// Stream sniffs the head of r and pipes the rest straight into the storage
+// backend. Images still go through Process since they have to be decoded.
+func (m *IPFSManager) Stream(r io.Reader) (*Media, proto.MiddlewareError) {
+
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, _ := br.Peek(sniffLen)
+
+	if len(head) == 0 {
+		return nil, uploadFileMissingError
+	}
+
+	contentType := sniff(head)
+
+	if !utils.Contains(m.mediaTypes, contentType) {
+		return nil, mediaTypeUnsupportedError
+	}
+
+	if !utils.Contains(imageTypes, contentType) {
+		return m.stream(br, contentType)
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(br, m.maxMediaSize+1))
+
+	if err != nil {
+		return nil, uploadReadError
+	}
+
+	return m.Process(payload)
+}
+
+func (m *IPFSManager) stream(r io.Reader, contentType string) (*Media, proto.MiddlewareError) {
+
+	lr := &limitedReader{r: r, limit: m.maxUploadSize}
+	cid, err := m.Put(lr)
+
+	if lr.exceeded {
+		return nil, mediaTooLargeError
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	media := &Media{CID: cid, ContentType: contentType, Size: int(lr.n)}
+	m.record(media)
+
+	return media, nil
+}
+
+// record keeps the metadata of an upload in the offchain store for Inspect.
+func (m *IPFSManager) record(media *Media) {
+
+	if m.db == nil {
+		return
+	}
+
+	info := MediaInfo{
+		CID:         media.CID,
+		ContentType: media.ContentType,
+		Thumbnail:   media.Thumbnail,
+		Width:       media.Width,
+		Height:      media.Height,
+		Size:        media.Size,
+	}
+
+	if err := m.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&info).Error; err != nil {
+		m.logger.Warn("Failed to record media metadata", zap.String("cid", media.CID), zap.Error(err))
+	}
+}
+
+// limitedReader fails the read once more than limit bytes went through,
+// which aborts the upload to the storage backend. Bytes past the limit are
+// never handed out.
+type limitedReader struct {
+	r        io.Reader
+	n        int64
+	limit    int64
+	exceeded bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.limit {
+		l.exceeded = true
+		return n - int(l.n-l.limit), errUploadTooLarge
+	}
+	return n, err
+}
+
+// Inspect describes an already stored payload. Uploads are described by the
+// metadata recorded when they went through the pipeline; anything else is
+// fetched and decoded once, then recorded as well. Thumbnails are generated
+// deterministically, so inspecting a processed upload yields the same
+// thumbnail CID without storing new content.
+func (m *IPFSManager) Inspect(cid string) (*Media, proto.MiddlewareError) {
+
+	if m.db != nil {
+		info := MediaInfo{}
+		if err := m.db.Where("c_id = ?", cid).Take(&info).Error; err == nil {
+			return &Media{
+				CID:         info.CID,
+				Thumbnail:   info.Thumbnail,
+				ContentType: info.ContentType,
+				Width:       info.Width,
+				Height:      info.Height,
+				Size:        info.Size,
+			}, nil
+		}
+	}
+
+	media, err := m.inspect(cid)
+
+	if err == nil {
+		m.record(media)
+	}
+
+	return media, err
+}
+
+func (m *IPFSManager) inspect(cid string) (*Media, proto.MiddlewareError) {
+
+	data, err := m.Cat(cid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	media := &Media{
+		CID:         cid,
+		ContentType: sniff(data),
+		Size:        len(data),
+	}
+
+	if !utils.Contains(imageTypes, media.ContentType) {
+		return media, nil
+	}
+
+	_, img, err := m.prepare(media.ContentType, data)
+
+	if err != nil {
+		return media, nil
+	}
+
+	media.Width, media.Height = img.Bounds().Dx(), img.Bounds().Dy()
+
+	if media.Thumbnail, err = m.putThumbnail(media.ContentType, img); err != nil {
+		return nil, err
+	}
+
+	return media, nil
+}
+
+func (m *IPFSManager) prepare(contentType string, payload []byte) ([]byte, image.Image, proto.MiddlewareError) {
+
+	if config, _, err := image.DecodeConfig(bytes.NewReader(payload)); err != nil {
+		return nil, nil, mediaDecodeError
+	} else if config.Width*config.Height > maxMediaPixels {
+		return nil, nil, mediaTooLargeError
+	}
+
+	if contentType == "image/gif" {
+		if frames, pixels, err := gifFrames(payload); err != nil {
+			return nil, nil, mediaDecodeError
+		} else if frames > maxGIFFrames || pixels > maxAnimationPixels {
+			return nil, nil, mediaTooLargeError
+		}
+	}
+
+	clean, err := stripMetadata(contentType, payload)
+
+	if err != nil {
+		return nil, nil, mediaDecodeError
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(clean))
+
+	if err != nil {
+		return nil, nil, mediaDecodeError
+	}
+
+	return clean, img, nil
+}
+
+func (m *IPFSManager) putThumbnail(contentType string, img image.Image) (string, proto.MiddlewareError) {
+
+	thumb := thumbnail(img, m.thumbnailSize)
+	buf := bytes.Buffer{}
+
+	if contentType == "image/jpeg" {
+		var _ = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80})
+	} else {
+		var _ = png.Encode(&buf, thumb)
+	}
+
+	return m.Put(&buf)
+}
+
+func stripMetadata(contentType string, payload []byte) ([]byte, error) {
+
+	switch contentType {
+
+	case "image/jpeg":
+
+		clean, orientation, err := stripJPEG(payload)
+
+		if err != nil || orientation <= 1 || orientation > 8 {
+			return clean, err
+		}
+
+		// The orientation tag is dropped with the rest of EXIF, so bake it
+		// into the pixels instead.
+		img, err := jpeg.Decode(bytes.NewReader(clean))
+
+		if err != nil {
+			return nil, err
+		}
+
+		buf := bytes.Buffer{}
+		err = jpeg.Encode(&buf, orient(img, orientation), &jpeg.Options{Quality: 95})
+		return buf.Bytes(), err
+
+	case "image/png":
+		return stripPNG(payload)
+
+	case "image/gif":
+
+		g, err := gif.DecodeAll(bytes.NewReader(payload))
+
+		if err != nil {
+			return nil, err
+		}
+
+		buf := bytes.Buffer{}
+		err = gif.EncodeAll(&buf, g)
+		return buf.Bytes(), err
+
+	}
+
+	return payload, nil
+}
+
+// gifFrames walks the blocks of a GIF without decoding it and reports the
+// number of frames along with the pixels they add up to, so that animations
+// too large to decode are rejected up front.
+func gifFrames(data []byte) (int, int, error) {
+
+	if len(data) < 13 || !bytes.HasPrefix(data, []byte("GIF8")) {
+		return 0, 0, errMalformedMedia
+	}
+
+	i := 13
+
+	if data[10]&0x80 != 0 {
+		i += 3 << (data[10]&0x07 + 1)
+	}
+
+	// skip jumps over a sequence of data sub-blocks and its terminator.
+	skip := func(i int) int {
+		for i < len(data) && data[i] != 0 {
+			i += int(data[i]) + 1
+		}
+		return i + 1
+	}
+
+	frames, pixels := 0, 0
+
+	for i < len(data) {
+
+		switch data[i] {
+
+		case 0x21:
+			i = skip(i + 2)
+
+		case 0x2C:
+			if i+10 > len(data) {
+				return 0, 0, errMalformedMedia
+			}
+
+			w := int(binary.LittleEndian.Uint16(data[i+5:]))
+			h := int(binary.LittleEndian.Uint16(data[i+7:]))
+			frames, pixels = frames+1, pixels+w*h
+
+			if frames > maxGIFFrames || pixels > maxAnimationPixels {
+				return frames, pixels, nil
+			}
+
+			flags := data[i+9]
+			i += 10
+
+			if flags&0x80 != 0 {
+				i += 3 << (flags&0x07 + 1)
+			}
+
+			i = skip(i + 1)
+
+		case 0x3B:
+			return frames, pixels, nil
+
+		default:
+			return 0, 0, errMalformedMedia
+		}
+	}
+
+	return 0, 0, errMalformedMedia
+}
+
+// stripJPEG drops EXIF, XMP, IPTC and comment segments without re-encoding
+// and reports the EXIF orientation found along the way.
+func stripJPEG(data []byte) ([]byte, int, error) {
+
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, 0, errMalformedMedia
+	}
+
+	out := bytes.Buffer{}
+	out.Write(data[:2])
+	orientation := 1
+
+	for i := 2; i+4 <= len(data); {
+
+		if data[i] != 0xFF {
+			return nil, 0, errMalformedMedia
+		}
+
+		marker := data[i+1]
+
+		switch {
+		case marker == 0xFF:
+			i++
+			continue
+		case marker == 0xDA || marker == 0xD9:
+			out.Write(data[i:])
+			return out.Bytes(), orientation, nil
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			out.Write(data[i : i+2])
+			i += 2
+			continue
+		}
+
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+
+		if end < i+4 || end > len(data) {
+			return nil, 0, errMalformedMedia
+		}
+
+		switch segment := data[i+4 : end]; marker {
+		case 0xE1:
+			if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				orientation = exifOrientation(segment[6:])
+			}
+		case 0xED, 0xFE:
+		default:
+			out.Write(data[i:end])
+		}
+
+		i = end
+	}
+
+	return nil, 0, errMalformedMedia
+}
+
+func exifOrientation(tiff []byte) int {
+
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+
+	count := int(order.Uint16(tiff[ifd:]))
+
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+
+	return 1
+}
+
+var pngMetadataChunks = []string{"eXIf", "tEXt", "zTXt", "iTXt", "tIME"}
+
+func stripPNG(data []byte) ([]byte, error) {
+
+	const signature = "\x89PNG\r\n\x1a\n"
+
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, errMalformedMedia
+	}
+
+	out := bytes.Buffer{}
+	out.WriteString(signature)
+
+	for i := len(signature); i+12 <= len(data); {
+
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+
+		if end < i+12 || end > len(data) {
+			return nil, errMalformedMedia
+		}
+
+		kind := string(data[i+4 : i+8])
+
+		if !utils.Contains(pngMetadataChunks, kind) {
+			out.Write(data[i:end])
+		}
+
+		if kind == "IEND" {
+			return out.Bytes(), nil
+		}
+
+		i = end
+	}
+
+	return nil, errMalformedMedia
+}
+
+// orient maps an image stored with the given EXIF orientation to its upright form.
+func orient(src image.Image, orientation int) image.Image {
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := x, y
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, src.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+
+	return dst
+}
+
+// thumbnail box-filters src down so that it fits within a size x size square.
+func thumbnail(src image.Image, size int) image.Image {
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	tw, th := w, h
+
+	if w > size || h > size {
+		if w >= h {
+			tw, th = size, h*size/w
+		} else {
+			tw, th = w*size/h, size
+		}
+	}
+
+	tw, th = max(tw, 1), max(th, 1)
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+
+	for y := 0; y < th; y++ {
+
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+max((y+1)*h/th, y*h/th+1)
+
+		for x := 0; x < tw; x++ {
+
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+max((x+1)*w/tw, x*w/tw+1)
+
+			var r, g, bl, a, n uint64
+
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+
+	return dst
+}
+
+func max(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
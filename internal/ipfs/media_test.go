@@ -0,0 +1,291 @@
+package ipfs
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/Cealgull/Middleware/internal/config"
+	"github.com/Cealgull/Middleware/internal/fabric/offchain"
+	. "github.com/Cealgull/Middleware/internal/models"
+	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"gorm.io/driver/sqlite"
+)
+
+func encodePNG(t *testing.T, w int, h int) []byte {
+	buf := bytes.Buffer{}
+	assert.NoError(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h))))
+	return buf.Bytes()
+}
+
+func encodeGIF(t *testing.T, w int, h int, frames int) []byte {
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, w, h), color.Palette{color.Black, color.White}))
+		g.Delay = append(g.Delay, 0)
+	}
+	buf := bytes.Buffer{}
+	assert.NoError(t, gif.EncodeAll(&buf, g))
+	return buf.Bytes()
+}
+
+// withPNGText inserts a tEXt chunk right after IHDR.
+func withPNGText(data []byte) []byte {
+	chunk := []byte{0, 0, 0, 4, 't', 'E', 'X', 't', 'a', '\x00', 'b', 'c', 0, 0, 0, 0}
+	ihdr := 8 + 12 + 13
+	return append(append(append([]byte{}, data[:ihdr]...), chunk...), data[ihdr:]...)
+}
+
+// encodeJPEG produces a jpeg carrying an EXIF segment with the given orientation.
+func encodeJPEG(t *testing.T, w int, h int, orientation byte) []byte {
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	img.Set(0, 0, color.White)
+
+	buf := bytes.Buffer{}
+	assert.NoError(t, jpeg.Encode(&buf, img, nil))
+
+	tiff := []byte{'I', 'I', 42, 0, 8, 0, 0, 0, 1, 0, 0x12, 0x01, 3, 0, 1, 0, 0, 0, orientation, 0, 0, 0, 0, 0, 0, 0}
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := append([]byte{0xFF, 0xE1, 0, byte(len(segment) + 2)}, segment...)
+
+	data := buf.Bytes()
+	return append(append(append([]byte{}, data[:2]...), app1...), data[2:]...)
+}
+
+func TestWithMediaLimits(t *testing.T) {
+	mgr := &IPFSManager{maxMediaSize: defaultMaxMediaSize, thumbnailSize: defaultThumbnailSize, mediaTypes: defaultMediaTypes}
+	var _ = WithMediaLimits(0, 0, nil)(mgr)
+	assert.Equal(t, defaultMaxMediaSize, mgr.maxMediaSize)
+	var _ = WithMediaLimits(16, 8, []string{"image/png"})(mgr)
+	assert.Equal(t, int64(16), mgr.maxMediaSize)
+	assert.Equal(t, 8, mgr.thumbnailSize)
+	assert.Equal(t, []string{"image/png"}, mgr.mediaTypes)
+}
+
+func TestProcess(t *testing.T) {
+
+	t.Run("PNG With Metadata", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+
+		var stored [][]byte
+		s.EXPECT().Add(mock.Anything).RunAndReturn(func(r io.Reader, _ ...func(*shell.RequestBuilder) error) (string, error) {
+			b, _ := io.ReadAll(r)
+			stored = append(stored, b)
+			return "Qm" + string(rune('0'+len(stored))), nil
+		}).Twice()
+
+		media, err := mgr.Process(withPNGText(encodePNG(t, 512, 256)))
+		assert.NoError(t, err)
+		assert.Equal(t, "Qm1", media.CID)
+		assert.Equal(t, "Qm2", media.Thumbnail)
+		assert.Equal(t, "image/png", media.ContentType)
+		assert.Equal(t, 512, media.Width)
+		assert.Equal(t, 256, media.Height)
+		assert.NotContains(t, string(stored[0]), "tEXt")
+
+		thumb, _, decodeErr := image.DecodeConfig(bytes.NewReader(stored[1]))
+		assert.NoError(t, decodeErr)
+		assert.Equal(t, 256, thumb.Width)
+		assert.Equal(t, 128, thumb.Height)
+	})
+
+	t.Run("JPEG With Orientation", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+
+		var original []byte
+		s.EXPECT().Add(mock.Anything).RunAndReturn(func(r io.Reader, _ ...func(*shell.RequestBuilder) error) (string, error) {
+			if original == nil {
+				original, _ = io.ReadAll(r)
+			}
+			return "QmZv", nil
+		}).Twice()
+
+		media, err := mgr.Process(encodeJPEG(t, 8, 4, 6))
+		assert.NoError(t, err)
+		assert.Equal(t, "image/jpeg", media.ContentType)
+		assert.Equal(t, 4, media.Width)
+		assert.Equal(t, 8, media.Height)
+		assert.NotContains(t, string(original), "Exif")
+	})
+
+	t.Run("JPEG Without Orientation", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+		s.EXPECT().Add(mock.Anything).Return("QmZv", nil).Twice()
+
+		payload := encodeJPEG(t, 8, 4, 1)
+		media, err := mgr.Process(payload)
+		assert.NoError(t, err)
+		assert.Equal(t, 8, media.Width)
+		assert.Equal(t, len(payload)-36, media.Size)
+	})
+
+	t.Run("Too Large", func(t *testing.T) {
+		_, mgr := newMockIPFSManager(t)
+		var _ = WithMediaLimits(16, 0, nil)(mgr)
+		_, err := mgr.Process(encodePNG(t, 4, 4))
+		assert.IsType(t, mediaTooLargeError, err)
+		var _ = err.Status()
+		var _ = err.Message()
+	})
+
+	t.Run("Unsupported Type", func(t *testing.T) {
+		_, mgr := newMockIPFSManager(t)
+		_, err := mgr.Process([]byte("hello world"))
+		assert.IsType(t, mediaTypeUnsupportedError, err)
+		var _ = err.Status()
+		var _ = err.Message()
+	})
+
+	t.Run("Decode Error", func(t *testing.T) {
+		_, mgr := newMockIPFSManager(t)
+		payload := encodePNG(t, 4, 4)
+		_, err := mgr.Process(payload[:len(payload)-20])
+		assert.IsType(t, mediaDecodeError, err)
+		var _ = err.Status()
+		var _ = err.Message()
+	})
+
+	t.Run("Backend Error", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+		s.EXPECT().Add(mock.Anything).Return("QmZv", nil).Once()
+		s.EXPECT().Add(mock.Anything).Return("", errors.New("hello world")).Once()
+		_, err := mgr.Process(encodePNG(t, 4, 4))
+		assert.IsType(t, ipfsBackendError, err)
+	})
+}
+
+func TestInspect(t *testing.T) {
+
+	t.Run("Image", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+		s.EXPECT().Cat("QmZv").Return(io.NopCloser(bytes.NewReader(encodePNG(t, 4, 2))), nil).Once()
+		s.EXPECT().Add(mock.Anything).Return("QmTh", nil).Once()
+
+		media, err := mgr.Inspect("QmZv")
+		assert.NoError(t, err)
+		assert.Equal(t, "QmTh", media.Thumbnail)
+		assert.Equal(t, 4, media.Width)
+		assert.Equal(t, 2, media.Height)
+	})
+
+	t.Run("Not An Image", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+		s.EXPECT().Cat("QmZv").Return(io.NopCloser(strings.NewReader("hello world")), nil).Once()
+
+		media, err := mgr.Inspect("QmZv")
+		assert.NoError(t, err)
+		assert.Equal(t, "text/plain", media.ContentType)
+		assert.Empty(t, media.Thumbnail)
+	})
+
+	t.Run("Corrupted Image", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+		payload := encodePNG(t, 4, 4)
+		s.EXPECT().Cat("QmZv").Return(io.NopCloser(bytes.NewReader(payload[:len(payload)-20])), nil).Once()
+
+		media, err := mgr.Inspect("QmZv")
+		assert.NoError(t, err)
+		assert.Equal(t, "image/png", media.ContentType)
+		assert.Empty(t, media.Thumbnail)
+	})
+
+	t.Run("Not Found", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+		s.EXPECT().Cat("QmZv").Return(nil, errors.New("hello world")).Once()
+
+		_, err := mgr.Inspect("QmZv")
+		assert.Error(t, err)
+	})
+}
+
+func TestInspectRecorded(t *testing.T) {
+
+	db, err := offchain.NewOffchainStore(sqlite.Open("file:inspect?mode=memory&cache=shared"), &config.PostgresGormConfig{})
+	assert.NoError(t, err)
+
+	s, mgr := newMockIPFSManager(t)
+	var _ = WithOffchainStore(db)(mgr)
+
+	t.Run("Uploads are recorded", func(t *testing.T) {
+		s.EXPECT().Add(mock.Anything).Return("QmUp", nil).Once()
+		s.EXPECT().Add(mock.Anything).Return("QmUpThumb", nil).Once()
+
+		_, err := mgr.Process(encodePNG(t, 8, 4))
+		assert.NoError(t, err)
+
+		media, err := mgr.Inspect("QmUp")
+		assert.NoError(t, err)
+		assert.Equal(t, "QmUpThumb", media.Thumbnail)
+		assert.Equal(t, "image/png", media.ContentType)
+		assert.Equal(t, 8, media.Width)
+		assert.Equal(t, 4, media.Height)
+	})
+
+	t.Run("Unknown content is inspected once", func(t *testing.T) {
+		s.EXPECT().Cat("QmOld").Return(io.NopCloser(strings.NewReader("hello world")), nil).Once()
+
+		for i := 0; i < 2; i++ {
+			media, err := mgr.Inspect("QmOld")
+			assert.NoError(t, err)
+			assert.Equal(t, "text/plain", media.ContentType)
+		}
+
+		var info MediaInfo
+		assert.NoError(t, db.Where("c_id = ?", "QmOld").Take(&info).Error)
+		assert.Equal(t, 11, info.Size)
+	})
+}
+
+func TestGIFLimits(t *testing.T) {
+
+	t.Run("Animation", func(t *testing.T) {
+		s, mgr := newMockIPFSManager(t)
+		s.EXPECT().Add(mock.Anything).Return("QmZv", nil).Twice()
+
+		media, err := mgr.Process(encodeGIF(t, 4, 2, 3))
+		assert.NoError(t, err)
+		assert.Equal(t, "image/gif", media.ContentType)
+		assert.Equal(t, 4, media.Width)
+	})
+
+	t.Run("Too Many Frames", func(t *testing.T) {
+		_, mgr := newMockIPFSManager(t)
+		_, err := mgr.Process(encodeGIF(t, 1, 1, maxGIFFrames+1))
+		assert.Equal(t, mediaTooLargeError, err)
+	})
+
+	t.Run("Frame Walk", func(t *testing.T) {
+		payload := encodeGIF(t, 1, 1, 2)
+		frames, pixels, err := gifFrames(payload)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, frames)
+		assert.Equal(t, 2, pixels)
+
+		_, _, err = gifFrames(payload[:len(payload)-1])
+		assert.Error(t, err)
+	})
+}
+
+func TestOrient(t *testing.T) {
+
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, color.White)
+
+	for orientation, corner := range map[int]image.Point{
+		2: {1, 0}, 3: {1, 0}, 4: {0, 0}, 5: {0, 0}, 6: {0, 0}, 7: {0, 1}, 8: {0, 1},
+	} {
+		dst := orient(src, orientation)
+		r, _, _, _ := dst.At(corner.X, corner.Y).RGBA()
+		assert.Equal(t, uint32(0xffff), r, "orientation %d", orientation)
+	}
+}
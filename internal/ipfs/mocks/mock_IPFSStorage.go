@@ -144,6 +144,143 @@ func (_c *MockIPFSStorage_Cat_Call) RunAndReturn(run func(string) (io.ReadCloser
 	return _c
 }
 
+// Pin provides a mock function with given fields: cid
+func (_m *MockIPFSStorage) Pin(cid string) error {
+	ret := _m.Called(cid)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string) error); ok {
+		r0 = rf(cid)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// MockIPFSStorage_Pin_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Pin'
+type MockIPFSStorage_Pin_Call struct {
+	*mock.Call
+}
+
+// Pin is a helper method to define mock.On call
+//   - cid string
+func (_e *MockIPFSStorage_Expecter) Pin(cid interface{}) *MockIPFSStorage_Pin_Call {
+	return &MockIPFSStorage_Pin_Call{Call: _e.mock.On("Pin", cid)}
+}
+
+func (_c *MockIPFSStorage_Pin_Call) Run(run func(cid string)) *MockIPFSStorage_Pin_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string))
+	})
+	return _c
+}
+
+func (_c *MockIPFSStorage_Pin_Call) Return(_a0 error) *MockIPFSStorage_Pin_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPFSStorage_Pin_Call) RunAndReturn(run func(string) error) *MockIPFSStorage_Pin_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Pins provides a mock function with given fields:
+func (_m *MockIPFSStorage) Pins() (map[string]shell.PinInfo, error) {
+	ret := _m.Called()
+
+	var r0 map[string]shell.PinInfo
+	var r1 error
+	if rf, ok := ret.Get(0).(func() (map[string]shell.PinInfo, error)); ok {
+		return rf()
+	}
+	if rf, ok := ret.Get(0).(func() map[string]shell.PinInfo); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(map[string]shell.PinInfo)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// MockIPFSStorage_Pins_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Pins'
+type MockIPFSStorage_Pins_Call struct {
+	*mock.Call
+}
+
+// Pins is a helper method to define mock.On call
+func (_e *MockIPFSStorage_Expecter) Pins() *MockIPFSStorage_Pins_Call {
+	return &MockIPFSStorage_Pins_Call{Call: _e.mock.On("Pins")}
+}
+
+func (_c *MockIPFSStorage_Pins_Call) Run(run func()) *MockIPFSStorage_Pins_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *MockIPFSStorage_Pins_Call) Return(_a0 map[string]shell.PinInfo, _a1 error) *MockIPFSStorage_Pins_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *MockIPFSStorage_Pins_Call) RunAndReturn(run func() (map[string]shell.PinInfo, error)) *MockIPFSStorage_Pins_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Unpin provides a mock function with given fields: cid
+func (_m *MockIPFSStorage) Unpin(cid string) error {
+	ret := _m.Called(cid)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string) error); ok {
+		r0 = rf(cid)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// MockIPFSStorage_Unpin_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Unpin'
+type MockIPFSStorage_Unpin_Call struct {
+	*mock.Call
+}
+
+// Unpin is a helper method to define mock.On call
+//   - cid string
+func (_e *MockIPFSStorage_Expecter) Unpin(cid interface{}) *MockIPFSStorage_Unpin_Call {
+	return &MockIPFSStorage_Unpin_Call{Call: _e.mock.On("Unpin", cid)}
+}
+
+func (_c *MockIPFSStorage_Unpin_Call) Run(run func(cid string)) *MockIPFSStorage_Unpin_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string))
+	})
+	return _c
+}
+
+func (_c *MockIPFSStorage_Unpin_Call) Return(_a0 error) *MockIPFSStorage_Unpin_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPFSStorage_Unpin_Call) RunAndReturn(run func(string) error) *MockIPFSStorage_Unpin_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // Version provides a mock function with given fields:
 func (_m *MockIPFSStorage) Version() (string, string, error) {
 	ret := _m.Called()
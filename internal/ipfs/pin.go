@@ -0,0 +1,213 @@
+package ipfs
+
+import (
+	"context"
+	"time"
+
+	. "github.com/Cealgull/Middleware/internal/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPinInterval    = 10 * time.Minute
+	defaultPinGracePeriod = 24 * time.Hour
+)
+
+// PinReconciler keeps the pins of the IPFS node in line with the offchain
+// store: referenced content is pinned, and content the middleware uploaded
+// that nobody references is unpinned once it has been orphaned for longer
+// than the grace period.
+type PinReconciler struct {
+	mgr         *IPFSManager
+	db          *gorm.DB
+	logger      *zap.Logger
+	interval    time.Duration
+	gracePeriod time.Duration
+	now         func() time.Time
+}
+
+type PinReconcilerOption func(r *PinReconciler) error
+
+func WithPinInterval(interval time.Duration) PinReconcilerOption {
+	return func(r *PinReconciler) error {
+		if interval > 0 {
+			r.interval = interval
+		}
+		return nil
+	}
+}
+
+func WithPinGracePeriod(gracePeriod time.Duration) PinReconcilerOption {
+	return func(r *PinReconciler) error {
+		if gracePeriod > 0 {
+			r.gracePeriod = gracePeriod
+		}
+		return nil
+	}
+}
+
+func NewPinReconciler(logger *zap.Logger, mgr *IPFSManager, db *gorm.DB, options ...PinReconcilerOption) *PinReconciler {
+
+	r := PinReconciler{
+		mgr:         mgr,
+		db:          db,
+		logger:      logger,
+		interval:    defaultPinInterval,
+		gracePeriod: defaultPinGracePeriod,
+		now:         time.Now,
+	}
+
+	for _, option := range options {
+		var _ = option(&r)
+	}
+
+	return &r
+}
+
+// references collects every CID the offchain store still points to.
+func (r *PinReconciler) references() (map[string]bool, error) {
+
+	sources := []struct {
+		model  interface{}
+		column string
+		where  []interface{}
+	}{
+		{&Topic{}, "c_id", nil},
+		{&Post{}, "c_id", nil},
+		{&Asset{}, "c_id", nil},
+		{&Asset{}, "thumbnail", nil},
+		{&PrivateContent{}, "c_id", nil},
+		{&Badge{}, "c_id", nil},
+		{&User{}, "avatar", nil},
+		{&HeldContent{}, "c_id", []interface{}{"status = ?", ModerationPending}},
+	}
+
+	refs := map[string]bool{}
+
+	for _, source := range sources {
+
+		cids := []string{}
+
+		tx := r.db.Model(source.model).Where(source.column + " <> ''")
+
+		if source.where != nil {
+			tx = tx.Where(source.where[0], source.where[1:]...)
+		}
+
+		if err := tx.Distinct().
+			Pluck(source.column, &cids).Error; err != nil {
+			return nil, err
+		}
+
+		for _, cid := range cids {
+			refs[cid] = true
+		}
+	}
+
+	return refs, nil
+}
+
+func (r *PinReconciler) Reconcile() error {
+
+	refs, err := r.references()
+
+	if err != nil {
+		return err
+	}
+
+	pins, err := r.mgr.storage.Pins()
+
+	if err != nil {
+		return err
+	}
+
+	pinned, unpinned := 0, 0
+
+	for cid := range refs {
+		if info, ok := pins[cid]; ok && info.Type != "indirect" {
+			continue
+		}
+		if err := r.mgr.storage.Pin(cid); err != nil {
+			r.logger.Warn("Failed to pin referenced content", zap.String("cid", cid), zap.Error(err))
+			continue
+		}
+		pinned++
+	}
+
+	uploaded := map[string]bool{}
+	cids := []string{}
+
+	if err := r.db.Model(&UploadedContent{}).Pluck("c_id", &cids).Error; err != nil {
+		return err
+	}
+
+	for _, cid := range cids {
+		uploaded[cid] = true
+	}
+
+	orphans := []*OrphanedContent{}
+
+	if err := r.db.Find(&orphans).Error; err != nil {
+		return err
+	}
+
+	detected := map[string]time.Time{}
+
+	for _, orphan := range orphans {
+		detected[orphan.CID] = orphan.DetectedAt
+	}
+
+	now := r.now()
+	stale := []string{}
+
+	for cid, since := range detected {
+		if info, ok := pins[cid]; refs[cid] || !uploaded[cid] || !ok || info.Type == "indirect" {
+			stale = append(stale, cid)
+		} else if now.Sub(since) >= r.gracePeriod {
+			if err := r.mgr.storage.Unpin(cid); err != nil {
+				r.logger.Warn("Failed to unpin orphaned content", zap.String("cid", cid), zap.Error(err))
+				continue
+			}
+			stale = append(stale, cid)
+			unpinned++
+		}
+	}
+
+	if len(stale) != 0 {
+		if err := r.db.Where("c_id IN ?", stale).Delete(&OrphanedContent{}).Error; err != nil {
+			return err
+		}
+	}
+
+	for cid, info := range pins {
+		if _, ok := detected[cid]; ok || refs[cid] || !uploaded[cid] || info.Type == "indirect" {
+			continue
+		}
+		if err := r.db.Create(&OrphanedContent{CID: cid, DetectedAt: now}).Error; err != nil {
+			return err
+		}
+	}
+
+	r.logger.Info("Reconciled IPFS pins", zap.Int("pinned", pinned), zap.Int("unpinned", unpinned))
+
+	return nil
+}
+
+// Run reconciles on every interval until ctx is cancelled.
+func (r *PinReconciler) Run(ctx context.Context) {
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.Reconcile(); err != nil {
+			r.logger.Error("Failed to reconcile IPFS pins", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package ipfs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cealgull/Middleware/internal/config"
+	"github.com/Cealgull/Middleware/internal/fabric/offchain"
+	. "github.com/Cealgull/Middleware/internal/models"
+	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func preparePinData(t *testing.T) *gorm.DB {
+
+	db, err := offchain.NewOffchainStore(sqlite.Open("file::memory:"), &config.PostgresGormConfig{})
+	assert.NoError(t, err)
+
+	user := User{Username: "Alice", Wallet: "0x123456789", Avatar: "QmAvatar"}
+	assert.NoError(t, db.Create(&user).Error)
+
+	topic := Topic{
+		Hash:          "topic1",
+		Title:         "Genshin Impact",
+		Content:       "hello",
+		CID:           "QmTopic",
+		CreatorWallet: user.Wallet,
+		Assets:        []*Asset{{CID: "QmImage", Thumbnail: "QmThumb", ContentType: "image/png", CreatorWallet: user.Wallet}},
+	}
+	assert.NoError(t, db.Create(&topic).Error)
+
+	post := Post{Hash: "post1", Content: "world", CID: "QmPost", CreatorWallet: user.Wallet, BelongToHash: topic.Hash}
+	assert.NoError(t, db.Create(&post).Error)
+
+	assert.NoError(t, db.Create(&Badge{Name: "badge", CID: "QmBadge"}).Error)
+	assert.NoError(t, db.Create(&UploadedContent{CID: "QmOrphan"}).Error)
+
+	return db
+}
+
+func TestPinReconciler(t *testing.T) {
+
+	logger, _ := zap.NewProduction()
+
+	t.Run("Pinning References And Unpinning Orphans", func(t *testing.T) {
+
+		s, mgr := newMockIPFSManager(t)
+		db := preparePinData(t)
+
+		now := time.Now()
+		r := NewPinReconciler(logger, mgr, db, WithPinInterval(time.Minute), WithPinGracePeriod(time.Hour))
+		r.now = func() time.Time { return now }
+
+		s.EXPECT().Pins().Return(map[string]shell.PinInfo{
+			"QmTopic":   {Type: "recursive"},
+			"QmPost":    {Type: "indirect"},
+			"QmOrphan":  {Type: "recursive"},
+			"QmChild":   {Type: "indirect"},
+			"QmForeign": {Type: "recursive"},
+		}, nil).Twice()
+
+		for _, cid := range []string{"QmPost", "QmImage", "QmThumb", "QmBadge", "QmAvatar"} {
+			s.EXPECT().Pin(cid).Return(nil).Twice()
+		}
+
+		assert.NoError(t, r.Reconcile())
+
+		orphans := []*OrphanedContent{}
+		assert.NoError(t, db.Find(&orphans).Error)
+		assert.Len(t, orphans, 1)
+		assert.Equal(t, "QmOrphan", orphans[0].CID)
+
+		now = now.Add(2 * time.Hour)
+		s.EXPECT().Unpin("QmOrphan").Return(nil).Once()
+
+		assert.NoError(t, r.Reconcile())
+		assert.NoError(t, db.Find(&orphans).Error)
+		assert.Len(t, orphans, 0)
+	})
+
+	t.Run("Forgetting Orphans Referenced Again", func(t *testing.T) {
+
+		s, mgr := newMockIPFSManager(t)
+		db := preparePinData(t)
+		assert.NoError(t, db.Create(&OrphanedContent{CID: "QmTopic", DetectedAt: time.Now().Add(-48 * time.Hour)}).Error)
+		assert.NoError(t, db.Create(&OrphanedContent{CID: "QmGone", DetectedAt: time.Now()}).Error)
+
+		r := NewPinReconciler(logger, mgr, db)
+
+		pins := map[string]shell.PinInfo{}
+		for _, cid := range []string{"QmTopic", "QmPost", "QmImage", "QmThumb", "QmBadge", "QmAvatar"} {
+			pins[cid] = shell.PinInfo{Type: "recursive"}
+		}
+		s.EXPECT().Pins().Return(pins, nil).Once()
+
+		assert.NoError(t, r.Reconcile())
+
+		var count int64
+		assert.NoError(t, db.Model(&OrphanedContent{}).Count(&count).Error)
+		assert.Equal(t, int64(0), count)
+	})
+
+	t.Run("Recording Uploads", func(t *testing.T) {
+
+		s, mgr := newMockIPFSManager(t)
+		db := preparePinData(t)
+		var _ = WithOffchainStore(db)(mgr)
+
+		s.EXPECT().Add(mock.Anything).Return("QmUpload", nil).Twice()
+
+		for i := 0; i < 2; i++ {
+			cid, err := mgr.Put(strings.NewReader("hello world"))
+			assert.NoError(t, err)
+			assert.Equal(t, "QmUpload", cid)
+		}
+
+		var count int64
+		assert.NoError(t, db.Model(&UploadedContent{}).Where("c_id = ?", "QmUpload").Count(&count).Error)
+		assert.Equal(t, int64(1), count)
+	})
+
+	t.Run("Storage Failures", func(t *testing.T) {
+
+		s, mgr := newMockIPFSManager(t)
+		db := preparePinData(t)
+		assert.NoError(t, db.Create(&OrphanedContent{CID: "QmOrphan", DetectedAt: time.Now().Add(-48 * time.Hour)}).Error)
+
+		r := NewPinReconciler(logger, mgr, db)
+
+		s.EXPECT().Pins().Return(nil, errors.New("hello world")).Once()
+		assert.Error(t, r.Reconcile())
+
+		s.EXPECT().Pins().Return(map[string]shell.PinInfo{"QmOrphan": {Type: "recursive"}}, nil).Once()
+		for _, cid := range []string{"QmTopic", "QmPost", "QmImage", "QmThumb", "QmBadge", "QmAvatar"} {
+			s.EXPECT().Pin(cid).Return(errors.New("hello world")).Once()
+		}
+		s.EXPECT().Unpin("QmOrphan").Return(errors.New("hello world")).Once()
+
+		assert.NoError(t, r.Reconcile())
+
+		var count int64
+		assert.NoError(t, db.Model(&OrphanedContent{}).Count(&count).Error)
+		assert.Equal(t, int64(1), count)
+	})
+
+	t.Run("Run Until Cancelled", func(t *testing.T) {
+
+		s, mgr := newMockIPFSManager(t)
+		db := preparePinData(t)
+
+		r := NewPinReconciler(logger, mgr, db)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		s.EXPECT().Pins().RunAndReturn(func() (map[string]shell.PinInfo, error) {
+			cancel()
+			return nil, errors.New("hello world")
+		}).Once()
+
+		r.Run(ctx)
+	})
+}
@@ -0,0 +1,539 @@
+package ipfs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/proto"
+	"github.com/Cealgull/Middleware/internal/rest"
+	"github.com/Cealgull/Middleware/internal/utils"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Private content is sealed with AES-256-GCM in segments of segmentSize so
+// that it can be streamed both ways. Every content has its own key, hence
+// the nonce is simply the segment counter, with the last byte marking the
+// final segment so that truncated ciphertext is rejected.
+const segmentSize = 64 << 10
+
+var errInvalidKey = errors.New("encryption key must be 32 bytes long")
+var errTruncatedContent = errors.New("truncated private content")
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+
+	if len(key) != 32 {
+		return nil, errInvalidKey
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// WithEncryptionKey enables private uploads given a base64 encoded 32 byte
+// key. The key wraps the per-content keys kept in the offchain store.
+func WithEncryptionKey(encoded string) IPFSManagerOption {
+	return func(mgr *IPFSManager) error {
+
+		if encoded == "" {
+			return nil
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+
+		if err != nil {
+			mgr.logger.Warn("Failed to decode the encryption key", zap.Error(err))
+			return err
+		}
+
+		aead, err := newAEAD(key)
+
+		if err != nil {
+			mgr.logger.Warn("Failed to initialize the encryption key", zap.Error(err))
+			return err
+		}
+
+		mgr.keyWrap = aead
+		return nil
+	}
+}
+
+func segmentNonce(aead cipher.AEAD, counter uint64, final bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, counter)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+type sealReader struct {
+	aead    cipher.AEAD
+	src     *bufio.Reader
+	counter uint64
+	buf     []byte
+	out     []byte
+	done    bool
+}
+
+func newSealReader(aead cipher.AEAD, src io.Reader) *sealReader {
+	return &sealReader{aead: aead, src: bufio.NewReaderSize(src, segmentSize), buf: make([]byte, segmentSize)}
+}
+
+func (s *sealReader) Read(p []byte) (int, error) {
+
+	for len(s.out) == 0 {
+
+		if s.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(s.src, s.buf)
+
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+
+		if err == nil {
+			_, err = s.src.Peek(1)
+		}
+
+		s.done = err != nil
+		s.out = s.aead.Seal(s.out[:0], segmentNonce(s.aead, s.counter, s.done), s.buf[:n], nil)
+		s.counter++
+	}
+
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+
+	return n, nil
+}
+
+type openReader struct {
+	aead    cipher.AEAD
+	src     *bufio.Reader
+	counter uint64
+	buf     []byte
+	out     []byte
+	done    bool
+}
+
+func newOpenReader(aead cipher.AEAD, src io.Reader) *openReader {
+	return &openReader{aead: aead, src: bufio.NewReaderSize(src, segmentSize), buf: make([]byte, segmentSize+aead.Overhead())}
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+
+	for len(o.out) == 0 {
+
+		if o.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(o.src, o.buf)
+
+		if err == io.EOF {
+			return 0, errTruncatedContent
+		}
+
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+
+		if err == nil {
+			_, err = o.src.Peek(1)
+		}
+
+		o.done = err != nil
+		o.out, err = o.aead.Open(o.out[:0], segmentNonce(o.aead, o.counter, o.done), o.buf[:n], nil)
+
+		if err != nil {
+			return 0, err
+		}
+
+		o.counter++
+	}
+
+	n := copy(p, o.out)
+	o.out = o.out[n:]
+
+	return n, nil
+}
+
+// StreamPrivate encrypts an upload with a fresh key and keeps the wrapped
+// key along with the wallets allowed to read it. Images are stripped of
+// their metadata, but no thumbnail is made as it would be readable by all.
+func (m *IPFSManager) StreamPrivate(r io.Reader, owner string, readers []string) (*Media, proto.MiddlewareError) {
+
+	if m.keyWrap == nil || m.db == nil {
+		return nil, privateContentDisabledError
+	}
+
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, _ := br.Peek(sniffLen)
+
+	if len(head) == 0 {
+		return nil, uploadFileMissingError
+	}
+
+	media := &Media{ContentType: sniff(head)}
+
+	if !utils.Contains(m.mediaTypes, media.ContentType) {
+		return nil, mediaTypeUnsupportedError
+	}
+
+	var payload io.Reader = br
+
+	if utils.Contains(imageTypes, media.ContentType) {
+
+		data, err := io.ReadAll(io.LimitReader(br, m.maxMediaSize+1))
+
+		if err != nil {
+			return nil, uploadReadError
+		}
+
+		if int64(len(data)) > m.maxMediaSize {
+			return nil, mediaTooLargeError
+		}
+
+		clean, img, merr := m.prepare(media.ContentType, data)
+
+		if merr != nil {
+			return nil, merr
+		}
+
+		media.Width, media.Height = img.Bounds().Dx(), img.Bounds().Dy()
+		payload = bytes.NewReader(clean)
+	}
+
+	key := make([]byte, 32)
+
+	if _, err := rand.Read(key); err != nil {
+		return nil, ipfsBackendError
+	}
+
+	aead, _ := newAEAD(key)
+
+	lr := &limitedReader{r: payload, limit: m.maxUploadSize}
+	cid, err := m.Put(newSealReader(aead, lr))
+
+	if lr.exceeded {
+		return nil, mediaTooLargeError
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	media.CID, media.Size = cid, int(lr.n)
+
+	wrapped, werr := m.wrapKey(key)
+
+	if werr != nil {
+		return nil, ipfsBackendError
+	}
+
+	content := PrivateContent{
+		CID:         cid,
+		OwnerWallet: owner,
+		ContentType: media.ContentType,
+		Size:        lr.n,
+		Key:         wrapped,
+	}
+
+	for _, wallet := range readers {
+		if wallet != "" && wallet != owner {
+			content.Readers = append(content.Readers, &PrivateContentReader{CID: cid, Wallet: wallet})
+		}
+	}
+
+	if m.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&content).Error != nil {
+		return nil, ipfsBackendError
+	}
+
+	return media, nil
+}
+
+func (m *IPFSManager) wrapKey(key []byte) ([]byte, error) {
+	nonce := make([]byte, m.keyWrap.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return m.keyWrap.Seal(nonce, nonce, key, nil), nil
+}
+
+func (m *IPFSManager) unwrapKey(wrapped []byte) ([]byte, error) {
+	size := m.keyWrap.NonceSize()
+	if len(wrapped) < size {
+		return nil, errInvalidKey
+	}
+	return m.keyWrap.Open(nil, wrapped[:size], wrapped[size:], nil)
+}
+
+// NewKey returns a fresh content key wrapped with the middleware key, to be
+// used with Seal and Open for payloads kept off IPFS such as messages.
+func (m *IPFSManager) NewKey() ([]byte, proto.MiddlewareError) {
+
+	if m.keyWrap == nil {
+		return nil, privateContentDisabledError
+	}
+
+	key := make([]byte, 32)
+
+	if _, err := rand.Read(key); err != nil {
+		return nil, ipfsBackendError
+	}
+
+	wrapped, err := m.wrapKey(key)
+
+	if err != nil {
+		return nil, ipfsBackendError
+	}
+
+	return wrapped, nil
+}
+
+func (m *IPFSManager) contentAEAD(wrapped []byte) (cipher.AEAD, proto.MiddlewareError) {
+
+	if m.keyWrap == nil {
+		return nil, privateContentDisabledError
+	}
+
+	key, err := m.unwrapKey(wrapped)
+
+	if err != nil {
+		return nil, ipfsBackendError
+	}
+
+	aead, _ := newAEAD(key)
+	return aead, nil
+}
+
+// Seal encrypts a small payload with the content key wrapped in wrapped.
+func (m *IPFSManager) Seal(wrapped []byte, plain []byte) ([]byte, proto.MiddlewareError) {
+
+	aead, merr := m.contentAEAD(wrapped)
+
+	if merr != nil {
+		return nil, merr
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, ipfsBackendError
+	}
+
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+// Open decrypts a payload produced by Seal with the same wrapped key.
+func (m *IPFSManager) Open(wrapped []byte, sealed []byte) ([]byte, proto.MiddlewareError) {
+
+	aead, merr := m.contentAEAD(wrapped)
+
+	if merr != nil {
+		return nil, merr
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, ipfsBackendError
+	}
+
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+
+	if err != nil {
+		return nil, ipfsBackendError
+	}
+
+	return plain, nil
+}
+
+// Grant lets wallets read a private content owned by owner.
+func (m *IPFSManager) Grant(cid string, owner string, wallets []string) proto.MiddlewareError {
+	return m.updateReaders(cid, owner, wallets, nil)
+}
+
+// Revoke withdraws the access of wallets to a private content owned by owner.
+func (m *IPFSManager) Revoke(cid string, owner string, wallets []string) proto.MiddlewareError {
+	return m.updateReaders(cid, owner, nil, wallets)
+}
+
+func (m *IPFSManager) updateReaders(cid string, owner string, grant []string, revoke []string) proto.MiddlewareError {
+
+	if m.keyWrap == nil || m.db == nil {
+		return privateContentDisabledError
+	}
+
+	content := PrivateContent{}
+
+	if err := m.db.Where("c_id = ?", cid).First(&content).Error; err != nil {
+		return &StorageFileNotFoundError{}
+	}
+
+	if content.OwnerWallet != owner {
+		return contentAccessDeniedError
+	}
+
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+
+		for _, wallet := range grant {
+			if wallet == "" || wallet == owner {
+				continue
+			}
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+				Create(&PrivateContentReader{CID: cid, Wallet: wallet}).Error; err != nil {
+				return err
+			}
+		}
+
+		if len(revoke) != 0 {
+			return tx.Where("c_id = ? AND wallet IN ?", cid, revoke).Delete(&PrivateContentReader{}).Error
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return ipfsBackendError
+	}
+
+	return nil
+}
+
+func (m *IPFSManager) uploadPrivate(c echo.Context) error {
+
+	owner := rest.WalletOf(c)
+	readers := []string{}
+
+	if q := c.QueryParam("readers"); q != "" {
+		readers = strings.Split(q, ",")
+	}
+
+	return m.receive(c, func(r io.Reader) (*Media, proto.MiddlewareError) {
+		return m.StreamPrivate(r, owner, readers)
+	})
+}
+
+func (m *IPFSManager) readers(c echo.Context) error {
+
+	type ReadersRequest struct {
+		Grant  []string `json:"grant"`
+		Revoke []string `json:"revoke"`
+	}
+
+	r := ReadersRequest{}
+
+	if c.Bind(&r) != nil {
+		return c.JSON(uploadJSONDecodeError.Status(), uploadJSONDecodeError.Message())
+	}
+
+	if err := m.updateReaders(c.Param("cid"), rest.WalletOf(c), r.Grant, r.Revoke); err != nil {
+		return c.JSON(err.Status(), err.Message())
+	}
+
+	return c.JSON(success.Status(), success.Message())
+}
+
+// private looks cid up among the private contents. The content is only
+// returned when wallet is its owner or one of its readers.
+func (m *IPFSManager) private(cid string, wallet string) (*PrivateContent, bool, proto.MiddlewareError) {
+
+	if m.db == nil {
+		return nil, false, nil
+	}
+
+	content := PrivateContent{}
+
+	if err := m.db.Where("c_id = ?", cid).First(&content).Error; err != nil {
+		return nil, false, nil
+	}
+
+	if wallet == "" {
+		return nil, true, contentAccessDeniedError
+	}
+
+	if content.OwnerWallet != wallet {
+		var count int64
+		if m.db.Model(&PrivateContentReader{}).Where("c_id = ? AND wallet = ?", cid, wallet).Count(&count); count == 0 {
+			return nil, true, contentAccessDeniedError
+		}
+	}
+
+	if m.keyWrap == nil {
+		return nil, true, privateContentDisabledError
+	}
+
+	return &content, true, nil
+}
+
+func (m *IPFSManager) servePrivate(c echo.Context, content *PrivateContent) error {
+
+	etag := `"` + content.CID + `"`
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderCacheControl, "private, no-cache")
+	header.Set("ETag", etag)
+	header.Set(echo.HeaderXContentTypeOptions, "nosniff")
+
+	if c.Request().Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	key, err := m.unwrapKey(content.Key)
+
+	if err != nil {
+		return c.JSON(ipfsBackendError.Status(), ipfsBackendError.Message())
+	}
+
+	aead, _ := newAEAD(key)
+
+	r, err := m.storage.Cat(content.CID)
+
+	if err != nil {
+		err := &StorageFileNotFoundError{}
+		return c.JSON(err.Status(), err.Message())
+	}
+
+	defer r.Close()
+
+	plain := newOpenReader(aead, r)
+
+	// The first segment is opened up front so that a corrupt or foreign
+	// ciphertext is still answered with an error status.
+	first := make([]byte, 1)
+	n, err := io.ReadFull(plain, first)
+
+	if err != nil && !(err == io.EOF && content.Size == 0) {
+		return c.JSON(ipfsBackendError.Status(), ipfsBackendError.Message())
+	}
+
+	header.Set(echo.HeaderContentType, content.ContentType)
+	header.Set(echo.HeaderContentLength, strconv.FormatInt(content.Size, 10))
+	c.Response().WriteHeader(http.StatusOK)
+
+	if _, err := c.Response().Write(first[:n]); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(c.Response(), plain)
+	return err
+}
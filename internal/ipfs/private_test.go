@@ -0,0 +1,256 @@
+package ipfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Cealgull/Middleware/internal/config"
+	"github.com/Cealgull/Middleware/internal/fabric/offchain"
+	. "github.com/Cealgull/Middleware/internal/models"
+	"github.com/Cealgull/Middleware/internal/rest"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+)
+
+func newPrivateManager(t *testing.T) *IPFSManager {
+
+	db, err := offchain.NewOffchainStore(sqlite.Open("file::memory:"), &config.PostgresGormConfig{})
+	assert.NoError(t, err)
+
+	key := make([]byte, 32)
+	var _, _ = rand.Read(key)
+
+	logger, _ := zap.NewProduction()
+	mgr, err := NewIPFSManager(logger,
+		WithFilesystem(t.TempDir()),
+		WithOffchainStore(db),
+		WithMediaLimits(0, 0, append([]string{"text/plain"}, imageTypes...)),
+		WithEncryptionKey(base64.StdEncoding.EncodeToString(key)),
+	)
+	assert.NoError(t, err)
+
+	return mgr
+}
+
+func newWalletContext(req *http.Request, rec *httptest.ResponseRecorder, wallet string) echo.Context {
+
+	c := server.NewContext(req, rec)
+
+	if wallet != "" {
+		rest.SetIdentity(c, &rest.Identity{Wallet: wallet})
+	}
+
+	return c
+}
+
+func getPrivateContent(mgr *IPFSManager, cid string, wallet string) *httptest.ResponseRecorder {
+
+	req := httptest.NewRequest(http.MethodGet, "/api/content/"+cid, nil)
+	rec := httptest.NewRecorder()
+
+	c := newWalletContext(req, rec, wallet)
+	c.SetParamNames("cid")
+	c.SetParamValues(cid)
+
+	var _ = mgr.content(c)
+	return rec
+}
+
+func postReaders(mgr *IPFSManager, cid string, wallet string, body string) *httptest.ResponseRecorder {
+
+	req := httptest.NewRequest(http.MethodPost, "/api/content/"+cid+"/readers", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+
+	c := newWalletContext(req, rec, wallet)
+	c.SetParamNames("cid")
+	c.SetParamValues(cid)
+
+	var _ = mgr.readers(c)
+	return rec
+}
+
+func TestSealOpen(t *testing.T) {
+
+	key := make([]byte, 32)
+	aead, err := newAEAD(key)
+	assert.NoError(t, err)
+
+	for _, size := range []int{0, 1, segmentSize, segmentSize + 1, 3*segmentSize - 7} {
+
+		plain := make([]byte, size)
+		var _, _ = rand.Read(plain)
+
+		sealed, err := io.ReadAll(newSealReader(aead, bytes.NewReader(plain)))
+		assert.NoError(t, err)
+
+		opened, err := io.ReadAll(newOpenReader(aead, bytes.NewReader(sealed)))
+		assert.NoError(t, err)
+		assert.Equal(t, plain, opened)
+
+		if size > segmentSize {
+			_, err = io.ReadAll(newOpenReader(aead, bytes.NewReader(sealed[:segmentSize+aead.Overhead()])))
+			assert.Error(t, err)
+		}
+
+		sealed[len(sealed)-1] ^= 1
+		_, err = io.ReadAll(newOpenReader(aead, bytes.NewReader(sealed)))
+		assert.Error(t, err)
+	}
+
+	_, err = io.ReadAll(newOpenReader(aead, bytes.NewReader(nil)))
+	assert.ErrorIs(t, err, errTruncatedContent)
+
+	_, err = newAEAD(key[:16])
+	assert.ErrorIs(t, err, errInvalidKey)
+}
+
+func TestPrivateContent(t *testing.T) {
+
+	mgr := newPrivateManager(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/upload/private?readers=0xBob,,0xAlice", strings.NewReader("hello world"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMETextPlain)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, mgr.uploadPrivate(newWalletContext(req, rec, "0xAlice")))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	content := PrivateContent{}
+	assert.NoError(t, mgr.db.Preload("Readers").First(&content).Error)
+	assert.Equal(t, "0xAlice", content.OwnerWallet)
+	assert.Equal(t, int64(11), content.Size)
+	assert.Len(t, content.Readers, 1)
+	assert.Contains(t, rec.Body.String(), content.CID)
+
+	stored, merr := mgr.Cat(content.CID)
+	assert.Nil(t, merr)
+	assert.NotContains(t, string(stored), "hello world")
+
+	t.Run("Owner And Readers", func(t *testing.T) {
+		for _, wallet := range []string{"0xAlice", "0xBob"} {
+			rec := getPrivateContent(mgr, content.CID, wallet)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "hello world", rec.Body.String())
+			assert.Equal(t, "text/plain", rec.Header().Get("Content-Type"))
+			assert.Contains(t, rec.Header().Get("Cache-Control"), "private")
+		}
+	})
+
+	t.Run("Strangers", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, getPrivateContent(mgr, content.CID, "0xEve").Code)
+		assert.Equal(t, http.StatusForbidden, getPrivateContent(mgr, content.CID, "").Code)
+	})
+
+	t.Run("Granting And Revoking", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, postReaders(mgr, content.CID, "0xBob", `{"grant":["0xEve"]}`).Code)
+		assert.Equal(t, http.StatusNotFound, postReaders(mgr, "QmUnknown", "0xAlice", `{"grant":["0xEve"]}`).Code)
+		assert.Equal(t, http.StatusBadRequest, postReaders(mgr, content.CID, "0xAlice", `{`).Code)
+
+		assert.Equal(t, http.StatusOK, postReaders(mgr, content.CID, "0xAlice", `{"grant":["0xEve","0xBob","0xAlice"]}`).Code)
+		assert.Equal(t, http.StatusOK, getPrivateContent(mgr, content.CID, "0xEve").Code)
+
+		assert.Nil(t, mgr.Revoke(content.CID, "0xAlice", []string{"0xEve", "0xBob"}))
+		assert.Equal(t, http.StatusForbidden, getPrivateContent(mgr, content.CID, "0xEve").Code)
+		assert.Equal(t, http.StatusForbidden, getPrivateContent(mgr, content.CID, "0xBob").Code)
+
+		assert.Nil(t, mgr.Grant(content.CID, "0xAlice", []string{"0xBob"}))
+		assert.Equal(t, http.StatusOK, getPrivateContent(mgr, content.CID, "0xBob").Code)
+	})
+
+	t.Run("Not Modified", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/content/"+content.CID, nil)
+		req.Header.Set("If-None-Match", `"`+content.CID+`"`)
+		rec := httptest.NewRecorder()
+		c := newWalletContext(req, rec, "0xAlice")
+		c.SetParamNames("cid")
+		c.SetParamValues(content.CID)
+		var _ = mgr.content(c)
+		assert.Equal(t, http.StatusNotModified, rec.Code)
+	})
+
+	t.Run("Corrupted Key", func(t *testing.T) {
+		keyWrap := mgr.keyWrap
+		defer func() { mgr.keyWrap = keyWrap }()
+		var _ = WithEncryptionKey(base64.StdEncoding.EncodeToString(make([]byte, 32)))(mgr)
+		assert.Equal(t, http.StatusInternalServerError, getPrivateContent(mgr, content.CID, "0xAlice").Code)
+	})
+}
+
+func TestPrivateImage(t *testing.T) {
+
+	mgr := newPrivateManager(t)
+
+	media, err := mgr.StreamPrivate(bytes.NewReader(withPNGText(encodePNG(t, 64, 32))), "0xAlice", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "image/png", media.ContentType)
+	assert.Equal(t, 64, media.Width)
+	assert.Empty(t, media.Thumbnail)
+
+	rec := getPrivateContent(mgr, media.CID, "0xAlice")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "tEXt")
+
+	_, err = mgr.StreamPrivate(bytes.NewReader([]byte("%PDF-1.4")), "0xAlice", nil)
+	assert.Equal(t, mediaTypeUnsupportedError, err)
+	_, err = mgr.StreamPrivate(bytes.NewReader(nil), "0xAlice", nil)
+	assert.Equal(t, uploadFileMissingError, err)
+	_, err = mgr.StreamPrivate(bytes.NewReader(encodePNG(t, 4, 4)[:30]), "0xAlice", nil)
+	assert.Equal(t, mediaDecodeError, err)
+
+	var _ = WithMaxUploadSize(4)(mgr)
+	_, err = mgr.StreamPrivate(strings.NewReader("hello world"), "0xAlice", nil)
+	assert.Equal(t, mediaTooLargeError, err)
+}
+
+func TestPrivateContentDisabled(t *testing.T) {
+
+	_, mgr := newMockIPFSManager(t)
+
+	_, err := mgr.StreamPrivate(strings.NewReader("hello world"), "0xAlice", nil)
+	assert.Equal(t, privateContentDisabledError, err)
+	assert.Equal(t, privateContentDisabledError, mgr.Grant("QmZv", "0xAlice", nil))
+
+	logger, _ := zap.NewProduction()
+	mgr = &IPFSManager{logger: logger}
+	assert.Error(t, WithEncryptionKey("not base64")(mgr))
+	assert.Error(t, WithEncryptionKey(base64.StdEncoding.EncodeToString([]byte("short")))(mgr))
+	assert.Nil(t, mgr.keyWrap)
+}
+
+func TestSealOpenMessage(t *testing.T) {
+
+	mgr := newPrivateManager(t)
+
+	key, err := mgr.NewKey()
+	assert.Nil(t, err)
+
+	sealed, err := mgr.Seal(key, []byte("hello world"))
+	assert.Nil(t, err)
+	assert.NotContains(t, string(sealed), "hello world")
+
+	plain, err := mgr.Open(key, sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(plain))
+
+	other, _ := mgr.NewKey()
+	_, err = mgr.Open(other, sealed)
+	assert.Equal(t, ipfsBackendError, err)
+	_, err = mgr.Open(key, sealed[:4])
+	assert.Equal(t, ipfsBackendError, err)
+	_, err = mgr.Seal([]byte("garbage"), nil)
+	assert.Equal(t, ipfsBackendError, err)
+
+	_, disabled := newMockIPFSManager(t)
+	_, err = disabled.NewKey()
+	assert.Equal(t, privateContentDisabledError, err)
+	_, err = disabled.Open(key, sealed)
+	assert.Equal(t, privateContentDisabledError, err)
+}
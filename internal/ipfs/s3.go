@@ -0,0 +1,331 @@
+package ipfs
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ipfs "github.com/ipfs/go-ipfs-api"
+)
+
+const (
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	s3DialTimeout           = 10 * time.Second
+	s3ResponseHeaderTimeout = 30 * time.Second
+	s3RequestTimeout        = time.Minute
+)
+
+type S3Options struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3Storage keeps content addressed blocks in an S3 compatible bucket under
+// blocks/<cid>, with an empty pins/<cid> object marking pinned content.
+// Requests are path-style and signed with AWS Signature Version 4. Requests
+// are bounded by requestTimeout, except for reading content, which may
+// stream for as long as the caller reads.
+type S3Storage struct {
+	options        S3Options
+	client         *http.Client
+	requestTimeout time.Duration
+	now            func() time.Time
+}
+
+type S3Error struct {
+	Status int
+	Code   string `xml:"Code"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s", e.Status, e.Code)
+}
+
+func NewS3Storage(options S3Options) *S3Storage {
+	if options.Region == "" {
+		options.Region = "us-east-1"
+	}
+
+	// A timeout on the client would cut off content streamed from the
+	// bucket, so only connecting and waiting for the response are bounded.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: s3DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.ResponseHeaderTimeout = s3ResponseHeaderTimeout
+
+	return &S3Storage{
+		options:        options,
+		client:         &http.Client{Transport: transport},
+		requestTimeout: s3RequestTimeout,
+		now:            time.Now,
+	}
+}
+
+func WithS3(options S3Options) IPFSManagerOption {
+	return func(mgr *IPFSManager) error {
+		mgr.storage = NewS3Storage(options)
+		return nil
+	}
+}
+
+func (s *S3Storage) do(ctx context.Context, method string, key string, query url.Values, body io.Reader, size int64, payloadHash string, headers ...string) (*http.Response, error) {
+
+	u, err := url.Parse(strings.TrimSuffix(s.options.Endpoint, "/") + "/" + s.options.Bucket + "/" + key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	req.ContentLength = size
+	signV4(req, payloadHash, s.options.AccessKey, s.options.SecretKey, s.options.Region, s.now())
+
+	resp, err := s.client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		s3err := &S3Error{Status: resp.StatusCode}
+		var _ = xml.NewDecoder(resp.Body).Decode(s3err)
+		return nil, s3err
+	}
+
+	return resp, nil
+}
+
+func (s *S3Storage) exec(method string, key string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.requestTimeout)
+	defer cancel()
+
+	resp, err := s.do(ctx, method, key, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *S3Storage) Version() (string, string, error) {
+	return "s3", s.options.Bucket, s.exec(http.MethodHead, "")
+}
+
+// Add stores payload under its CIDv1. Options of the IPFS shell are ignored.
+func (s *S3Storage) Add(payload io.Reader, opts ...ipfs.AddOpts) (string, error) {
+
+	tmp, digest, size, err := spool("", payload)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	cid, err := rawCID(digest)
+
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.requestTimeout)
+	defer cancel()
+
+	resp, err := s.do(ctx, http.MethodPut, "blocks/"+cid, nil, tmp, size, hex.EncodeToString(digest))
+
+	if err != nil {
+		return "", err
+	}
+
+	var _ = resp.Body.Close()
+
+	return cid, s.Pin(cid)
+}
+
+func (s *S3Storage) Cat(cid string) (io.ReadCloser, error) {
+	return s.CatFrom(cid, 0)
+}
+
+// CatFrom reads content from offset on with a ranged GET.
+func (s *S3Storage) CatFrom(cid string, offset int64) (io.ReadCloser, error) {
+
+	if !cidPattern.MatchString(cid) {
+		return nil, errInvalidCID
+	}
+
+	headers := []string{}
+
+	if offset > 0 {
+		headers = append(headers, "Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+
+	resp, err := s.do(context.Background(), http.MethodGet, "blocks/"+cid, nil, nil, 0, emptyPayloadHash, headers...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (s *S3Storage) Pin(cid string) error {
+
+	if !cidPattern.MatchString(cid) {
+		return errInvalidCID
+	}
+
+	if err := s.exec(http.MethodHead, "blocks/"+cid); err != nil {
+		return err
+	}
+
+	return s.exec(http.MethodPut, "pins/"+cid)
+}
+
+func (s *S3Storage) Unpin(cid string) error {
+
+	if !cidPattern.MatchString(cid) {
+		return errInvalidCID
+	}
+
+	if err := s.exec(http.MethodDelete, "pins/"+cid); err != nil {
+		return err
+	}
+
+	return s.exec(http.MethodDelete, "blocks/"+cid)
+}
+
+func (s *S3Storage) Pins() (map[string]ipfs.PinInfo, error) {
+
+	type ListBucketResult struct {
+		Contents []struct {
+			Key string `xml:"Key"`
+		} `xml:"Contents"`
+		IsTruncated           bool   `xml:"IsTruncated"`
+		NextContinuationToken string `xml:"NextContinuationToken"`
+	}
+
+	pins := map[string]ipfs.PinInfo{}
+	query := url.Values{"list-type": {"2"}, "prefix": {"pins/"}}
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), s.requestTimeout)
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, 0, emptyPayloadHash)
+
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+
+		result := ListBucketResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		var _ = resp.Body.Close()
+		cancel()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			pins[strings.TrimPrefix(c.Key, "pins/")] = ipfs.PinInfo{Type: "recursive"}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return pins, nil
+		}
+
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header to req,
+// signing the host, the range and every x-amz-* header.
+func signV4(req *http.Request, payloadHash string, accessKey string, secretKey string, region string, now time.Time) {
+
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+
+	for k, v := range req.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-amz-") || k == "range" {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := strings.Builder{}
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
@@ -12,12 +12,60 @@ type Asset struct {
 	CreatorWallet string
 	Creator       *User  `gorm:"references:Wallet"`
 	ContentType   string `gorm:"not null" json:"contentType"`
+	Thumbnail     string
+	Width         int
+	Height        int
+	Size          int
 	OwnerID       uint
 	OwnerType     string
   CreatedAt     time.Time      `gorm:"autoCreateTime"`
   UpdatedAt     time.Time      `gorm:"autoUpdateTime"`
 }
 
+// MediaInfo is what the media pipeline learned about an upload, recorded
+// so that attaching the upload later does not fetch and decode it again.
+type MediaInfo struct {
+	CID         string    `gorm:"primaryKey"`
+	ContentType string    `gorm:"not null"`
+	Thumbnail   string
+	Width       int
+	Height      int
+	Size        int
+	CreatedAt   time.Time `gorm:"autoCreateTime"`
+}
+
+// UploadedContent records a CID the middleware stored itself. Only such
+// content is ever unpinned, pins made by anyone else are left alone.
+type UploadedContent struct {
+	CID       string    `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+}
+
+// OrphanedContent tracks a pinned CID that nothing references anymore, so
+// that it is only unpinned once the grace period has passed.
+type OrphanedContent struct {
+	CID        string    `gorm:"primaryKey"`
+	DetectedAt time.Time `gorm:"not null"`
+}
+
+// PrivateContent records an encrypted upload. Key is the per-content key
+// wrapped with the middleware key, and only the owner and the readers are
+// allowed to have the content decrypted.
+type PrivateContent struct {
+	CID         string                  `gorm:"primaryKey"`
+	OwnerWallet string                  `gorm:"index;not null"`
+	ContentType string                  `gorm:"not null"`
+	Size        int64
+	Key         []byte                  `gorm:"not null"`
+	Readers     []*PrivateContentReader `gorm:"foreignKey:CID;references:CID"`
+	CreatedAt   time.Time               `gorm:"autoCreateTime"`
+}
+
+type PrivateContentReader struct {
+	CID    string `gorm:"primaryKey"`
+	Wallet string `gorm:"primaryKey"`
+}
+
 func (a *Asset) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&struct {
 		Creator     string    `json:"creator"`
@@ -25,11 +73,19 @@ func (a *Asset) MarshalJSON() ([]byte, error) {
 		CreatedAt   time.Time `json:"createdAt"`
 		UpdatedAt   time.Time `json:"updatedAt"`
 		CID         string    `json:"cid"`
+		Thumbnail   string    `json:"thumbnail,omitempty"`
+		Width       int       `json:"width,omitempty"`
+		Height      int       `json:"height,omitempty"`
+		Size        int       `json:"size"`
 	}{
 		ContentType: a.ContentType,
 		Creator:     a.CreatorWallet,
 		CreatedAt:   a.CreatedAt,
 		UpdatedAt:   a.UpdatedAt,
 		CID:         a.CID,
+		Thumbnail:   a.Thumbnail,
+		Width:       a.Width,
+		Height:      a.Height,
+		Size:        a.Size,
 	})
 }
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// WalletCert records which wallet logged in with which certificate, so a
+// revoked serial can be traced back to the wallet it was issued for.
+type WalletCert struct {
+	Serial     string `gorm:"primaryKey"`
+	Wallet     string `gorm:"index;not null"`
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	RevokedAt  *time.Time
+}
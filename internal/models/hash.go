@@ -0,0 +1,56 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+)
+
+// ContentHashLength is the length of a content hash: a SHA-256 digest in
+// URL-safe base64 without padding. Hashes of the former scheme were padded
+// base64, so they never have this length.
+const ContentHashLength = 43
+
+func encodeContentHash(canonical []byte) string {
+	digest := sha256.Sum256(canonical)
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// IsContentHash tells whether hash was computed by the content hashing
+// scheme rather than the former one.
+func IsContentHash(hash string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(hash)
+	return err == nil && len(b) == sha256.Size
+}
+
+// ContentHash is the hash of a topic: the digest of the JSON encoding of its
+// block without the hash itself and the fields that change after creation.
+func (b TopicBlock) ContentHash() string {
+	b.Hash, b.Deleted, b.Upvotes, b.Downvotes, b.Emojis = "", false, nil, nil, nil
+	canonical, _ := json.Marshal(&struct {
+		Kind string `json:"kind"`
+		TopicBlock
+	}{"topic", b})
+	return encodeContentHash(canonical)
+}
+
+// ContentHash is the hash of a post, computed as for topics.
+func (b PostBlock) ContentHash() string {
+	b.Hash, b.Deleted, b.Upvotes, b.Downvotes, b.Emojis = "", false, nil, nil, nil
+	canonical, _ := json.Marshal(&struct {
+		Kind string `json:"kind"`
+		PostBlock
+	}{"post", b})
+	return encodeContentHash(canonical)
+}
+
+// RehashLegacy gives a topic or post hashed by the former scheme its content
+// hash. The block it was created from is gone, so the digest covers the
+// former hash, which is unique.
+func RehashLegacy(source string, legacy string) string {
+	canonical, _ := json.Marshal(&struct {
+		Kind   string `json:"kind"`
+		Legacy string `json:"legacy"`
+	}{source, legacy})
+	return encodeContentHash(canonical)
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const profileLinkPrefix = "/user/"
+
+func ProfileLink(wallet string) string {
+	return profileLinkPrefix + wallet
+}
+
+type Mention struct {
+	ID              uint   `gorm:"primaryKey"`
+	OwnerID         uint   `gorm:"index:idx_mention_owner"`
+	OwnerType       string `gorm:"index:idx_mention_owner"`
+	OwnerHash       string `gorm:"not null"`
+	CreatorWallet   string `gorm:"index;not null"`
+	MentionedWallet string `gorm:"index;not null"`
+	Mentioned       *User  `gorm:"foreignKey:MentionedWallet;references:Wallet"`
+
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+}
+
+func (m *Mention) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Username  string    `json:"username"`
+		Wallet    string    `json:"wallet"`
+		Link      string    `json:"link"`
+		Creator   string    `json:"creator"`
+		Source    string    `json:"source"`
+		Hash      string    `json:"hash"`
+		CreatedAt time.Time `json:"createdAt"`
+	}{
+		Username: func() string {
+			if m.Mentioned == nil {
+				return ""
+			}
+			return m.Mentioned.Username
+		}(),
+		Wallet:    m.MentionedWallet,
+		Link:      ProfileLink(m.MentionedWallet),
+		Creator:   m.CreatorWallet,
+		Source:    m.OwnerType,
+		Hash:      m.OwnerHash,
+		CreatedAt: m.CreatedAt,
+	})
+}
@@ -0,0 +1,79 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	NotificationMessage = "message"
+)
+
+// Conversation is a private channel between two or more wallets. Hash is
+// derived from the participants, so each set of wallets has a single
+// conversation. Key is the conversation key wrapped with the middleware key.
+type Conversation struct {
+	ID            uint                       `gorm:"primaryKey"`
+	Hash          string                     `gorm:"uniqueIndex;not null"`
+	Key           []byte                     `gorm:"not null"`
+	CreatorWallet string                     `gorm:"not null"`
+	Participants  []*ConversationParticipant `gorm:"foreignKey:ConversationID"`
+	CreatedAt     time.Time                  `gorm:"autoCreateTime"`
+	UpdatedAt     time.Time                  `gorm:"autoUpdateTime"`
+}
+
+type ConversationParticipant struct {
+	ConversationID uint   `gorm:"primaryKey"`
+	UserWallet     string `gorm:"primaryKey"`
+	User           *User  `gorm:"references:Wallet"`
+	LastReadID     uint   `gorm:"not null"`
+}
+
+// Message keeps its content sealed with the conversation key. Hash is the
+// SHA-256 of the sealed content, which is what gets anchored on the ledger.
+type Message struct {
+	ID             uint   `gorm:"primaryKey"`
+	Hash           string `gorm:"uniqueIndex;not null"`
+	ConversationID uint   `gorm:"index;not null"`
+	SenderWallet   string `gorm:"not null"`
+	Content        []byte `gorm:"not null"`
+	Anchored       bool   `gorm:"not null"`
+
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+}
+
+// MessageBlock is what gets anchored on the ledger for a message.
+type MessageBlock struct {
+	Hash         string `json:"hash"`
+	Conversation string `json:"conversation"`
+	Sender       string `json:"sender"`
+}
+
+// UserBlock stops BlockedWallet from messaging BlockerWallet.
+type UserBlock struct {
+	BlockerWallet string    `gorm:"primaryKey"`
+	BlockedWallet string    `gorm:"primaryKey"`
+	CreatedAt     time.Time `gorm:"autoCreateTime"`
+}
+
+func (p *ConversationParticipant) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Username string `json:"username"`
+		Wallet   string `json:"wallet"`
+		Avatar   string `json:"avatar"`
+	}{
+		Username: func() string {
+			if p.User == nil {
+				return ""
+			}
+			return p.User.Username
+		}(),
+		Wallet: p.UserWallet,
+		Avatar: func() string {
+			if p.User == nil {
+				return ""
+			}
+			return p.User.Avatar
+		}(),
+	})
+}
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	ModerationPending  = "pending"
+	ModerationApproved = "approved"
+	ModerationRejected = "rejected"
+)
+
+// HeldContent is a topic or post that screening held back for a moderator
+// instead of submitting it. Block is the ledger block submitted once the
+// content is approved.
+type HeldContent struct {
+	ID             uint   `gorm:"primaryKey"`
+	Hash           string `gorm:"uniqueIndex;not null"`
+	SourceType     string `gorm:"index;not null"`
+	CreatorWallet  string `gorm:"index;not null"`
+	Title          string
+	Content        string `gorm:"not null"`
+	CID            string `gorm:"index"`
+	Block          []byte `gorm:"not null"`
+	Reason         string
+	Score          float64
+	Status         string `gorm:"index;not null"`
+	ReviewerWallet string
+
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime"`
+}
+
+// ContentFingerprint records the digest of content a wallet submitted, so
+// that the same content can be told apart when it is sent again. Bucket
+// numbers the duplicate window the content was sent in.
+type ContentFingerprint struct {
+	ID            uint      `gorm:"primaryKey"`
+	CreatorWallet string    `gorm:"index:idx_fingerprint;uniqueIndex:idx_fingerprint_bucket;not null"`
+	Digest        string    `gorm:"index:idx_fingerprint;uniqueIndex:idx_fingerprint_bucket;not null"`
+	Bucket        int64     `gorm:"uniqueIndex:idx_fingerprint_bucket;not null;default:0"`
+	CreatedAt     time.Time `gorm:"autoCreateTime;index"`
+}
+
+func (h *HeldContent) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Hash      string    `json:"hash"`
+		Source    string    `json:"source"`
+		Creator   string    `json:"creator"`
+		Title     string    `json:"title,omitempty"`
+		Content   string    `json:"content"`
+		Reason    string    `json:"reason"`
+		Score     float64   `json:"score"`
+		Status    string    `json:"status"`
+		Reviewer  string    `json:"reviewer,omitempty"`
+		CreatedAt time.Time `json:"createdAt"`
+		UpdatedAt time.Time `json:"updatedAt"`
+	}{
+		Hash:      h.Hash,
+		Source:    h.SourceType,
+		Creator:   h.CreatorWallet,
+		Title:     h.Title,
+		Content:   h.Content,
+		Reason:    h.Reason,
+		Score:     h.Score,
+		Status:    h.Status,
+		Reviewer:  h.ReviewerWallet,
+		CreatedAt: h.CreatedAt,
+		UpdatedAt: h.UpdatedAt,
+	})
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	NotificationMention = "mention"
+)
+
+type Notification struct {
+	ID              uint   `gorm:"primaryKey"`
+	RecipientWallet string `gorm:"index;not null"`
+	ActorWallet     string `gorm:"not null"`
+	Type            string `gorm:"not null"`
+	SourceType      string
+	SourceHash      string
+	Read            bool      `gorm:"not null"`
+	CreatedAt       time.Time `gorm:"autoCreateTime"`
+}
+
+func (n *Notification) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Actor     string    `json:"actor"`
+		Type      string    `json:"type"`
+		Source    string    `json:"source"`
+		Hash      string    `json:"hash"`
+		Read      bool      `json:"read"`
+		CreatedAt time.Time `json:"createdAt"`
+	}{
+		Actor:     n.ActorWallet,
+		Type:      n.Type,
+		Source:    n.SourceType,
+		Hash:      n.SourceHash,
+		Read:      n.Read,
+		CreatedAt: n.CreatedAt,
+	})
+}
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Cealgull/Middleware/internal/utils"
+)
+
+type PollBlock struct {
+	Options     []string  `json:"options"`
+	MultiChoice bool      `json:"multiChoice"`
+	CloseAt     time.Time `json:"closeAt"`
+}
+
+type VoteBlock struct {
+	Hash    string `json:"hash"`
+	Creator string `json:"creator"`
+	Options []uint `json:"options"`
+}
+
+type Poll struct {
+	ID          uint          `gorm:"primaryKey"`
+	TopicID     uint          `gorm:"uniqueIndex;not null"`
+	MultiChoice bool          `gorm:"not null"`
+	CloseAt     time.Time     `gorm:"not null"`
+	Voters      uint          `gorm:"not null"`
+	Options     []*PollOption `gorm:"constraint:OnDelete:CASCADE"`
+	Votes       []*PollVote   `gorm:"constraint:OnDelete:CASCADE"`
+	CreatedAt   time.Time     `gorm:"autoCreateTime"`
+	UpdatedAt   time.Time     `gorm:"autoUpdateTime"`
+}
+
+type PollOption struct {
+	ID      uint   `gorm:"primaryKey"`
+	PollID  uint   `gorm:"index;not null"`
+	Ordinal uint   `gorm:"not null"`
+	Content string `gorm:"not null"`
+	Count   uint   `gorm:"not null"`
+}
+
+type PollVote struct {
+	ID          uint      `gorm:"primaryKey"`
+	PollID      uint      `gorm:"index:idx_poll_vote,unique;not null"`
+	Ordinal     uint      `gorm:"index:idx_poll_vote,unique;not null"`
+	VoterWallet string    `gorm:"index:idx_poll_vote,unique;not null"`
+	Voter       *User     `gorm:"foreignKey:VoterWallet;references:Wallet"`
+	CreatedAt   time.Time `gorm:"autoCreateTime"`
+}
+
+func (p *Poll) Closed() bool {
+	return time.Now().After(p.CloseAt)
+}
+
+func (p *Poll) MarshalJSON() ([]byte, error) {
+
+	type DisplayOption struct {
+		Content string `json:"content"`
+		Votes   uint   `json:"votes"`
+	}
+
+	return json.Marshal(&struct {
+		MultiChoice bool             `json:"multiChoice"`
+		CloseAt     time.Time        `json:"closeAt"`
+		Closed      bool             `json:"closed"`
+		Voters      uint             `json:"voters"`
+		Options     []*DisplayOption `json:"options"`
+	}{
+		MultiChoice: p.MultiChoice,
+		CloseAt:     p.CloseAt,
+		Closed:      p.Closed(),
+		Voters:      p.Voters,
+		Options: utils.Map(p.Options, func(o *PollOption) *DisplayOption {
+			return &DisplayOption{Content: o.Content, Votes: o.Count}
+		}),
+	})
+}
@@ -23,6 +23,10 @@ type PostBlock struct {
 	BelongTo string   `json:"belongTo"`
 	Assets   []string `json:"assets,omitempty"`
 
+	// Timestamp is when the post was created, in nanoseconds since the
+	// epoch. It keeps the hashes of identical posts apart.
+	Timestamp int64 `json:"timestamp,omitempty"`
+
 	Deleted bool `json:"deleted"`
 
 	Upvotes   []string            `json:"upvotes,omitempty"`
@@ -33,9 +37,11 @@ type PostBlock struct {
 type Post struct {
 	ID            uint      `gorm:"primaryKey"`
 	Hash          string    `gorm:"uniqueIndex"`
+	LegacyHash    string    `gorm:"index;not null;default:''"`
 	CreatorWallet string    `gorm:"index;not null"`
 	Creator       *User     `gorm:"references:Wallet"`
 	Content       string    `gorm:"not null"`
+	CID           string    `gorm:"index"`
 	CreatedAt     time.Time `gorm:"autoCreateTime;not null"`
 	UpdatedAt     time.Time `gorm:"autoUpdateTime;not null"`
 	DeletedAt     gorm.DeletedAt
@@ -48,6 +54,15 @@ type Post struct {
 	Downvotes []*Downvote `gorm:"polymorphic:Owner"`
 	Closed    bool        `gorm:"not null"`
 	Assets    []*Asset    `gorm:"polymorphic:Owner"`
+	Mentions  []*Mention  `gorm:"polymorphic:Owner"`
+}
+
+// LedgerHash is the key of the post on the ledger, as for topics.
+func (p *Post) LedgerHash() string {
+	if p.LegacyHash != "" {
+		return p.LegacyHash
+	}
+	return p.Hash
 }
 
 func (p *Post) MarshalJSON() ([]byte, error) {
@@ -71,6 +86,7 @@ func (p *Post) MarshalJSON() ([]byte, error) {
 		Assets    []*Asset      `json:"assets"`
 		Upvotes   []string      `json:"upvotes"`
 		Downvotes []string      `json:"downvotes"`
+		Mentions  []*Mention    `json:"mentions"`
 		BelongTo  string        `json:"belongTo"`
 	}{
 		Hash:     p.Hash,
@@ -99,5 +115,6 @@ func (p *Post) MarshalJSON() ([]byte, error) {
 		Downvotes: utils.Map(p.Downvotes, func(downvote *Downvote) string {
 			return downvote.CreatorWallet
 		}),
+		Mentions: p.Mentions,
 	})
 }
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Session is a server-side login session. The cookie only carries Token,
+// so deleting the row revokes the session.
+type Session struct {
+	ID         uint   `gorm:"primaryKey"`
+	Token      string `gorm:"uniqueIndex;not null"`
+	Wallet     string `gorm:"index"`
+	Data       []byte `gorm:"not null"`
+	UserAgent  string
+	IP         string
+	CreatedAt  time.Time `gorm:"autoCreateTime"`
+	LastSeenAt time.Time `gorm:"not null"`
+	ExpiresAt  time.Time `gorm:"index;not null"`
+	Current    bool      `gorm:"-"`
+}
+
+func (s *Session) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		ID         uint      `json:"id"`
+		Device     string    `json:"device"`
+		IP         string    `json:"ip"`
+		CreatedAt  time.Time `json:"createdAt"`
+		LastSeenAt time.Time `json:"lastSeenAt"`
+		ExpiresAt  time.Time `json:"expiresAt"`
+		Current    bool      `json:"current"`
+	}{
+		ID:         s.ID,
+		Device:     s.UserAgent,
+		IP:         s.IP,
+		CreatedAt:  s.CreatedAt,
+		LastSeenAt: s.LastSeenAt,
+		ExpiresAt:  s.ExpiresAt,
+		Current:    s.Current,
+	})
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const (
+	ScopeRead     = "read"
+	ScopePost     = "post"
+	ScopeModerate = "moderate"
+)
+
+// APIToken lets a bot act for Wallet within Scopes until ExpiresAt. Only
+// the SHA-256 of the token is stored, Secret is set once when minted.
+type APIToken struct {
+	ID         uint   `gorm:"primaryKey"`
+	Wallet     string `gorm:"index;not null"`
+	Name       string `gorm:"not null"`
+	Prefix     string `gorm:"not null"`
+	Hash       string `gorm:"uniqueIndex;not null"`
+	Scopes     string `gorm:"not null"`
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	ExpiresAt  time.Time `gorm:"index;not null"`
+	Secret     string    `gorm:"-"`
+}
+
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range strings.Split(t.Scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *APIToken) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		ID         uint       `json:"id"`
+		Name       string     `json:"name"`
+		Prefix     string     `json:"prefix"`
+		Scopes     []string   `json:"scopes"`
+		CreatedAt  time.Time  `json:"createdAt"`
+		LastUsedAt *time.Time `json:"lastUsedAt"`
+		ExpiresAt  time.Time  `json:"expiresAt"`
+		Token      string     `json:"token,omitempty"`
+	}{
+		ID:         t.ID,
+		Name:       t.Name,
+		Prefix:     t.Prefix,
+		Scopes:     strings.Split(t.Scopes, ","),
+		CreatedAt:  t.CreatedAt,
+		LastUsedAt: t.LastUsedAt,
+		ExpiresAt:  t.ExpiresAt,
+		Token:      t.Secret,
+	})
+}
@@ -22,6 +22,12 @@ type TopicBlock struct {
 	Tags     []string `json:"tags"`
 	Images   []string `json:"images"`
 
+	Poll *PollBlock `json:"poll,omitempty"`
+
+	// Timestamp is when the topic was created, in nanoseconds since the
+	// epoch. It keeps the hashes of identical topics apart.
+	Timestamp int64 `json:"timestamp,omitempty"`
+
 	Deleted bool `json:"deleted"`
 
 	Upvotes   []string            `json:"upvotes"`
@@ -32,15 +38,19 @@ type TopicBlock struct {
 type Topic struct {
 	ID               uint   `gorm:"primaryKey"`
 	Hash             string `gorm:"uniqueIndex;not null"`
+	LegacyHash       string `gorm:"index;not null;default:''"`
 	Title            string `gorm:"not null"`
 	CreatorWallet    string `gorm:"index;not null"`
 	Creator          *User  `gorm:"references:Wallet"`
 	Content          string `gorm:"not null"`
+	CID              string `gorm:"index"`
 	CategoryAssigned *CategoryRelation
 	TagsAssigned     []*TagRelation `gorm:"polymorphic:Owner"`
 	Upvotes          []*Upvote      `gorm:"polymorphic:Owner"`
 	Downvotes        []*Downvote    `gorm:"polymorphic:Owner"`
 	Assets           []*Asset       `gorm:"polymorphic:Owner"`
+	Poll             *Poll          `gorm:"constraint:OnDelete:CASCADE"`
+	Mentions         []*Mention     `gorm:"polymorphic:Owner"`
 	Closed           bool           `gorm:"not null"`
 
 	CreatedAt time.Time      `gorm:"autoCreateTime"`
@@ -48,6 +58,15 @@ type Topic struct {
 	DeletedAt gorm.DeletedAt `gorm:"index"`
 }
 
+// LedgerHash is the key of the topic on the ledger, which is still the
+// former hash for topics created before content hashing.
+func (t *Topic) LedgerHash() string {
+	if t.LegacyHash != "" {
+		return t.LegacyHash
+	}
+	return t.Hash
+}
+
 func (t *Topic) MarshalJSON() ([]byte, error) {
 
 	type DisplayTag struct {
@@ -77,6 +96,8 @@ func (t *Topic) MarshalJSON() ([]byte, error) {
 		Upvotes          []string         `json:"upvotes"`
 		Downvotes        []string         `json:"downvotes"`
 		Assets           []*Asset         `json:"assets"`
+		Poll             *Poll            `json:"poll"`
+		Mentions         []*Mention       `json:"mentions"`
 		Closed           bool             `json:"closed"`
 		CreatedAt        time.Time        `json:"createdAt"`
 		UpdatedAt        time.Time        `json:"updatedAt"`
@@ -98,6 +119,8 @@ func (t *Topic) MarshalJSON() ([]byte, error) {
 		Upvotes:   utils.Map(t.Upvotes, func(u *Upvote) string { return u.CreatorWallet }),
 		Downvotes: utils.Map(t.Downvotes, func(d *Downvote) string { return d.CreatorWallet }),
 		Assets:    t.Assets,
+		Poll:      t.Poll,
+		Mentions:  t.Mentions,
 		Closed:    t.Closed,
 		CreatedAt: t.CreatedAt,
 		UpdatedAt: t.UpdatedAt,
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// AppliedTransaction records that the event of a ledger transaction was
+// processed into the off-chain store, so that reads can wait for writes.
+type AppliedTransaction struct {
+	ID            uint      `gorm:"primaryKey"`
+	TransactionID string    `gorm:"uniqueIndex;not null"`
+	Chaincode     string    `gorm:"index;not null"`
+	EventName     string    `gorm:"not null"`
+	BlockNumber   uint64    `gorm:"index"`
+	CreatedAt     time.Time `gorm:"autoCreateTime;index"`
+}
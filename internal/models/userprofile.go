@@ -19,7 +19,19 @@ type Profile struct {
 	BadgeRelationsReceived []*BadgeRelation `gorm:"polymorphic:Owner"`
 }
 
+// PublicProfile is the view of a profile served to anyone. It leaves out
+// private fields such as the balance.
+type PublicProfile Profile
+
+func (p *PublicProfile) MarshalJSON() ([]byte, error) {
+	return (*Profile)(p).marshal(false)
+}
+
 func (p *Profile) MarshalJSON() ([]byte, error) {
+	return p.marshal(true)
+}
+
+func (p *Profile) marshal(private bool) ([]byte, error) {
 
 	type ProfileBadge struct {
 		Name string `json:"name"`
@@ -34,7 +46,7 @@ func (p *Profile) MarshalJSON() ([]byte, error) {
 		Muted     bool   `json:"muted"`
 		Banned    bool   `json:"banned"`
 
-		Balance     int  `json:"balance"`
+		Balance     *int `json:"balance,omitempty"`
 		Credibility uint `json:"credibility"`
 		Privilege   uint `json:"privilege"`
 
@@ -54,7 +66,12 @@ func (p *Profile) MarshalJSON() ([]byte, error) {
 		Muted:     p.User.Muted,
 		Banned:    p.User.Banned,
 
-		Balance:     p.Balance,
+		Balance: func() *int {
+			if private {
+				return &p.Balance
+			}
+			return nil
+		}(),
 		Credibility: p.Credibility,
 		Privilege: func() uint {
 			if p.User.ActiveRoleRelation == nil {
@@ -102,7 +119,7 @@ func (p *Profile) MarshalJSON() ([]byte, error) {
 
 type User struct {
 	ID        uint   `gorm:"primaryKey"`
-	Username  string `gorm:"not null"`
+	Username  string `gorm:"uniqueIndex;not null"`
 	Wallet    string `gorm:"index:,unique,sort:desc,not null"`
 	Avatar    string
 	Muted     bool           `gorm:"not null"`
@@ -189,3 +206,10 @@ type Badge struct {
 	Name        string `gorm:"uniqueIndex" json:"name"`
 	Description string `json:"description"`
 }
+
+type UsernameHistory struct {
+	ID         uint      `gorm:"primaryKey"`
+	UserWallet string    `gorm:"index;not null"`
+	Username   string    `gorm:"not null"`
+	CreatedAt  time.Time `gorm:"autoCreateTime"`
+}
@@ -0,0 +1,104 @@
+package rest
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/Cealgull/Middleware/internal/proto"
+	"github.com/labstack/echo/v4"
+)
+
+// AuthPolicy states who may call a route. It is declared next to the route
+// when an endpoint registers it and enforced by the authority middleware.
+type AuthPolicy int
+
+const (
+	// AuthRequired routes need a signed in wallet. Routes that declare no
+	// policy are treated this way.
+	AuthRequired AuthPolicy = iota
+	// AuthPublic routes are served to anyone and never look at credentials.
+	AuthPublic
+	// AuthOptional routes identify the caller when credentials are sent.
+	AuthOptional
+	// AuthAdmin routes need a signed in admin wallet.
+	AuthAdmin
+)
+
+// Identity is the caller of a request, set by the authority middleware.
+type Identity struct {
+	Wallet string
+	Admin  bool
+}
+
+const identityKey = "identity"
+
+type routeKey struct {
+	method string
+	path   string
+}
+
+// policies maps each *echo.Echo to the policies of its routes.
+var policies sync.Map
+
+// Declare sets the policy of routes registered on e.
+func Declare(e *echo.Echo, policy AuthPolicy, routes ...*echo.Route) {
+	table, _ := policies.LoadOrStore(e, &sync.Map{})
+	for _, route := range routes {
+		table.(*sync.Map).Store(routeKey{route.Method, route.Path}, policy)
+	}
+}
+
+// unrouted tells whether c matched no route, so that echo answers it with
+// 404 or 405.
+func unrouted(c echo.Context) bool {
+	h := reflect.ValueOf(c.Handler()).Pointer()
+	return h == reflect.ValueOf(echo.NotFoundHandler).Pointer() ||
+		h == reflect.ValueOf(echo.MethodNotAllowedHandler).Pointer()
+}
+
+// PolicyOf is the policy declared for the route c was routed to. Requests
+// matching no route are public, so that they are told the route is unknown
+// rather than asked to sign in.
+func PolicyOf(c echo.Context) AuthPolicy {
+	if unrouted(c) {
+		return AuthPublic
+	}
+	if table, ok := policies.Load(c.Echo()); ok {
+		if policy, ok := table.(*sync.Map).Load(routeKey{c.Request().Method, c.Path()}); ok {
+			return policy.(AuthPolicy)
+		}
+	}
+	return AuthRequired
+}
+
+// Check tells whether id may call a route with policy p.
+func (p AuthPolicy) Check(id *Identity) proto.MiddlewareError {
+	switch {
+	case p == AuthPublic || p == AuthOptional:
+		return nil
+	case id == nil:
+		return authRequiredError
+	case p == AuthAdmin && !id.Admin:
+		return authForbiddenError
+	}
+	return nil
+}
+
+// SetIdentity records the caller of a request.
+func SetIdentity(c echo.Context, id *Identity) {
+	c.Set(identityKey, id)
+}
+
+// IdentityOf is the caller of a request, if it was identified.
+func IdentityOf(c echo.Context) (*Identity, bool) {
+	id, ok := c.Get(identityKey).(*Identity)
+	return id, ok && id != nil
+}
+
+// WalletOf is the wallet of the caller, or empty for anonymous requests.
+func WalletOf(c echo.Context) string {
+	if id, ok := IdentityOf(c); ok {
+		return id.Wallet
+	}
+	return ""
+}
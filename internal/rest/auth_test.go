@@ -0,0 +1,106 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func ok(c echo.Context) error {
+	return c.String(http.StatusOK, "OK")
+}
+
+func TestPolicyOf(t *testing.T) {
+
+	e := echo.New()
+
+	Declare(e, AuthPublic, e.GET("/api/topic/query/tags", ok))
+	Declare(e, AuthAdmin, e.POST("/auth/sessions/revoke/wallet", ok))
+	e.POST("/api/topic/invoke/create", ok)
+	e.POST("/api/topic/query/tags", ok)
+
+	other := echo.New()
+	other.GET("/api/topic/query/tags", ok)
+
+	policyOf := func(e *echo.Echo, method string, path string) AuthPolicy {
+		c := e.NewContext(httptest.NewRequest(method, path, nil), httptest.NewRecorder())
+		e.Router().Find(method, path, c)
+		return PolicyOf(c)
+	}
+
+	assert.Equal(t, AuthPublic, policyOf(e, http.MethodGet, "/api/topic/query/tags"))
+	assert.Equal(t, AuthAdmin, policyOf(e, http.MethodPost, "/auth/sessions/revoke/wallet"))
+	assert.Equal(t, AuthRequired, policyOf(e, http.MethodPost, "/api/topic/invoke/create"))
+
+	// the policy belongs to the method and the server it was declared on
+	assert.Equal(t, AuthRequired, policyOf(e, http.MethodPost, "/api/topic/query/tags"))
+	assert.Equal(t, AuthRequired, policyOf(other, http.MethodGet, "/api/topic/query/tags"))
+
+	routed := func(method string, path string) (AuthPolicy, int) {
+		var policy AuthPolicy
+		e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				policy = PolicyOf(c)
+				return next(c)
+			}
+		})
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return policy, rec.Code
+	}
+
+	// unknown routes are answered as such
+	policy, code := routed(http.MethodGet, "/api/unknown")
+	assert.Equal(t, AuthPublic, policy)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	policy, code = routed(http.MethodGet, "/api/topic/invoke/create")
+	assert.Equal(t, AuthPublic, policy)
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	policy, code = routed(http.MethodPost, "/api/topic/invoke/create")
+	assert.Equal(t, AuthRequired, policy)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestPolicyCheck(t *testing.T) {
+
+	user := &Identity{Wallet: "0x123456789"}
+	admin := &Identity{Wallet: "0x987654321", Admin: true}
+
+	assert.Nil(t, AuthPublic.Check(nil))
+	assert.Nil(t, AuthOptional.Check(nil))
+	assert.Nil(t, AuthOptional.Check(user))
+
+	assert.IsType(t, &AuthRequiredError{}, AuthRequired.Check(nil))
+	assert.Nil(t, AuthRequired.Check(user))
+
+	assert.IsType(t, &AuthRequiredError{}, AuthAdmin.Check(nil))
+	assert.IsType(t, &AuthForbiddenError{}, AuthAdmin.Check(user))
+	assert.Nil(t, AuthAdmin.Check(admin))
+
+	err := AuthAdmin.Check(user)
+	assert.Equal(t, http.StatusForbidden, err.Status())
+	assert.Equal(t, "A0251", err.Message().Code)
+	assert.Equal(t, http.StatusUnauthorized, authRequiredError.Status())
+	assert.Equal(t, "A0250", authRequiredError.Message().Code)
+}
+
+func TestIdentity(t *testing.T) {
+
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+
+	_, ok := IdentityOf(c)
+	assert.False(t, ok)
+	assert.Empty(t, WalletOf(c))
+
+	SetIdentity(c, &Identity{Wallet: "0x123456789"})
+
+	id, ok := IdentityOf(c)
+	assert.True(t, ok)
+	assert.False(t, id.Admin)
+	assert.Equal(t, "0x123456789", WalletOf(c))
+}
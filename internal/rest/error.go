@@ -0,0 +1,130 @@
+package rest
+
+import (
+	"net/http"
+
+	"github.com/Cealgull/Middleware/internal/proto"
+)
+
+type AuthRequiredError struct{}
+type AuthForbiddenError struct{}
+type RateLimitedError struct{}
+
+func (e *AuthRequiredError) Error() string {
+	return "Auth: Authentication Required. Please log in first."
+}
+
+func (e *AuthRequiredError) Status() int {
+	return http.StatusUnauthorized
+}
+
+func (e *AuthRequiredError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "A0250",
+		Message: e.Error(),
+	}
+}
+
+func (e *AuthForbiddenError) Error() string {
+	return "Auth: Forbidden. Only admins may call this endpoint."
+}
+
+func (e *AuthForbiddenError) Status() int {
+	return http.StatusForbidden
+}
+
+func (e *AuthForbiddenError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "A0251",
+		Message: e.Error(),
+	}
+}
+
+var authRequiredError *AuthRequiredError = &AuthRequiredError{}
+var authForbiddenError *AuthForbiddenError = &AuthForbiddenError{}
+var rateLimitedError *RateLimitedError = &RateLimitedError{}
+
+func (e *RateLimitedError) Error() string {
+	return "Rate Limit: Too Many Requests. Please try again later."
+}
+
+func (e *RateLimitedError) Status() int {
+	return http.StatusTooManyRequests
+}
+
+func (e *RateLimitedError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "A0252",
+		Message: e.Error(),
+	}
+}
+
+type IdempotencyKeyInvalidError struct{}
+type IdempotencyKeyReusedError struct{}
+type IdempotencyInProgressError struct{}
+type IdempotentRequestTooLargeError struct{}
+
+func (e *IdempotencyKeyInvalidError) Error() string {
+	return "Idempotency: Invalid Idempotency-Key. Use up to 255 printable characters."
+}
+
+func (e *IdempotencyKeyInvalidError) Status() int {
+	return http.StatusBadRequest
+}
+
+func (e *IdempotencyKeyInvalidError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "A0253",
+		Message: e.Error(),
+	}
+}
+
+func (e *IdempotencyKeyReusedError) Error() string {
+	return "Idempotency: Idempotency-Key was already used for a different request."
+}
+
+func (e *IdempotencyKeyReusedError) Status() int {
+	return http.StatusUnprocessableEntity
+}
+
+func (e *IdempotencyKeyReusedError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "A0254",
+		Message: e.Error(),
+	}
+}
+
+func (e *IdempotencyInProgressError) Error() string {
+	return "Idempotency: A request with this Idempotency-Key is still in progress."
+}
+
+func (e *IdempotencyInProgressError) Status() int {
+	return http.StatusConflict
+}
+
+func (e *IdempotencyInProgressError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "A0255",
+		Message: e.Error(),
+	}
+}
+
+func (e *IdempotentRequestTooLargeError) Error() string {
+	return "Idempotency: Request body is too large."
+}
+
+func (e *IdempotentRequestTooLargeError) Status() int {
+	return http.StatusRequestEntityTooLarge
+}
+
+func (e *IdempotentRequestTooLargeError) Message() *proto.ResponseMessage {
+	return &proto.ResponseMessage{
+		Code:    "A0256",
+		Message: e.Error(),
+	}
+}
+
+var idempotencyKeyInvalidError *IdempotencyKeyInvalidError = &IdempotencyKeyInvalidError{}
+var idempotencyKeyReusedError *IdempotencyKeyReusedError = &IdempotencyKeyReusedError{}
+var idempotencyInProgressError *IdempotencyInProgressError = &IdempotencyInProgressError{}
+var idempotentRequestTooLargeError *IdempotentRequestTooLargeError = &IdempotentRequestTooLargeError{}
@@ -0,0 +1,282 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Cealgull/Middleware/internal/config"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	HeaderIdempotencyKey     = "Idempotency-Key"
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+	defaultIdempotencyWindow = 24 * time.Hour
+	defaultPendingTimeout    = 2 * time.Minute
+	defaultMaxIdempotentBody = 1 << 20
+	maxIdempotencyKeyLength  = 255
+)
+
+var errIdempotencyStoreKind = errors.New("unknown idempotency store")
+
+// IdempotentRecord is what is kept of a request sent with an
+// Idempotency-Key. It is pending until the response is saved.
+type IdempotentRecord struct {
+	Fingerprint string `json:"fingerprint"`
+	Done        bool   `json:"done"`
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType"`
+	Body        []byte `json:"body"`
+}
+
+// IdempotencyStore keeps the records of idempotent requests for a window.
+type IdempotencyStore interface {
+	// Reserve stores record under key unless key is taken, and returns the
+	// record already stored in that case. Reserved keys expire after ttl.
+	Reserve(ctx context.Context, key string, record *IdempotentRecord, ttl time.Duration) (*IdempotentRecord, error)
+	// Save replaces the record of a reserved key.
+	Save(ctx context.Context, key string, record *IdempotentRecord, window time.Duration) error
+	// Release frees a reserved key so that the request can be sent again.
+	Release(ctx context.Context, key string) error
+}
+
+type expiringRecord struct {
+	record  *IdempotentRecord
+	expires time.Time
+}
+
+func (m *MemoryStore) Reserve(ctx context.Context, key string, record *IdempotentRecord, ttl time.Duration) (*IdempotentRecord, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+
+	if m.reserves++; m.reserves%memoryStoreSweepEvery == 0 {
+		for k, r := range m.records {
+			if !now.Before(r.expires) {
+				delete(m.records, k)
+			}
+		}
+	}
+
+	if r, ok := m.records[key]; ok && now.Before(r.expires) {
+		return r.record, nil
+	}
+
+	m.records[key] = &expiringRecord{record: record, expires: now.Add(ttl)}
+
+	return nil, nil
+}
+
+func (m *MemoryStore) Save(ctx context.Context, key string, record *IdempotentRecord, window time.Duration) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.records[key] = &expiringRecord{record: record, expires: m.now().Add(window)}
+
+	return nil
+}
+
+func (m *MemoryStore) Release(ctx context.Context, key string) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.records, key)
+
+	return nil
+}
+
+// recordingWriter keeps a copy of the response body.
+type recordingWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// Idempotency answers invokes repeated with the same Idempotency-Key by the
+// same wallet from the stored response, so that a retry after a timeout
+// does not submit a second transaction. A key is only held for pending
+// until its response is saved, so that a request lost on the way does not
+// lock the key for the whole window.
+type Idempotency struct {
+	store       IdempotencyStore
+	window      time.Duration
+	pending     time.Duration
+	maxBodySize int64
+	logger      *zap.Logger
+}
+
+// NewIdempotency keeps responses in store, or in memory when store is nil.
+func NewIdempotency(logger *zap.Logger, cfg *config.IdempotencyConfig, store IdempotencyStore) *Idempotency {
+
+	if store == nil {
+		store = NewMemoryStore()
+	}
+
+	window := cfg.Window
+
+	if window <= 0 {
+		window = defaultIdempotencyWindow
+	}
+
+	pending := cfg.PendingTimeout
+
+	if pending <= 0 {
+		pending = defaultPendingTimeout
+	}
+
+	if pending > window {
+		pending = window
+	}
+
+	maxBodySize := cfg.MaxBodySize
+
+	if maxBodySize <= 0 {
+		maxBodySize = defaultMaxIdempotentBody
+	}
+
+	return &Idempotency{store: store, window: window, pending: pending, maxBodySize: maxBodySize, logger: logger}
+}
+
+func validIdempotencyKey(key string) bool {
+
+	if len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Handle is meant to run after the caller has been identified. Requests
+// without a key or a wallet, and every request that is not an invoke, go
+// through untouched. Responses are only kept when the request did not fail
+// on the server, so that those can be retried with the same key.
+func (i *Idempotency) Handle(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		key := c.Request().Header.Get(HeaderIdempotencyKey)
+		wallet := WalletOf(c)
+
+		if key == "" || wallet == "" || classify(c) != rateInvoke {
+			return next(c)
+		}
+
+		if !validIdempotencyKey(key) {
+			return c.JSON(idempotencyKeyInvalidError.Status(), idempotencyKeyInvalidError.Message())
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Response(), c.Request().Body, i.maxBodySize))
+
+		var tooLarge *http.MaxBytesError
+
+		if errors.As(err, &tooLarge) {
+			return c.JSON(idempotentRequestTooLargeError.Status(), idempotentRequestTooLargeError.Message())
+		}
+
+		if err != nil {
+			return err
+		}
+
+		c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+		digest := sha256.New()
+		digest.Write([]byte(c.Request().Method + " " + c.Request().URL.Path + "\n"))
+		digest.Write(body)
+
+		fingerprint := hex.EncodeToString(digest.Sum(nil))
+		storeKey := "idempotency:" + wallet + ":" + key
+		ctx := c.Request().Context()
+
+		stored, err := i.store.Reserve(ctx, storeKey, &IdempotentRecord{Fingerprint: fingerprint}, i.pending)
+
+		if err != nil {
+			i.logger.Warn("Failed to reserve idempotency key", zap.String("key", storeKey), zap.Error(err))
+			return next(c)
+		}
+
+		if stored != nil {
+
+			if stored.Fingerprint != fingerprint {
+				return c.JSON(idempotencyKeyReusedError.Status(), idempotencyKeyReusedError.Message())
+			}
+
+			if !stored.Done {
+				return c.JSON(idempotencyInProgressError.Status(), idempotencyInProgressError.Message())
+			}
+
+			c.Response().Header().Set(HeaderIdempotentReplayed, "true")
+			return c.Blob(stored.Status, stored.ContentType, stored.Body)
+		}
+
+		writer := &recordingWriter{ResponseWriter: c.Response().Writer}
+		c.Response().Writer = writer
+
+		err = next(c)
+
+		c.Response().Writer = writer.ResponseWriter
+
+		if status := c.Response().Status; err != nil || status >= http.StatusInternalServerError {
+			if err := i.store.Release(ctx, storeKey); err != nil {
+				i.logger.Warn("Failed to release idempotency key", zap.String("key", storeKey), zap.Error(err))
+			}
+			return err
+		}
+
+		if err := i.store.Save(ctx, storeKey, &IdempotentRecord{
+			Fingerprint: fingerprint,
+			Done:        true,
+			Status:      c.Response().Status,
+			ContentType: c.Response().Header().Get(echo.HeaderContentType),
+			Body:        writer.body.Bytes(),
+		}, i.window); err != nil {
+			i.logger.Warn("Failed to save idempotent response", zap.String("key", storeKey), zap.Error(err))
+		}
+
+		return nil
+	}
+}
+
+// WithIdempotency honours Idempotency-Key on invokes as configured, keeping
+// responses in memory or in Redis. It runs after the rate limiter.
+func WithIdempotency(logger *zap.Logger, cfg *config.IdempotencyConfig) Option {
+	return func(r *RestServer) error {
+
+		if !cfg.Enabled {
+			return nil
+		}
+
+		var store IdempotencyStore
+
+		switch cfg.Store {
+		case "", "memory":
+			store = NewMemoryStore()
+		case "redis":
+			store = NewRedisStore(&cfg.Redis)
+		default:
+			return errIdempotencyStoreKind
+		}
+
+		r.idempotency = NewIdempotency(logger, cfg, store)
+		return nil
+	}
+}
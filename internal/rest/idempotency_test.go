@@ -0,0 +1,263 @@
+package rest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cealgull/Middleware/internal/config"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestIdempotencyStores(t *testing.T) {
+
+	standIn := newRedisStandIn(t, "")
+
+	stores := map[string]IdempotencyStore{
+		"memory": NewMemoryStore(),
+		"redis":  NewRedisStore(&config.RedisConfig{Addr: standIn.listener.Addr().String()}),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+
+			ctx := context.Background()
+
+			stored, err := store.Reserve(ctx, "k", &IdempotentRecord{Fingerprint: "a"}, time.Minute)
+			assert.NoError(t, err)
+			assert.Nil(t, stored)
+
+			stored, err = store.Reserve(ctx, "k", &IdempotentRecord{Fingerprint: "b"}, time.Minute)
+			assert.NoError(t, err)
+			assert.Equal(t, &IdempotentRecord{Fingerprint: "a"}, stored)
+
+			done := &IdempotentRecord{Fingerprint: "a", Done: true, Status: 200, ContentType: "application/json", Body: []byte(`{}`)}
+			assert.NoError(t, store.Save(ctx, "k", done, time.Minute))
+
+			stored, err = store.Reserve(ctx, "k", &IdempotentRecord{Fingerprint: "a"}, time.Minute)
+			assert.NoError(t, err)
+			assert.Equal(t, done, stored)
+
+			assert.NoError(t, store.Release(ctx, "k"))
+
+			stored, err = store.Reserve(ctx, "k", &IdempotentRecord{Fingerprint: "c"}, 50*time.Millisecond)
+			assert.NoError(t, err)
+			assert.Nil(t, stored)
+
+			time.Sleep(60 * time.Millisecond)
+
+			stored, err = store.Reserve(ctx, "k", &IdempotentRecord{Fingerprint: "d"}, time.Minute)
+			assert.NoError(t, err)
+			assert.Nil(t, stored)
+		})
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+
+	logger, _ := zap.NewProduction()
+
+	e := echo.New()
+
+	// stands in for the authority middleware
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if wallet := c.Request().Header.Get("wallet"); wallet != "" {
+				SetIdentity(c, &Identity{Wallet: wallet})
+			}
+			return next(c)
+		}
+	})
+	e.Use(NewIdempotency(logger, &config.IdempotencyConfig{MaxBodySize: 64}, nil).Handle)
+
+	calls := 0
+	release := make(chan struct{})
+
+	counted := func(status int) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			calls++
+			if c.QueryParam("wait") != "" {
+				<-release
+			}
+			return c.JSON(status, map[string]int{"call": calls})
+		}
+	}
+
+	e.POST("/api/topic/invoke/create", counted(http.StatusOK))
+	e.POST("/api/topic/invoke/fail", counted(http.StatusInternalServerError))
+	e.POST("/api/topic/query/list", counted(http.StatusOK))
+
+	send := func(path string, wallet string, key string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("wallet", wallet)
+		if key != "" {
+			req.Header.Set(HeaderIdempotencyKey, key)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("Repeated invoke is replayed", func(t *testing.T) {
+		calls = 0
+
+		first := send("/api/topic/invoke/create", "0x1", "retry-1", `{"title":"a"}`)
+		assert.Equal(t, http.StatusOK, first.Code)
+		assert.Empty(t, first.Header().Get(HeaderIdempotentReplayed))
+
+		again := send("/api/topic/invoke/create", "0x1", "retry-1", `{"title":"a"}`)
+		assert.Equal(t, http.StatusOK, again.Code)
+		assert.Equal(t, "true", again.Header().Get(HeaderIdempotentReplayed))
+		assert.Equal(t, first.Body.String(), again.Body.String())
+		assert.Equal(t, echo.MIMEApplicationJSONCharsetUTF8, again.Header().Get(echo.HeaderContentType))
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("Keys are per wallet", func(t *testing.T) {
+		calls = 0
+		assert.Equal(t, http.StatusOK, send("/api/topic/invoke/create", "0x2", "retry-1", `{"title":"a"}`).Code)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("Reused key with another request", func(t *testing.T) {
+		rec := send("/api/topic/invoke/create", "0x1", "retry-1", `{"title":"b"}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+		assert.Contains(t, rec.Body.String(), "A0254")
+	})
+
+	t.Run("Invalid key", func(t *testing.T) {
+		rec := send("/api/topic/invoke/create", "0x1", strings.Repeat("k", maxIdempotencyKeyLength+1), `{}`)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "A0253")
+	})
+
+	t.Run("Oversized body", func(t *testing.T) {
+		calls = 0
+		rec := send("/api/topic/invoke/create", "0x1", "large-1", `{"title":"`+strings.Repeat("a", 64)+`"}`)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+		assert.Contains(t, rec.Body.String(), "A0256")
+		assert.Equal(t, 0, calls)
+	})
+
+	t.Run("Request still in progress", func(t *testing.T) {
+		done := make(chan *httptest.ResponseRecorder)
+		go func() {
+			done <- send("/api/topic/invoke/create?wait=1", "0x3", "slow", `{}`)
+		}()
+
+		assert.Eventually(t, func() bool {
+			return send("/api/topic/invoke/create?wait=1", "0x3", "slow", `{}`).Code == http.StatusConflict
+		}, time.Second, 10*time.Millisecond)
+
+		close(release)
+		assert.Equal(t, http.StatusOK, (<-done).Code)
+	})
+
+	t.Run("Server failures are not kept", func(t *testing.T) {
+		calls = 0
+		assert.Equal(t, http.StatusInternalServerError, send("/api/topic/invoke/fail", "0x1", "fail-1", `{}`).Code)
+		assert.Equal(t, http.StatusInternalServerError, send("/api/topic/invoke/fail", "0x1", "fail-1", `{}`).Code)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("Queries and anonymous requests are not kept", func(t *testing.T) {
+		calls = 0
+		for i := 0; i < 2; i++ {
+			rec := send("/api/topic/query/list", "0x1", "query-1", `{}`)
+			assert.Equal(t, `{"call":`+strconv.Itoa(i+1)+"}\n", rec.Body.String())
+		}
+		send("/api/topic/invoke/create", "", "anonymous", `{}`)
+		send("/api/topic/invoke/create", "", "anonymous", `{}`)
+		assert.Equal(t, 4, calls)
+	})
+}
+
+func TestIdempotencyPending(t *testing.T) {
+
+	logger, _ := zap.NewProduction()
+
+	clock := time.Now()
+	store := NewMemoryStore()
+	store.now = func() time.Time { return clock }
+
+	e := echo.New()
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			SetIdentity(c, &Identity{Wallet: "0x1"})
+			return next(c)
+		}
+	})
+	e.Use(NewIdempotency(logger, &config.IdempotencyConfig{Window: time.Hour, PendingTimeout: time.Minute}, store).Handle)
+
+	calls := 0
+	release := make(chan struct{})
+
+	e.POST("/api/topic/invoke/create", func(c echo.Context) error {
+		calls++
+		if c.QueryParam("wait") != "" {
+			<-release
+		}
+		return c.JSON(http.StatusOK, map[string]int{"call": calls})
+	})
+
+	send := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{}`))
+		req.Header.Set(HeaderIdempotencyKey, "lost")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- send("/api/topic/invoke/create?wait=1")
+	}()
+
+	assert.Eventually(t, func() bool {
+		return send("/api/topic/invoke/create?wait=1").Code == http.StatusConflict
+	}, time.Second, 10*time.Millisecond)
+
+	// a request that never finishes only holds its key until it is pending
+	clock = clock.Add(2 * time.Minute)
+	assert.Equal(t, http.StatusOK, send("/api/topic/invoke/create").Code)
+	assert.Equal(t, 2, calls)
+
+	close(release)
+	<-done
+
+	// saved responses are kept for the whole window
+	clock = clock.Add(30 * time.Minute)
+	rec := send("/api/topic/invoke/create")
+	assert.Equal(t, "true", rec.Header().Get(HeaderIdempotentReplayed))
+	assert.Equal(t, 2, calls)
+}
+
+func TestWithIdempotency(t *testing.T) {
+
+	logger, _ := zap.NewProduction()
+
+	r, err := NewRestServer("127.0.0.1", 0, WithIdempotency(logger, &config.IdempotencyConfig{}))
+	assert.NoError(t, err)
+	assert.Nil(t, r.idempotency)
+
+	r, err = NewRestServer("127.0.0.1", 0, WithIdempotency(logger, &config.IdempotencyConfig{Enabled: true}))
+	assert.NoError(t, err)
+	assert.IsType(t, &MemoryStore{}, r.idempotency.store)
+	assert.Equal(t, defaultIdempotencyWindow, r.idempotency.window)
+	assert.Equal(t, defaultPendingTimeout, r.idempotency.pending)
+	assert.Equal(t, int64(defaultMaxIdempotentBody), r.idempotency.maxBodySize)
+
+	r, err = NewRestServer("127.0.0.1", 0, WithIdempotency(logger, &config.IdempotencyConfig{Enabled: true, Store: "redis"}))
+	assert.NoError(t, err)
+	assert.IsType(t, &RedisStore{}, r.idempotency.store)
+
+	_, err = NewRestServer("127.0.0.1", 0, WithIdempotency(logger, &config.IdempotencyConfig{Enabled: true, Store: "disk"}))
+	assert.ErrorIs(t, err, errIdempotencyStoreKind)
+}
@@ -0,0 +1,263 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cealgull/Middleware/internal/config"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultRateWindow     = time.Minute
+	memoryStoreSweepEvery = 1024
+)
+
+var errRateLimitStoreKind = errors.New("unknown rate limit store")
+
+// RateLimitStore counts requests in fixed windows.
+type RateLimitStore interface {
+	// Take counts one request against key and returns the requests counted
+	// so far in the current window of key and when that window ends. A
+	// window starts with the first request after the previous one ended.
+	Take(ctx context.Context, key string, window time.Duration) (int64, time.Time, error)
+}
+
+type rateWindow struct {
+	count int64
+	reset time.Time
+}
+
+// MemoryStore keeps the rate limit counts and idempotent responses of a
+// single instance in memory.
+type MemoryStore struct {
+	mu       sync.Mutex
+	windows  map[string]*rateWindow
+	records  map[string]*expiringRecord
+	takes    int
+	reserves int
+	now      func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		windows: map[string]*rateWindow{},
+		records: map[string]*expiringRecord{},
+		now:     time.Now,
+	}
+}
+
+func (m *MemoryStore) Take(ctx context.Context, key string, window time.Duration) (int64, time.Time, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+
+	// Windows that ended are dropped every so often so that the map does
+	// not keep every client ever seen.
+	if m.takes++; m.takes%memoryStoreSweepEvery == 0 {
+		for k, w := range m.windows {
+			if !now.Before(w.reset) {
+				delete(m.windows, k)
+			}
+		}
+	}
+
+	w, ok := m.windows[key]
+
+	if !ok || !now.Before(w.reset) {
+		w = &rateWindow{reset: now.Add(window)}
+		m.windows[key] = w
+	}
+
+	w.count++
+
+	return w.count, w.reset, nil
+}
+
+type rateClass string
+
+const (
+	rateQuery  rateClass = "query"
+	rateInvoke rateClass = "invoke"
+	rateUpload rateClass = "upload"
+)
+
+// classify tells which budget a request is paid from. Invokes and uploads
+// cost an endorsement or a storage write, everything else is a query.
+func classify(c echo.Context) rateClass {
+	path := c.Path()
+	switch {
+	case strings.HasPrefix(path, "/api/upload"):
+		return rateUpload
+	case strings.Contains(path, "/invoke/"):
+		return rateInvoke
+	default:
+		return rateQuery
+	}
+}
+
+// RateLimiter limits how many requests of each class a wallet and an IP may
+// make per window.
+type RateLimiter struct {
+	store   RateLimitStore
+	window  time.Duration
+	budgets map[rateClass]config.RateLimitBudget
+	logger  *zap.Logger
+}
+
+func budget(b config.RateLimitBudget, wallet int, ip int) config.RateLimitBudget {
+	if b.Wallet == 0 {
+		b.Wallet = wallet
+	}
+	if b.IP == 0 {
+		b.IP = ip
+	}
+	return b
+}
+
+// NewRateLimiter counts in store, or in memory when store is nil. Zero
+// budgets pick the defaults and negative ones lift the limit.
+func NewRateLimiter(logger *zap.Logger, cfg *config.RateLimitConfig, store RateLimitStore) *RateLimiter {
+
+	if store == nil {
+		store = NewMemoryStore()
+	}
+
+	window := cfg.Window
+
+	if window <= 0 {
+		window = defaultRateWindow
+	}
+
+	return &RateLimiter{
+		store:  store,
+		window: window,
+		budgets: map[rateClass]config.RateLimitBudget{
+			rateQuery:  budget(cfg.Query, 600, 1200),
+			rateInvoke: budget(cfg.Invoke, 30, 60),
+			rateUpload: budget(cfg.Upload, 20, 40),
+		},
+		logger: logger,
+	}
+}
+
+// rateLimitKey holds the tightest limit counted so far for the request, so
+// that the headers report it across LimitIP and Limit.
+const rateLimitKey = "_rate_limit"
+
+type rateLimit struct {
+	limit     int
+	remaining int64
+	reset     time.Time
+}
+
+// LimitIP counts the request against the budget of its IP. It is meant to
+// run before the caller is identified, so that requests failing to sign in
+// are paid for as well.
+func (l *RateLimiter) LimitIP(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		class := classify(c)
+		return l.take(c, next, "ratelimit:"+string(class)+":ip:"+c.RealIP(), l.budgets[class].IP)
+	}
+}
+
+// Limit is meant to run after the caller has been identified, so that
+// signed in wallets are counted on their own besides their IP.
+func (l *RateLimiter) Limit(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		wallet := WalletOf(c)
+
+		if wallet == "" {
+			return next(c)
+		}
+
+		class := classify(c)
+		return l.take(c, next, "ratelimit:"+string(class)+":wallet:"+wallet, l.budgets[class].Wallet)
+	}
+}
+
+// take counts the request under key and answers 429 Too Many Requests once
+// more than limit requests were counted in the window. Requests are let
+// through when the store cannot be reached.
+func (l *RateLimiter) take(c echo.Context, next echo.HandlerFunc, key string, limit int) error {
+
+	if limit < 0 {
+		return next(c)
+	}
+
+	count, until, err := l.store.Take(c.Request().Context(), key, l.window)
+
+	if err != nil {
+		l.logger.Warn("Failed to count request", zap.String("key", key), zap.Error(err))
+		return next(c)
+	}
+
+	tightest := rateLimit{limit: limit, remaining: int64(limit) - count, reset: until}
+
+	if previous, ok := c.Get(rateLimitKey).(rateLimit); ok && previous.remaining <= tightest.remaining {
+		tightest = previous
+	}
+
+	c.Set(rateLimitKey, tightest)
+
+	seconds := int64(time.Until(tightest.reset).Round(time.Second) / time.Second)
+
+	if seconds < 0 {
+		seconds = 0
+	}
+
+	remaining := tightest.remaining
+
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	header := c.Response().Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(tightest.limit))
+	header.Set("RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+	header.Set("RateLimit-Reset", strconv.FormatInt(seconds, 10))
+
+	if int64(limit) < count {
+		if seconds < 1 {
+			seconds = 1
+		}
+		header.Set(echo.HeaderRetryAfter, strconv.FormatInt(seconds, 10))
+		return c.JSON(rateLimitedError.Status(), rateLimitedError.Message())
+	}
+
+	return next(c)
+}
+
+// WithRateLimit limits requests as configured, counting in memory or in
+// Redis. IPs are limited ahead of the endpoints' own middleware and wallets
+// after it.
+func WithRateLimit(logger *zap.Logger, cfg *config.RateLimitConfig) Option {
+	return func(r *RestServer) error {
+
+		if !cfg.Enabled {
+			return nil
+		}
+
+		var store RateLimitStore
+
+		switch cfg.Store {
+		case "", "memory":
+			store = NewMemoryStore()
+		case "redis":
+			store = NewRedisStore(&cfg.Redis)
+		default:
+			return errRateLimitStoreKind
+		}
+
+		r.limiter = NewRateLimiter(logger, cfg, store)
+		return nil
+	}
+}
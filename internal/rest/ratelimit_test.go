@@ -0,0 +1,386 @@
+package rest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cealgull/Middleware/internal/config"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// redisStandIn speaks just enough of the Redis protocol for RedisStore.
+type redisStandIn struct {
+	mu       sync.Mutex
+	password string
+	values   map[string]string
+	expires  map[string]time.Time
+	listener net.Listener
+}
+
+func newRedisStandIn(t *testing.T, password string) *redisStandIn {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	s := &redisStandIn{
+		password: password,
+		values:   map[string]string{},
+		expires:  map[string]time.Time{},
+		listener: l,
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *redisStandIn) serve(conn net.Conn) {
+
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	authorized := s.password == ""
+
+	var queue [][]string
+	queued := false
+
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+
+		items := reply.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i] = item.(string)
+		}
+
+		cmd := strings.ToUpper(args[0])
+
+		switch {
+		case cmd == "AUTH":
+			if args[1] != s.password {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authorized = true
+			fmt.Fprint(conn, "+OK\r\n")
+		case !authorized:
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+		case cmd == "SELECT":
+			fmt.Fprint(conn, "+OK\r\n")
+		case cmd == "MULTI":
+			queued, queue = true, nil
+			fmt.Fprint(conn, "+OK\r\n")
+		case cmd == "EXEC":
+			fmt.Fprintf(conn, "*%d\r\n", len(queue))
+			for _, q := range queue {
+				fmt.Fprint(conn, s.exec(q))
+			}
+			queued = false
+		case queued:
+			queue = append(queue, args)
+			fmt.Fprint(conn, "+QUEUED\r\n")
+		default:
+			fmt.Fprint(conn, s.exec(args))
+		}
+	}
+}
+
+func (s *redisStandIn) exec(args []string) string {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := args[1]
+
+	if exp, ok := s.expires[key]; ok && !time.Now().Before(exp) {
+		delete(s.values, key)
+		delete(s.expires, key)
+	}
+
+	value, exists := s.values[key]
+
+	switch strings.ToUpper(args[0]) {
+	case "SET":
+		var ttl time.Duration
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				if exists {
+					return "$-1\r\n"
+				}
+			case "PX":
+				ms, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(ms) * time.Millisecond
+				i++
+			}
+		}
+		s.values[key] = args[2]
+		delete(s.expires, key)
+		if ttl > 0 {
+			s.expires[key] = time.Now().Add(ttl)
+		}
+		return "+OK\r\n"
+	case "GET":
+		if !exists {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "DEL":
+		delete(s.values, key)
+		delete(s.expires, key)
+		if !exists {
+			return ":0\r\n"
+		}
+		return ":1\r\n"
+	case "INCR":
+		n, _ := strconv.ParseInt(value, 10, 64)
+		s.values[key] = strconv.FormatInt(n+1, 10)
+		return ":" + s.values[key] + "\r\n"
+	case "PTTL":
+		exp, ok := s.expires[key]
+		if !ok {
+			return ":-1\r\n"
+		}
+		return ":" + strconv.FormatInt(time.Until(exp).Milliseconds(), 10) + "\r\n"
+	}
+
+	return "-ERR unknown command\r\n"
+}
+
+func TestMemoryStore(t *testing.T) {
+
+	now := time.Unix(1700000000, 0)
+	m := NewMemoryStore()
+	m.now = func() time.Time { return now }
+
+	count, reset, err := m.Take(context.Background(), "a", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+	assert.Equal(t, now.Add(time.Minute), reset)
+
+	count, _, _ = m.Take(context.Background(), "a", time.Minute)
+	assert.Equal(t, int64(2), count)
+
+	count, _, _ = m.Take(context.Background(), "b", time.Minute)
+	assert.Equal(t, int64(1), count)
+
+	// a new window starts once the previous one ended
+	now = now.Add(time.Minute)
+	count, reset, _ = m.Take(context.Background(), "a", time.Minute)
+	assert.Equal(t, int64(1), count)
+	assert.Equal(t, now.Add(time.Minute), reset)
+
+	// ended windows are swept
+	now = now.Add(time.Hour)
+	for i := 0; i < memoryStoreSweepEvery; i++ {
+		m.Take(context.Background(), "c", time.Hour)
+	}
+	assert.Len(t, m.windows, 1)
+}
+
+func TestRedisStore(t *testing.T) {
+
+	standIn := newRedisStandIn(t, "secret")
+
+	store := NewRedisStore(&config.RedisConfig{Addr: standIn.listener.Addr().String(), Password: "secret", DB: 1})
+
+	count, reset, err := store.Take(context.Background(), "a", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), reset, time.Second)
+
+	count, _, err = store.Take(context.Background(), "a", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+	assert.Len(t, store.pool, 1)
+
+	count, _, err = store.Take(context.Background(), "short", 50*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	time.Sleep(60 * time.Millisecond)
+
+	count, _, err = store.Take(context.Background(), "short", 50*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	wrong := NewRedisStore(&config.RedisConfig{Addr: standIn.listener.Addr().String(), Password: "wrong"})
+	_, _, err = wrong.Take(context.Background(), "a", time.Minute)
+	assert.IsType(t, RedisError(""), err)
+
+	unreachable := NewRedisStore(&config.RedisConfig{Addr: "127.0.0.1:1", Timeout: 100 * time.Millisecond})
+	_, _, err = unreachable.Take(context.Background(), "a", time.Minute)
+	assert.Error(t, err)
+}
+
+type failingStore struct{}
+
+func (failingStore) Take(context.Context, string, time.Duration) (int64, time.Time, error) {
+	return 0, time.Time{}, net.ErrClosed
+}
+
+func newLimitedServer(t *testing.T, limiter *RateLimiter) *echo.Echo {
+
+	e := echo.New()
+	e.Use(limiter.LimitIP)
+
+	// stands in for the authority middleware
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			switch wallet := c.Request().Header.Get("wallet"); wallet {
+			case "":
+			case "invalid":
+				return c.NoContent(http.StatusUnauthorized)
+			default:
+				SetIdentity(c, &Identity{Wallet: wallet})
+			}
+			return next(c)
+		}
+	})
+	e.Use(limiter.Limit)
+
+	e.POST("/api/topic/query/list", ok)
+	e.POST("/api/topic/invoke/create", ok)
+	e.POST("/api/upload", ok)
+
+	return e
+}
+
+func call(e *echo.Echo, path string, ip string, wallet string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, nil)
+	req.RemoteAddr = ip + ":1234"
+	if wallet != "" {
+		req.Header.Set("wallet", wallet)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRateLimiter(t *testing.T) {
+
+	logger, _ := zap.NewProduction()
+
+	limiter := NewRateLimiter(logger, &config.RateLimitConfig{
+		Query:  config.RateLimitBudget{Wallet: -1, IP: -1},
+		Invoke: config.RateLimitBudget{Wallet: 2, IP: 3},
+		Upload: config.RateLimitBudget{Wallet: 1},
+	}, nil)
+
+	e := newLimitedServer(t, limiter)
+
+	t.Run("Defaults and unlimited budgets", func(t *testing.T) {
+		assert.Equal(t, 40, limiter.budgets[rateUpload].IP)
+		assert.Equal(t, defaultRateWindow, limiter.window)
+
+		rec := call(e, "/api/topic/query/list", "10.0.0.1", "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Empty(t, rec.Header().Get("RateLimit-Limit"))
+	})
+
+	t.Run("Wallet budget", func(t *testing.T) {
+		rec := call(e, "/api/topic/invoke/create", "10.0.0.2", "0x1")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "2", rec.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, "1", rec.Header().Get("RateLimit-Remaining"))
+		assert.Equal(t, "60", rec.Header().Get("RateLimit-Reset"))
+
+		assert.Equal(t, http.StatusOK, call(e, "/api/topic/invoke/create", "10.0.0.3", "0x1").Code)
+
+		rec = call(e, "/api/topic/invoke/create", "10.0.0.4", "0x1")
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+		assert.Equal(t, "60", rec.Header().Get(echo.HeaderRetryAfter))
+		assert.Contains(t, rec.Body.String(), "A0252")
+
+		// uploads are paid from their own budget
+		assert.Equal(t, http.StatusOK, call(e, "/api/upload", "10.0.0.4", "0x1").Code)
+		assert.Equal(t, http.StatusTooManyRequests, call(e, "/api/upload", "10.0.0.4", "0x1").Code)
+	})
+
+	t.Run("IP budget", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, http.StatusOK, call(e, "/api/topic/invoke/create", "10.0.0.5", "0x"+strconv.Itoa(100+i)).Code)
+		}
+		assert.Equal(t, http.StatusTooManyRequests, call(e, "/api/topic/invoke/create", "10.0.0.5", "0x200").Code)
+	})
+
+	t.Run("IP budget counts failed sign ins", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, http.StatusUnauthorized, call(e, "/api/topic/invoke/create", "10.0.0.7", "invalid").Code)
+		}
+		assert.Equal(t, http.StatusTooManyRequests, call(e, "/api/topic/invoke/create", "10.0.0.7", "invalid").Code)
+	})
+
+	t.Run("Requests pass when the store fails", func(t *testing.T) {
+		e := newLimitedServer(t, NewRateLimiter(logger, &config.RateLimitConfig{}, failingStore{}))
+		rec := call(e, "/api/topic/invoke/create", "10.0.0.6", "0x1")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Empty(t, rec.Header().Get("RateLimit-Limit"))
+	})
+}
+
+func TestNewIPExtractor(t *testing.T) {
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.1.0.1:1234"
+	req.Header.Set(echo.HeaderXForwardedFor, "203.0.113.9, 198.51.100.7")
+
+	direct, err := NewIPExtractor(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.1.0.1", direct(req))
+
+	proxied, err := NewIPExtractor([]string{"10.1.0.0/16"})
+	assert.NoError(t, err)
+	assert.Equal(t, "198.51.100.7", proxied(req))
+
+	chained, err := NewIPExtractor([]string{"10.1.0.0/16", "198.51.100.0/24"})
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.9", chained(req))
+
+	_, err = NewIPExtractor([]string{"10.1.0.0"})
+	assert.Error(t, err)
+
+	r, err := NewRestServer("127.0.0.1", 0, WithIPExtractor(proxied))
+	assert.NoError(t, err)
+	assert.NotNil(t, r.echo.IPExtractor)
+}
+
+func TestWithRateLimit(t *testing.T) {
+
+	logger, _ := zap.NewProduction()
+
+	r, err := NewRestServer("127.0.0.1", 0, WithRateLimit(logger, &config.RateLimitConfig{}))
+	assert.NoError(t, err)
+	assert.Nil(t, r.limiter)
+
+	r, err = NewRestServer("127.0.0.1", 0, WithRateLimit(logger, &config.RateLimitConfig{Enabled: true, Store: "redis"}))
+	assert.NoError(t, err)
+	assert.IsType(t, &RedisStore{}, r.limiter.store)
+
+	_, err = NewRestServer("127.0.0.1", 0, WithRateLimit(logger, &config.RateLimitConfig{Enabled: true, Store: "disk"}))
+	assert.ErrorIs(t, err, errRateLimitStoreKind)
+}
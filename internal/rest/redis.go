@@ -0,0 +1,351 @@
+package rest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Cealgull/Middleware/internal/config"
+)
+
+const (
+	defaultRedisTimeout = time.Second
+	redisPoolSize       = 16
+)
+
+var errRedisReply = errors.New("redis: unexpected reply")
+
+// RedisError is an error reply of the server.
+type RedisError string
+
+func (e RedisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// RedisStore keeps rate limit counts and idempotent responses in Redis, or
+// any server speaking its protocol, so that they are shared between
+// instances. It only needs SET, GET, DEL, INCR, PTTL and MULTI, which every
+// Redis compatible server implements.
+type RedisStore struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	pool     chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func NewRedisStore(cfg *config.RedisConfig) *RedisStore {
+
+	timeout := cfg.Timeout
+
+	if timeout <= 0 {
+		timeout = defaultRedisTimeout
+	}
+
+	return &RedisStore{
+		addr:     cfg.Addr,
+		password: cfg.Password,
+		db:       cfg.DB,
+		timeout:  timeout,
+		pool:     make(chan *redisConn, redisPoolSize),
+	}
+}
+
+func (s *RedisStore) dial(ctx context.Context) (*redisConn, error) {
+
+	d := net.Dialer{Timeout: s.timeout}
+	nc, err := d.DialContext(ctx, "tcp", s.addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+
+	var setup [][]string
+
+	if s.password != "" {
+		setup = append(setup, []string{"AUTH", s.password})
+	}
+
+	if s.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(s.db)})
+	}
+
+	for _, args := range setup {
+		if _, err := conn.do(s.timeout, args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func (s *RedisStore) get(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-s.pool:
+		return conn, nil
+	default:
+		return s.dial(ctx)
+	}
+}
+
+func (s *RedisStore) put(conn *redisConn) {
+	select {
+	case s.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// run sends the commands on a pooled connection and returns the reply to
+// the last. Connections that failed are closed rather than pooled.
+func (s *RedisStore) run(ctx context.Context, commands ...[]string) (interface{}, error) {
+
+	conn, err := s.get(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.pipeline(s.timeout, commands...)
+
+	if _, ok := err.(RedisError); err != nil && !ok {
+		conn.Close()
+		return nil, err
+	}
+
+	s.put(conn)
+
+	return reply, err
+}
+
+// Take starts the window of key with SET NX PX unless one is running, then
+// counts the request. INCR keeps the expiry, so the key disappears when
+// the window ends.
+func (s *RedisStore) Take(ctx context.Context, key string, window time.Duration) (int64, time.Time, error) {
+
+	ms := strconv.FormatInt(window.Milliseconds(), 10)
+
+	reply, err := s.run(ctx,
+		[]string{"MULTI"},
+		[]string{"SET", key, "0", "PX", ms, "NX"},
+		[]string{"INCR", key},
+		[]string{"PTTL", key},
+		[]string{"EXEC"},
+	)
+
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	results, ok := reply.([]interface{})
+
+	if !ok || len(results) != 3 {
+		return 0, time.Time{}, errRedisReply
+	}
+
+	count, ok := results[1].(int64)
+	ttl, _ := results[2].(int64)
+
+	if !ok {
+		return 0, time.Time{}, errRedisReply
+	}
+
+	if ttl < 0 {
+		ttl = window.Milliseconds()
+	}
+
+	return count, time.Now().Add(time.Duration(ttl) * time.Millisecond), nil
+}
+
+// Reserve sets key with SET NX and reads it back in the same transaction,
+// so that the record of whoever claimed it first is returned.
+func (s *RedisStore) Reserve(ctx context.Context, key string, record *IdempotentRecord, ttl time.Duration) (*IdempotentRecord, error) {
+
+	b, _ := json.Marshal(record)
+
+	reply, err := s.run(ctx,
+		[]string{"MULTI"},
+		[]string{"SET", key, string(b), "PX", strconv.FormatInt(ttl.Milliseconds(), 10), "NX"},
+		[]string{"GET", key},
+		[]string{"EXEC"},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	results, ok := reply.([]interface{})
+
+	if !ok || len(results) != 2 {
+		return nil, errRedisReply
+	}
+
+	if results[0] == "OK" {
+		return nil, nil
+	}
+
+	value, ok := results[1].(string)
+
+	if !ok {
+		return nil, errRedisReply
+	}
+
+	stored := IdempotentRecord{}
+
+	if err := json.Unmarshal([]byte(value), &stored); err != nil {
+		return nil, errRedisReply
+	}
+
+	return &stored, nil
+}
+
+func (s *RedisStore) Save(ctx context.Context, key string, record *IdempotentRecord, window time.Duration) error {
+
+	b, _ := json.Marshal(record)
+
+	_, err := s.run(ctx, []string{"SET", key, string(b), "PX", strconv.FormatInt(window.Milliseconds(), 10)})
+
+	return err
+}
+
+func (s *RedisStore) Release(ctx context.Context, key string) error {
+	_, err := s.run(ctx, []string{"DEL", key})
+	return err
+}
+
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	return c.pipeline(timeout, args)
+}
+
+// pipeline sends the commands at once and returns the reply to the last.
+func (c *redisConn) pipeline(timeout time.Duration, commands ...[]string) (interface{}, error) {
+
+	if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(c.Conn)
+
+	for _, args := range commands {
+		fmt.Fprintf(w, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	var (
+		reply interface{}
+		err   error
+	)
+
+	// Every reply is read so that the connection can be reused, and the
+	// first error reply is the one returned.
+	var first error
+
+	for range commands {
+		reply, err = readReply(c.r)
+
+		if _, ok := err.(RedisError); ok {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if first != nil {
+		return nil, first
+	}
+
+	return reply, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+
+	line, err := r.ReadString('\n')
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", errRedisReply
+	}
+
+	return line[:len(line)-2], nil
+}
+
+// readReply reads one RESP reply. Nil replies are returned as nil.
+func readReply(r *bufio.Reader) (interface{}, error) {
+
+	line, err := readLine(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, RedisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errRedisReply
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errRedisReply
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			item, err := readReply(r)
+			if _, ok := err.(RedisError); err != nil && !ok {
+				return nil, err
+			} else if ok {
+				item = err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+
+	return nil, errRedisReply
+}
@@ -2,6 +2,7 @@ package rest
 
 import (
 	"fmt"
+	"net"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -9,9 +10,11 @@ import (
 )
 
 type RestServer struct {
-	addr      string
-	endpoints []RestEndpoint
-	echo      *echo.Echo
+	addr        string
+	endpoints   []RestEndpoint
+	limiter     *RateLimiter
+	idempotency *Idempotency
+	echo        *echo.Echo
 }
 
 type Option func(r *RestServer) error
@@ -45,6 +48,40 @@ func WithEndpoint(endpoint RestEndpoint) Option {
 	}
 }
 
+// NewIPExtractor tells the IP of a client from X-Forwarded-For, believing
+// only the hops added by proxies in the trusted CIDR ranges. Without any
+// trusted proxy the address of the connection is used.
+func NewIPExtractor(trustedProxies []string) (echo.IPExtractor, error) {
+
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+
+	for _, proxy := range trustedProxies {
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+// WithIPExtractor sets how the IP of a client is told, for RealIP.
+func WithIPExtractor(extractor echo.IPExtractor) Option {
+	return func(r *RestServer) error {
+		r.echo.IPExtractor = extractor
+		return nil
+	}
+}
+
 func NewRestServer(host string, port int, options ...Option) (*RestServer, error) {
 
 	var rest RestServer
@@ -55,13 +92,30 @@ func NewRestServer(host string, port int, options ...Option) (*RestServer, error
 	rest.echo.HideBanner = true
 
 	for _, option := range options {
-		var _ = option(&rest)
+		if err := option(&rest); err != nil {
+			return nil, err
+		}
+	}
+
+	// IPs are limited before anything else runs, failed sign ins included.
+	if rest.limiter != nil {
+		rest.echo.Use(rest.limiter.LimitIP)
 	}
 
 	for _, endpoint := range rest.endpoints {
 		var _ = endpoint.Register(rest.echo)
 	}
 
+	// Endpoints identify the caller in their own middleware, so the wallet
+	// limit and idempotency go last to see the wallet.
+	if rest.limiter != nil {
+		rest.echo.Use(rest.limiter.Limit)
+	}
+
+	if rest.idempotency != nil {
+		rest.echo.Use(rest.idempotency.Handle)
+	}
+
 	return &rest, nil
 }
 
@@ -4,6 +4,7 @@ import (
 	"github.com/Cealgull/Middleware/internal/authority"
 	"github.com/Cealgull/Middleware/internal/config"
 	"github.com/Cealgull/Middleware/internal/fabric"
+	"github.com/Cealgull/Middleware/internal/fabric/offchain"
 	"github.com/Cealgull/Middleware/internal/ipfs"
 	"github.com/Cealgull/Middleware/internal/rest"
 	"go.uber.org/zap"
@@ -34,22 +35,68 @@ func main() {
 		logger.Panic(err.Error())
 	}
 
-	ipfs, _ := ipfs.NewIPFSManager(logger, ipfs.WithUrl(config.IPFS.Host, config.IPFS.Port))
-	ca := authority.NewCertAuthority(logger, config.Verify.Host, config.Verify.Port)
+	dialector := offchain.NewPostgresDialector(offchain.WithPostgresGormConfig(&config.Postgres))
 
-	fab, err := fabric.NewGatewayMiddleware(logger, ipfs, &config)
+	db, err := offchain.NewOffchainStore(dialector, &config.Postgres)
 
 	if err != nil {
 		logger.Panic(err.Error())
 	}
 
-	r, _ := rest.NewRestServer(config.Host,
+	ipfs, err := ipfs.NewIPFSManager(logger,
+		ipfs.WithStorageConfig(&config.IPFS),
+		ipfs.WithMediaLimits(config.IPFS.Media.MaxSize, config.IPFS.Media.ThumbnailSize, config.IPFS.Media.Types),
+		ipfs.WithMaxUploadSize(config.IPFS.MaxUploadSize),
+		ipfs.WithCatTimeout(config.IPFS.Cache.Timeout),
+		ipfs.WithFetchTimeout(config.IPFS.Cache.FetchTimeout),
+		ipfs.WithContentCache(config.IPFS.Cache.MemorySize, config.IPFS.Cache.MaxEntrySize,
+			config.IPFS.Cache.DiskPath, config.IPFS.Cache.DiskSize),
+		ipfs.WithMaxContentSize(config.IPFS.MaxContentSize),
+		ipfs.WithOffchainStore(db),
+		ipfs.WithEncryptionKey(config.IPFS.EncryptionKey),
+	)
+
+	if err != nil {
+		logger.Panic(err.Error())
+	}
+
+	ca, err := authority.NewCertAuthority(logger, config.Verify.Host, config.Verify.Port,
+		authority.WithVerifyConfig(&config.Verify),
+		authority.WithSessionConfig(&config.Session),
+		authority.WithOffchainStore(db),
+		authority.WithAdmins(config.Admins),
+	)
+
+	if err != nil {
+		logger.Panic(err.Error())
+	}
+
+	fab, err := fabric.NewGatewayMiddleware(logger, ipfs, db, &config)
+
+	if err != nil {
+		logger.Panic(err.Error())
+	}
+
+	extractor, err := rest.NewIPExtractor(config.TrustedProxies)
+
+	if err != nil {
+		logger.Panic(err.Error())
+	}
+
+	r, err := rest.NewRestServer(config.Host,
 		config.Port,
+		rest.WithIPExtractor(extractor),
 		rest.WithEndpoint(ca),
 		rest.WithEndpoint(ipfs),
 		rest.WithEndpoint(fab),
+		rest.WithRateLimit(logger, &config.RateLimit),
+		rest.WithIdempotency(logger, &config.Idempotency),
 	)
 
+	if err != nil {
+		logger.Panic(err.Error())
+	}
+
 	r.Start()
 
 }
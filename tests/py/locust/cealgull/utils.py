@@ -3,7 +3,9 @@ from .config import *
 from cryptography.hazmat.primitives.asymmetric import ed25519
 from dataclasses import dataclass
 from typing import Any
+import secrets
 import base64
+import time
 
 
 @dataclass
@@ -23,17 +25,34 @@ def cealgull_auth_login(user):
         headers={"signature": "HACK"},
         json={"pub": pubb64},
     ).json()["cert"]
-    sig = base64.b64encode(priv.sign(cert.encode())).decode()
+
+    nonce = user.client.post(CEALGULL_MIDDLEWARE_HOST + "/auth/challenge").json()["nonce"]
+    timestamp = str(int(time.time()))
+    message = "\n".join([nonce, timestamp, CEALGULL_MIDDLEWARE_HOST])
+    sig = base64.b64encode(priv.sign(message.encode())).decode()
 
     res = user.client.post(
         CEALGULL_MIDDLEWARE_HOST + "/auth/login",
-        headers={"signature": sig},
+        headers={
+            "signature": sig,
+            "nonce": nonce,
+            "timestamp": timestamp,
+            "origin": CEALGULL_MIDDLEWARE_HOST,
+        },
         json={"cert": cert},
     )
 
-    wallet = res.json()["wallet"]
     cookies = res.cookies
 
+    if res.status_code != 200:
+        res = user.client.post(
+            CEALGULL_MIDDLEWARE_HOST + "/api/user/invoke/create",
+            json={"username": "user_" + secrets.token_hex(4)},
+            cookies=cookies,
+        )
+
+    wallet = res.json()["wallet"]
+
     return Credential(wallet=wallet, cookies=cookies, cert=cert)
 
 
@@ -2,6 +2,7 @@ from .config import *
 from .utils import *
 
 import unittest
+import secrets
 import time
 
 
@@ -13,10 +14,12 @@ class UserProfileSmokeTest(unittest.TestCase):
     def test_0001_update_user(self):
         time.sleep(0.5)
 
+        username = "alice_" + secrets.token_hex(4)
+
         res = self.request(
             "/api/user/invoke/update",
             {
-                "username": "alice_exp",
+                "username": username,
                 "avatar": "0xsaadfwadf",
                 "wallet": self.credential.wallet,
                 "signature": "Genshin Impact is a good game",
@@ -31,7 +34,7 @@ class UserProfileSmokeTest(unittest.TestCase):
             {"wallet": self.credential.wallet},
         )
 
-        self.assertEqual(res["username"], "alice_exp")
+        self.assertEqual(res["username"], username)
         self.assertEqual(res["wallet"], self.credential.wallet)
         self.assertEqual(res["avatar"], "0xsaadfwadf")
         self.assertEqual(res["signature"], "Genshin Impact is a good game")
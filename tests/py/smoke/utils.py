@@ -5,6 +5,7 @@ from cryptography.hazmat.primitives.asymmetric import ed25519
 from requests.sessions import RequestsCookieJar
 from dataclasses import dataclass
 import requests
+import secrets
 import base64
 import time
 
@@ -26,18 +27,35 @@ def test_auth_login(cookies=None) -> Credential:
         headers={"signature": "HACK"},
         json={"pub": pubb64},
     ).json()["cert"]
-    sig = base64.b64encode(priv.sign(cert.encode())).decode()
+
+    nonce = requests.post(CEALGULL_MIDDLEWARE_HOST + "/auth/challenge").json()["nonce"]
+    timestamp = str(int(time.time()))
+    message = "\n".join([nonce, timestamp, CEALGULL_MIDDLEWARE_HOST])
+    sig = base64.b64encode(priv.sign(message.encode())).decode()
 
     res = requests.post(
         CEALGULL_MIDDLEWARE_HOST + "/auth/login",
-        headers={"signature": sig},
+        headers={
+            "signature": sig,
+            "nonce": nonce,
+            "timestamp": timestamp,
+            "origin": CEALGULL_MIDDLEWARE_HOST,
+        },
         json={"cert": cert},
         cookies=cookies,
     )
 
-    wallet = res.json()["wallet"]
     cookies = res.cookies
 
+    if res.status_code != 200:
+        res = requests.post(
+            CEALGULL_MIDDLEWARE_HOST + "/api/user/invoke/create",
+            json={"username": "user_" + secrets.token_hex(4)},
+            cookies=cookies,
+        )
+
+    wallet = res.json()["wallet"]
+
     return Credential(wallet=wallet, cookies=cookies, cert=cert)
 
 